@@ -0,0 +1,254 @@
+package genai
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	anthropicBaseURL = "https://api.anthropic.com"
+	anthropicVersion = "2023-06-01"
+	// anthropicMaxTokens caps a response, the Messages API requires a limit
+	anthropicMaxTokens = 8192
+)
+
+var defaultAnthropicModels = []string{"claude-sonnet-4-5", "claude-haiku-4-5", "claude-opus-4-1"}
+
+// anthropicProvider speaks the Anthropic Messages API
+type anthropicProvider struct {
+	cfg     ProviderConfig
+	baseURL string
+	client  *http.Client
+}
+
+func newAnthropicProvider(cfg ProviderConfig) *anthropicProvider {
+	baseURL := anthropicBaseURL
+	if cfg.BaseURL != "" {
+		baseURL = strings.TrimRight(cfg.BaseURL, "/")
+	}
+
+	return &anthropicProvider{cfg: cfg, baseURL: baseURL, client: &http.Client{}}
+}
+
+func (p *anthropicProvider) Name() string {
+	return p.cfg.Name
+}
+
+func (p *anthropicProvider) Capabilities() Capabilities {
+	return Capabilities{Streaming: true, SystemPrompt: true, MultiTurn: true, Vision: true}
+}
+
+type anthropicMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type anthropicRequest struct {
+	Model     string             `json:"model"`
+	MaxTokens int                `json:"max_tokens"`
+	System    string             `json:"system,omitempty"`
+	Messages  []anthropicMessage `json:"messages"`
+	Stream    bool               `json:"stream,omitempty"`
+}
+
+type anthropicError struct {
+	Type  string `json:"type"`
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// do sends a request to the API and returns the response when it succeeded
+func (p *anthropicProvider) do(ctx context.Context, method, path string, body any) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, p.baseURL+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("x-api-key", p.cfg.APIKey)
+	req.Header.Set("anthropic-version", anthropicVersion)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		var apiErr anthropicError
+		if err := json.NewDecoder(resp.Body).Decode(&apiErr); err == nil && apiErr.Error.Message != "" {
+			return nil, fmt.Errorf("anthropic: %s: %s", apiErr.Error.Type, apiErr.Error.Message)
+		}
+		return nil, fmt.Errorf("anthropic: unexpected status %s", resp.Status)
+	}
+
+	return resp, nil
+}
+
+func (p *anthropicProvider) ContextWindow(model string) int {
+	return contextWindow(p.cfg, model)
+}
+
+func (p *anthropicProvider) CostTier(model string) string {
+	return costTier(p.cfg, model)
+}
+
+func (p *anthropicProvider) request(req Request, stream bool) anthropicRequest {
+	messages := make([]anthropicMessage, 0, len(req.History)+1)
+	for _, turn := range req.History {
+		role := RoleUser
+		if turn.Role == RoleAssistant {
+			role = RoleAssistant
+		}
+		messages = append(messages, anthropicMessage{Role: role, Content: turn.Content})
+	}
+	messages = append(messages, anthropicMessage{Role: RoleUser, Content: req.Prompt})
+
+	maxTokens := anthropicMaxTokens
+	if req.MaxTokens > 0 {
+		maxTokens = min(req.MaxTokens, anthropicMaxTokens)
+	}
+
+	return anthropicRequest{
+		Model:     req.Model,
+		MaxTokens: maxTokens,
+		System:    req.System,
+		Messages:  messages,
+		Stream:    stream,
+	}
+}
+
+func (p *anthropicProvider) Generate(ctx context.Context, req Request) (*GenAiResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
+	defer cancel()
+
+	resp, err := p.do(ctx, http.MethodPost, "/v1/messages", p.request(req, false))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("anthropic: decode response: %w", err)
+	}
+
+	var response strings.Builder
+	for _, block := range result.Content {
+		if block.Type == "text" {
+			response.WriteString(block.Text)
+		}
+	}
+	if response.Len() == 0 {
+		return nil, fmt.Errorf("empty response")
+	}
+
+	return &GenAiResponse{
+		Prompt:   req.Prompt,
+		Response: response.String(),
+		Model:    ModelID(p.cfg.Name, req.Model),
+	}, nil
+}
+
+// Stream reads the server sent events of a streamed message, the text arrives
+// in content_block_delta events
+func (p *anthropicProvider) Stream(ctx context.Context, req Request, onDelta func(delta string) error) (*GenAiResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
+	defer cancel()
+
+	resp, err := p.do(ctx, http.MethodPost, "/v1/messages", p.request(req, true))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var response strings.Builder
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+
+		var event struct {
+			Type  string `json:"type"`
+			Delta struct {
+				Type string `json:"type"`
+				Text string `json:"text"`
+			} `json:"delta"`
+			Error struct {
+				Type    string `json:"type"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal([]byte(data), &event); err != nil {
+			return nil, fmt.Errorf("anthropic: decode event: %w", err)
+		}
+
+		switch event.Type {
+		case "content_block_delta":
+			if event.Delta.Type != "text_delta" || event.Delta.Text == "" {
+				continue
+			}
+			response.WriteString(event.Delta.Text)
+			if err := onDelta(event.Delta.Text); err != nil {
+				return nil, err
+			}
+		case "error":
+			return nil, fmt.Errorf("anthropic: %s: %s", event.Error.Type, event.Error.Message)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if response.Len() == 0 {
+		return nil, fmt.Errorf("empty response")
+	}
+
+	return &GenAiResponse{
+		Prompt:   req.Prompt,
+		Response: response.String(),
+		Model:    ModelID(p.cfg.Name, req.Model),
+	}, nil
+}
+
+// Ping lists a single model, which any valid API key may do
+func (p *anthropicProvider) Ping(ctx context.Context) error {
+	resp, err := p.do(ctx, http.MethodGet, "/v1/models?limit=1", nil)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (p *anthropicProvider) Models(ctx context.Context) ([]Model, error) {
+	if len(p.cfg.Models) > 0 {
+		return staticModels(p.cfg.Name, p.cfg.Models), nil
+	}
+	return staticModels(p.cfg.Name, defaultAnthropicModels), nil
+}
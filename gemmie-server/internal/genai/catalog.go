@@ -0,0 +1,226 @@
+package genai
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+const (
+	// HealthTTL is how long a provider's health probe is trusted
+	HealthTTL = 5 * time.Minute
+	// unhealthyTTL is how long a failed probe is trusted, shorter so a
+	// provider that comes back shows up soon
+	unhealthyTTL = time.Minute
+	// probeTimeout bounds one health probe
+	probeTimeout = 10 * time.Second
+)
+
+// Input modalities of models
+const (
+	ModalityText  = "text"
+	ModalityImage = "image"
+)
+
+// ProviderStatus is what the last health probe of a provider found
+type ProviderStatus struct {
+	Name      string    `json:"name"`
+	Available bool      `json:"available"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+
+	models []Model // the models the provider offered when last listed
+	listed bool    // whether models came from a listing that succeeded
+}
+
+// fresh reports whether the probe is recent enough to trust
+func (s ProviderStatus) fresh() bool {
+	ttl := HealthTTL
+	if !s.Available {
+		ttl = unhealthyTTL
+	}
+	return time.Since(s.CheckedAt) < ttl
+}
+
+// CatalogModel describes a model for clients choosing one
+type CatalogModel struct {
+	Model
+	DisplayName   string   `json:"display_name"`
+	ContextWindow int      `json:"context_window"`
+	Modalities    []string `json:"modalities"` // input it accepts, ModalityText and ModalityImage
+	Streaming     bool     `json:"streaming"`
+	CostTier      string   `json:"cost_tier"`
+	Available     bool     `json:"available"` // whether its provider answered the last health probe
+}
+
+// Catalog lists the models of every provider and what they can do, with the
+// status of each provider. Providers are probed concurrently, at most once a
+// HealthTTL, see providerStatus.
+func (r *Registry) Catalog(ctx context.Context) ([]CatalogModel, []ProviderStatus) {
+	providers := r.Providers()
+	statuses := make([]ProviderStatus, len(providers))
+
+	var wg sync.WaitGroup
+	for i, p := range providers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			statuses[i] = r.providerStatus(ctx, p)
+		}()
+	}
+	wg.Wait()
+
+	// The default model is listed even when its provider does not offer it
+	defaultProvider, defaultName, err := r.Resolve("")
+
+	var models []CatalogModel
+	for i, p := range providers {
+		caps := p.Capabilities()
+		modalities := []string{ModalityText}
+		if caps.Vision {
+			modalities = append(modalities, ModalityImage)
+		}
+
+		offered := statuses[i].models
+		if err == nil && defaultProvider == p && !slices.ContainsFunc(offered, func(m Model) bool { return m.Name == defaultName }) {
+			offered = append(staticModels(p.Name(), []string{defaultName}), offered...)
+		}
+
+		for _, model := range offered {
+			models = append(models, CatalogModel{
+				Model:         model,
+				DisplayName:   displayName(model.Name),
+				ContextWindow: p.ContextWindow(model.Name),
+				Modalities:    modalities,
+				Streaming:     caps.Streaming,
+				CostTier:      p.CostTier(model.Name),
+				Available:     statuses[i].Available,
+			})
+		}
+	}
+	return models, statuses
+}
+
+// Offers reports whether a model is the default model or one its provider
+// offers. The provider's models are cached like Catalog's. A provider whose
+// models could never be listed is left to turn down models it lacks itself.
+func (r *Registry) Offers(ctx context.Context, model string) bool {
+	p, name, err := r.Resolve(model)
+	if err != nil {
+		return false
+	}
+	if defaultProvider, defaultName, err := r.Resolve(""); err == nil && defaultProvider == p && defaultName == name {
+		return true
+	}
+	status := r.providerStatus(ctx, p)
+	if !status.listed {
+		return true
+	}
+	return slices.ContainsFunc(status.models, func(m Model) bool { return m.Name == name })
+}
+
+// providerStatus returns the last probe of a provider. A stale probe is
+// returned as is while a new one runs in the background, only a provider
+// never probed is waited for. Callers share one probe per provider.
+func (r *Registry) providerStatus(ctx context.Context, p Provider) ProviderStatus {
+	r.statusMu.Lock()
+	status, ok := r.status[p.Name()]
+	if ok && status.fresh() {
+		r.statusMu.Unlock()
+		return status
+	}
+	done, running := r.probing[p.Name()]
+	if !running {
+		done = make(chan struct{})
+		r.probing[p.Name()] = done
+		go r.probe(p, status, done)
+	}
+	r.statusMu.Unlock()
+
+	if ok {
+		return status
+	}
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ProviderStatus{Name: p.Name(), Error: ctx.Err().Error(), CheckedAt: time.Now()}
+	}
+	r.statusMu.Lock()
+	defer r.statusMu.Unlock()
+	return r.status[p.Name()]
+}
+
+// probe checks a provider's health and lists its models, then closes done.
+// When the listing fails the models of the previous probe are kept.
+func (r *Registry) probe(p Provider, previous ProviderStatus, done chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+
+	status := ProviderStatus{Name: p.Name(), Available: true}
+	if err := p.Ping(ctx); err != nil {
+		status.Available = false
+		status.Error = err.Error()
+	}
+
+	models, err := p.Models(ctx)
+	if err != nil {
+		if status.Available {
+			status.Available = false
+			status.Error = err.Error()
+		}
+		status.models, status.listed = previous.models, previous.listed
+	} else {
+		status.models, status.listed = models, true
+	}
+	status.CheckedAt = time.Now()
+
+	r.statusMu.Lock()
+	r.status[p.Name()] = status
+	delete(r.probing, p.Name())
+	r.statusMu.Unlock()
+	close(done)
+}
+
+// displayName makes a readable name of a model name, such as "Gemini 2.5
+// Flash" of "gemini-2.5-flash" or "Claude Sonnet 4.5" of "claude-sonnet-4-5"
+func displayName(model string) string {
+	// Names may start with an organization, like "meta-llama/Llama-3.1-8B"
+	if i := strings.LastIndex(model, "/"); i >= 0 {
+		model = model[i+1:]
+	}
+
+	var words []string
+	for _, part := range strings.FieldsFunc(model, func(r rune) bool { return r == '-' || r == '_' }) {
+		// Versions split by dashes, like the 4-5 of claude-sonnet-4-5, are
+		// joined with a dot. Longer numbers, like dates, stay words of their own.
+		if n := len(words); n > 0 && len(part) <= 2 && isNumber(part) && isNumber(strings.ReplaceAll(words[n-1], ".", "")) {
+			words[n-1] += "." + part
+			continue
+		}
+		words = append(words, displayWord(part))
+	}
+	return strings.Join(words, " ")
+}
+
+// displayWord capitalizes one word of a model name. Acronyms are upper cased,
+// and names like o3 are left as they are.
+func displayWord(word string) string {
+	switch strings.ToLower(word) {
+	case "gpt":
+		return "GPT"
+	}
+	runes := []rune(word)
+	if len(runes) > 1 && unicode.IsDigit(runes[1]) {
+		return word
+	}
+	runes[0] = unicode.ToUpper(runes[0])
+	return string(runes)
+}
+
+func isNumber(s string) bool {
+	return s != "" && strings.IndexFunc(s, func(r rune) bool { return !unicode.IsDigit(r) }) == -1
+}
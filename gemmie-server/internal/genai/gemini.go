@@ -0,0 +1,145 @@
+package genai
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	googleai "google.golang.org/genai"
+)
+
+var defaultGeminiModels = []string{"gemini-2.5-flash", "gemini-2.5-flash-lite", "gemini-2.5-pro"}
+
+// geminiProvider speaks the Gemini API
+type geminiProvider struct {
+	cfg    ProviderConfig
+	client *googleai.Client
+}
+
+func newGeminiProvider(cfg ProviderConfig) (*geminiProvider, error) {
+	config := &googleai.ClientConfig{
+		APIKey:  cfg.APIKey,
+		Backend: googleai.BackendGeminiAPI,
+	}
+	if cfg.BaseURL != "" {
+		config.HTTPOptions.BaseURL = strings.TrimRight(cfg.BaseURL, "/") + "/"
+	}
+
+	client, err := googleai.NewClient(context.Background(), config)
+	if err != nil {
+		return nil, fmt.Errorf("provider %s: %w", cfg.Name, err)
+	}
+
+	return &geminiProvider{cfg: cfg, client: client}, nil
+}
+
+func (p *geminiProvider) Name() string {
+	return p.cfg.Name
+}
+
+func (p *geminiProvider) Capabilities() Capabilities {
+	return Capabilities{Streaming: true, SystemPrompt: true, MultiTurn: true, Vision: true}
+}
+
+func (p *geminiProvider) ContextWindow(model string) int {
+	return contextWindow(p.cfg, model)
+}
+
+func (p *geminiProvider) CostTier(model string) string {
+	return costTier(p.cfg, model)
+}
+
+// contents turns a request into Gemini's conversation, which calls the
+// assistant "model"
+func (p *geminiProvider) contents(req Request) []*googleai.Content {
+	contents := make([]*googleai.Content, 0, len(req.History)+1)
+	for _, turn := range req.History {
+		role := googleai.Role(googleai.RoleUser)
+		if turn.Role == RoleAssistant {
+			role = googleai.RoleModel
+		}
+		contents = append(contents, googleai.NewContentFromText(turn.Content, role))
+	}
+	return append(contents, googleai.NewContentFromText(req.Prompt, googleai.RoleUser))
+}
+
+// config carries the system prompt and response limit, nil without either
+func (p *geminiProvider) config(req Request) *googleai.GenerateContentConfig {
+	if req.System == "" && req.MaxTokens <= 0 {
+		return nil
+	}
+
+	config := &googleai.GenerateContentConfig{}
+	if req.System != "" {
+		config.SystemInstruction = googleai.NewContentFromText(req.System, googleai.RoleUser)
+	}
+	if req.MaxTokens > 0 {
+		config.MaxOutputTokens = int32(req.MaxTokens)
+	}
+	return config
+}
+
+func (p *geminiProvider) Generate(ctx context.Context, req Request) (*GenAiResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
+	defer cancel()
+
+	result, err := p.client.Models.GenerateContent(ctx, req.Model, p.contents(req), p.config(req))
+	if err != nil {
+		return nil, err
+	}
+
+	text := result.Text()
+	if text == "" {
+		return nil, fmt.Errorf("empty response")
+	}
+
+	return &GenAiResponse{
+		Prompt:   req.Prompt,
+		Response: text,
+		Model:    ModelID(p.cfg.Name, req.Model),
+	}, nil
+}
+
+func (p *geminiProvider) Stream(ctx context.Context, req Request, onDelta func(delta string) error) (*GenAiResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
+	defer cancel()
+
+	var response strings.Builder
+	for chunk, err := range p.client.Models.GenerateContentStream(ctx, req.Model, p.contents(req), p.config(req)) {
+		if err != nil {
+			return nil, err
+		}
+
+		delta := chunk.Text()
+		if delta == "" {
+			continue
+		}
+		response.WriteString(delta)
+		if err := onDelta(delta); err != nil {
+			return nil, err
+		}
+	}
+
+	if response.Len() == 0 {
+		return nil, fmt.Errorf("empty response")
+	}
+
+	return &GenAiResponse{
+		Prompt:   req.Prompt,
+		Response: response.String(),
+		Model:    ModelID(p.cfg.Name, req.Model),
+	}, nil
+}
+
+// Ping lists a single model, which any valid API key may do
+func (p *geminiProvider) Ping(ctx context.Context) error {
+	_, err := p.client.Models.List(ctx, &googleai.ListModelsConfig{PageSize: 1})
+	return err
+}
+
+func (p *geminiProvider) Models(ctx context.Context) ([]Model, error) {
+	if len(p.cfg.Models) > 0 {
+		return staticModels(p.cfg.Name, p.cfg.Models), nil
+	}
+	return staticModels(p.cfg.Name, defaultGeminiModels), nil
+}
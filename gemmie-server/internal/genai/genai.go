@@ -1,81 +1,455 @@
+// Package genai generates responses with large language models. Each backend
+// is a Provider, and a Registry picks one by the "provider/model" identifier
+// of the model asked for, such as "gemini/gemini-2.5-flash" or
+// "ollama/llama3.2".
 package genai
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
 
-	geminiwrapper "github.com/imrany/wrapper/pkg/gemini"
-	openaiwrapper "github.com/imrany/wrapper/pkg/openai"
+// Provider kinds, the API a provider speaks
+const (
+	KindGemini           = "gemini"
+	KindOpenAI           = "openai"
+	KindAnthropic        = "anthropic"
+	KindOpenAICompatible = "openai-compatible" // local Ollama or llama.cpp servers, proxies and other hosted APIs
 )
 
-type GENAISERVICE struct {
-	Model  string
-	APIKey string
+var ErrEmptyPrompt = errors.New("prompt cannot be empty")
+
+// Provider is one LLM backend
+type Provider interface {
+	// Name is the provider part of model identifiers
+	Name() string
+	// Generate returns the whole response at once
+	Generate(ctx context.Context, req Request) (*GenAiResponse, error)
+	// Stream calls onDelta with each piece of the response as it is
+	// generated and returns the whole response at the end. An error from
+	// onDelta stops the generation.
+	Stream(ctx context.Context, req Request, onDelta func(delta string) error) (*GenAiResponse, error)
+	// Models lists the models the provider offers
+	Models(ctx context.Context) ([]Model, error)
+	// ContextWindow is how many tokens of input a model accepts
+	ContextWindow(model string) int
+	// CostTier is how expensive a model is next to others, see TierEconomy
+	CostTier(model string) string
+	Capabilities() Capabilities
+	// Ping makes the cheapest request that proves the provider answers with
+	// its credentials
+	Ping(ctx context.Context) error
+}
+
+// Cost tiers, how expensive a model is to run relative to others
+const (
+	TierEconomy  = "economy"  // small and self hosted models
+	TierStandard = "standard" // general purpose hosted models
+	TierPremium  = "premium"  // the largest and reasoning models
+)
+
+// Tiers are the cost tiers from cheapest to most expensive
+var Tiers = []string{TierEconomy, TierStandard, TierPremium}
+
+// Roles of conversation turns
+const (
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+)
+
+// Turn is one earlier message of a conversation
+type Turn struct {
+	Role    string // RoleUser or RoleAssistant
+	Content string
+}
+
+// Request asks for a response. Registries take a "provider/model" identifier
+// as Model and pass providers their own name for it.
+type Request struct {
+	Model   string
+	Prompt  string
+	History []Turn // earlier turns, oldest first, alternating and starting with RoleUser
+	System  string // system prompt, see SystemPrompt
+	// MaxTokens caps the length of the response, 0 leaves it to the provider
+	MaxTokens int
 }
 
 type GenAiResponse struct {
 	Prompt   string
 	Response string
+	Model    string // "provider/model" identifier of the model that answered
 }
 
-func (g *GENAISERVICE) GenerateAIResponse(ctx context.Context, prompt string) (*GenAiResponse, error) {
-	if prompt == "" {
-		return nil, fmt.Errorf("prompt cannot be empty")
-	}
+// Model is a model a provider offers
+type Model struct {
+	ID       string `json:"id"` // "provider/model", what requests ask for
+	Provider string `json:"provider"`
+	Name     string `json:"name"` // the provider's own model name
+}
+
+// Capabilities says what a provider supports beyond plain generation
+type Capabilities struct {
+	Streaming    bool `json:"streaming"`
+	SystemPrompt bool `json:"system_prompt"`
+	MultiTurn    bool `json:"multi_turn"`
+	Vision       bool `json:"vision"`
+}
 
-	// Extract provider from model name (case-insensitive)
-	modelParts := strings.Split(g.Model, "-")
-	if len(modelParts) == 0 {
-		slog.Error("Invalid model format", "model", g.Model)
-		return nil, fmt.Errorf("invalid model format: %s", g.Model)
+// ProviderConfig configures one provider
+type ProviderConfig struct {
+	Name    string        // provider part of model identifiers, the kind for the built in providers
+	Kind    string        // KindGemini, KindOpenAI, KindAnthropic or KindOpenAICompatible
+	APIKey  string        // optional for OpenAI compatible servers
+	BaseURL string        // empty uses the provider's public API, required for OpenAI compatible servers
+	Timeout time.Duration // longest a generation may take, 0 for DefaultTimeout
+	Models  []string      // models to offer, empty for the provider's defaults
+	// ContextWindow overrides the tokens of input every model of the provider
+	// accepts, 0 uses what is known about each model
+	ContextWindow int
+	// CostTier overrides the cost tier of every model of the provider, empty
+	// guesses it from each model's name
+	CostTier string
+}
+
+// DefaultTimeout bounds a generation when its provider sets no timeout
+const DefaultTimeout = 2 * time.Minute
+
+// NewProvider creates the provider a config describes
+func NewProvider(cfg ProviderConfig) (Provider, error) {
+	if cfg.Name == "" {
+		cfg.Name = cfg.Kind
+	}
+	if strings.Contains(cfg.Name, "/") {
+		return nil, fmt.Errorf("provider name %q cannot contain '/'", cfg.Name)
+	}
+	if cfg.CostTier != "" && !slices.Contains(Tiers, cfg.CostTier) {
+		return nil, fmt.Errorf("provider %s: unknown cost tier %q", cfg.Name, cfg.CostTier)
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
 	}
-	provider := strings.ToLower(modelParts[0])
 
-	switch provider {
-	case "gemini":
-		config := geminiwrapper.GeminiClientConfig{
-			APIKey: g.APIKey,
-			Model:  g.Model,
+	switch cfg.Kind {
+	case KindGemini:
+		if cfg.APIKey == "" {
+			return nil, fmt.Errorf("provider %s: API key is required", cfg.Name)
 		}
-		result, err := config.GenerateGeminiContent(ctx, prompt)
+		p, err := newGeminiProvider(cfg)
 		if err != nil {
-			slog.Error("Gemini generation failed", "error", err)
-			// Check if it's a context error
-			if ctx.Err() != nil {
-				return nil, ctx.Err()
-			}
-			// Return the actual error to the client for debugging
 			return nil, err
 		}
-		return &GenAiResponse{
-			Prompt:   prompt,
-			Response: result,
-		}, nil
-
-	case "gpt", "o1":
-		config := openaiwrapper.OpenAIClient{
-			APIKey: g.APIKey,
-			Model:  g.Model,
+		return p, nil
+	case KindOpenAI:
+		if cfg.APIKey == "" {
+			return nil, fmt.Errorf("provider %s: API key is required", cfg.Name)
+		}
+		return newOpenAIProvider(cfg), nil
+	case KindOpenAICompatible:
+		if cfg.BaseURL == "" {
+			return nil, fmt.Errorf("provider %s: base URL is required", cfg.Name)
 		}
-		result, err := config.GenerateOpenAIContent(ctx, prompt)
+		return newOpenAIProvider(cfg), nil
+	case KindAnthropic:
+		if cfg.APIKey == "" {
+			return nil, fmt.Errorf("provider %s: API key is required", cfg.Name)
+		}
+		return newAnthropicProvider(cfg), nil
+	default:
+		return nil, fmt.Errorf("provider %s: unknown kind %q", cfg.Name, cfg.Kind)
+	}
+}
+
+// Registry holds the configured providers
+type Registry struct {
+	mu           sync.RWMutex
+	providers    map[string]Provider
+	defaultModel string
+
+	statusMu sync.Mutex
+	status   map[string]ProviderStatus // last health probe of each provider, see Catalog
+	probing  map[string]chan struct{}  // probes running, closed when they finish
+}
+
+// NewRegistry returns an empty registry. defaultModel answers requests that
+// do not ask for a model.
+func NewRegistry(defaultModel string) *Registry {
+	return &Registry{
+		providers:    map[string]Provider{},
+		defaultModel: defaultModel,
+		status:       map[string]ProviderStatus{},
+		probing:      map[string]chan struct{}{},
+	}
+}
+
+// Register adds a provider, replacing one with the same name
+func (r *Registry) Register(p Provider) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.providers[p.Name()] = p
+}
+
+// Provider returns a provider by name
+func (r *Registry) Provider(name string) (Provider, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	p, ok := r.providers[name]
+	return p, ok
+}
+
+// Providers lists the providers by name
+func (r *Registry) Providers() []Provider {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	providers := make([]Provider, 0, len(r.providers))
+	for _, p := range r.providers {
+		providers = append(providers, p)
+	}
+	sort.Slice(providers, func(i, j int) bool { return providers[i].Name() < providers[j].Name() })
+	return providers
+}
+
+// DefaultModel is the model used when a request names none
+func (r *Registry) DefaultModel() string {
+	return r.defaultModel
+}
+
+// Resolve finds the provider of a model and the provider's name for it. An
+// empty model is the default one.
+func (r *Registry) Resolve(model string) (Provider, string, error) {
+	if model == "" {
+		model = r.defaultModel
+	}
+	if model == "" {
+		return nil, "", fmt.Errorf("no model requested and no default model configured")
+	}
+
+	providerName, name := ParseModelID(model)
+	if providerName == "" || name == "" {
+		return nil, "", fmt.Errorf("unsupported model: %s, use a provider/model identifier", model)
+	}
+
+	p, ok := r.Provider(providerName)
+	if !ok {
+		return nil, "", fmt.Errorf("provider %s is not configured", providerName)
+	}
+	return p, name, nil
+}
+
+// Generate returns a response of req.Model, the default model when empty
+func (r *Registry) Generate(ctx context.Context, req Request) (*GenAiResponse, error) {
+	if req.Prompt == "" {
+		return nil, ErrEmptyPrompt
+	}
+
+	p, name, err := r.Resolve(req.Model)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Model = name
+	resp, err := p.Generate(ctx, req)
+	if err != nil {
+		slog.Error("Generation failed", "provider", p.Name(), "model", name, "error", err)
+		// Check if it's a context error
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Stream generates a response of req.Model piece by piece, see Provider.Stream
+func (r *Registry) Stream(ctx context.Context, req Request, onDelta func(delta string) error) (*GenAiResponse, error) {
+	if req.Prompt == "" {
+		return nil, ErrEmptyPrompt
+	}
+
+	p, name, err := r.Resolve(req.Model)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Model = name
+	resp, err := p.Stream(ctx, req, onDelta)
+	if err != nil {
+		slog.Error("Streamed generation failed", "provider", p.Name(), "model", name, "error", err)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Models lists the models of every provider. A provider that cannot list its
+// models is logged and left out.
+func (r *Registry) Models(ctx context.Context) []Model {
+	var models []Model
+	for _, p := range r.Providers() {
+		list, err := p.Models(ctx)
 		if err != nil {
-			slog.Error("OpenAI generation failed", "error", err)
-			// Check if it's a context error
-			if ctx.Err() != nil {
-				return nil, ctx.Err()
-			}
-			// Return the actual error to the client for debugging
-			return nil, err
+			slog.Warn("Failed to list models", "provider", p.Name(), "error", err)
+			continue
 		}
-		return &GenAiResponse{
-			Prompt:   prompt,
-			Response: result,
-		}, nil
+		models = append(models, list...)
+	}
+	return models
+}
 
-	default:
-		slog.Warn("Unsupported model", "model", g.Model)
-		return nil, fmt.Errorf("unsupported model: %s", g.Model)
+// ParseModelID splits a "provider/model" identifier. Bare model names from
+// before providers were configurable, like "gemini-2.5-flash" or "gpt-4o",
+// get their provider from the name.
+func ParseModelID(id string) (provider, model string) {
+	if provider, model, ok := strings.Cut(id, "/"); ok {
+		return strings.ToLower(provider), model
+	}
+
+	prefix, _, _ := strings.Cut(strings.ToLower(id), "-")
+	switch prefix {
+	case "gemini", "gemma":
+		return KindGemini, id
+	case "gpt", "chatgpt", "o1", "o3", "o4":
+		return KindOpenAI, id
+	case "claude":
+		return KindAnthropic, id
+	}
+	return "", id
+}
+
+// ContextWindow is how many tokens of input a model accepts, 0 when the
+// model cannot be resolved
+func (r *Registry) ContextWindow(model string) int {
+	p, name, err := r.Resolve(model)
+	if err != nil {
+		return 0
+	}
+	return p.ContextWindow(name)
+}
+
+// CostTier is the cost tier of a model, empty when the model cannot be resolved
+func (r *Registry) CostTier(model string) string {
+	p, name, err := r.Resolve(model)
+	if err != nil {
+		return ""
+	}
+	return p.CostTier(name)
+}
+
+// EstimateTokens approximates the tokens of a text, at about four characters
+// a token. It errs high for English and is close enough for other languages
+// to budget a context window.
+func EstimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
+
+// defaultContextWindow is assumed for models nothing is known about, small
+// enough for most local models
+const defaultContextWindow = 8192
+
+// contextWindow is the known context window of a model, cfg.ContextWindow
+// when set
+func contextWindow(cfg ProviderConfig, model string) int {
+	if cfg.ContextWindow > 0 {
+		return cfg.ContextWindow
 	}
+
+	name := strings.ToLower(model)
+	switch {
+	case strings.HasPrefix(name, "gemini-"):
+		return 1048576
+	case strings.HasPrefix(name, "gpt-4.1"):
+		return 1047576
+	case strings.HasPrefix(name, "gpt-4o"), strings.HasPrefix(name, "gpt-4-turbo"):
+		return 128000
+	case strings.HasPrefix(name, "o1"), strings.HasPrefix(name, "o3"), strings.HasPrefix(name, "o4"):
+		return 200000
+	case strings.HasPrefix(name, "gpt-5"):
+		return 400000
+	case strings.HasPrefix(name, "gpt-3.5"):
+		return 16385
+	case strings.HasPrefix(name, "claude-"):
+		return 200000
+	}
+
+	switch cfg.Kind {
+	case KindGemini, KindAnthropic:
+		return 200000
+	case KindOpenAI:
+		return 128000
+	}
+	return defaultContextWindow
+}
+
+// costTier guesses the cost tier of a model from its name, cfg.CostTier when
+// set. Models of OpenAI compatible servers are assumed to be self hosted.
+func costTier(cfg ProviderConfig, model string) string {
+	if cfg.CostTier != "" {
+		return cfg.CostTier
+	}
+	if cfg.Kind == KindOpenAICompatible {
+		return TierEconomy
+	}
+
+	name := strings.ToLower(model)
+	for _, small := range []string{"lite", "mini", "nano", "haiku", "gemma", "gpt-3.5"} {
+		if strings.Contains(name, small) {
+			return TierEconomy
+		}
+	}
+	for _, large := range []string{"pro", "opus", "gpt-4.5", "gpt-4-turbo"} {
+		if strings.Contains(name, large) {
+			return TierPremium
+		}
+	}
+	switch {
+	case strings.HasPrefix(name, "o1"), strings.HasPrefix(name, "o3"), strings.HasPrefix(name, "gpt-5"):
+		return TierPremium
+	}
+	return TierStandard
+}
+
+// ModelID joins a provider and model name into an identifier
+func ModelID(provider, model string) string {
+	return provider + "/" + model
+}
+
+// staticModels lists configured or default model names as models of a provider
+func staticModels(provider string, names []string) []Model {
+	models := make([]Model, 0, len(names))
+	for _, name := range names {
+		models = append(models, Model{ID: ModelID(provider, name), Provider: provider, Name: name})
+	}
+	return models
+}
+
+var registry = NewRegistry("")
+
+// Configure replaces the providers used by the package level functions
+func Configure(defaultModel string, configs ...ProviderConfig) error {
+	r := NewRegistry(defaultModel)
+	for _, cfg := range configs {
+		p, err := NewProvider(cfg)
+		if err != nil {
+			return err
+		}
+		r.Register(p)
+	}
+
+	registry = r
+	return nil
+}
+
+// Default returns the registry set up by Configure
+func Default() *Registry {
+	return registry
 }
@@ -0,0 +1,61 @@
+package genai
+
+import (
+	"fmt"
+	"strings"
+)
+
+// MaxSystemPromptTokens bounds a compiled system prompt, so instructions
+// cannot crowd the conversation out of small context windows
+const MaxSystemPromptTokens = 2000
+
+// Instructions are what a user told the assistant to keep in mind in every
+// response, the persona picked for a chat and how the response mode wants
+// the response made
+type Instructions struct {
+	Guidance     string // how this response is to be made, from its response mode
+	PersonaName  string
+	Persona      string // the persona's instructions
+	HowToRespond string
+	AboutMe      string
+	WorkFunction string
+}
+
+// SystemPrompt compiles instructions into a system prompt, empty when there
+// are none. Sections are ordered by how much they shape a response, a prompt
+// over MaxSystemPromptTokens is cut from the end and reported as truncated.
+func SystemPrompt(in Instructions) (prompt string, truncated bool) {
+	var sections []string
+
+	if guidance := strings.TrimSpace(in.Guidance); guidance != "" {
+		sections = append(sections, guidance)
+	}
+	if persona := strings.TrimSpace(in.Persona); persona != "" {
+		name := strings.TrimSpace(in.PersonaName)
+		if name == "" {
+			name = "assistant"
+		}
+		sections = append(sections, fmt.Sprintf("You are acting as the persona %q. Stay in this persona:\n%s", name, persona))
+	}
+	if how := strings.TrimSpace(in.HowToRespond); how != "" {
+		sections = append(sections, "How the user wants you to respond:\n"+how)
+	}
+	if about := strings.TrimSpace(in.AboutMe); about != "" {
+		sections = append(sections, "What the user wants you to know about them:\n"+about)
+	}
+	if work := strings.TrimSpace(in.WorkFunction); work != "" {
+		sections = append(sections, "The user's work: "+work)
+	}
+
+	if len(sections) == 0 {
+		return "", false
+	}
+
+	prompt = strings.Join(sections, "\n\n")
+	if EstimateTokens(prompt) <= MaxSystemPromptTokens {
+		return prompt, false
+	}
+
+	runes := []rune(prompt)
+	return strings.TrimSpace(string(runes[:MaxSystemPromptTokens*4])), true
+}
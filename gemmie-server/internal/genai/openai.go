@@ -0,0 +1,179 @@
+package genai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	openai "github.com/sashabaranov/go-openai"
+)
+
+var defaultOpenAIModels = []string{"gpt-4o-mini", "gpt-4o", "gpt-4.1-mini", "gpt-4.1"}
+
+// openAIProvider speaks the OpenAI chat completions API, to OpenAI itself or
+// to any server that implements it
+type openAIProvider struct {
+	cfg    ProviderConfig
+	client *openai.Client
+}
+
+func newOpenAIProvider(cfg ProviderConfig) *openAIProvider {
+	config := openai.DefaultConfig(cfg.APIKey)
+	if cfg.BaseURL != "" {
+		config.BaseURL = strings.TrimRight(cfg.BaseURL, "/")
+	}
+
+	return &openAIProvider{cfg: cfg, client: openai.NewClientWithConfig(config)}
+}
+
+func (p *openAIProvider) Name() string {
+	return p.cfg.Name
+}
+
+func (p *openAIProvider) Capabilities() Capabilities {
+	// What a compatible server's models can do is not known up front
+	return Capabilities{
+		Streaming:    true,
+		SystemPrompt: true,
+		MultiTurn:    true,
+		Vision:       p.cfg.Kind == KindOpenAI,
+	}
+}
+
+func (p *openAIProvider) ContextWindow(model string) int {
+	return contextWindow(p.cfg, model)
+}
+
+func (p *openAIProvider) CostTier(model string) string {
+	return costTier(p.cfg, model)
+}
+
+func (p *openAIProvider) request(req Request) openai.ChatCompletionRequest {
+	messages := make([]openai.ChatCompletionMessage, 0, len(req.History)+2)
+	if req.System != "" {
+		messages = append(messages, openai.ChatCompletionMessage{
+			Role:    openai.ChatMessageRoleSystem,
+			Content: req.System,
+		})
+	}
+	for _, turn := range req.History {
+		role := openai.ChatMessageRoleUser
+		if turn.Role == RoleAssistant {
+			role = openai.ChatMessageRoleAssistant
+		}
+		messages = append(messages, openai.ChatCompletionMessage{Role: role, Content: turn.Content})
+	}
+	messages = append(messages, openai.ChatCompletionMessage{
+		Role:    openai.ChatMessageRoleUser,
+		Content: req.Prompt,
+	})
+
+	completion := openai.ChatCompletionRequest{
+		Model:    req.Model,
+		Messages: messages,
+	}
+	if req.MaxTokens > 0 {
+		// OpenAI's reasoning models only take max_completion_tokens, while
+		// compatible servers mostly know max_tokens
+		if p.cfg.Kind == KindOpenAI {
+			completion.MaxCompletionTokens = req.MaxTokens
+		} else {
+			completion.MaxTokens = req.MaxTokens
+		}
+	}
+	return completion
+}
+
+func (p *openAIProvider) Generate(ctx context.Context, req Request) (*GenAiResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
+	defer cancel()
+
+	resp, err := p.client.CreateChatCompletion(ctx, p.request(req))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Choices) == 0 || resp.Choices[0].Message.Content == "" {
+		return nil, fmt.Errorf("empty response")
+	}
+
+	return &GenAiResponse{
+		Prompt:   req.Prompt,
+		Response: resp.Choices[0].Message.Content,
+		Model:    ModelID(p.cfg.Name, req.Model),
+	}, nil
+}
+
+func (p *openAIProvider) Stream(ctx context.Context, req Request, onDelta func(delta string) error) (*GenAiResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
+	defer cancel()
+
+	stream, err := p.client.CreateChatCompletionStream(ctx, p.request(req))
+	if err != nil {
+		return nil, err
+	}
+	defer stream.Close()
+
+	var response strings.Builder
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(chunk.Choices) == 0 || chunk.Choices[0].Delta.Content == "" {
+			continue
+		}
+
+		delta := chunk.Choices[0].Delta.Content
+		response.WriteString(delta)
+		if err := onDelta(delta); err != nil {
+			return nil, err
+		}
+	}
+
+	if response.Len() == 0 {
+		return nil, fmt.Errorf("empty response")
+	}
+
+	return &GenAiResponse{
+		Prompt:   req.Prompt,
+		Response: response.String(),
+		Model:    ModelID(p.cfg.Name, req.Model),
+	}, nil
+}
+
+// Ping lists the models the server has, which any valid API key may do
+func (p *openAIProvider) Ping(ctx context.Context) error {
+	_, err := p.client.ListModels(ctx)
+	return err
+}
+
+// Models returns the configured models. Without any, OpenAI offers its
+// defaults and a compatible server is asked what it has installed.
+func (p *openAIProvider) Models(ctx context.Context) ([]Model, error) {
+	if len(p.cfg.Models) > 0 {
+		return staticModels(p.cfg.Name, p.cfg.Models), nil
+	}
+	if p.cfg.Kind == KindOpenAI {
+		return staticModels(p.cfg.Name, defaultOpenAIModels), nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.cfg.Timeout)
+	defer cancel()
+
+	list, err := p.client.ListModels(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(list.Models))
+	for _, model := range list.Models {
+		names = append(names, model.ID)
+	}
+	return staticModels(p.cfg.Name, names), nil
+}
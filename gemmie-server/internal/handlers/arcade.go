@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
@@ -147,6 +148,10 @@ func GetArcadeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if notModified(w, r, versionETag(arcade.Version)) {
+		return
+	}
+
 	w.WriteHeader(http.StatusOK)
 	json.NewEncoder(w).Encode(store.Response{
 		Success: true,
@@ -294,6 +299,11 @@ func UpdateArcadeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ifVersion, ok := ifMatchVersion(w, r, arcade.Version)
+	if !ok {
+		return
+	}
+
 	// Update arcade fields
 	arcade.Label = req.Label
 	if req.Code != "" {
@@ -305,7 +315,11 @@ func UpdateArcadeHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	arcade.UpdatedAt = time.Now()
 
-	updatedArcade, err := store.UpdateArcade(arcade)
+	updatedArcade, err := store.UpdateArcadeIfVersion(arcade, ifVersion)
+	if errors.Is(err, store.ErrVersionConflict) {
+		preconditionFailed(w, 0)
+		return
+	}
 	if err != nil {
 		slog.Error("Failed to update arcade", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -316,6 +330,7 @@ func UpdateArcadeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w.Header().Set("ETag", versionETag(updatedArcade.Version))
 	slog.Info("Arcade updated successfully", "id", arcade.ID, "user_id", userID)
 
 	w.WriteHeader(http.StatusOK)
@@ -394,7 +409,16 @@ func DeleteArcadeHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = store.DeleteArcadeByID(id)
+	ifVersion, ok := ifMatchVersion(w, r, arcade.Version)
+	if !ok {
+		return
+	}
+
+	err = store.DeleteArcadeByIDIfVersion(id, ifVersion)
+	if errors.Is(err, store.ErrVersionConflict) {
+		preconditionFailed(w, 0)
+		return
+	}
 	if err != nil {
 		slog.Error("Failed to delete arcade", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
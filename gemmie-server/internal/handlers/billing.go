@@ -0,0 +1,135 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/imrany/gemmie/gemmie-server/store"
+)
+
+// GetPlanSubscriptionsHandler handles GET /api/subscriptions, returning the
+// period a user is entitled to now, which may be an organization's, and
+// every period they bought
+func GetPlanSubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	current, err := store.GetActivePlanSubscription(userID)
+	if err != nil {
+		slog.Error("Failed to get active subscription", "user_id", userID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to get subscriptions",
+		})
+		return
+	}
+
+	subscriptions, err := store.GetPlanSubscriptions(userID)
+	if err != nil {
+		slog.Error("Failed to get subscriptions", "user_id", userID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to get subscriptions",
+		})
+		return
+	}
+
+	if subscriptions == nil {
+		subscriptions = []store.PlanSubscription{}
+	}
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Subscriptions retrieved successfully",
+		Data: map[string]any{
+			"current":       current,
+			"subscriptions": subscriptions,
+		},
+	})
+}
+
+// GetOrganizationPlanSubscriptionsHandler handles GET /api/organizations/{id}/subscriptions,
+// the period covering the members now and every period the organization bought
+func GetOrganizationPlanSubscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	orgID := mux.Vars(r)["id"]
+	if _, ok := authorizeOrganization(w, orgID, userID, store.OrgRoleAdmin); !ok {
+		return
+	}
+
+	current, err := store.GetActiveOrganizationPlan(orgID)
+	if err != nil {
+		slog.Error("Failed to get active organization subscription", "org_id", orgID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to get subscriptions",
+		})
+		return
+	}
+
+	subscriptions, err := store.GetOrganizationPlanSubscriptions(orgID)
+	if err != nil {
+		slog.Error("Failed to get organization subscriptions", "org_id", orgID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to get subscriptions",
+		})
+		return
+	}
+
+	if subscriptions == nil {
+		subscriptions = []store.PlanSubscription{}
+	}
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Subscriptions retrieved successfully",
+		Data: map[string]any{
+			"current":       current,
+			"subscriptions": subscriptions,
+		},
+	})
+}
+
+// StartPlanSubscriptionExpiry periodically marks ended plan periods as expired
+func StartPlanSubscriptionExpiry(interval time.Duration) {
+	slog.Info("Starting plan subscription expiry", "interval", interval.String())
+
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			if expired, err := store.ExpirePlanSubscriptions(time.Now()); err != nil {
+				slog.Error("Failed to expire plan subscriptions", "error", err)
+			} else if expired > 0 {
+				slog.Info("Expired plan subscriptions", "count", expired)
+			}
+		}
+	}()
+}
@@ -0,0 +1,374 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/imrany/gemmie/gemmie-server/internal/encrypt"
+	"github.com/imrany/gemmie/gemmie-server/internal/genai"
+	"github.com/imrany/gemmie/gemmie-server/store"
+)
+
+// GetChatMessagesHandler handles GET /api/chats/{id}/messages?view=path|tree
+// path (default) returns the active branch, tree returns every branch nested by parent
+func GetChatMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	chatID := mux.Vars(r)["id"]
+	view := r.URL.Query().Get("view")
+	if view == "" {
+		view = "path"
+	}
+	if view != "path" && view != "tree" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "view must be 'path' or 'tree'",
+		})
+		return
+	}
+
+	chat, err := store.GetChatById(chatID)
+	if err != nil {
+		slog.Error("Failed to get chat", "chat_id", chatID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve chat",
+		})
+		return
+	}
+
+	if chat == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Chat not found",
+		})
+		return
+	}
+
+	// Same rule as GET /api/chats/{id}: members only
+	role, err := chatRole(chat, userID)
+	if err != nil {
+		slog.Error("Failed to get chat role", "chat_id", chatID, "user_id", userID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve chat",
+		})
+		return
+	}
+	if role == "" {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Access denied",
+		})
+		return
+	}
+
+	if notModified(w, r, versionETag(chat.Version)) {
+		return
+	}
+
+	if view == "path" {
+		messages := chat.Messages
+		if messages == nil {
+			messages = []store.Message{}
+		}
+		json.NewEncoder(w).Encode(store.Response{
+			Success: true,
+			Message: "Messages retrieved successfully",
+			Data: map[string]any{
+				"active_leaf_id": chat.ActiveLeafId,
+				"messages":       messages,
+			},
+		})
+		return
+	}
+
+	messages, err := store.GetMessagesByChatId(chatID)
+	if err != nil {
+		slog.Error("Failed to get messages", "chat_id", chatID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve messages",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Messages retrieved successfully",
+		Data: map[string]any{
+			"active_leaf_id": chat.ActiveLeafId,
+			"tree":           store.BuildMessageTree(messages),
+		},
+	})
+}
+
+// SetActiveBranchHandler handles PUT /api/chats/{id}/branch
+// The body names any message of the wanted branch; the chat then shows that
+// message and its newest replies
+func SetActiveBranchHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	chatID := mux.Vars(r)["id"]
+
+	var req struct {
+		MessageID string `json:"message_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.MessageID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "message_id is required",
+		})
+		return
+	}
+
+	// The active branch is shared by everyone in the chat
+	if _, _, ok := authorizeChat(w, chatID, userID, store.ChatRoleEditor); !ok {
+		return
+	}
+
+	messages, err := store.GetMessagesByChatId(chatID)
+	if err != nil {
+		slog.Error("Failed to get messages", "chat_id", chatID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve messages",
+		})
+		return
+	}
+
+	found := false
+	for _, msg := range messages {
+		if msg.ID == req.MessageID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Message not found in this chat",
+		})
+		return
+	}
+
+	leafID := store.LatestLeaf(messages, req.MessageID)
+	if err := store.SetChatActiveLeaf(chatID, leafID); err != nil {
+		slog.Error("Failed to switch branch", "chat_id", chatID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to switch branch",
+		})
+		return
+	}
+
+	slog.Info("Active branch switched", "chat_id", chatID, "leaf_id", leafID, "user_id", userID)
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Active branch switched successfully",
+		Data: map[string]any{
+			"active_leaf_id": leafID,
+			"messages":       store.ActivePath(messages, leafID),
+		},
+	})
+}
+
+// RegenerateMessageHandler handles POST /api/messages/{id}/regenerate
+// A new response to the same prompt is added as a sibling of the message
+func RegenerateMessageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	message, ok := getMessageForRole(w, mux.Vars(r)["id"], userID, store.ChatRoleEditor)
+	if !ok {
+		return
+	}
+
+	createSiblingMessage(w, userID, message, message.Prompt, message.References)
+}
+
+// BranchMessageHandler handles POST /api/messages/{id}/branch
+// Editing an earlier prompt this way keeps the original turn and starts a new
+// branch beside it with a fresh response
+func BranchMessageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	var req struct {
+		Prompt     string   `json:"prompt"`
+		References []string `json:"references,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Invalid request body",
+		})
+		return
+	}
+
+	if req.Prompt == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Prompt is required",
+		})
+		return
+	}
+
+	message, ok := getMessageForRole(w, mux.Vars(r)["id"], userID, store.ChatRoleEditor)
+	if !ok {
+		return
+	}
+
+	createSiblingMessage(w, userID, message, req.Prompt, req.References)
+}
+
+// createSiblingMessage generates a response for prompt and stores it under the
+// same parent as message, making the new message the chat's active leaf
+func createSiblingMessage(w http.ResponseWriter, userID string, message *store.Message, prompt string, references []string) {
+	chat, err := store.GetChatById(message.ChatId)
+	if err != nil || chat == nil {
+		slog.Error("Failed to get chat", "chat_id", message.ChatId, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve chat",
+		})
+		return
+	}
+
+	// Regenerate with the model that answered the original message, and the
+	// conversation that led up to it, as long as the user's plan still allows
+	// the model
+	model, accessErr := authorizeGeneration(userID, generationModel(userID, chat, message.Model))
+	if accessErr != nil {
+		slog.Info("Generation not allowed", "chat_id", chat.ID, "user_id", userID, "reason", accessErr.Message)
+		accessErr.write(w)
+		return
+	}
+
+	genReq, sources, err := messageRequest(context.Background(), userID, chat, store.Message{
+		ChatId:   message.ChatId,
+		ParentId: message.ParentId,
+		Prompt:   prompt,
+		Model:    model,
+	}, generateOptions{withHistory: true})
+	if err != nil {
+		slog.Error("Failed to get conversation history", "chat_id", message.ChatId, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve conversation history",
+		})
+		return
+	}
+
+	genAIResponse, err := genai.Default().Generate(context.Background(), genReq)
+	if err != nil {
+		slog.Error("Failed to generate AI response", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: fmt.Sprintf("Failed to generate AI response: %s", err.Error()),
+		})
+		return
+	}
+	countRequest(userID)
+
+	addSiblingMessage(w, userID, chat, message, store.Message{
+		ID:         encrypt.GenerateID(nil),
+		ChatId:     message.ChatId,
+		ParentId:   message.ParentId,
+		AuthorId:   userID,
+		Prompt:     prompt,
+		Response:   genAIResponse.Response,
+		CreatedAt:  time.Now(),
+		Model:      genAIResponse.Model,
+		References: uniqueStrings(append(references, sources...)),
+	})
+}
+
+// addSiblingMessage stores sibling under the same parent as message, making
+// it the chat's active leaf, and answers with it
+func addSiblingMessage(w http.ResponseWriter, userID string, chat *store.Chat, message *store.Message, sibling store.Message) {
+	if err := store.CreateMessage(sibling); err != nil {
+		slog.Error("Failed to create message", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to create message",
+		})
+		return
+	}
+
+	// Keep the chat's ordering in the chat list up to date
+	chat.LastMessageAt = time.Now()
+	if err := store.TouchChat(chat.ID, chat.LastMessageAt); err != nil {
+		slog.Error("Failed to update chat", "chat_id", chat.ID, "error", err)
+	}
+	publishMessageCreated(chat.UserId, sibling, "")
+
+	slog.Info("Branch created", "message_id", sibling.ID, "sibling_of", message.ID, "chat_id", message.ChatId, "user_id", userID)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Branch created successfully",
+		Data:    sibling,
+	})
+}
@@ -3,9 +3,12 @@ package handlers
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
+	"slices"
+	"strconv"
 	"time"
 
 	"github.com/SherClockHolmes/webpush-go"
@@ -61,6 +64,16 @@ func CreateChatHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// A chat may start out with a model of its own, one the user's plan allows
+	if req.Model != "" {
+		model, accessErr := authorizeModel(userID, req.Model)
+		if accessErr != nil {
+			accessErr.write(w)
+			return
+		}
+		req.Model = model
+	}
+
 	// Create new chat
 	chat := store.Chat{
 		ID:            req.ID,
@@ -73,6 +86,7 @@ func CreateChatHandler(w http.ResponseWriter, r *http.Request) {
 		Messages:      []store.Message{},
 		LastMessageAt: time.Now(),
 		IsPrivate:     req.IsPrivate,
+		Model:         req.Model,
 	}
 
 	if err := store.CreateChat(chat); err != nil {
@@ -130,8 +144,41 @@ func GetChatsHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get user chats
-	chats, err := store.GetChatsByUserId(userID)
+	// Optional filters: ?folder=<id|none>&tag=<id>&pinned=<bool>&archived=<bool>&sort=<key>
+	query := r.URL.Query()
+	filter := store.ChatFilter{
+		FolderId: query.Get("folder"),
+		TagId:    query.Get("tag"),
+		SortBy:   query.Get("sort"),
+	}
+	for name, target := range map[string]**bool{"pinned": &filter.Pinned, "archived": &filter.Archived} {
+		value := query.Get(name)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: fmt.Sprintf("Invalid value for %s, expected true or false", name),
+			})
+			return
+		}
+		*target = &parsed
+	}
+
+	// Every change to a chat the user sees moves their sync cursor, so it
+	// identifies this list. It is read before the chats so it is never newer.
+	cursor, err := store.GetUserChangeSeq(userID)
+	if err != nil {
+		slog.Error("Failed to get sync cursor", "user_id", userID, "error", err)
+	} else if notModified(w, r, cursorETag(cursor)) {
+		return
+	}
+
+	// Get user chats, pinned first
+	chats, err := store.GetChatsByUserIdFiltered(userID, filter)
 	if err != nil {
 		slog.Error("Failed to get chats", "user_id", userID, "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -196,18 +243,36 @@ func GetChatHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Verify chat belongs to user
-	if chat.UserId != userID {
-		if chat.IsPrivate == true {
-			// If chat is private, access denied
-			w.WriteHeader(http.StatusForbidden)
-			json.NewEncoder(w).Encode(store.Response{
-				Success: false,
-				Message: "Access denied",
-			})
-			return
-		}
-		chat.IsReadOnly = true
+	// Only members see the chat, anyone else reads it through a share link
+	role, err := chatRole(chat, userID)
+	if err != nil {
+		slog.Error("Failed to get chat role", "chat_id", chatID, "user_id", userID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve chat",
+		})
+		return
+	}
+	if role == "" {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Access denied",
+		})
+		return
+	}
+	chat.Role = role
+	chat.IsReadOnly = role == store.ChatRoleViewer
+	// Folders, tags and pins are the owner's own organisation
+	if role != store.ChatRoleOwner {
+		chat.FolderId = ""
+		chat.Tags = nil
+		chat.IsPinned = false
+	}
+
+	if notModified(w, r, versionETag(chat.Version)) {
+		return
 	}
 
 	json.NewEncoder(w).Encode(store.Response{
@@ -253,34 +318,14 @@ func UpdateChatHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get existing chat
-	chat, err := store.GetChatById(chatID)
-	if err != nil {
-		slog.Error("Failed to get chat", "chat_id", chatID, "error", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(store.Response{
-			Success: false,
-			Message: "Failed to retrieve chat",
-		})
-		return
-	}
-
-	if chat == nil {
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(store.Response{
-			Success: false,
-			Message: "Chat not found",
-		})
+	// Editors may rename the chat, the rest is up to the owner
+	chat, role, ok := authorizeChat(w, chatID, userID, store.ChatRoleEditor)
+	if !ok {
 		return
 	}
 
-	// Verify chat belongs to user
-	if chat.UserId != userID {
-		w.WriteHeader(http.StatusForbidden)
-		json.NewEncoder(w).Encode(store.Response{
-			Success: false,
-			Message: "Access denied",
-		})
+	ifVersion, ok := ifMatchVersion(w, r, chat.Version)
+	if !ok {
 		return
 	}
 
@@ -291,13 +336,20 @@ func UpdateChatHandler(w http.ResponseWriter, r *http.Request) {
 	if !req.LastMessageAt.IsZero() {
 		chat.LastMessageAt = req.LastMessageAt
 	}
-	chat.IsArchived = req.IsArchived
-	if req.IsPrivate != chat.IsPrivate {
-		chat.IsPrivate = req.IsPrivate
+	if role == store.ChatRoleOwner {
+		chat.IsArchived = req.IsArchived
+		if req.IsPrivate != chat.IsPrivate {
+			chat.IsPrivate = req.IsPrivate
+		}
 	}
 	chat.UpdatedAt = time.Now()
 
-	if err := store.UpdateChat(*chat); err != nil {
+	version, err := store.UpdateChatIfVersion(*chat, ifVersion)
+	if errors.Is(err, store.ErrVersionConflict) {
+		preconditionFailed(w, 0)
+		return
+	}
+	if err != nil {
 		slog.Error("Failed to update chat", "chat_id", chatID, "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(store.Response{
@@ -307,6 +359,9 @@ func UpdateChatHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	chat.Version = version
+	w.Header().Set("ETag", versionETag(version))
+
 	slog.Info("Chat updated successfully", "chat_id", chatID, "user_id", userID)
 
 	json.NewEncoder(w).Encode(store.Response{
@@ -342,39 +397,24 @@ func DeleteChatHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get chat to verify ownership
-	chat, err := store.GetChatById(chatID)
-	if err != nil {
-		slog.Error("Failed to get chat", "chat_id", chatID, "error", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(store.Response{
-			Success: false,
-			Message: "Failed to retrieve chat",
-		})
+	// Only the owner can delete a chat
+	chat, _, ok := authorizeChat(w, chatID, userID, store.ChatRoleOwner)
+	if !ok {
 		return
 	}
 
-	if chat == nil {
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(store.Response{
-			Success: false,
-			Message: "Chat not found",
-		})
+	ifVersion, ok := ifMatchVersion(w, r, chat.Version)
+	if !ok {
 		return
 	}
 
-	// Verify chat belongs to user
-	if chat.UserId != userID {
-		w.WriteHeader(http.StatusForbidden)
-		json.NewEncoder(w).Encode(store.Response{
-			Success: false,
-			Message: "Access denied",
-		})
+	// Delete the chat, unless it changed since the If-Match check
+	err := store.DeleteChatByIDIfVersion(chatID, ifVersion)
+	if errors.Is(err, store.ErrVersionConflict) {
+		preconditionFailed(w, 0)
 		return
 	}
-
-	// Delete the chat
-	if err := store.DeleteChatByID(chatID); err != nil {
+	if err != nil {
 		slog.Error("Failed to delete chat", "chat_id", chatID, "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(store.Response{
@@ -424,7 +464,8 @@ func DeleteAllChatsHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// CreateMessageHandler handles POST /api/chats/{id}/messages
+// CreateMessageHandler handles POST /api/chats/{id}/messages. With Accept:
+// text/event-stream or ?stream=true the response is streamed, see streamMessage.
 func CreateMessageHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -450,7 +491,13 @@ func CreateMessageHandler(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Parse request body
-	var req store.Message
+	var req struct {
+		store.Message
+		// History false answers the prompt without the chat's earlier messages
+		History *bool `json:"history,omitempty"`
+		// Mode overrides the user's preferred response mode for this message
+		Mode store.Modes `json:"mode,omitempty"`
+	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		slog.Error("Invalid request body", "error", err)
 		w.WriteHeader(http.StatusBadRequest)
@@ -471,46 +518,99 @@ func CreateMessageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get chat to verify ownership first (before generating AI response)
-	chat, err := store.GetChatById(chatID)
-	if err != nil {
-		slog.Error("Failed to get chat", "chat_id", chatID, "error", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	if !validMode(req.Mode) {
+		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(store.Response{
 			Success: false,
-			Message: "Failed to retrieve chat",
+			Message: "mode must be one of light-response, web-search or deep-search",
 		})
 		return
 	}
 
-	if chat == nil {
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(store.Response{
-			Success: false,
-			Message: "Chat not found",
-		})
+	// Verify the user may write to the chat first (before generating AI response)
+	chat, _, ok := authorizeChat(w, chatID, userID, store.ChatRoleEditor)
+	if !ok {
 		return
 	}
 
-	// Verify chat belongs to user
-	if chat.UserId != userID {
-		w.WriteHeader(http.StatusForbidden)
-		json.NewEncoder(w).Encode(store.Response{
-			Success: false,
-			Message: "Access denied",
-		})
-		return
+	// New messages reply to the given parent, or continue the active branch
+	parentID := req.ParentId
+	if parentID != "" {
+		parent, err := store.GetMessageById(parentID)
+		if err != nil {
+			slog.Error("Failed to get parent message", "message_id", parentID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Failed to retrieve parent message",
+			})
+			return
+		}
+		if parent == nil || parent.ChatId != chatID {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Parent message not found in this chat",
+			})
+			return
+		}
+	} else if len(chat.Messages) > 0 {
+		parentID = chat.Messages[len(chat.Messages)-1].ID
+	}
+
+	opts := generateOptions{
+		withHistory: req.History == nil || *req.History,
+		mode:        req.Mode,
+	}
+
+	// Generated responses use the chat's model unless the message asks for
+	// another, and only models the user's plan allows
+	if req.Response == "" {
+		model, accessErr := authorizeGeneration(userID, generationModel(userID, chat, req.Model))
+		if accessErr != nil {
+			slog.Info("Generation not allowed", "chat_id", chatID, "user_id", userID, "reason", accessErr.Message)
+			accessErr.write(w)
+			return
+		}
+		req.Model = model
 	}
 
-	// Generate response using AI wrapper (only if response not provided)
-	genaiResp := genai.GENAISERVICE{
-		APIKey: viper.GetString("API_KEY"),
-		Model:  viper.GetString("MODEL"),
+	// Streamed responses are sent piece by piece and stored when they end
+	if req.Response == "" && wantsStream(r) {
+		streamMessage(w, r, userID, chat, store.Message{
+			ID:         encrypt.GenerateID(nil),
+			ChatId:     chatID,
+			ParentId:   parentID,
+			AuthorId:   userID,
+			Prompt:     req.Prompt,
+			Model:      req.Model,
+			References: req.References,
+		}, opts)
+		return
 	}
 
+	// Generate response with the requested model (only if response not provided)
+	model := req.Model
+	references := req.References
 	var aiResponse string
 	if req.Response == "" {
-		genAIResponse, err := genaiResp.GenerateAIResponse(context.Background(), req.Prompt)
+		genReq, sources, err := messageRequest(r.Context(), userID, chat, store.Message{
+			ChatId:   chatID,
+			ParentId: parentID,
+			Prompt:   req.Prompt,
+			Model:    req.Model,
+		}, opts)
+		if err != nil {
+			slog.Error("Failed to get conversation history", "chat_id", chatID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Failed to retrieve conversation history",
+			})
+			return
+		}
+
+		genAIResponse, err := genai.Default().Generate(context.Background(), genReq)
 		if err != nil {
 			slog.Error("Failed to generate AI response", "error", err)
 			w.WriteHeader(http.StatusInternalServerError)
@@ -521,19 +621,29 @@ func CreateMessageHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		aiResponse = genAIResponse.Response
+		model = genAIResponse.Model
+		if len(sources) > 0 {
+			references = uniqueStrings(append(references, sources...))
+		}
+		countRequest(userID)
 	} else {
 		aiResponse = req.Response
+		if model == "" {
+			model = genai.Default().DefaultModel()
+		}
 	}
 
 	// Create new message
 	message := store.Message{
 		ID:         encrypt.GenerateID(nil),
 		ChatId:     chatID,
+		ParentId:   parentID,
+		AuthorId:   userID,
 		Prompt:     req.Prompt,
 		Response:   aiResponse,
 		CreatedAt:  time.Now(),
-		Model:      genaiResp.Model,
-		References: req.References,
+		Model:      model,
+		References: references,
 	}
 
 	if err := store.CreateMessage(message); err != nil {
@@ -551,12 +661,14 @@ func CreateMessageHandler(w http.ResponseWriter, r *http.Request) {
 	chat.LastMessageAt = time.Now()
 	chat.UpdatedAt = time.Now()
 
-	if err := store.UpdateChat(*chat); err != nil {
+	if err := store.TouchChat(chat.ID, chat.LastMessageAt); err != nil {
 		slog.Error("Failed to update chat", "chat_id", chatID, "error", err)
 	}
 
 	slog.Info("Message created successfully", "message_id", message.ID, "chat_id", chatID, "user_id", userID)
 
+	publishMessageCreated(chat.UserId, message, r.Header.Get("X-Device-ID"))
+
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(store.Response{
 		Success: true,
@@ -565,128 +677,135 @@ func CreateMessageHandler(w http.ResponseWriter, r *http.Request) {
 	})
 
 	// Send push notification asynchronously to avoid blocking the response
-	go func() {
-		// Use a new context with timeout for the notification
-		notifCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-		defer cancel()
+	go sendTaskCompletedPush(userID, message)
+}
 
-		// Get subscriptions
-		subscriptions, err := store.GetSubscriptionsByUserID(notifCtx, userID)
-		if err != nil {
-			slog.Error("Failed to get subscriptions", "user_id", userID, "error", err)
-			return
-		}
+// sendTaskCompletedPush tells the user's devices that a response is ready
+func sendTaskCompletedPush(userID string, message store.Message) {
+	if !pushAllowed(userID, notifyTaskCompleted) {
+		return
+	}
 
-		if len(subscriptions) == 0 {
-			slog.Debug("No subscriptions found for user", "user_id", userID)
-			return
-		}
+	// Use a new context with timeout for the notification
+	notifCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Get subscriptions
+	subscriptions, err := store.GetSubscriptionsByUserID(notifCtx, userID)
+	if err != nil {
+		slog.Error("Failed to get subscriptions", "user_id", userID, "error", err)
+		return
+	}
+
+	if len(subscriptions) == 0 {
+		slog.Debug("No subscriptions found for user", "user_id", userID)
+		return
+	}
+
+	// Prepare notification payload
+	promptPreview := message.Prompt
+	if len(promptPreview) > 20 {
+		promptPreview = promptPreview[:20] + "..."
+	} else if len(promptPreview) == 0 {
+		promptPreview = "your request"
+	}
+
+	payload := store.NotificationPayload{
+		Title: "✅ Gemmie Finished Your Task!",
+		Body:  fmt.Sprintf("The response for '%s' is ready — tap to review it now.", promptPreview),
+		Data: map[string]any{
+			"chat_id":    message.ChatId,
+			"message_id": message.ID,
+			"url":        "/chat/" + message.ChatId,
+		},
+		Tag:                "response-complete",
+		RequireInteraction: true,
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		slog.Error("Failed to marshal notification payload", "error", err)
+		return
+	}
 
-		// Prepare notification payload
-		promptPreview := message.Prompt
-		if len(promptPreview) > 20 {
-			promptPreview = promptPreview[:20] + "..."
-		} else if len(promptPreview) == 0 {
-			promptPreview = "your request"
+	// Send to all subscriptions
+	successCount := 0
+	failureCount := 0
+
+	for _, sub := range subscriptions {
+		// Validate subscription before sending
+		if sub.Endpoint == "" || sub.P256dhKey == "" || sub.AuthKey == "" {
+			slog.Warn("Invalid subscription data", "user_id", sub.UserID)
+			// Delete invalid subscription
+			store.DeleteSubscription(notifCtx, sub.Endpoint)
+			failureCount++
+			continue
 		}
 
-		payload := store.NotificationPayload{
-			Title: "✅ Gemmie Finished Your Task!",
-			Body:  fmt.Sprintf("The response for '%s' is ready — tap to review it now.", promptPreview),
-			Data: map[string]any{
-				"chat_id":    message.ChatId,
-				"message_id": message.ID,
-				"url":        "/chat/" + message.ChatId,
+		resp, err := webpush.SendNotification(data, &webpush.Subscription{
+			Endpoint: sub.Endpoint,
+			Keys: webpush.Keys{
+				Auth:   sub.AuthKey,
+				P256dh: sub.P256dhKey,
 			},
-			Tag:                "response-complete",
-			RequireInteraction: true,
-		}
+		}, &webpush.Options{
+			Subscriber:      viper.GetString("VAPID_EMAIL"),
+			VAPIDPublicKey:  viper.GetString("VAPID_PUBLIC_KEY"),
+			VAPIDPrivateKey: viper.GetString("VAPID_PRIVATE_KEY"),
+			TTL:             30,
+		})
 
-		data, err := json.Marshal(payload)
 		if err != nil {
-			slog.Error("Failed to marshal notification payload", "error", err)
-			return
-		}
-
-		// Send to all subscriptions
-		successCount := 0
-		failureCount := 0
+			slog.Error("Failed to send push notification",
+				"user_id", sub.UserID,
+				"error", err.Error(),
+			)
 
-		for _, sub := range subscriptions {
-			// Validate subscription before sending
-			if sub.Endpoint == "" || sub.P256dhKey == "" || sub.AuthKey == "" {
-				slog.Warn("Invalid subscription data", "user_id", sub.UserID)
-				// Delete invalid subscription
+			// Delete subscription if it's a key mismatch or invalid endpoint
+			if resp != nil && (resp.StatusCode == 410 || resp.StatusCode == 404) {
+				slog.Info("Deleting invalid subscription", "user_id", sub.UserID, "status", resp.StatusCode)
+				store.DeleteSubscription(notifCtx, sub.Endpoint)
+			} else if err.Error() == "P256 point not on curve" {
+				// This means the subscription was created with different VAPID keys
+				slog.Warn("Deleting subscription with mismatched VAPID keys", "user_id", sub.UserID)
 				store.DeleteSubscription(notifCtx, sub.Endpoint)
-				failureCount++
-				continue
 			}
 
-			resp, err := webpush.SendNotification(data, &webpush.Subscription{
-				Endpoint: sub.Endpoint,
-				Keys: webpush.Keys{
-					Auth:   sub.AuthKey,
-					P256dh: sub.P256dhKey,
-				},
-			}, &webpush.Options{
-				Subscriber:      viper.GetString("VAPID_EMAIL"),
-				VAPIDPublicKey:  viper.GetString("VAPID_PUBLIC_KEY"),
-				VAPIDPrivateKey: viper.GetString("VAPID_PRIVATE_KEY"),
-				TTL:             30,
-			})
-
-			if err != nil {
-				slog.Error("Failed to send push notification",
-					"user_id", sub.UserID,
-					"error", err.Error(),
-				)
-
-				// Delete subscription if it's a key mismatch or invalid endpoint
-				if resp != nil && (resp.StatusCode == 410 || resp.StatusCode == 404) {
-					slog.Info("Deleting invalid subscription", "user_id", sub.UserID, "status", resp.StatusCode)
-					store.DeleteSubscription(notifCtx, sub.Endpoint)
-				} else if err.Error() == "P256 point not on curve" {
-					// This means the subscription was created with different VAPID keys
-					slog.Warn("Deleting subscription with mismatched VAPID keys", "user_id", sub.UserID)
-					store.DeleteSubscription(notifCtx, sub.Endpoint)
-				}
-
-				failureCount++
-				continue
-			}
+			failureCount++
+			continue
+		}
 
-			// Close response body
-			if resp != nil && resp.Body != nil {
-				resp.Body.Close()
-			}
+		// Close response body
+		if resp != nil && resp.Body != nil {
+			resp.Body.Close()
+		}
 
-			// Check response status
-			if resp != nil && resp.StatusCode >= 200 && resp.StatusCode < 300 {
-				successCount++
-				slog.Debug("Push notification sent successfully",
+		// Check response status
+		if resp != nil && resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			successCount++
+			slog.Debug("Push notification sent successfully",
+				"user_id", sub.UserID,
+				"status", resp.StatusCode,
+			)
+		} else {
+			failureCount++
+			if resp != nil {
+				slog.Warn("Push notification failed",
 					"user_id", sub.UserID,
 					"status", resp.StatusCode,
 				)
-			} else {
-				failureCount++
-				if resp != nil {
-					slog.Warn("Push notification failed",
-						"user_id", sub.UserID,
-						"status", resp.StatusCode,
-					)
-				}
 			}
 		}
+	}
 
-		if successCount > 0 || failureCount > 0 {
-			slog.Info("Push notification summary",
-				"user_id", userID,
-				"success", successCount,
-				"failed", failureCount,
-				"total", len(subscriptions),
-			)
-		}
-	}()
+	if successCount > 0 || failureCount > 0 {
+		slog.Info("Push notification summary",
+			"user_id", userID,
+			"success", successCount,
+			"failed", failureCount,
+			"total", len(subscriptions),
+		)
+	}
 }
 
 // DeleteMessageHandler handles DELETE /api/messages/{id}
@@ -736,29 +855,23 @@ func DeleteMessageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get chat to verify ownership
-	chat, err := store.GetChatById(message.ChatId)
-	if err != nil {
-		slog.Error("Failed to get chat", "chat_id", message.ChatId, "error", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(store.Response{
-			Success: false,
-			Message: "Failed to retrieve chat",
-		})
+	// Verify the user may edit messages in the chat
+	if _, _, ok := authorizeChat(w, message.ChatId, userID, store.ChatRoleEditor); !ok {
 		return
 	}
 
-	if chat == nil || chat.UserId != userID {
-		w.WriteHeader(http.StatusForbidden)
-		json.NewEncoder(w).Encode(store.Response{
-			Success: false,
-			Message: "Access denied",
-		})
+	ifVersion, ok := ifMatchVersion(w, r, message.Version)
+	if !ok {
 		return
 	}
 
-	// Delete the message
-	if err := store.DeleteMessageByID(messageID); err != nil {
+	// Delete the message, unless it changed since the If-Match check
+	err = store.DeleteMessageByIDIfVersion(messageID, ifVersion)
+	if errors.Is(err, store.ErrVersionConflict) {
+		preconditionFailed(w, 0)
+		return
+	}
+	if err != nil {
 		slog.Error("Failed to delete message", "message_id", messageID, "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(store.Response{
@@ -823,24 +936,13 @@ func UpdateMessageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Get chat to verify ownership
-	chat, err := store.GetChatById(message.ChatId)
-	if err != nil {
-		slog.Error("Failed to get chat", "chat_id", message.ChatId, "error", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(store.Response{
-			Success: false,
-			Message: "Failed to retrieve chat",
-		})
+	// Verify the user may edit messages in the chat
+	if _, _, ok := authorizeChat(w, message.ChatId, userID, store.ChatRoleEditor); !ok {
 		return
 	}
 
-	if chat == nil || chat.UserId != userID {
-		w.WriteHeader(http.StatusForbidden)
-		json.NewEncoder(w).Encode(store.Response{
-			Success: false,
-			Message: "Access denied",
-		})
+	ifVersion, ok := ifMatchVersion(w, r, message.Version)
+	if !ok {
 		return
 	}
 
@@ -856,13 +958,38 @@ func UpdateMessageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	message.Prompt = req.Prompt
+	// A new prompt starts a branch beside the message instead of overwriting
+	// it, like POST /api/messages/{id}/branch. Edits in place only fix the
+	// response, model and references.
+	if req.Prompt != "" && req.Prompt != message.Prompt {
+		createSiblingMessage(w, userID, message, req.Prompt, req.References)
+		return
+	}
+	req.Prompt = message.Prompt
+
+	// Nothing to record if the content did not change
+	if message.Prompt == req.Prompt && message.Response == req.Response &&
+		message.Model == req.Model && slices.Equal(message.References, req.References) {
+		w.Header().Set("ETag", versionETag(message.Version))
+		json.NewEncoder(w).Encode(store.Response{
+			Success: true,
+			Message: "Message unchanged",
+			Data:    message,
+		})
+		return
+	}
+
 	message.Response = req.Response
 	message.Model = req.Model
 	message.References = req.References
 
-	// Update message
-	if err := store.UpdateMessage(*message); err != nil {
+	// Update message, keeping the previous content as a version
+	version, err := store.UpdateMessageWithHistoryIfVersion(*message, userID, ifVersion)
+	if errors.Is(err, store.ErrVersionConflict) {
+		preconditionFailed(w, 0)
+		return
+	}
+	if err != nil {
 		slog.Error("Failed to update message", "message_id", messageID, "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(store.Response{
@@ -872,10 +999,17 @@ func UpdateMessageHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	message.IsEdited = true
+	message.EditedAt = time.Now()
+	message.VersionCount++
+	message.Version = version
+	w.Header().Set("ETag", versionETag(version))
+
 	slog.Info("Message updated successfully", "message_id", messageID, "user_id", userID)
 
 	json.NewEncoder(w).Encode(store.Response{
 		Success: true,
 		Message: "Message updated successfully",
+		Data:    message,
 	})
 }
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+
+	"github.com/imrany/gemmie/gemmie-server/internal/genai"
+	"github.com/imrany/gemmie/gemmie-server/store"
+)
+
+const (
+	// historyTokenCap bounds the history sent with a prompt however large the
+	// model's context window is, the oldest turns cost more than they help
+	historyTokenCap = 32000
+	// responseTokenReserve is kept free in the context window for the response
+	responseTokenReserve = 4096
+	// turnTokenCap shortens a single long turn, so one pasted document does
+	// not crowd every other turn out
+	turnTokenCap = 4000
+)
+
+// conversationHistory returns at most tokenCap tokens of the turns leading up
+// to parentID that fit the model's context window next to reserved tokens of
+// prompt, system prompt and sources, as role tagged turns. The newest
+// turns are kept and older ones dropped once the budget runs out. activePath
+// is the chat's active branch when already loaded, it is used when parentID
+// is on it and saves loading the chat's messages again.
+func conversationHistory(chatID, parentID string, activePath []store.Message, model string, reserved, tokenCap int) ([]genai.Turn, error) {
+	if parentID == "" {
+		return nil, nil
+	}
+
+	path := activePath
+	if len(path) == 0 || path[len(path)-1].ID != parentID {
+		messages, err := store.GetMessagesByChatId(chatID)
+		if err != nil {
+			return nil, err
+		}
+		path = store.ActivePath(messages, parentID)
+	}
+
+	window := genai.Default().ContextWindow(model)
+	budget := min(tokenCap, window-responseTokenReserve-reserved)
+	if budget <= 0 {
+		return nil, nil
+	}
+
+	// Collect newest first, each message is a user turn and an assistant turn
+	var turns []genai.Turn
+	used := 0
+	for i := len(path) - 1; i >= 0; i-- {
+		msg := path[i]
+		if msg.Prompt == "" || msg.Response == "" {
+			continue
+		}
+
+		user := truncateTurn(msg.Prompt)
+		assistant := truncateTurn(msg.Response)
+		cost := genai.EstimateTokens(user) + genai.EstimateTokens(assistant)
+		if used+cost > budget {
+			slog.Debug("Conversation history truncated", "chat_id", chatID, "kept_messages", len(turns)/2, "dropped_messages", i+1)
+			break
+		}
+		used += cost
+
+		turns = append(turns,
+			genai.Turn{Role: genai.RoleAssistant, Content: assistant},
+			genai.Turn{Role: genai.RoleUser, Content: user},
+		)
+	}
+
+	slices.Reverse(turns)
+	return turns, nil
+}
+
+// truncateTurn keeps the start and end of a text longer than turnTokenCap
+func truncateTurn(text string) string {
+	if genai.EstimateTokens(text) <= turnTokenCap {
+		return text
+	}
+
+	runes := []rune(text)
+	keep := turnTokenCap * 4 / 2
+	return string(runes[:keep]) + "\n\n[...]\n\n" + string(runes[len(runes)-keep:])
+}
+
+// messageRequest is the generation request for a new message of a chat, sent
+// by userID. It carries the user's system prompt with the chat's persona, the
+// conversation leading up to the message unless opts.withHistory is false,
+// see conversationHistory, and what the response mode adds, see applyMode.
+// It returns the URLs of the sources the response is grounded in.
+func messageRequest(ctx context.Context, userID string, chat *store.Chat, message store.Message, opts generateOptions) (genai.Request, []string, error) {
+	instructions, preferred := userInstructions(userID, chat.PersonaId)
+	mode := responseMode(opts.mode, preferred)
+	instructions.Guidance = modeGuidance(mode)
+
+	system, _ := genai.SystemPrompt(instructions)
+	req := genai.Request{Model: message.Model, Prompt: message.Prompt, System: system}
+
+	if opts.withHistory {
+		tokenCap := historyTokenCap
+		if mode == store.ModesLightResponse {
+			tokenCap = lightHistoryTokenCap
+		}
+		// Sources are added to the prompt after the history is chosen
+		reserved := genai.EstimateTokens(message.Prompt) + genai.EstimateTokens(system) + sourcesTokenReserve(mode)
+
+		history, err := conversationHistory(message.ChatId, message.ParentId, chat.Messages, message.Model, reserved, tokenCap)
+		if err != nil {
+			return req, nil, err
+		}
+		req.History = history
+	}
+
+	sources := applyMode(ctx, &req, mode, opts.onSearch)
+	return req, sources, nil
+}
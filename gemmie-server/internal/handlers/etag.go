@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/imrany/gemmie/gemmie-server/store"
+)
+
+// versionETag is the ETag of a resource at a row version
+func versionETag(version int64) string {
+	return `"` + strconv.FormatInt(version, 10) + `"`
+}
+
+// cursorETag is the weak ETag of a user's chat list, built from their sync cursor
+func cursorETag(cursor int64) string {
+	return `W/"c` + strconv.FormatInt(cursor, 10) + `"`
+}
+
+// etagMatches reports whether a If-Match or If-None-Match header value lists etag
+func etagMatches(header, etag string) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified sets the ETag header and answers 304 when the client already has etag.
+// The caller stops when it returns true.
+func notModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+
+	if header := r.Header.Get("If-None-Match"); header != "" && etagMatches(header, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// ifMatchVersion checks If-Match against the current version of a resource.
+// It returns the version a conditional update must still find, 0 when the
+// request has no If-Match, and false after answering 412 on a mismatch.
+func ifMatchVersion(w http.ResponseWriter, r *http.Request, current int64) (int64, bool) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return 0, true
+	}
+
+	if !etagMatches(header, versionETag(current)) {
+		preconditionFailed(w, current)
+		return 0, false
+	}
+	return current, true
+}
+
+// preconditionFailed answers 412 so the client refetches. current is the
+// version the resource is at, 0 when a conditional update lost a race and
+// the new version is unknown.
+func preconditionFailed(w http.ResponseWriter, current int64) {
+	var data any
+	if current != 0 {
+		w.Header().Set("ETag", versionETag(current))
+		data = map[string]string{"etag": versionETag(current)}
+	}
+
+	w.WriteHeader(http.StatusPreconditionFailed)
+	json.NewEncoder(w).Encode(store.Response{
+		Success: false,
+		Message: "Resource was modified by another request, fetch it again and retry",
+		Data:    data,
+	})
+}
@@ -0,0 +1,659 @@
+package handlers
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/imrany/gemmie/gemmie-server/internal/encrypt"
+	"github.com/imrany/gemmie/gemmie-server/store"
+	"github.com/imrany/whats-email/pkg/mailer"
+	"github.com/spf13/viper"
+)
+
+// exportLinkTTL is how long a finished export can be downloaded
+const exportLinkTTL = 24 * time.Hour
+
+// exportProfile is the profile section of a data export, without credentials or internal tokens
+type exportProfile struct {
+	ID              string             `json:"id"`
+	Username        string             `json:"username"`
+	Email           string             `json:"email"`
+	CreatedAt       time.Time          `json:"created_at"`
+	UpdatedAt       time.Time          `json:"updated_at"`
+	Preferences     string             `json:"preferences,omitempty"`
+	WorkFunction    string             `json:"work_function,omitempty"`
+	Theme           string             `json:"theme,omitempty"`
+	SyncEnabled     bool               `json:"sync_enabled"`
+	Plan            string             `json:"plan,omitempty"`
+	PlanName        string             `json:"plan_name,omitempty"`
+	Amount          int                `json:"amount,omitempty"`
+	Duration        string             `json:"duration,omitempty"`
+	PhoneNumber     string             `json:"phone_number,omitempty"`
+	ExpiryTimestamp int64              `json:"expiry_timestamp,omitempty"`
+	ExpireDuration  int64              `json:"expire_duration,omitempty"`
+	Price           string             `json:"price,omitempty"`
+	ResponseMode    store.Modes        `json:"response_mode,omitempty"`
+	AgreeToTerms    bool               `json:"agree_to_terms"`
+	RequestCount    store.RequestCount `json:"request_count"`
+	EmailVerified   bool               `json:"email_verified"`
+	EmailSubscribed bool               `json:"email_subscribed"`
+	UserAgent       string             `json:"user_agent,omitempty"`
+}
+
+// exportPushSubscription leaves out the device encryption keys
+type exportPushSubscription struct {
+	Endpoint  string    `json:"endpoint"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+const exportReadme = `Gemmie account data export
+==========================
+
+This archive contains all data Gemmie stores about your account.
+
+  profile.json             Your profile, plan and preferences
+  chats.json               Your chats, each with its messages
+  folders.json             Folders you use to organise chats
+  tags.json                Tags you put on chats
+  personas.json            Personas you pick for chats
+  arcades.json             Code arcades you created
+  transactions.json        Payments made with your phone number
+  subscriptions.json       Plan periods you bought
+  push_subscriptions.json  Devices registered for push notifications
+  platform_errors.json     Error reports submitted from your devices
+
+All files are UTF-8 encoded JSON. Timestamps are in RFC 3339 format.
+Passwords and verification tokens are never included.
+`
+
+// exportDir returns the directory export archives are written to
+func exportDir() string {
+	if dir := viper.GetString("EXPORT_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join(os.TempDir(), "gemmie-exports")
+}
+
+// publicBaseURL returns the externally reachable base URL of this server
+func publicBaseURL(r *http.Request) string {
+	if base := viper.GetString("PUBLIC_URL"); base != "" {
+		return base
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, r.Host)
+}
+
+// exportDownloadPath is the path an export's archive is downloaded from, with
+// its token
+func exportDownloadPath(export store.DataExport) string {
+	return fmt.Sprintf("/api/exports/%s/download?token=%s", export.ID, export.Token)
+}
+
+// withDownloadURL sets the download link of a ready export for its owner. The
+// link is relative to this server unless PUBLIC_URL is set.
+func withDownloadURL(export *store.DataExport) {
+	if export.Status != store.ExportStatusReady || time.Now().After(export.ExpiresAt) {
+		return
+	}
+	export.DownloadURL = viper.GetString("PUBLIC_URL") + exportDownloadPath(*export)
+}
+
+// RequestDataExportHandler handles POST /api/exports
+func RequestDataExportHandler(w http.ResponseWriter, r *http.Request, smtpConfig mailer.SMTPConfig) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	user, err := store.GetUserByID(userID)
+	if err != nil {
+		slog.Error("Database error", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Database error",
+		})
+		return
+	}
+
+	if user == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User not found",
+		})
+		return
+	}
+
+	// Only one export may run at a time per user
+	active, err := store.HasActiveDataExport(userID)
+	if err != nil {
+		slog.Error("Failed to check active exports", "user_id", userID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Database error",
+		})
+		return
+	}
+
+	if active {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "An export is already in progress",
+		})
+		return
+	}
+
+	token, err := encrypt.GenerateSecureToken(32)
+	if err != nil {
+		slog.Error("Failed to generate export token", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to create export",
+		})
+		return
+	}
+
+	prefix := "export"
+	export := store.DataExport{
+		ID:        encrypt.GenerateID(&prefix),
+		UserId:    userID,
+		Status:    store.ExportStatusPending,
+		Token:     token,
+		CreatedAt: time.Now(),
+	}
+
+	if err := store.CreateDataExport(export); err != nil {
+		slog.Error("Failed to create data export", "user_id", userID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to create export",
+		})
+		return
+	}
+
+	// Links sent by email or push must not come from the request's Host
+	// header, they are only sent when PUBLIC_URL is set
+	var downloadURL string
+	if base := viper.GetString("PUBLIC_URL"); base != "" {
+		downloadURL = base + exportDownloadPath(export)
+	}
+	go runDataExport(export, *user, downloadURL, smtpConfig)
+
+	slog.Info("Data export requested", "export_id", export.ID, "user_id", userID)
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Export started. You will be notified when it is ready.",
+		Data:    export,
+	})
+}
+
+// GetDataExportsHandler handles GET /api/exports
+func GetDataExportsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	exports, err := store.GetDataExportsByUserID(userID)
+	if err != nil {
+		slog.Error("Failed to get data exports", "user_id", userID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve exports",
+		})
+		return
+	}
+
+	for i := range exports {
+		withDownloadURL(&exports[i])
+	}
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Exports retrieved successfully",
+		Data:    exports,
+	})
+}
+
+// GetDataExportHandler handles GET /api/exports/{id}
+func GetDataExportHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	exportID := mux.Vars(r)["id"]
+
+	export, err := store.GetDataExportByID(exportID)
+	if err != nil {
+		slog.Error("Failed to get data export", "export_id", exportID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve export",
+		})
+		return
+	}
+
+	if export == nil || export.UserId != userID {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Export not found",
+		})
+		return
+	}
+
+	withDownloadURL(export)
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Export retrieved successfully",
+		Data:    export,
+	})
+}
+
+// DownloadDataExportHandler handles GET /api/exports/{id}/download?token=...
+// The token in the link is the only credential, so the link works from an email client.
+func DownloadDataExportHandler(w http.ResponseWriter, r *http.Request) {
+	exportID := mux.Vars(r)["id"]
+	token := r.URL.Query().Get("token")
+
+	export, err := store.GetDataExportByID(exportID)
+	if err != nil {
+		slog.Error("Failed to get data export", "export_id", exportID, "error", err)
+		http.Error(w, "Failed to retrieve export", http.StatusInternalServerError)
+		return
+	}
+
+	if export == nil || token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(export.Token)) != 1 {
+		http.Error(w, "Export not found", http.StatusNotFound)
+		return
+	}
+
+	if export.Status != store.ExportStatusReady {
+		http.Error(w, "Export is not ready", http.StatusConflict)
+		return
+	}
+
+	if time.Now().After(export.ExpiresAt) {
+		http.Error(w, "Download link has expired", http.StatusGone)
+		return
+	}
+
+	file, err := os.Open(export.FilePath)
+	if err != nil {
+		slog.Error("Failed to open export archive", "export_id", exportID, "error", err)
+		http.Error(w, "Export file is no longer available", http.StatusGone)
+		return
+	}
+	defer file.Close()
+
+	filename := fmt.Sprintf("gemmie-export-%s.zip", export.CompletedAt.Format("2006-01-02"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.Header().Set("Cache-Control", "no-store")
+
+	slog.Info("Data export downloaded", "export_id", exportID, "user_id", export.UserId)
+	http.ServeContent(w, r, filename, export.CompletedAt, file)
+}
+
+// runDataExport builds the archive for an export job and notifies the user
+func runDataExport(export store.DataExport, user store.User, downloadURL string, smtpConfig mailer.SMTPConfig) {
+	export.Status = store.ExportStatusProcessing
+	if err := store.UpdateDataExport(export); err != nil {
+		slog.Error("Failed to mark export as processing", "export_id", export.ID, "error", err)
+	}
+
+	path, size, err := buildDataExportArchive(export.ID, user)
+	if err != nil {
+		slog.Error("Data export failed", "export_id", export.ID, "user_id", user.ID, "error", err)
+		export.Status = store.ExportStatusFailed
+		export.Error = "Failed to build export archive"
+		export.CompletedAt = time.Now()
+		if err := store.UpdateDataExport(export); err != nil {
+			slog.Error("Failed to mark export as failed", "export_id", export.ID, "error", err)
+		}
+		return
+	}
+
+	now := time.Now()
+	export.Status = store.ExportStatusReady
+	export.FilePath = path
+	export.FileSize = size
+	export.CompletedAt = now
+	export.ExpiresAt = now.Add(exportLinkTTL)
+
+	if err := store.UpdateDataExport(export); err != nil {
+		slog.Error("Failed to mark export as ready", "export_id", export.ID, "error", err)
+		os.Remove(path)
+		return
+	}
+
+	slog.Info("Data export ready", "export_id", export.ID, "user_id", user.ID, "size", size)
+
+	if downloadURL == "" {
+		slog.Warn("PUBLIC_URL is not set, the export link is only listed by GET /api/exports", "export_id", export.ID)
+	}
+
+	if downloadURL != "" && smtpConfig.Host != "" && user.Email != "" {
+		emailData := mailer.EmailData{
+			To:      []string{user.Email},
+			Subject: "Your Gemmie data export is ready",
+			Body:    buildDataExportEmailBody(user.Username, downloadURL, export.ExpiresAt),
+			IsHTML:  true,
+		}
+		if err := mailer.SendEmail(emailData, smtpConfig); err != nil {
+			slog.Error("Failed to send export email", "export_id", export.ID, "user_id", user.ID, "error", err)
+		}
+	}
+
+	notifyUser(context.Background(), user.ID, notifyDataExports, store.NotificationPayload{
+		Title: "📦 Your data export is ready",
+		Body:  "Tap to download your Gemmie archive. The link expires in 24 hours.",
+		Data: map[string]any{
+			"export_id": export.ID,
+			"url":       downloadURL, // empty without PUBLIC_URL, the client lists its exports instead
+		},
+		Tag:                "data-export-ready",
+		RequireInteraction: true,
+	})
+}
+
+// buildDataExportArchive writes the zip archive for a user and returns its path and size
+func buildDataExportArchive(exportID string, user store.User) (string, int64, error) {
+	dir := exportDir()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", 0, err
+	}
+
+	path := filepath.Join(dir, exportID+".zip")
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return "", 0, err
+	}
+
+	zw := zip.NewWriter(file)
+	if err := writeDataExportFiles(zw, user); err != nil {
+		zw.Close()
+		file.Close()
+		os.Remove(path)
+		return "", 0, err
+	}
+
+	if err := zw.Close(); err != nil {
+		file.Close()
+		os.Remove(path)
+		return "", 0, err
+	}
+
+	info, err := file.Stat()
+	file.Close()
+	if err != nil {
+		os.Remove(path)
+		return "", 0, err
+	}
+
+	return path, info.Size(), nil
+}
+
+func writeDataExportFiles(zw *zip.Writer, user store.User) error {
+	readme, err := zw.Create("README.txt")
+	if err != nil {
+		return err
+	}
+	if _, err := readme.Write([]byte(exportReadme)); err != nil {
+		return err
+	}
+
+	profile := exportProfile{
+		ID:              user.ID,
+		Username:        user.Username,
+		Email:           user.Email,
+		CreatedAt:       user.CreatedAt,
+		UpdatedAt:       user.UpdatedAt,
+		Preferences:     user.Preferences,
+		WorkFunction:    user.WorkFunction,
+		Theme:           user.Theme,
+		SyncEnabled:     user.SyncEnabled,
+		Plan:            user.Plan,
+		PlanName:        user.PlanName,
+		Amount:          user.Amount,
+		Duration:        user.Duration,
+		PhoneNumber:     user.PhoneNumber,
+		ExpiryTimestamp: user.ExpiryTimestamp,
+		ExpireDuration:  user.ExpireDuration,
+		Price:           user.Price,
+		ResponseMode:    user.ResponseMode,
+		AgreeToTerms:    user.AgreeToTerms,
+		RequestCount:    user.RequestCount,
+		EmailVerified:   user.EmailVerified,
+		EmailSubscribed: user.EmailSubscribed,
+		UserAgent:       user.UserAgent,
+	}
+	if err := writeZipJSON(zw, "profile.json", profile); err != nil {
+		return err
+	}
+
+	chatList, err := store.GetChatsByUserId(user.ID)
+	if err != nil {
+		return fmt.Errorf("chats: %w", err)
+	}
+	chats := make([]store.Chat, 0, len(chatList))
+	for _, c := range chatList {
+		// Chats shared with the user belong to someone else
+		if c.Role != store.ChatRoleOwner {
+			continue
+		}
+		chat, err := store.GetChatById(c.ID)
+		if err != nil {
+			return fmt.Errorf("chat %s: %w", c.ID, err)
+		}
+		if chat != nil {
+			// Export every branch, not only the one currently shown
+			if chat.Messages, err = store.GetMessagesByChatId(c.ID); err != nil {
+				return fmt.Errorf("chat %s messages: %w", c.ID, err)
+			}
+			chats = append(chats, *chat)
+		}
+	}
+	if err := writeZipJSON(zw, "chats.json", chats); err != nil {
+		return err
+	}
+
+	folders, err := store.GetFoldersByUserID(user.ID)
+	if err != nil {
+		return fmt.Errorf("folders: %w", err)
+	}
+	if err := writeZipJSON(zw, "folders.json", folders); err != nil {
+		return err
+	}
+
+	tags, err := store.GetTagsByUserID(user.ID)
+	if err != nil {
+		return fmt.Errorf("tags: %w", err)
+	}
+	if err := writeZipJSON(zw, "tags.json", tags); err != nil {
+		return err
+	}
+
+	personas, err := store.GetPersonasByUserID(user.ID)
+	if err != nil {
+		return fmt.Errorf("personas: %w", err)
+	}
+	if err := writeZipJSON(zw, "personas.json", personas); err != nil {
+		return err
+	}
+
+	arcades, err := store.GetArcadesByUserID(user.ID)
+	if err != nil {
+		return fmt.Errorf("arcades: %w", err)
+	}
+	if err := writeZipJSON(zw, "arcades.json", arcades); err != nil {
+		return err
+	}
+
+	var transactions []store.Transaction
+	if user.PhoneNumber != "" {
+		transactions, err = store.GetUserTransactions(user.PhoneNumber)
+		if err != nil {
+			return fmt.Errorf("transactions: %w", err)
+		}
+	}
+	if err := writeZipJSON(zw, "transactions.json", transactions); err != nil {
+		return err
+	}
+
+	planSubscriptions, err := store.GetPlanSubscriptions(user.ID)
+	if err != nil {
+		return fmt.Errorf("plan subscriptions: %w", err)
+	}
+	if err := writeZipJSON(zw, "subscriptions.json", planSubscriptions); err != nil {
+		return err
+	}
+
+	subscriptions, err := store.GetSubscriptionsByUserID(context.Background(), user.ID)
+	if err != nil {
+		return fmt.Errorf("push subscriptions: %w", err)
+	}
+	pushSubscriptions := make([]exportPushSubscription, 0, len(subscriptions))
+	for _, sub := range subscriptions {
+		pushSubscriptions = append(pushSubscriptions, exportPushSubscription{
+			Endpoint:  sub.Endpoint,
+			UserAgent: sub.UserAgent,
+			CreatedAt: sub.CreatedAt,
+			UpdatedAt: sub.UpdatedAt,
+		})
+	}
+	if err := writeZipJSON(zw, "push_subscriptions.json", pushSubscriptions); err != nil {
+		return err
+	}
+
+	platformErrors, err := store.GetPlatformErrorsByUserID(user.ID)
+	if err != nil {
+		return fmt.Errorf("platform errors: %w", err)
+	}
+	return writeZipJSON(zw, "platform_errors.json", platformErrors)
+}
+
+func writeZipJSON(zw *zip.Writer, name string, v any) error {
+	f, err := zw.Create(name)
+	if err != nil {
+		return err
+	}
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// StartDataExportCleanup periodically removes expired export archives and fails stuck jobs
+func StartDataExportCleanup(interval time.Duration) {
+	slog.Info("Starting data export cleanup", "interval", interval.String())
+
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			cleanupDataExports()
+		}
+	}()
+}
+
+func cleanupDataExports() {
+	now := time.Now()
+
+	if failed, err := store.FailStaleDataExports(now.Add(-time.Hour)); err != nil {
+		slog.Error("Failed to fail stale data exports", "error", err)
+	} else if failed > 0 {
+		slog.Warn("Marked stale data exports as failed", "count", failed)
+	}
+
+	expired, err := store.GetExpiredDataExports(now)
+	if err != nil {
+		slog.Error("Failed to get expired data exports", "error", err)
+		return
+	}
+
+	for _, export := range expired {
+		if export.FilePath != "" {
+			if err := os.Remove(export.FilePath); err != nil && !os.IsNotExist(err) {
+				slog.Error("Failed to remove export archive", "export_id", export.ID, "error", err)
+				continue
+			}
+		}
+		if err := store.DeleteDataExportByID(export.ID); err != nil {
+			slog.Error("Failed to delete expired export", "export_id", export.ID, "error", err)
+		}
+	}
+
+	if len(expired) > 0 {
+		slog.Info("Expired data exports removed", "count", len(expired))
+	}
+}
+
+func buildDataExportEmailBody(username, downloadURL string, expiresAt time.Time) string {
+	return `
+<!DOCTYPE html>
+<html>
+<head>
+    <meta charset="UTF-8">
+    <style>
+        body { font-family: Arial, sans-serif; line-height: 1.6; color: #333; }
+        .container { max-width: 600px; margin: 0 auto; padding: 20px; }
+        .cta-button { display: inline-block; background: #667eea; color: #ffff; padding: 15px 30px; text-decoration: none; border-radius: 5px; margin: 20px 0; font-weight: bold; }
+        .footer { text-align: center; padding: 20px; color: #666; font-size: 12px; }
+    </style>
+</head>
+<body>
+    <div class="container">
+        <h2>Hi ` + username + `,</h2>
+        <p>The export of your Gemmie account data is ready. It contains your profile, chats, arcades, payments and devices.</p>
+        <a href="` + downloadURL + `" class="cta-button">Download your data</a>
+        <p>This link expires on ` + expiresAt.UTC().Format("Jan 2, 2006 at 15:04 UTC") + `. Anyone with the link can download the archive, so do not forward this email.</p>
+        <div class="footer">If you did not request this export, please contact support.</div>
+    </div>
+</body>
+</html>`
+}
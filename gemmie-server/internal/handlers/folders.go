@@ -0,0 +1,532 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/imrany/gemmie/gemmie-server/internal/encrypt"
+	"github.com/imrany/gemmie/gemmie-server/store"
+)
+
+// FoldersHandler handles POST /api/folders and GET /api/folders
+func FoldersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		folders, err := store.GetFoldersByUserID(userID)
+		if err != nil {
+			slog.Error("Failed to get folders", "user_id", userID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Failed to retrieve folders",
+			})
+			return
+		}
+		if folders == nil {
+			folders = []store.Folder{}
+		}
+
+		json.NewEncoder(w).Encode(store.Response{
+			Success: true,
+			Message: "Folders retrieved successfully",
+			Data:    folders,
+		})
+		return
+	}
+
+	var req store.Folder
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Invalid request body",
+		})
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Folder name is required",
+		})
+		return
+	}
+
+	prefix := "fld"
+	folder := store.Folder{
+		ID:        encrypt.GenerateID(&prefix),
+		UserId:    userID,
+		Name:      req.Name,
+		Color:     req.Color,
+		CreatedAt: time.Now(),
+		UpdatedAt: time.Now(),
+	}
+
+	if err := store.CreateFolder(folder); err != nil {
+		if store.IsUniqueViolation(err) {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "A folder with this name already exists",
+			})
+			return
+		}
+		slog.Error("Failed to create folder", "user_id", userID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to create folder",
+		})
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Folder created successfully",
+		Data:    folder,
+	})
+}
+
+// FolderHandler handles GET, PUT and DELETE /api/folders/{id}
+// Deleting a folder keeps its chats, they are moved out of the folder
+func FolderHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	folderID := mux.Vars(r)["id"]
+	folder, err := store.GetFolderByID(folderID)
+	if err != nil {
+		slog.Error("Failed to get folder", "folder_id", folderID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve folder",
+		})
+		return
+	}
+
+	if folder == nil || folder.UserId != userID {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Folder not found",
+		})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(store.Response{
+			Success: true,
+			Message: "Folder retrieved successfully",
+			Data:    folder,
+		})
+
+	case http.MethodPut:
+		var req store.Folder
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Invalid request body",
+			})
+			return
+		}
+
+		if name := strings.TrimSpace(req.Name); name != "" {
+			folder.Name = name
+		}
+		folder.Color = req.Color
+		folder.UpdatedAt = time.Now()
+
+		if err := store.UpdateFolder(*folder); err != nil {
+			if store.IsUniqueViolation(err) {
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(store.Response{
+					Success: false,
+					Message: "A folder with this name already exists",
+				})
+				return
+			}
+			slog.Error("Failed to update folder", "folder_id", folderID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Failed to update folder",
+			})
+			return
+		}
+
+		json.NewEncoder(w).Encode(store.Response{
+			Success: true,
+			Message: "Folder updated successfully",
+			Data:    folder,
+		})
+
+	case http.MethodDelete:
+		if err := store.DeleteFolderByID(folderID); err != nil {
+			slog.Error("Failed to delete folder", "folder_id", folderID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Failed to delete folder",
+			})
+			return
+		}
+
+		slog.Info("Folder deleted", "folder_id", folderID, "user_id", userID)
+
+		json.NewEncoder(w).Encode(store.Response{
+			Success: true,
+			Message: "Folder deleted successfully",
+		})
+	}
+}
+
+// TagsHandler handles POST /api/tags and GET /api/tags
+func TagsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		tags, err := store.GetTagsByUserID(userID)
+		if err != nil {
+			slog.Error("Failed to get tags", "user_id", userID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Failed to retrieve tags",
+			})
+			return
+		}
+		if tags == nil {
+			tags = []store.Tag{}
+		}
+
+		json.NewEncoder(w).Encode(store.Response{
+			Success: true,
+			Message: "Tags retrieved successfully",
+			Data:    tags,
+		})
+		return
+	}
+
+	var req store.Tag
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Invalid request body",
+		})
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Tag name is required",
+		})
+		return
+	}
+
+	prefix := "tag"
+	tag := store.Tag{
+		ID:        encrypt.GenerateID(&prefix),
+		UserId:    userID,
+		Name:      req.Name,
+		CreatedAt: time.Now(),
+	}
+
+	if err := store.CreateTag(tag); err != nil {
+		if store.IsUniqueViolation(err) {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "A tag with this name already exists",
+			})
+			return
+		}
+		slog.Error("Failed to create tag", "user_id", userID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to create tag",
+		})
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Tag created successfully",
+		Data:    tag,
+	})
+}
+
+// TagHandler handles PUT and DELETE /api/tags/{id}
+func TagHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	tagID := mux.Vars(r)["id"]
+	tag, err := store.GetTagByID(tagID)
+	if err != nil {
+		slog.Error("Failed to get tag", "tag_id", tagID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve tag",
+		})
+		return
+	}
+
+	if tag == nil || tag.UserId != userID {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Tag not found",
+		})
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if err := store.DeleteTagByID(tagID); err != nil {
+			slog.Error("Failed to delete tag", "tag_id", tagID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Failed to delete tag",
+			})
+			return
+		}
+
+		json.NewEncoder(w).Encode(store.Response{
+			Success: true,
+			Message: "Tag deleted successfully",
+		})
+		return
+	}
+
+	var req store.Tag
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Tag name is required",
+		})
+		return
+	}
+	tag.Name = strings.TrimSpace(req.Name)
+
+	if err := store.UpdateTag(*tag); err != nil {
+		if store.IsUniqueViolation(err) {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "A tag with this name already exists",
+			})
+			return
+		}
+		slog.Error("Failed to update tag", "tag_id", tagID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to update tag",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Tag updated successfully",
+		Data:    tag,
+	})
+}
+
+// OrganizeChatHandler handles PUT /api/chats/{id}/folder, /api/chats/{id}/tags and /api/chats/{id}/pin
+// Bodies are {"folder_id": ""}, {"tag_ids": []} and {"pinned": true} respectively
+func OrganizeChatHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	chatID := mux.Vars(r)["id"]
+
+	var req struct {
+		FolderID *string  `json:"folder_id"`
+		TagIDs   []string `json:"tag_ids"`
+		Pinned   *bool    `json:"pinned"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Invalid request body",
+		})
+		return
+	}
+
+	// Folders, tags and pins are the owner's organisation
+	chat, _, ok := authorizeChat(w, chatID, userID, store.ChatRoleOwner)
+	if !ok {
+		return
+	}
+
+	var err error
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/folder"):
+		if req.FolderID == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "folder_id is required, use an empty string to remove the chat from its folder",
+			})
+			return
+		}
+		if *req.FolderID != "" {
+			folder, err := store.GetFolderByID(*req.FolderID)
+			if err != nil {
+				slog.Error("Failed to get folder", "folder_id", *req.FolderID, "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(store.Response{
+					Success: false,
+					Message: "Failed to retrieve folder",
+				})
+				return
+			}
+			if folder == nil || folder.UserId != userID {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(store.Response{
+					Success: false,
+					Message: "Folder not found",
+				})
+				return
+			}
+		}
+		err = store.SetChatFolder(chatID, *req.FolderID)
+		chat.FolderId = *req.FolderID
+
+	case strings.HasSuffix(r.URL.Path, "/tags"):
+		if len(req.TagIDs) > 0 {
+			count, err := store.CountUserTags(userID, req.TagIDs)
+			if err != nil {
+				slog.Error("Failed to check tags", "user_id", userID, "error", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(store.Response{
+					Success: false,
+					Message: "Failed to retrieve tags",
+				})
+				return
+			}
+			if count != len(uniqueStrings(req.TagIDs)) {
+				w.WriteHeader(http.StatusNotFound)
+				json.NewEncoder(w).Encode(store.Response{
+					Success: false,
+					Message: "Tag not found",
+				})
+				return
+			}
+		}
+		if err = store.SetChatTags(chatID, req.TagIDs); err == nil {
+			tagsByChat, tagErr := store.GetTagsByChatIDs([]string{chatID})
+			err = tagErr
+			chat.Tags = tagsByChat[chatID]
+		}
+
+	case strings.HasSuffix(r.URL.Path, "/pin"):
+		if req.Pinned == nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "pinned is required",
+			})
+			return
+		}
+		err = store.SetChatPinned(chatID, *req.Pinned)
+		chat.IsPinned = *req.Pinned
+	}
+
+	if err != nil {
+		slog.Error("Failed to update chat", "chat_id", chatID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to update chat",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Chat updated successfully",
+		Data:    chat,
+	})
+}
+
+// uniqueStrings returns values without duplicates, keeping the first occurrence
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	unique := make([]string, 0, len(values))
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
@@ -9,10 +9,9 @@ import (
 
 	"github.com/imrany/gemmie/gemmie-server/internal/genai"
 	"github.com/imrany/gemmie/gemmie-server/store"
-	"github.com/spf13/viper"
 )
 
-// GenerateAIResponseHandler - POST /api/genai
+// GenerateAIResponseHandler - POST /api/genai?model=provider/model[&stream=true]
 func GenerateAIResponseHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 
@@ -45,13 +44,18 @@ func GenerateAIResponseHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Generate response using AI wrapper (only if response not provided)
-	genaiResp := genai.GENAISERVICE{
-		APIKey: viper.GetString("API_KEY"),
-		Model:  viper.GetString("MODEL"),
+	// Without a model query parameter the user's default model answers
+	model, accessErr := authorizeGeneration(userID, generationModel(userID, nil, r.URL.Query().Get("model")))
+	if accessErr != nil {
+		accessErr.write(w)
+		return
+	}
+	if wantsStream(r) {
+		streamGeneration(w, r, userID, model, prompt)
+		return
 	}
 
-	genAIResponse, err := genaiResp.GenerateAIResponse(context.Background(), prompt)
+	genAIResponse, err := genai.Default().Generate(context.Background(), genai.Request{Model: model, Prompt: prompt, System: plainSystemPrompt(userID)})
 	if err != nil {
 		slog.Error("Failed to generate AI response", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -61,6 +65,7 @@ func GenerateAIResponseHandler(w http.ResponseWriter, r *http.Request) {
 		})
 		return
 	}
+	countRequest(userID)
 
 	json.NewEncoder(w).Encode(store.Response{
 		Success: true,
@@ -68,3 +73,19 @@ func GenerateAIResponseHandler(w http.ResponseWriter, r *http.Request) {
 		Data:    genAIResponse,
 	})
 }
+
+// plainSystemPrompt is the system prompt of POST /api/genai, the user's own
+// instructions without a chat's persona or a response mode
+func plainSystemPrompt(userID string) string {
+	instructions, _ := userInstructions(userID, "")
+	system, _ := genai.SystemPrompt(instructions)
+	return system
+}
+
+// countRequest records one AI request against the user's daily request count.
+// The count is server owned, clients only read it through sync.
+func countRequest(userID string) {
+	if _, err := store.IncrementRequestCount(userID); err != nil {
+		slog.Warn("Failed to count request", "user_id", userID, "error", err)
+	}
+}
@@ -0,0 +1,198 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/imrany/gemmie/gemmie-server/store"
+)
+
+const (
+	// idempotencyRetention is how long a response is kept for replay
+	idempotencyRetention = 24 * time.Hour
+	// idempotencyStaleAfter is when an unfinished request is assumed lost
+	// and its key can be claimed again
+	idempotencyStaleAfter   = 5 * time.Minute
+	maxIdempotencyKeyLength = 255
+)
+
+// idempotencyRecorder passes a response through while keeping a copy of it
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	statusCode int
+	body       bytes.Buffer
+}
+
+func (rec *idempotencyRecorder) WriteHeader(code int) {
+	if rec.statusCode == 0 {
+		rec.statusCode = code
+	}
+	rec.ResponseWriter.WriteHeader(code)
+}
+
+func (rec *idempotencyRecorder) Write(b []byte) (int, error) {
+	if rec.statusCode == 0 {
+		rec.statusCode = http.StatusOK
+	}
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the connection, for streaming
+func (rec *idempotencyRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Idempotent makes a handler safe to retry. When the request carries an
+// Idempotency-Key header, the first response for that key is stored and
+// replayed to later requests with the same key and payload, without running
+// the handler again. Reusing a key for a different payload is rejected.
+// Requests without the header run as usual.
+func Idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if key == "" {
+			next(w, r)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if len(key) > maxIdempotencyKeyLength {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Idempotency-Key must be at most 255 characters",
+			})
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Invalid request body",
+			})
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		// Keys are per user, requests without a user share one scope
+		scope := r.Header.Get("X-User-ID")
+		if scope == "" {
+			scope = "anonymous"
+		}
+
+		hash := sha256.New()
+		hash.Write([]byte(r.Method + " " + r.URL.Path + "?" + r.URL.RawQuery + "\n"))
+		hash.Write(body)
+		fingerprint := hex.EncodeToString(hash.Sum(nil))
+
+		now := time.Now()
+		claimed, err := store.ClaimIdempotencyKey(scope, key, fingerprint,
+			now.Add(idempotencyRetention), now.Add(-idempotencyStaleAfter))
+		if err != nil {
+			slog.Error("Failed to claim idempotency key", "key", key, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Failed to process request",
+			})
+			return
+		}
+
+		if !claimed {
+			replayIdempotentResponse(w, scope, key, fingerprint)
+			return
+		}
+
+		rec := &idempotencyRecorder{ResponseWriter: w}
+		next(rec, r)
+
+		// Server errors are not kept so the client can retry with the same key
+		if rec.statusCode == 0 || rec.statusCode >= http.StatusInternalServerError {
+			if err := store.ReleaseIdempotencyKey(scope, key); err != nil {
+				slog.Error("Failed to release idempotency key", "key", key, "error", err)
+			}
+			return
+		}
+
+		if err := store.CompleteIdempotencyKey(scope, key, rec.statusCode,
+			rec.Header().Get("Content-Type"), rec.body.Bytes()); err != nil {
+			slog.Error("Failed to store idempotent response", "key", key, "error", err)
+		}
+	}
+}
+
+// replayIdempotentResponse answers a request whose key was already used
+func replayIdempotentResponse(w http.ResponseWriter, scope, key, fingerprint string) {
+	record, err := store.GetIdempotencyKey(scope, key)
+	if err != nil {
+		slog.Error("Failed to get idempotency key", "key", key, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to process request",
+		})
+		return
+	}
+
+	// Released between our claim and this read, the retry can simply go again
+	if record == nil {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Request with this Idempotency-Key did not complete, retry it",
+		})
+		return
+	}
+
+	if record.Fingerprint != fingerprint {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Idempotency-Key was already used with a different request",
+		})
+		return
+	}
+
+	if record.State != store.IdempotencyStateCompleted {
+		w.Header().Set("Retry-After", "1")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Request with this Idempotency-Key is still in progress",
+		})
+		return
+	}
+
+	if record.ContentType != "" {
+		w.Header().Set("Content-Type", record.ContentType)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(record.StatusCode)
+	w.Write(record.Response)
+}
+
+// StartIdempotencyKeyCleanup periodically removes keys past their retention window
+func StartIdempotencyKeyCleanup(interval time.Duration) {
+	slog.Info("Starting idempotency key cleanup", "interval", interval.String())
+
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			if deleted, err := store.DeleteExpiredIdempotencyKeys(time.Now()); err != nil {
+				slog.Error("Failed to delete expired idempotency keys", "error", err)
+			} else if deleted > 0 {
+				slog.Info("Deleted expired idempotency keys", "count", deleted)
+			}
+		}
+	}()
+}
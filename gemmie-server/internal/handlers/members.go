@@ -0,0 +1,581 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/imrany/gemmie/gemmie-server/internal/encrypt"
+	"github.com/imrany/gemmie/gemmie-server/store"
+)
+
+// chatRole returns the role userID has in chat, or "" when they are not a member
+func chatRole(chat *store.Chat, userID string) (string, error) {
+	if chat.UserId == userID {
+		return store.ChatRoleOwner, nil
+	}
+
+	role, err := store.GetChatMemberRole(chat.ID, userID)
+	if err != nil || role == store.ChatRoleEditor {
+		return role, err
+	}
+
+	// Members of an organization the chat is shared into get the role it was shared with
+	orgRole, err := store.GetOrganizationChatRole(chat.ID, userID)
+	if err != nil {
+		return "", err
+	}
+	if store.ChatRoleAtLeast(orgRole, store.ChatRoleViewer) && !store.ChatRoleAtLeast(role, orgRole) {
+		return orgRole, nil
+	}
+	return role, nil
+}
+
+// authorizeChat loads a chat and checks that userID has at least minRole in it.
+// It writes the error response and returns false when the caller should stop.
+func authorizeChat(w http.ResponseWriter, chatID, userID, minRole string) (*store.Chat, string, bool) {
+	if chatID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Chat ID is required",
+		})
+		return nil, "", false
+	}
+
+	chat, err := store.GetChatById(chatID)
+	if err != nil {
+		slog.Error("Failed to get chat", "chat_id", chatID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve chat",
+		})
+		return nil, "", false
+	}
+
+	if chat == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Chat not found",
+		})
+		return nil, "", false
+	}
+
+	role, err := chatRole(chat, userID)
+	if err != nil {
+		slog.Error("Failed to get chat role", "chat_id", chatID, "user_id", userID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve chat",
+		})
+		return nil, "", false
+	}
+
+	if !store.ChatRoleAtLeast(role, minRole) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Access denied",
+		})
+		return nil, "", false
+	}
+
+	chat.Role = role
+	chat.IsReadOnly = role == store.ChatRoleViewer
+	return chat, role, true
+}
+
+// ChatMembersHandler handles GET /api/chats/{id}/members
+func ChatMembersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	chatID := mux.Vars(r)["id"]
+	chat, role, ok := authorizeChat(w, chatID, userID, store.ChatRoleViewer)
+	if !ok {
+		return
+	}
+
+	members, err := store.GetChatMembers(chat.ID)
+	if err != nil {
+		slog.Error("Failed to get chat members", "chat_id", chatID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve members",
+		})
+		return
+	}
+	if members == nil {
+		members = []store.ChatMember{}
+	}
+
+	data := map[string]any{"members": members}
+
+	// Only the owner sees who is still invited
+	if role == store.ChatRoleOwner {
+		invitations, err := store.GetPendingInvitationsForChat(chat.ID)
+		if err != nil {
+			slog.Error("Failed to get chat invitations", "chat_id", chatID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Failed to retrieve invitations",
+			})
+			return
+		}
+		if invitations == nil {
+			invitations = []store.ChatInvitation{}
+		}
+		data["invitations"] = invitations
+	}
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Members retrieved successfully",
+		Data:    data,
+	})
+}
+
+// ChatMemberHandler handles PUT and DELETE /api/chats/{id}/members/{user_id}
+// The owner changes roles and removes members; any member may remove themselves
+func ChatMemberHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	vars := mux.Vars(r)
+	chatID := vars["id"]
+	memberID := vars["user_id"]
+
+	minRole := store.ChatRoleOwner
+	if r.Method == http.MethodDelete && memberID == userID {
+		minRole = store.ChatRoleViewer
+	}
+
+	chat, _, ok := authorizeChat(w, chatID, userID, minRole)
+	if !ok {
+		return
+	}
+
+	if memberID == chat.UserId {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "The owner cannot be changed or removed",
+		})
+		return
+	}
+
+	current, err := store.GetChatMemberRole(chatID, memberID)
+	if err != nil {
+		slog.Error("Failed to get chat member", "chat_id", chatID, "member_id", memberID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve member",
+		})
+		return
+	}
+
+	if current == "" {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Member not found",
+		})
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		if err := store.RemoveChatMember(chatID, memberID); err != nil {
+			slog.Error("Failed to remove chat member", "chat_id", chatID, "member_id", memberID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Failed to remove member",
+			})
+			return
+		}
+
+		slog.Info("Chat member removed", "chat_id", chatID, "member_id", memberID, "user_id", userID)
+
+		json.NewEncoder(w).Encode(store.Response{
+			Success: true,
+			Message: "Member removed successfully",
+		})
+		return
+	}
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil ||
+		(req.Role != store.ChatRoleEditor && req.Role != store.ChatRoleViewer) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "role must be 'editor' or 'viewer'",
+		})
+		return
+	}
+
+	if err := store.UpdateChatMemberRole(chatID, memberID, req.Role); err != nil {
+		slog.Error("Failed to update chat member", "chat_id", chatID, "member_id", memberID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to update member",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Member updated successfully",
+	})
+}
+
+// InviteChatMemberHandler handles POST /api/chats/{id}/invitations
+// Body: {"username": "..."} or {"email": "..."} and a role of editor or viewer.
+// Only existing Gemmie users can be invited.
+func InviteChatMemberHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	var req struct {
+		Username string `json:"username"`
+		Email    string `json:"email"`
+		Role     string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Invalid request body",
+		})
+		return
+	}
+
+	if req.Role == "" {
+		req.Role = store.ChatRoleViewer
+	}
+	if req.Role != store.ChatRoleEditor && req.Role != store.ChatRoleViewer {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "role must be 'editor' or 'viewer'",
+		})
+		return
+	}
+
+	chatID := mux.Vars(r)["id"]
+	chat, _, ok := authorizeChat(w, chatID, userID, store.ChatRoleOwner)
+	if !ok {
+		return
+	}
+
+	var invitee *store.User
+	var err error
+	switch {
+	case strings.TrimSpace(req.Email) != "":
+		invitee, err = store.GetUserByEmail(strings.TrimSpace(req.Email))
+	case strings.TrimSpace(req.Username) != "":
+		invitee, err = store.GetUserByUsername(strings.TrimSpace(req.Username))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "username or email is required",
+		})
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to look up invitee", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Database error",
+		})
+		return
+	}
+
+	if invitee == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User not found",
+		})
+		return
+	}
+
+	if invitee.ID == userID {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "You cannot invite yourself",
+		})
+		return
+	}
+
+	if role, err := store.GetChatMemberRole(chatID, invitee.ID); err == nil && role != "" {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User is already a member of this chat",
+		})
+		return
+	}
+
+	prefix := "inv"
+	invitation := store.ChatInvitation{
+		ID:          encrypt.GenerateID(&prefix),
+		ChatId:      chatID,
+		ChatTitle:   chat.Title,
+		InviteeId:   invitee.ID,
+		InviteeName: invitee.Username,
+		InvitedBy:   userID,
+		Role:        req.Role,
+		Status:      store.InvitationStatusPending,
+		CreatedAt:   time.Now(),
+	}
+
+	if err := store.CreateChatInvitation(invitation); err != nil {
+		if store.IsUniqueViolation(err) {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "User already has a pending invitation to this chat",
+			})
+			return
+		}
+		slog.Error("Failed to create invitation", "chat_id", chatID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to create invitation",
+		})
+		return
+	}
+
+	slog.Info("Chat invitation created", "invitation_id", invitation.ID, "chat_id", chatID, "invitee_id", invitee.ID, "user_id", userID)
+
+	go notifyUser(context.Background(), invitee.ID, notifyChatInvitations, store.NotificationPayload{
+		Title: "You've been invited to a chat",
+		Body:  fmt.Sprintf("You were invited to join '%s' as %s.", chat.Title, req.Role),
+		Data: map[string]any{
+			"invitation_id": invitation.ID,
+			"chat_id":       chatID,
+			"url":           "/invitations",
+		},
+		Tag: "chat-invitation",
+	})
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Invitation sent successfully",
+		Data:    invitation,
+	})
+}
+
+// CancelChatInvitationHandler handles DELETE /api/chats/{id}/invitations/{invitation_id}
+func CancelChatInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	vars := mux.Vars(r)
+	chatID := vars["id"]
+	invitationID := vars["invitation_id"]
+
+	if _, _, ok := authorizeChat(w, chatID, userID, store.ChatRoleOwner); !ok {
+		return
+	}
+
+	invitation, err := store.GetChatInvitationByID(invitationID)
+	if err != nil {
+		slog.Error("Failed to get invitation", "invitation_id", invitationID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve invitation",
+		})
+		return
+	}
+
+	if invitation == nil || invitation.ChatId != chatID || invitation.Status != store.InvitationStatusPending {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Invitation not found",
+		})
+		return
+	}
+
+	if err := store.CancelChatInvitation(invitationID); err != nil {
+		slog.Error("Failed to cancel invitation", "invitation_id", invitationID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to cancel invitation",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Invitation cancelled successfully",
+	})
+}
+
+// GetInvitationsHandler handles GET /api/invitations, the user's pending invitations
+func GetInvitationsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	invitations, err := store.GetPendingInvitationsForUser(userID)
+	if err != nil {
+		slog.Error("Failed to get invitations", "user_id", userID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve invitations",
+		})
+		return
+	}
+	if invitations == nil {
+		invitations = []store.ChatInvitation{}
+	}
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Invitations retrieved successfully",
+		Data:    invitations,
+	})
+}
+
+// RespondInvitationHandler handles POST /api/invitations/{id}/accept and /api/invitations/{id}/decline
+func RespondInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	invitationID := mux.Vars(r)["id"]
+	accept := strings.HasSuffix(r.URL.Path, "/accept")
+
+	invitation, err := store.GetChatInvitationByID(invitationID)
+	if err != nil {
+		slog.Error("Failed to get invitation", "invitation_id", invitationID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve invitation",
+		})
+		return
+	}
+
+	if invitation == nil || invitation.InviteeId != userID {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Invitation not found",
+		})
+		return
+	}
+
+	if invitation.Status != store.InvitationStatusPending {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: fmt.Sprintf("Invitation was already %s", invitation.Status),
+		})
+		return
+	}
+
+	if err := store.RespondToChatInvitation(*invitation, accept); err != nil {
+		slog.Error("Failed to respond to invitation", "invitation_id", invitationID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to respond to invitation",
+		})
+		return
+	}
+
+	message := "Invitation declined"
+	if accept {
+		message = "Invitation accepted"
+		invitation.Status = store.InvitationStatusAccepted
+	} else {
+		invitation.Status = store.InvitationStatusDeclined
+	}
+	invitation.RespondedAt = time.Now()
+
+	slog.Info(message, "invitation_id", invitationID, "chat_id", invitation.ChatId, "user_id", userID)
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: message,
+		Data:    invitation,
+	})
+}
@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/imrany/gemmie/gemmie-server/internal/encrypt"
+	"github.com/imrany/gemmie/gemmie-server/store"
+)
+
+// GetMessageVersionsHandler handles GET /api/messages/{id}/versions
+func GetMessageVersionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	messageID := mux.Vars(r)["id"]
+	message, ok := getMessageForRole(w, messageID, userID, store.ChatRoleViewer)
+	if !ok {
+		return
+	}
+
+	versions, err := store.GetMessageVersions(message.ID)
+	if err != nil {
+		slog.Error("Failed to get message versions", "message_id", messageID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve message versions",
+		})
+		return
+	}
+
+	if versions == nil {
+		versions = []store.MessageVersion{}
+	}
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Message versions retrieved successfully",
+		Data:    versions,
+	})
+}
+
+// RestoreMessageVersionHandler handles POST /api/messages/{id}/versions/{version_id}/restore
+// The current content is kept as a new version, so a restore can itself be undone
+func RestoreMessageVersionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	vars := mux.Vars(r)
+	messageID := vars["id"]
+	versionID := vars["version_id"]
+
+	message, ok := getMessageForRole(w, messageID, userID, store.ChatRoleEditor)
+	if !ok {
+		return
+	}
+
+	ifVersion, ok := ifMatchVersion(w, r, message.Version)
+	if !ok {
+		return
+	}
+
+	version, err := store.GetMessageVersionByID(versionID)
+	if err != nil {
+		slog.Error("Failed to get message version", "version_id", versionID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve message version",
+		})
+		return
+	}
+
+	if version == nil || version.MessageId != message.ID {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Message version not found",
+		})
+		return
+	}
+
+	// A different prompt is restored as a branch beside the message, like an
+	// edit of the prompt, so later turns keep the prompt they answered
+	if version.Prompt != message.Prompt {
+		chat, err := store.GetChatById(message.ChatId)
+		if err != nil || chat == nil {
+			slog.Error("Failed to get chat", "chat_id", message.ChatId, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Failed to retrieve chat",
+			})
+			return
+		}
+
+		addSiblingMessage(w, userID, chat, message, store.Message{
+			ID:         encrypt.GenerateID(nil),
+			ChatId:     message.ChatId,
+			ParentId:   message.ParentId,
+			AuthorId:   userID,
+			Prompt:     version.Prompt,
+			Response:   version.Response,
+			CreatedAt:  time.Now(),
+			Model:      version.Model,
+			References: version.References,
+		})
+		return
+	}
+
+	message.Response = version.Response
+	message.Model = version.Model
+	message.References = version.References
+
+	newVersion, err := store.UpdateMessageWithHistoryIfVersion(*message, userID, ifVersion)
+	if errors.Is(err, store.ErrVersionConflict) {
+		preconditionFailed(w, 0)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to restore message version", "message_id", messageID, "version_id", versionID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to restore message version",
+		})
+		return
+	}
+
+	message.IsEdited = true
+	message.EditedAt = time.Now()
+	message.VersionCount++
+	message.Version = newVersion
+	w.Header().Set("ETag", versionETag(newVersion))
+
+	slog.Info("Message version restored", "message_id", messageID, "version_id", versionID, "user_id", userID)
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Message version restored successfully",
+		Data:    message,
+	})
+}
+
+// getMessageForRole loads a message and checks that userID has at least minRole in its chat.
+// It writes the error response and returns false when the caller should stop.
+func getMessageForRole(w http.ResponseWriter, messageID, userID, minRole string) (*store.Message, bool) {
+	if messageID == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Message ID is required",
+		})
+		return nil, false
+	}
+
+	message, err := store.GetMessageById(messageID)
+	if err != nil {
+		slog.Error("Failed to get message", "message_id", messageID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve message",
+		})
+		return nil, false
+	}
+
+	if message == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Message not found",
+		})
+		return nil, false
+	}
+
+	if _, _, ok := authorizeChat(w, message.ChatId, userID, minRole); !ok {
+		return nil, false
+	}
+
+	return message, true
+}
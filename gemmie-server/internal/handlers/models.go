@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/imrany/gemmie/gemmie-server/internal/genai"
+	"github.com/imrany/gemmie/gemmie-server/store"
+)
+
+// catalogModel is a model of the catalog as the caller sees it
+type catalogModel struct {
+	genai.CatalogModel
+	Allowed bool `json:"allowed"` // whether the caller's plan may use the model
+	Default bool `json:"default"` // whether the model answers when none is asked for
+}
+
+// ModelsHandler handles GET /api/models
+// It lists the models this server can generate with, what each can do, and
+// which of them the caller's plan allows
+func ModelsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	plan := userPlan(userID)
+	defaultModel := defaultModelID()
+
+	catalog, providers := genai.Default().Catalog(r.Context())
+	models := make([]catalogModel, 0, len(catalog))
+	for _, model := range catalog {
+		models = append(models, catalogModel{
+			CatalogModel: model,
+			Allowed:      planAllows(plan, model.ID, model.CostTier),
+			Default:      model.ID == defaultModel,
+		})
+	}
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Models retrieved successfully",
+		Data: map[string]any{
+			"plan":          plan,
+			"default_model": defaultModel,
+			"providers":     providers,
+			"models":        models,
+		},
+	})
+}
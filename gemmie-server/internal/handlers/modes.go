@@ -0,0 +1,294 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/imrany/gemmie/gemmie-server/internal/genai"
+	"github.com/imrany/gemmie/gemmie-server/internal/search"
+	"github.com/imrany/gemmie/gemmie-server/store"
+)
+
+const (
+	// lightMaxTokens caps light responses
+	lightMaxTokens = 1024
+	// lightHistoryTokenCap is the most history a light response is sent with
+	lightHistoryTokenCap = 4000
+
+	// webSearchResults is how many results ground a web search response
+	webSearchResults = 5
+	// deepSearchRounds is how many rounds of searches deep search runs
+	// before the synthesis pass
+	deepSearchRounds = 3
+	// deepSearchQueries is how many searches a deep search round runs at most
+	deepSearchQueries = 3
+	// deepSearchResults is how many results each deep search query keeps
+	deepSearchResults = 4
+	// deepSearchMaxSources caps the sources a deep search answer is grounded in
+	deepSearchMaxSources = 15
+	// researchMaxTokens caps the model's answers while planning searches
+	researchMaxTokens = 256
+	// snippetMaxRunes shortens each source's snippet in the prompt
+	snippetMaxRunes = 400
+)
+
+// listMarker is a bullet or number a model puts ahead of list items
+var listMarker = regexp.MustCompile(`^(?:[-*•]|\d+[.)])\s+`)
+
+// generateOptions are the choices a client makes for one generation
+type generateOptions struct {
+	withHistory bool
+	mode        store.Modes // empty for the user's preferred mode
+	// onSearch is told each search query as it is run, nil when nobody listens
+	onSearch func(query string)
+}
+
+// validMode reports whether mode is empty or one of the response modes
+func validMode(mode store.Modes) bool {
+	return mode == "" || slices.Contains(preferenceModes, mode)
+}
+
+// responseMode is the mode of a generation: the requested one, else the
+// user's preference. Search modes fall back to an ordinary response,
+// returned as an empty mode, when no search backend is configured.
+func responseMode(requested, preferred store.Modes) store.Modes {
+	mode := requested
+	if mode == "" {
+		mode = preferred
+	}
+	if (mode == store.ModesWebSearch || mode == store.ModesDeepSearch) && search.Default() == nil {
+		slog.Warn("No search backend configured, answering without searching", "mode", mode)
+		return ""
+	}
+	return mode
+}
+
+// modeGuidance tells the model how a response of mode is made
+func modeGuidance(mode store.Modes) string {
+	switch mode {
+	case store.ModesLightResponse:
+		return "Answer briefly and directly. Skip preambles and only go into detail when asked."
+	case store.ModesWebSearch:
+		return "Answer from the numbered web search results given with the question, and cite them like [1]. Say so when they do not answer it."
+	case store.ModesDeepSearch:
+		return "Write a thorough answer that brings together the numbered research sources given with the question. Cite them like [1], point out where they disagree, and say what they leave open."
+	}
+	return ""
+}
+
+// sourcesTokenReserve is room kept in the context window for the sources a
+// response of mode is grounded in
+func sourcesTokenReserve(mode store.Modes) int {
+	// Each source is a title, URL and snippet of up to snippetMaxRunes
+	perSource := snippetMaxRunes/4 + 50
+	switch mode {
+	case store.ModesWebSearch:
+		return webSearchResults * perSource
+	case store.ModesDeepSearch:
+		return deepSearchMaxSources * perSource
+	}
+	return 0
+}
+
+// applyMode turns req into the request for mode. Light responses are capped,
+// search modes look the prompt up and put the sources found into the prompt.
+// It returns the URLs of the sources.
+func applyMode(ctx context.Context, req *genai.Request, mode store.Modes, onSearch func(query string)) []string {
+	var results []search.Result
+	switch mode {
+	case store.ModesLightResponse:
+		req.MaxTokens = lightMaxTokens
+		return nil
+	case store.ModesWebSearch:
+		results = webSearch(ctx, *req, onSearch)
+	case store.ModesDeepSearch:
+		results = deepSearch(ctx, *req, onSearch)
+	default:
+		return nil
+	}
+
+	req.Prompt = groundedPrompt(req.Prompt, results)
+
+	sources := make([]string, 0, len(results))
+	for _, r := range results {
+		sources = append(sources, r.URL)
+	}
+	return sources
+}
+
+// webSearch runs one search for the prompt. A follow up question is first
+// rewritten into a query that stands on its own.
+func webSearch(ctx context.Context, req genai.Request, onSearch func(query string)) []search.Result {
+	query := req.Prompt
+	if len(req.History) > 0 {
+		query = standaloneQuery(ctx, req)
+	}
+	return runSearches(ctx, []string{query}, webSearchResults, nil, onSearch)
+}
+
+// deepSearch researches the prompt in rounds. The model plans the first
+// round's queries, and after each round it is shown what was found and asks
+// for more or says it has enough. The synthesis pass is the response itself.
+func deepSearch(ctx context.Context, req genai.Request, onSearch func(query string)) []search.Result {
+	var results []search.Result
+	var asked []string
+
+	queries := planQueries(ctx, req, nil, asked)
+	if len(queries) == 0 {
+		queries = []string{req.Prompt}
+	}
+
+	for round := 0; round < deepSearchRounds && len(queries) > 0; round++ {
+		asked = append(asked, queries...)
+		results = runSearches(ctx, queries, deepSearchResults, results, onSearch)
+		if len(results) >= deepSearchMaxSources || ctx.Err() != nil {
+			break
+		}
+		if round < deepSearchRounds-1 {
+			queries = planQueries(ctx, req, results, asked)
+		}
+	}
+
+	if len(results) > deepSearchMaxSources {
+		results = results[:deepSearchMaxSources]
+	}
+	return results
+}
+
+// runSearches runs each query and adds the results to found, leaving out
+// pages already found. A failed search is logged and skipped.
+func runSearches(ctx context.Context, queries []string, limit int, found []search.Result, onSearch func(query string)) []search.Result {
+	backend := search.Default()
+
+	for _, query := range queries {
+		if ctx.Err() != nil {
+			break
+		}
+		if onSearch != nil {
+			onSearch(query)
+		}
+
+		results, err := backend.Search(ctx, query, limit)
+		if err != nil {
+			slog.Warn("Search failed", "backend", backend.Name(), "query", query, "error", err)
+			continue
+		}
+		for _, r := range results {
+			if r.URL == "" || slices.ContainsFunc(found, func(f search.Result) bool { return f.URL == r.URL }) {
+				continue
+			}
+			found = append(found, r)
+		}
+	}
+	return found
+}
+
+// standaloneQuery asks the model for a search query for the prompt that does
+// not depend on the conversation, or returns the prompt when that fails
+func standaloneQuery(ctx context.Context, req genai.Request) string {
+	resp, err := genai.Default().Generate(ctx, genai.Request{
+		Model:     req.Model,
+		History:   req.History,
+		MaxTokens: researchMaxTokens,
+		Prompt: "Write a web search query for the question below that can be understood without this conversation. " +
+			"Reply with the query only.\n\nQuestion: " + req.Prompt,
+	})
+	if err != nil {
+		slog.Warn("Failed to write search query", "error", err)
+		return req.Prompt
+	}
+
+	queries := parseQueries(resp.Response, 1)
+	if len(queries) == 0 {
+		return req.Prompt
+	}
+	return queries[0]
+}
+
+// planQueries asks the model which searches answer the prompt, given what was
+// found so far. It returns none when the model has enough or fails.
+func planQueries(ctx context.Context, req genai.Request, found []search.Result, asked []string) []string {
+	var prompt strings.Builder
+	prompt.WriteString("You are researching the question below on the web. ")
+	if len(found) == 0 {
+		fmt.Fprintf(&prompt, "Write up to %d search queries that together find what is needed to answer it, one per line.", deepSearchQueries)
+	} else {
+		fmt.Fprintf(&prompt, "The sources found so far are listed after it. Write up to %d search queries, one per line, for what they leave unanswered, or DONE when they are enough.", deepSearchQueries)
+	}
+	prompt.WriteString(" Reply with the queries only.\n\nQuestion: ")
+	prompt.WriteString(req.Prompt)
+	if len(found) > 0 {
+		prompt.WriteString("\n\nSources found so far:\n\n")
+		writeSources(&prompt, found)
+	}
+
+	resp, err := genai.Default().Generate(ctx, genai.Request{
+		Model:     req.Model,
+		History:   req.History,
+		MaxTokens: researchMaxTokens,
+		Prompt:    prompt.String(),
+	})
+	if err != nil {
+		slog.Warn("Failed to plan research", "error", err)
+		return nil
+	}
+
+	var queries []string
+	for _, query := range parseQueries(resp.Response, deepSearchQueries) {
+		if !slices.ContainsFunc(asked, func(a string) bool { return strings.EqualFold(a, query) }) {
+			queries = append(queries, query)
+		}
+	}
+	return queries
+}
+
+// parseQueries reads up to limit queries from a model's answer, one per
+// line, without list markers or quotes. DONE ends the list.
+func parseQueries(text string, limit int) []string {
+	var queries []string
+	for _, line := range strings.Split(text, "\n") {
+		line = listMarker.ReplaceAllString(strings.TrimSpace(line), "")
+		line = strings.Trim(line, "\"'`")
+		line = strings.TrimSpace(line)
+		if strings.EqualFold(line, "done") {
+			break
+		}
+		if line == "" {
+			continue
+		}
+		queries = append(queries, line)
+		if len(queries) == limit {
+			break
+		}
+	}
+	return queries
+}
+
+// groundedPrompt puts the sources ahead of the user's prompt
+func groundedPrompt(prompt string, results []search.Result) string {
+	var b strings.Builder
+	if len(results) == 0 {
+		b.WriteString("The web search found no sources. Answer from what you know, and say that no sources were found.\n\n")
+	} else {
+		b.WriteString("Web search results:\n\n")
+		writeSources(&b, results)
+	}
+	b.WriteString("Question: ")
+	b.WriteString(prompt)
+	return b.String()
+}
+
+// writeSources lists results numbered from 1, the numbers citations use
+func writeSources(b *strings.Builder, results []search.Result) {
+	for i, r := range results {
+		snippet := []rune(strings.TrimSpace(r.Snippet))
+		if len(snippet) > snippetMaxRunes {
+			snippet = append(snippet[:snippetMaxRunes], '…')
+		}
+		fmt.Fprintf(b, "[%d] %s\n%s\n%s\n\n", i+1, r.Title, r.URL, string(snippet))
+	}
+}
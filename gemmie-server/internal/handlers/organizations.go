@@ -0,0 +1,1020 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/imrany/gemmie/gemmie-server/internal/encrypt"
+	"github.com/imrany/gemmie/gemmie-server/store"
+)
+
+// orgIDPrefix starts every organization id. Payment references that start
+// with an organization id buy a plan for the organization.
+const orgIDPrefix = "org"
+
+// defaultUsageDays is the period organization usage covers when none is asked for
+const defaultUsageDays = 30
+
+// isOrganizationID reports whether an identifier from a payment reference names an organization
+func isOrganizationID(identifier string) bool {
+	return strings.HasPrefix(identifier, orgIDPrefix+"_")
+}
+
+// authorizeOrganization loads an organization and checks that userID has at
+// least minRole in it. It writes the error response and returns false when
+// the caller should stop.
+func authorizeOrganization(w http.ResponseWriter, orgID, userID, minRole string) (*store.Organization, bool) {
+	org, err := store.GetOrganizationByID(orgID)
+	if err != nil {
+		slog.Error("Failed to get organization", "org_id", orgID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve organization",
+		})
+		return nil, false
+	}
+
+	role := ""
+	if org != nil {
+		role, err = store.GetOrganizationMemberRole(orgID, userID)
+		if err != nil {
+			slog.Error("Failed to get organization role", "org_id", orgID, "user_id", userID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Failed to retrieve organization",
+			})
+			return nil, false
+		}
+	}
+
+	// Organizations are not visible to people outside them
+	if org == nil || role == "" {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Organization not found",
+		})
+		return nil, false
+	}
+
+	if !store.OrgRoleAtLeast(role, minRole) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Access denied",
+		})
+		return nil, false
+	}
+
+	org.Role = role
+	return org, true
+}
+
+// OrganizationsHandler handles POST /api/organizations and GET /api/organizations,
+// the organizations the user is a member of
+func OrganizationsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		orgs, err := store.GetOrganizationsForUser(userID)
+		if err != nil {
+			slog.Error("Failed to get organizations", "user_id", userID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Failed to retrieve organizations",
+			})
+			return
+		}
+		if orgs == nil {
+			orgs = []store.Organization{}
+		}
+
+		json.NewEncoder(w).Encode(store.Response{
+			Success: true,
+			Message: "Organizations retrieved successfully",
+			Data:    orgs,
+		})
+		return
+	}
+
+	var req struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Invalid request body",
+		})
+		return
+	}
+
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Organization name is required",
+		})
+		return
+	}
+
+	prefix := orgIDPrefix
+	org := store.Organization{
+		ID:          encrypt.GenerateID(&prefix),
+		Name:        req.Name,
+		CreatedBy:   userID,
+		Role:        store.OrgRoleOwner,
+		MemberCount: 1,
+		CreatedAt:   time.Now(),
+		UpdatedAt:   time.Now(),
+	}
+
+	if err := store.CreateOrganization(org); err != nil {
+		slog.Error("Failed to create organization", "user_id", userID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to create organization",
+		})
+		return
+	}
+
+	slog.Info("Organization created", "org_id", org.ID, "user_id", userID)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Organization created successfully",
+		Data:    org,
+	})
+}
+
+// OrganizationHandler handles GET, PUT and DELETE /api/organizations/{id}.
+// Members read it with the plan that covers them, admins rename it and only
+// the owner deletes it.
+func OrganizationHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	orgID := mux.Vars(r)["id"]
+
+	minRole := store.OrgRoleMember
+	switch r.Method {
+	case http.MethodPut:
+		minRole = store.OrgRoleAdmin
+	case http.MethodDelete:
+		minRole = store.OrgRoleOwner
+	}
+
+	org, ok := authorizeOrganization(w, orgID, userID, minRole)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		plan, err := store.GetActiveOrganizationPlan(orgID)
+		if err != nil {
+			slog.Error("Failed to get organization plan", "org_id", orgID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Failed to retrieve organization",
+			})
+			return
+		}
+
+		json.NewEncoder(w).Encode(store.Response{
+			Success: true,
+			Message: "Organization retrieved successfully",
+			Data: map[string]any{
+				"organization": org,
+				"plan":         plan,
+			},
+		})
+
+	case http.MethodPut:
+		var req struct {
+			Name string `json:"name"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Name) == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Organization name is required",
+			})
+			return
+		}
+
+		org.Name = strings.TrimSpace(req.Name)
+		org.UpdatedAt = time.Now()
+		if err := store.UpdateOrganization(*org); err != nil {
+			slog.Error("Failed to update organization", "org_id", orgID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Failed to update organization",
+			})
+			return
+		}
+
+		json.NewEncoder(w).Encode(store.Response{
+			Success: true,
+			Message: "Organization updated successfully",
+			Data:    org,
+		})
+
+	case http.MethodDelete:
+		if err := store.DeleteOrganization(orgID); err != nil {
+			slog.Error("Failed to delete organization", "org_id", orgID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Failed to delete organization",
+			})
+			return
+		}
+
+		slog.Info("Organization deleted", "org_id", orgID, "user_id", userID)
+
+		json.NewEncoder(w).Encode(store.Response{
+			Success: true,
+			Message: "Organization deleted successfully",
+		})
+	}
+}
+
+// OrganizationMembersHandler handles GET /api/organizations/{id}/members
+func OrganizationMembersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	orgID := mux.Vars(r)["id"]
+	org, ok := authorizeOrganization(w, orgID, userID, store.OrgRoleMember)
+	if !ok {
+		return
+	}
+
+	members, err := store.GetOrganizationMembers(orgID)
+	if err != nil {
+		slog.Error("Failed to get organization members", "org_id", orgID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve members",
+		})
+		return
+	}
+	if members == nil {
+		members = []store.OrganizationMember{}
+	}
+
+	data := map[string]any{"members": members}
+
+	// Only admins see who is still invited
+	if store.OrgRoleAtLeast(org.Role, store.OrgRoleAdmin) {
+		invitations, err := store.GetPendingInvitationsForOrganization(orgID)
+		if err != nil {
+			slog.Error("Failed to get organization invitations", "org_id", orgID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Failed to retrieve invitations",
+			})
+			return
+		}
+		if invitations == nil {
+			invitations = []store.OrganizationInvitation{}
+		}
+		data["invitations"] = invitations
+	}
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Members retrieved successfully",
+		Data:    data,
+	})
+}
+
+// OrganizationMemberHandler handles PUT and DELETE /api/organizations/{id}/members/{user_id}.
+// The owner changes roles and can hand ownership to another member, admins
+// remove members, and anyone but the owner may leave.
+func OrganizationMemberHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	vars := mux.Vars(r)
+	orgID := vars["id"]
+	memberID := vars["user_id"]
+
+	minRole := store.OrgRoleOwner
+	if r.Method == http.MethodDelete {
+		minRole = store.OrgRoleAdmin
+		if memberID == userID {
+			minRole = store.OrgRoleMember
+		}
+	}
+
+	org, ok := authorizeOrganization(w, orgID, userID, minRole)
+	if !ok {
+		return
+	}
+
+	current, err := store.GetOrganizationMemberRole(orgID, memberID)
+	if err != nil {
+		slog.Error("Failed to get organization member", "org_id", orgID, "member_id", memberID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve member",
+		})
+		return
+	}
+
+	if current == "" {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Member not found",
+		})
+		return
+	}
+
+	if current == store.OrgRoleOwner {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "The owner cannot be changed or removed, transfer ownership first",
+		})
+		return
+	}
+
+	if r.Method == http.MethodDelete {
+		// Admins remove members, only the owner removes other admins
+		if memberID != userID && current == store.OrgRoleAdmin && org.Role != store.OrgRoleOwner {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Only the owner can remove an admin",
+			})
+			return
+		}
+
+		if err := store.RemoveOrganizationMember(orgID, memberID); err != nil {
+			slog.Error("Failed to remove organization member", "org_id", orgID, "member_id", memberID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Failed to remove member",
+			})
+			return
+		}
+
+		slog.Info("Organization member removed", "org_id", orgID, "member_id", memberID, "user_id", userID)
+
+		json.NewEncoder(w).Encode(store.Response{
+			Success: true,
+			Message: "Member removed successfully",
+		})
+		return
+	}
+
+	var req struct {
+		Role string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil ||
+		(req.Role != store.OrgRoleOwner && req.Role != store.OrgRoleAdmin && req.Role != store.OrgRoleMember) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "role must be 'owner', 'admin' or 'member'",
+		})
+		return
+	}
+
+	if req.Role == store.OrgRoleOwner {
+		if err := store.TransferOrganizationOwnership(orgID, userID, memberID); err != nil {
+			slog.Error("Failed to transfer organization ownership", "org_id", orgID, "member_id", memberID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Failed to transfer ownership",
+			})
+			return
+		}
+
+		slog.Info("Organization ownership transferred", "org_id", orgID, "from", userID, "to", memberID)
+
+		json.NewEncoder(w).Encode(store.Response{
+			Success: true,
+			Message: "Ownership transferred successfully",
+		})
+		return
+	}
+
+	if err := store.UpdateOrganizationMemberRole(orgID, memberID, req.Role); err != nil {
+		slog.Error("Failed to update organization member", "org_id", orgID, "member_id", memberID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to update member",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Member updated successfully",
+	})
+}
+
+// InviteOrganizationMemberHandler handles POST /api/organizations/{id}/invitations
+// Body: {"username": "..."} or {"email": "..."} and a role of admin or member.
+// Admins invite members, only the owner invites admins.
+func InviteOrganizationMemberHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	var req struct {
+		Username string `json:"username"`
+		Email    string `json:"email"`
+		Role     string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Invalid request body",
+		})
+		return
+	}
+
+	if req.Role == "" {
+		req.Role = store.OrgRoleMember
+	}
+	if req.Role != store.OrgRoleAdmin && req.Role != store.OrgRoleMember {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "role must be 'admin' or 'member'",
+		})
+		return
+	}
+
+	orgID := mux.Vars(r)["id"]
+	minRole := store.OrgRoleAdmin
+	if req.Role == store.OrgRoleAdmin {
+		minRole = store.OrgRoleOwner
+	}
+	org, ok := authorizeOrganization(w, orgID, userID, minRole)
+	if !ok {
+		return
+	}
+
+	var invitee *store.User
+	var err error
+	switch {
+	case strings.TrimSpace(req.Email) != "":
+		invitee, err = store.GetUserByEmail(strings.TrimSpace(req.Email))
+	case strings.TrimSpace(req.Username) != "":
+		invitee, err = store.GetUserByUsername(strings.TrimSpace(req.Username))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "username or email is required",
+		})
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to look up invitee", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Database error",
+		})
+		return
+	}
+
+	if invitee == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User not found",
+		})
+		return
+	}
+
+	if role, err := store.GetOrganizationMemberRole(orgID, invitee.ID); err == nil && role != "" {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User is already a member of this organization",
+		})
+		return
+	}
+
+	prefix := "orginv"
+	invitation := store.OrganizationInvitation{
+		ID:          encrypt.GenerateID(&prefix),
+		OrgId:       orgID,
+		OrgName:     org.Name,
+		InviteeId:   invitee.ID,
+		InviteeName: invitee.Username,
+		InvitedBy:   userID,
+		Role:        req.Role,
+		Status:      store.InvitationStatusPending,
+		CreatedAt:   time.Now(),
+	}
+
+	if err := store.CreateOrganizationInvitation(invitation); err != nil {
+		if store.IsUniqueViolation(err) {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "User already has a pending invitation to this organization",
+			})
+			return
+		}
+		slog.Error("Failed to create organization invitation", "org_id", orgID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to create invitation",
+		})
+		return
+	}
+
+	slog.Info("Organization invitation created", "invitation_id", invitation.ID, "org_id", orgID, "invitee_id", invitee.ID, "user_id", userID)
+
+	go notifyUser(context.Background(), invitee.ID, notifyChatInvitations, store.NotificationPayload{
+		Title: "You've been invited to an organization",
+		Body:  fmt.Sprintf("You were invited to join '%s' as %s.", org.Name, req.Role),
+		Data: map[string]any{
+			"invitation_id": invitation.ID,
+			"org_id":        orgID,
+			"url":           "/invitations",
+		},
+		Tag: "organization-invitation",
+	})
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Invitation sent successfully",
+		Data:    invitation,
+	})
+}
+
+// CancelOrganizationInvitationHandler handles DELETE /api/organizations/{id}/invitations/{invitation_id}
+func CancelOrganizationInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	vars := mux.Vars(r)
+	orgID := vars["id"]
+	invitationID := vars["invitation_id"]
+
+	if _, ok := authorizeOrganization(w, orgID, userID, store.OrgRoleAdmin); !ok {
+		return
+	}
+
+	invitation, err := store.GetOrganizationInvitationByID(invitationID)
+	if err != nil {
+		slog.Error("Failed to get organization invitation", "invitation_id", invitationID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve invitation",
+		})
+		return
+	}
+
+	if invitation == nil || invitation.OrgId != orgID || invitation.Status != store.InvitationStatusPending {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Invitation not found",
+		})
+		return
+	}
+
+	if err := store.CancelOrganizationInvitation(invitationID); err != nil {
+		slog.Error("Failed to cancel organization invitation", "invitation_id", invitationID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to cancel invitation",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Invitation cancelled successfully",
+	})
+}
+
+// GetOrganizationInvitationsHandler handles GET /api/organization-invitations,
+// the user's pending organization invitations
+func GetOrganizationInvitationsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	invitations, err := store.GetPendingOrganizationInvitationsForUser(userID)
+	if err != nil {
+		slog.Error("Failed to get organization invitations", "user_id", userID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve invitations",
+		})
+		return
+	}
+	if invitations == nil {
+		invitations = []store.OrganizationInvitation{}
+	}
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Invitations retrieved successfully",
+		Data:    invitations,
+	})
+}
+
+// RespondOrganizationInvitationHandler handles POST /api/organization-invitations/{id}/accept
+// and /api/organization-invitations/{id}/decline
+func RespondOrganizationInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	invitationID := mux.Vars(r)["id"]
+	accept := strings.HasSuffix(r.URL.Path, "/accept")
+
+	invitation, err := store.GetOrganizationInvitationByID(invitationID)
+	if err != nil {
+		slog.Error("Failed to get organization invitation", "invitation_id", invitationID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve invitation",
+		})
+		return
+	}
+
+	if invitation == nil || invitation.InviteeId != userID {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Invitation not found",
+		})
+		return
+	}
+
+	if invitation.Status != store.InvitationStatusPending {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: fmt.Sprintf("Invitation was already %s", invitation.Status),
+		})
+		return
+	}
+
+	if err := store.RespondToOrganizationInvitation(*invitation, accept); err != nil {
+		slog.Error("Failed to respond to organization invitation", "invitation_id", invitationID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to respond to invitation",
+		})
+		return
+	}
+
+	message := "Invitation declined"
+	if accept {
+		message = "Invitation accepted"
+		invitation.Status = store.InvitationStatusAccepted
+	} else {
+		invitation.Status = store.InvitationStatusDeclined
+	}
+	invitation.RespondedAt = time.Now()
+
+	slog.Info(message, "invitation_id", invitationID, "org_id", invitation.OrgId, "user_id", userID)
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: message,
+		Data:    invitation,
+	})
+}
+
+// OrganizationChatsHandler handles GET and POST /api/organizations/{id}/chats,
+// the organization's space. Chats stay personal until their owner shares one
+// into it with {"chat_id": "...", "role": "viewer"} or "editor".
+func OrganizationChatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	orgID := mux.Vars(r)["id"]
+	if _, ok := authorizeOrganization(w, orgID, userID, store.OrgRoleMember); !ok {
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		chats, err := store.GetOrganizationChats(orgID)
+		if err != nil {
+			slog.Error("Failed to get organization chats", "org_id", orgID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Failed to retrieve chats",
+			})
+			return
+		}
+		if chats == nil {
+			chats = []store.OrganizationChat{}
+		}
+
+		json.NewEncoder(w).Encode(store.Response{
+			Success: true,
+			Message: "Chats retrieved successfully",
+			Data:    chats,
+		})
+		return
+	}
+
+	var req struct {
+		ChatId string `json:"chat_id"`
+		Role   string `json:"role"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Invalid request body",
+		})
+		return
+	}
+
+	if req.Role == "" {
+		req.Role = store.ChatRoleViewer
+	}
+	if req.Role != store.ChatRoleEditor && req.Role != store.ChatRoleViewer {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "role must be 'editor' or 'viewer'",
+		})
+		return
+	}
+
+	// Only the chat's owner decides to share it
+	chat, _, ok := authorizeChat(w, req.ChatId, userID, store.ChatRoleOwner)
+	if !ok {
+		return
+	}
+
+	if err := store.ShareChatWithOrganization(orgID, chat.ID, req.Role, userID); err != nil {
+		slog.Error("Failed to share chat with organization", "org_id", orgID, "chat_id", chat.ID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to share chat",
+		})
+		return
+	}
+
+	slog.Info("Chat shared with organization", "org_id", orgID, "chat_id", chat.ID, "role", req.Role, "user_id", userID)
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Chat shared successfully",
+		Data: store.OrganizationChat{
+			OrgId:         orgID,
+			ChatId:        chat.ID,
+			Title:         chat.Title,
+			OwnerId:       chat.UserId,
+			Role:          req.Role,
+			SharedBy:      userID,
+			LastMessageAt: chat.LastMessageAt,
+			CreatedAt:     time.Now(),
+		},
+	})
+}
+
+// OrganizationChatHandler handles DELETE /api/organizations/{id}/chats/{chat_id},
+// taking a chat out of the space. The chat's owner and admins can do it.
+func OrganizationChatHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	vars := mux.Vars(r)
+	orgID := vars["id"]
+	chatID := vars["chat_id"]
+
+	org, ok := authorizeOrganization(w, orgID, userID, store.OrgRoleMember)
+	if !ok {
+		return
+	}
+
+	if !store.OrgRoleAtLeast(org.Role, store.OrgRoleAdmin) {
+		chat, err := store.GetChatById(chatID)
+		if err != nil {
+			slog.Error("Failed to get chat", "chat_id", chatID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Failed to retrieve chat",
+			})
+			return
+		}
+		if chat == nil || chat.UserId != userID {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Access denied",
+			})
+			return
+		}
+	}
+
+	removed, err := store.UnshareChatFromOrganization(orgID, chatID)
+	if err != nil {
+		slog.Error("Failed to unshare chat from organization", "org_id", orgID, "chat_id", chatID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to unshare chat",
+		})
+		return
+	}
+
+	if !removed {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Chat is not shared with this organization",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Chat unshared successfully",
+	})
+}
+
+// OrganizationUsageHandler handles GET /api/organizations/{id}/usage?days=30,
+// what each member did over the last days and the totals, for admins
+func OrganizationUsageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	orgID := mux.Vars(r)["id"]
+	if _, ok := authorizeOrganization(w, orgID, userID, store.OrgRoleAdmin); !ok {
+		return
+	}
+
+	days := defaultUsageDays
+	if value := r.URL.Query().Get("days"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > 365 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "days must be between 1 and 365",
+			})
+			return
+		}
+		days = parsed
+	}
+
+	since := time.Now().AddDate(0, 0, -days)
+	usage, err := store.GetOrganizationUsage(orgID, since)
+	if err != nil {
+		slog.Error("Failed to get organization usage", "org_id", orgID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve usage",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Usage retrieved successfully",
+		Data:    usage,
+	})
+}
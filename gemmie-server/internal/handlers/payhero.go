@@ -11,6 +11,7 @@ import (
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/imrany/gemmie/gemmie-server/internal/encrypt"
 	"github.com/imrany/gemmie/gemmie-server/store"
 	"github.com/spf13/viper"
 )
@@ -78,7 +79,9 @@ func validatePayHeroConfig() error {
 	return nil
 }
 
-// updateUserPlan updates user plan based on transaction amount
+// updateUserPlan records the plan period a transaction paid for. The period
+// starts when the transaction was made, and the user's plan fields follow
+// from their active periods.
 func updateUserPlan(userID string, transaction store.Transaction) error {
 	plan, exists := planConfigs[transaction.Amount]
 	if !exists {
@@ -105,34 +108,117 @@ func updateUserPlan(userID string, transaction store.Transaction) error {
 		"oldPlan", user.Plan,
 	)
 
-	// Update user plan
-	now := time.Now()
-	var u store.User
-	u.Plan = planKey
-	u.PlanName = plan.Name
-	u.Price = plan.Price
-	u.Duration = plan.Duration
-	u.Amount = transaction.Amount
-	u.PhoneNumber = transaction.PhoneNumber
-	u.ExpireDuration = int64(plan.ExpireDuration.Seconds())
-	u.ExpiryTimestamp = now.Add(plan.ExpireDuration).Unix()
-	u.UpdatedAt = now
-
-	if err = store.UpdateUser(u); err != nil {
+	startsAt := transaction.CreatedAt
+	if startsAt.IsZero() {
+		startsAt = time.Now()
+	}
+
+	prefix := "sub"
+	sub, created, err := store.CreatePlanSubscription(store.PlanSubscription{
+		ID:             encrypt.GenerateID(&prefix),
+		UserId:         userID,
+		TransactionRef: transaction.ExternalReference,
+		PlanKey:        planKey,
+		PlanName:       plan.Name,
+		Amount:         transaction.Amount,
+		Price:          plan.Price,
+		Duration:       plan.Duration,
+		PhoneNumber:    transaction.PhoneNumber,
+		StartsAt:       startsAt,
+		EndsAt:         startsAt.Add(plan.ExpireDuration),
+	})
+	if err != nil {
 		slog.Error("Error updating user plan", "error", err)
 		return err
 	}
-	
+
+	if !created {
+		slog.Info("Transaction already recorded as a subscription",
+			"userID", userID,
+			"subscriptionID", sub.ID,
+			"reference", transaction.ExternalReference,
+		)
+		return nil
+	}
+
+	publishPaymentConfirmed([]string{userID}, sub)
+
 	// Log after update for confirmation
 	slog.Info("User plan updated", 
 		"userID", userID,
-		"newPlan", u.Plan,
-		"expiryTimestamp", u.ExpiryTimestamp,
+		"subscriptionID", sub.ID,
+		"newPlan", sub.PlanKey,
+		"status", sub.Status,
+		"endsAt", sub.EndsAt,
 	)
 	
 	return nil
 }
 
+// updateOrganizationPlan records the plan period a transaction paid for on
+// behalf of an organization. It covers every member, whose plan fields
+// follow from it like from their own periods.
+func updateOrganizationPlan(orgID string, transaction store.Transaction) error {
+	plan, exists := planConfigs[transaction.Amount]
+	if !exists {
+		slog.Warn("Unknown plan amount", "amount", transaction.Amount, "transaction", transaction.ExternalReference)
+		return nil
+	}
+
+	org, err := store.GetOrganizationByID(orgID)
+	if err != nil {
+		return err
+	}
+	if org == nil {
+		return fmt.Errorf("organization not found: %s", orgID)
+	}
+
+	startsAt := transaction.CreatedAt
+	if startsAt.IsZero() {
+		startsAt = time.Now()
+	}
+
+	prefix := "sub"
+	sub, created, err := store.CreatePlanSubscription(store.PlanSubscription{
+		ID:             encrypt.GenerateID(&prefix),
+		OrgId:          orgID,
+		TransactionRef: transaction.ExternalReference,
+		PlanKey:        getPlanKey(transaction.Amount),
+		PlanName:       plan.Name,
+		Amount:         transaction.Amount,
+		Price:          plan.Price,
+		Duration:       plan.Duration,
+		PhoneNumber:    transaction.PhoneNumber,
+		StartsAt:       startsAt,
+		EndsAt:         startsAt.Add(plan.ExpireDuration),
+	})
+	if err != nil {
+		return err
+	}
+
+	if created {
+		slog.Info("Organization plan updated",
+			"orgID", orgID,
+			"subscriptionID", sub.ID,
+			"newPlan", sub.PlanKey,
+			"members", org.MemberCount,
+			"endsAt", sub.EndsAt,
+		)
+
+		members, err := store.GetOrganizationMembers(orgID)
+		if err != nil {
+			slog.Warn("Failed to get organization members", "orgID", orgID, "error", err)
+		}
+		userIDs := make([]string, 0, len(members))
+		for _, member := range members {
+			userIDs = append(userIDs, member.UserId)
+		}
+		publishPaymentConfirmed(userIDs, sub)
+	}
+
+	return nil
+}
+
 func getPlanKey(amount int) string {
 	switch amount {
 	case 50:
@@ -159,62 +245,50 @@ func checkAndUpdateUserFromTransaction(transaction store.Transaction) {
 		return
 	}
 
+	// A transaction pays for one period, skip it once that is recorded
+	sub, err := store.GetPlanSubscriptionByTransactionRef(transaction.ExternalReference)
+	if err != nil {
+		slog.Error("Failed to get subscription for transaction",
+			"error", err,
+			"reference", transaction.ExternalReference,
+		)
+		return
+	}
+	if sub != nil {
+		return
+	}
+
 	identifier := parts[0]
+	if isOrganizationID(identifier) {
+		if err := updateOrganizationPlan(identifier, transaction); err != nil {
+			slog.Error("Failed to update organization plan from transaction check",
+				"error", err,
+				"orgID", identifier,
+				"reference", transaction.ExternalReference,
+			)
+		}
+		return
+	}
+
 	_, userID, found := store.FindUserByEmailOrUsername(identifier)
 	if !found {
 		return
 	}
 
-	user, _ := store.GetUserByID(userID)
-
-	// Check if user needs plan update
-	shouldUpdate := false
-	currentTime := time.Now().Unix()
-	transactionTime := transaction.CreatedAt.Unix()
+	// Periods that already ended are still recorded, as expired history
+	slog.Info("Recording plan from existing transaction", 
+		"userID", userID,
+		"transactionTime", transaction.CreatedAt.Unix(),
+		"reference", transaction.ExternalReference,
+	)
 
-	// Check if plan details are missing or incomplete
-	if user.Plan == "" || user.PlanName == "" || user.ExpiryTimestamp == 0 {
-		shouldUpdate = true
-		slog.Info("User missing plan details", 
+	if err := updateUserPlan(userID, transaction); err != nil {
+		slog.Error("Failed to update user plan from transaction check", 
+			"error", err, 
 			"userID", userID, 
-			"plan", user.Plan, 
-			"planName", user.PlanName,
-			"expiryTimestamp", user.ExpiryTimestamp,
+			"reference", transaction.ExternalReference,
 		)
 	}
-
-	// Check if transaction is within valid duration and user should still have active plan
-	plan, planExists := planConfigs[transaction.Amount]
-	if planExists && shouldUpdate {
-		expectedExpiryTime := transactionTime + int64(plan.ExpireDuration.Seconds())
-		
-		// If current time is still within the expected duration, update the user
-		if currentTime <= expectedExpiryTime {
-			slog.Info("Updating user plan from existing transaction within valid duration", 
-				"userID", userID,
-				"transactionTime", transactionTime,
-				"expectedExpiryTime", expectedExpiryTime,
-				"currentTime", currentTime,
-				"reference", transaction.ExternalReference,
-			)
-			
-			if err := updateUserPlan(userID, transaction); err != nil {
-				slog.Error("Failed to update user plan from transaction check", 
-					"error", err, 
-					"userID", userID, 
-					"reference", transaction.ExternalReference,
-				)
-			}
-		} else {
-			slog.Info("Transaction expired, not updating user plan", 
-				"userID", userID,
-				"transactionTime", transactionTime,
-				"expectedExpiryTime", expectedExpiryTime,
-				"currentTime", currentTime,
-				"reference", transaction.ExternalReference,
-			)
-		}
-	}
 }
 
 // SendSTKHandler initiates STK push payment
@@ -259,6 +333,14 @@ func SendSTKHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// A reference starting with an organization id buys the organization's
+	// plan, only its owner and admins can do that
+	if identifier, _, _ := strings.Cut(stkReq.ExternalReference, "-"); isOrganizationID(identifier) {
+		if _, ok := authorizeOrganization(w, identifier, r.Header.Get("X-User-ID"), store.OrgRoleAdmin); !ok {
+			return
+		}
+	}
+
 	// Check if transaction already exists
 	if tranx, _ := store.GetTransactionByExtRef(stkReq.ExternalReference); tranx != nil {
 		w.WriteHeader(http.StatusConflict)
@@ -431,7 +513,16 @@ func StoreTransactionHandler(w http.ResponseWriter, r *http.Request) {
 		parts := strings.Split(transaction.ExternalReference, "-")
 		if len(parts) > 0 {
 			identifier := parts[0]
-			if _, userID, found := store.FindUserByEmailOrUsername(identifier); found {
+			if isOrganizationID(identifier) {
+				if err := updateOrganizationPlan(identifier, transaction); err != nil {
+					slog.Error("Failed to update organization plan",
+						"error", err,
+						"orgID", identifier,
+						"reference", transaction.ExternalReference,
+					)
+					// Don't fail the entire request, transaction is already stored
+				}
+			} else if _, userID, found := store.FindUserByEmailOrUsername(identifier); found {
 				if err := updateUserPlan(userID, transaction); err != nil {
 					slog.Error("Failed to update user plan", 
 						"error", err, 
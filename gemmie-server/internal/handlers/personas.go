@@ -0,0 +1,420 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/imrany/gemmie/gemmie-server/internal/encrypt"
+	"github.com/imrany/gemmie/gemmie-server/internal/genai"
+	"github.com/imrany/gemmie/gemmie-server/store"
+)
+
+const (
+	maxPersonaNameLength         = 60
+	maxPersonaInstructionsLength = 4000
+)
+
+// userInstructions loads the instructions a user's generations are sent
+// with, from their preferences and the persona when personaID is set, and
+// the response mode the user prefers. A preference or persona that cannot be
+// loaded is left out rather than failing the generation.
+func userInstructions(userID, personaID string) (genai.Instructions, store.Modes) {
+	prefs, err := store.GetUserPreferences(userID)
+	if err != nil {
+		slog.Warn("Failed to get preferences for system prompt", "user_id", userID, "error", err)
+	}
+
+	instructions := genai.Instructions{
+		HowToRespond: prefs.CustomInstructions,
+		AboutMe:      prefs.AboutMe,
+		WorkFunction: prefs.WorkFunction,
+	}
+
+	if personaID != "" {
+		persona, err := store.GetPersonaByID(personaID)
+		if err != nil {
+			slog.Warn("Failed to get persona for system prompt", "persona_id", personaID, "error", err)
+		} else if persona != nil {
+			instructions.PersonaName = persona.Name
+			instructions.Persona = persona.Instructions
+		}
+	}
+
+	return instructions, prefs.ResponseMode
+}
+
+// validatePersona trims a persona's fields and returns what is wrong with
+// them, an empty string when they are valid
+func validatePersona(persona *store.Persona) string {
+	persona.Name = strings.TrimSpace(persona.Name)
+	persona.Instructions = strings.TrimSpace(persona.Instructions)
+
+	switch {
+	case persona.Name == "":
+		return "Persona name is required"
+	case len(persona.Name) > maxPersonaNameLength:
+		return fmt.Sprintf("Persona name must be at most %d characters", maxPersonaNameLength)
+	case persona.Instructions == "":
+		return "Persona instructions are required"
+	case len(persona.Instructions) > maxPersonaInstructionsLength:
+		return fmt.Sprintf("Persona instructions must be at most %d characters", maxPersonaInstructionsLength)
+	}
+	return ""
+}
+
+// PersonasHandler handles POST /api/personas and GET /api/personas
+func PersonasHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		personas, err := store.GetPersonasByUserID(userID)
+		if err != nil {
+			slog.Error("Failed to get personas", "user_id", userID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Failed to retrieve personas",
+			})
+			return
+		}
+		if personas == nil {
+			personas = []store.Persona{}
+		}
+
+		json.NewEncoder(w).Encode(store.Response{
+			Success: true,
+			Message: "Personas retrieved successfully",
+			Data:    personas,
+		})
+		return
+	}
+
+	var req store.Persona
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Invalid request body",
+		})
+		return
+	}
+
+	if problem := validatePersona(&req); problem != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: problem,
+		})
+		return
+	}
+
+	prefix := "per"
+	persona := store.Persona{
+		ID:           encrypt.GenerateID(&prefix),
+		UserId:       userID,
+		Name:         req.Name,
+		Instructions: req.Instructions,
+		CreatedAt:    time.Now(),
+		UpdatedAt:    time.Now(),
+	}
+
+	if err := store.CreatePersona(persona); err != nil {
+		if store.IsUniqueViolation(err) {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "A persona with this name already exists",
+			})
+			return
+		}
+		slog.Error("Failed to create persona", "user_id", userID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to create persona",
+		})
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Persona created successfully",
+		Data:    persona,
+	})
+}
+
+// getUserPersona loads a persona of userID. It writes the error response and
+// returns false when the caller should stop.
+func getUserPersona(w http.ResponseWriter, personaID, userID string) (*store.Persona, bool) {
+	persona, err := store.GetPersonaByID(personaID)
+	if err != nil {
+		slog.Error("Failed to get persona", "persona_id", personaID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve persona",
+		})
+		return nil, false
+	}
+
+	if persona == nil || persona.UserId != userID {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Persona not found",
+		})
+		return nil, false
+	}
+
+	return persona, true
+}
+
+// PersonaHandler handles GET, PUT and DELETE /api/personas/{id}
+// Deleting a persona leaves the chats that used it without one
+func PersonaHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	personaID := mux.Vars(r)["id"]
+	persona, ok := getUserPersona(w, personaID, userID)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(store.Response{
+			Success: true,
+			Message: "Persona retrieved successfully",
+			Data:    persona,
+		})
+
+	case http.MethodPut:
+		var req store.Persona
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Invalid request body",
+			})
+			return
+		}
+
+		// Fields left out keep their value
+		if req.Name == "" {
+			req.Name = persona.Name
+		}
+		if req.Instructions == "" {
+			req.Instructions = persona.Instructions
+		}
+		if problem := validatePersona(&req); problem != "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: problem,
+			})
+			return
+		}
+		persona.Name = req.Name
+		persona.Instructions = req.Instructions
+		persona.UpdatedAt = time.Now()
+
+		if err := store.UpdatePersona(*persona); err != nil {
+			if store.IsUniqueViolation(err) {
+				w.WriteHeader(http.StatusConflict)
+				json.NewEncoder(w).Encode(store.Response{
+					Success: false,
+					Message: "A persona with this name already exists",
+				})
+				return
+			}
+			slog.Error("Failed to update persona", "persona_id", personaID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Failed to update persona",
+			})
+			return
+		}
+
+		json.NewEncoder(w).Encode(store.Response{
+			Success: true,
+			Message: "Persona updated successfully",
+			Data:    persona,
+		})
+
+	case http.MethodDelete:
+		if err := store.DeletePersonaByID(personaID); err != nil {
+			slog.Error("Failed to delete persona", "persona_id", personaID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Failed to delete persona",
+			})
+			return
+		}
+
+		slog.Info("Persona deleted", "persona_id", personaID, "user_id", userID)
+
+		json.NewEncoder(w).Encode(store.Response{
+			Success: true,
+			Message: "Persona deleted successfully",
+		})
+	}
+}
+
+// ChatPersonaHandler handles PUT /api/chats/{id}/persona
+// The body is {"persona_id": ""}, an empty persona_id removes the chat's persona
+func ChatPersonaHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	chatID := mux.Vars(r)["id"]
+
+	var req struct {
+		PersonaID *string `json:"persona_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Invalid request body",
+		})
+		return
+	}
+	if req.PersonaID == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "persona_id is required, use an empty string to remove the chat's persona",
+		})
+		return
+	}
+
+	// The persona is one of the owner's, it answers every member of the chat
+	chat, _, ok := authorizeChat(w, chatID, userID, store.ChatRoleOwner)
+	if !ok {
+		return
+	}
+
+	if *req.PersonaID != "" {
+		if _, ok := getUserPersona(w, *req.PersonaID, userID); !ok {
+			return
+		}
+	}
+
+	if err := store.SetChatPersona(chatID, *req.PersonaID); err != nil {
+		slog.Error("Failed to set chat persona", "chat_id", chatID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to update chat",
+		})
+		return
+	}
+	chat.PersonaId = *req.PersonaID
+
+	slog.Info("Chat persona updated", "chat_id", chatID, "persona_id", chat.PersonaId, "user_id", userID)
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Chat updated successfully",
+		Data:    chat,
+	})
+}
+
+// SystemPromptHandler handles GET /api/system-prompt[?chat_id=...][&persona_id=...][&mode=...]
+// It returns the exact system prompt the user's next message would be sent
+// with, in the given chat, with the given persona or in the given mode.
+func SystemPromptHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	requested := store.Modes(r.URL.Query().Get("mode"))
+	if !validMode(requested) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "mode must be one of light-response, web-search or deep-search",
+		})
+		return
+	}
+
+	var personaID string
+	if chatID := r.URL.Query().Get("chat_id"); chatID != "" {
+		chat, _, ok := authorizeChat(w, chatID, userID, store.ChatRoleViewer)
+		if !ok {
+			return
+		}
+		personaID = chat.PersonaId
+	}
+
+	// A persona asked for is previewed in place of the chat's
+	if id := r.URL.Query().Get("persona_id"); id != "" {
+		if _, ok := getUserPersona(w, id, userID); !ok {
+			return
+		}
+		personaID = id
+	}
+
+	instructions, preferred := userInstructions(userID, personaID)
+	mode := responseMode(requested, preferred)
+	instructions.Guidance = modeGuidance(mode)
+	prompt, truncated := genai.SystemPrompt(instructions)
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "System prompt retrieved successfully",
+		Data: map[string]any{
+			"system_prompt": prompt,
+			"persona_id":    personaID,
+			"mode":          mode,
+			"tokens":        genai.EstimateTokens(prompt),
+			"max_tokens":    genai.MaxSystemPromptTokens,
+			"truncated":     truncated,
+		},
+	})
+}
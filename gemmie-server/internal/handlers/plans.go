@@ -0,0 +1,310 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/imrany/gemmie/gemmie-server/internal/genai"
+	"github.com/imrany/gemmie/gemmie-server/store"
+	"github.com/spf13/viper"
+)
+
+// planFree is the plan of users without an active subscription
+const planFree = "free"
+
+// planOrder lists the plans from cheapest to most expensive, the order
+// upgrades are suggested in
+var planOrder = []string{planFree, "student", "hobbyist", "pro"}
+
+// planLimits are what a plan may generate with
+type planLimits struct {
+	Tiers         []string // cost tiers of the models the plan may use
+	DailyRequests int      // AI requests a day, 0 for unlimited
+}
+
+// defaultPlanLimits are the limits of each plan unless PLAN_<KEY>_TIERS or
+// PLAN_<KEY>_DAILY_REQUESTS override them
+var defaultPlanLimits = map[string]planLimits{
+	planFree:   {Tiers: []string{genai.TierEconomy}, DailyRequests: 20},
+	"student":  {Tiers: []string{genai.TierEconomy, genai.TierStandard}},
+	"hobbyist": {Tiers: []string{genai.TierEconomy, genai.TierStandard}},
+	"pro":      {Tiers: genai.Tiers},
+}
+
+// limitsOf returns the limits of a plan. Plans without limits of their own,
+// such as one bought with an unknown amount, get the free plan's.
+func limitsOf(plan string) planLimits {
+	limits, ok := defaultPlanLimits[plan]
+	if !ok {
+		limits = defaultPlanLimits[planFree]
+		plan = planFree
+	}
+
+	prefix := "PLAN_" + strings.ToUpper(plan) + "_"
+	if tiers := viper.GetString(prefix + "TIERS"); tiers != "" {
+		limits.Tiers = nil
+		for _, tier := range strings.Split(tiers, ",") {
+			tier = strings.ToLower(strings.TrimSpace(tier))
+			if slices.Contains(genai.Tiers, tier) {
+				limits.Tiers = append(limits.Tiers, tier)
+			} else if tier != "" {
+				slog.Warn("Ignoring unknown cost tier", "plan", plan, "tier", tier)
+			}
+		}
+	}
+	if viper.IsSet(prefix + "DAILY_REQUESTS") {
+		limits.DailyRequests = max(viper.GetInt(prefix+"DAILY_REQUESTS"), 0)
+	}
+	return limits
+}
+
+// userPlan is the key of the plan a user is entitled to now
+func userPlan(userID string) string {
+	sub, err := store.GetActivePlanSubscription(userID)
+	if err != nil {
+		slog.Warn("Failed to get plan subscription, assuming free plan", "user_id", userID, "error", err)
+		return planFree
+	}
+	if sub == nil {
+		return planFree
+	}
+	return sub.PlanKey
+}
+
+// upgradeFor is the cheapest plan above plan whose limits allow, empty when
+// none does
+func upgradeFor(plan string, allows func(limits planLimits) bool) string {
+	start := slices.Index(planOrder, plan) + 1
+	for _, key := range planOrder[start:] {
+		if allows(limitsOf(key)) {
+			return key
+		}
+	}
+	return ""
+}
+
+// defaultModelID is the "provider/model" identifier of the server's default
+// model, empty when it cannot be resolved
+func defaultModelID() string {
+	p, name, err := genai.Default().Resolve("")
+	if err != nil {
+		return ""
+	}
+	return genai.ModelID(p.Name(), name)
+}
+
+// planAllows reports whether a plan may generate with a model of a cost tier.
+// The server's default model answers every plan.
+func planAllows(plan, id, tier string) bool {
+	return id == defaultModelID() || slices.Contains(limitsOf(plan).Tiers, tier)
+}
+
+// accessError is why a user may not generate with a model, sent with the
+// status and data clients show an upgrade prompt from
+type accessError struct {
+	Status  int
+	Message string
+	Data    map[string]any
+}
+
+func (e *accessError) Error() string {
+	return e.Message
+}
+
+// write sends the error as the JSON response
+func (e *accessError) write(w http.ResponseWriter) {
+	w.WriteHeader(e.Status)
+	json.NewEncoder(w).Encode(store.Response{
+		Success: false,
+		Message: e.Message,
+		Data:    e.Data,
+	})
+}
+
+// generationModel is the model a new message of a chat is generated with:
+// the one asked for, else the chat's, else the user's default model
+func generationModel(userID string, chat *store.Chat, requested string) string {
+	if requested != "" {
+		return requested
+	}
+	if chat != nil && chat.Model != "" {
+		return chat.Model
+	}
+	prefs, err := store.GetUserPreferences(userID)
+	if err != nil {
+		slog.Warn("Failed to get preferences for model", "user_id", userID, "error", err)
+	}
+	return prefs.DefaultModel
+}
+
+// authorizeModel checks that a model is one the server offers and that a
+// user's plan allows it, see authorizeGeneration. It returns the model's
+// "provider/model" identifier.
+func authorizeModel(userID, model string) (string, *accessError) {
+	p, name, err := genai.Default().Resolve(model)
+	if err != nil {
+		return "", &accessError{Status: http.StatusBadRequest, Message: err.Error()}
+	}
+	id := genai.ModelID(p.Name(), name)
+
+	// Only models listed by GET /api/models can be picked
+	if !genai.Default().Offers(context.Background(), id) {
+		return "", &accessError{
+			Status:  http.StatusBadRequest,
+			Message: fmt.Sprintf("%s is not offered by this server, pick a model from GET /api/models", id),
+			Data:    map[string]any{"code": "unknown_model", "model": id},
+		}
+	}
+
+	plan := userPlan(userID)
+	tier := p.CostTier(name)
+	if planAllows(plan, id, tier) {
+		return id, nil
+	}
+
+	upgrade := upgradeFor(plan, func(limits planLimits) bool { return slices.Contains(limits.Tiers, tier) })
+	message := fmt.Sprintf("%s is a %s model, which the %s plan does not include", id, tier, plan)
+	if upgrade != "" {
+		message += fmt.Sprintf(". Upgrade to the %s plan to use it", upgrade)
+	}
+	return "", &accessError{
+		Status:  http.StatusForbidden,
+		Message: message,
+		Data: map[string]any{
+			"code":       "upgrade_required",
+			"plan":       plan,
+			"model":      id,
+			"tier":       tier,
+			"upgrade_to": upgrade,
+		},
+	}
+}
+
+// authorizeGeneration checks that a user may generate a response with a
+// model now: that their plan allows the model and that they have requests
+// left today. It returns the model's "provider/model" identifier.
+func authorizeGeneration(userID, model string) (string, *accessError) {
+	id, accessErr := authorizeModel(userID, model)
+	if accessErr != nil {
+		return "", accessErr
+	}
+
+	plan := userPlan(userID)
+	limit := limitsOf(plan).DailyRequests
+	if limit == 0 {
+		return id, nil
+	}
+
+	user, err := store.GetUserByID(userID)
+	if err != nil || user == nil {
+		slog.Warn("Failed to get user for request limit", "user_id", userID, "error", err)
+		return id, nil
+	}
+
+	// The count starts over once its 24 hour window has passed
+	count := user.RequestCount.Count
+	if time.Since(time.UnixMilli(user.RequestCount.Timestamp)) >= 24*time.Hour {
+		count = 0
+	}
+	if count < limit {
+		return id, nil
+	}
+
+	upgrade := upgradeFor(plan, func(limits planLimits) bool {
+		return limits.DailyRequests == 0 || limits.DailyRequests > limit
+	})
+	message := fmt.Sprintf("The %s plan allows %d AI requests a day and they are used up", plan, limit)
+	if upgrade != "" {
+		message += fmt.Sprintf(". Upgrade to the %s plan for more", upgrade)
+	}
+	return "", &accessError{
+		Status:  http.StatusTooManyRequests,
+		Message: message,
+		Data: map[string]any{
+			"code":       "request_limit",
+			"plan":       plan,
+			"limit":      limit,
+			"upgrade_to": upgrade,
+		},
+	}
+}
+
+// ChatModelHandler handles PUT /api/chats/{id}/model
+// The body is {"model": "provider/model"}, an empty model goes back to the
+// user's default model. The model must be one the user's plan allows.
+func ChatModelHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	chatID := mux.Vars(r)["id"]
+
+	var req struct {
+		Model *string `json:"model"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Invalid request body",
+		})
+		return
+	}
+	if req.Model == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "model is required, use an empty string for your default model",
+		})
+		return
+	}
+
+	chat, _, ok := authorizeChat(w, chatID, userID, store.ChatRoleEditor)
+	if !ok {
+		return
+	}
+
+	model := strings.TrimSpace(*req.Model)
+	if model != "" {
+		id, accessErr := authorizeModel(userID, model)
+		if accessErr != nil {
+			accessErr.write(w)
+			return
+		}
+		model = id
+	}
+
+	if err := store.SetChatModel(chatID, model); err != nil {
+		slog.Error("Failed to set chat model", "chat_id", chatID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to update chat",
+		})
+		return
+	}
+	chat.Model = model
+
+	slog.Info("Chat model updated", "chat_id", chatID, "model", model, "user_id", userID)
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Chat updated successfully",
+		Data:    chat,
+	})
+}
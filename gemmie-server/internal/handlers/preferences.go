@@ -0,0 +1,352 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"slices"
+
+	"github.com/imrany/gemmie/gemmie-server/store"
+	"github.com/spf13/viper"
+)
+
+const (
+	maxDefaultModelLength       = 100
+	maxWorkFunctionLength       = 100
+	maxCustomInstructionsLength = 4000
+	maxAboutMeLength            = 4000
+)
+
+// Push notification kinds a user can turn off in their preferences
+const (
+	notifyTaskCompleted   = "task_completed"
+	notifyChatInvitations = "chat_invitations"
+	notifyDataExports     = "data_exports"
+)
+
+var (
+	preferenceThemes   = []string{"system", "light", "dark"}
+	preferenceModes    = []store.Modes{store.ModesLightResponse, store.ModesWebSearch, store.ModesDeepSearch}
+	languageTagPattern = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+)
+
+// preferencesDocument is the stored, sparse preferences document. Only the
+// values a user has set are present, the rest resolve to defaults.
+type preferencesDocument struct {
+	SchemaVersion      *int                   `json:"schema_version,omitempty"`
+	Theme              *string                `json:"theme,omitempty"`
+	Language           *string                `json:"language,omitempty"`
+	DefaultModel       *string                `json:"default_model,omitempty"`
+	ResponseMode       *string                `json:"response_mode,omitempty"`
+	WorkFunction       *string                `json:"work_function,omitempty"`
+	AboutMe            *string                `json:"about_me,omitempty"`
+	CustomInstructions *string                `json:"custom_instructions,omitempty"`
+	Notifications      *notificationsDocument `json:"notifications,omitempty"`
+}
+
+type notificationsDocument struct {
+	Push            *bool `json:"push,omitempty"`
+	TaskCompleted   *bool `json:"task_completed,omitempty"`
+	ChatInvitations *bool `json:"chat_invitations,omitempty"`
+	DataExports     *bool `json:"data_exports,omitempty"`
+}
+
+// validate returns what is wrong with the document, nothing when it is valid
+func (doc *preferencesDocument) validate() []string {
+	var problems []string
+
+	if doc.Theme != nil && !slices.Contains(preferenceThemes, *doc.Theme) {
+		problems = append(problems, "theme must be one of system, light or dark")
+	}
+	if doc.Language != nil && !languageTagPattern.MatchString(*doc.Language) {
+		problems = append(problems, "language must be a language tag such as en or sw-KE")
+	}
+	if doc.DefaultModel != nil && len(*doc.DefaultModel) > maxDefaultModelLength {
+		problems = append(problems, fmt.Sprintf("default_model must be at most %d characters", maxDefaultModelLength))
+	}
+	if doc.ResponseMode != nil && !slices.Contains(preferenceModes, store.Modes(*doc.ResponseMode)) {
+		problems = append(problems, "response_mode must be one of light-response, web-search or deep-search")
+	}
+	if doc.WorkFunction != nil && len(*doc.WorkFunction) > maxWorkFunctionLength {
+		problems = append(problems, fmt.Sprintf("work_function must be at most %d characters", maxWorkFunctionLength))
+	}
+	if doc.AboutMe != nil && len(*doc.AboutMe) > maxAboutMeLength {
+		problems = append(problems, fmt.Sprintf("about_me must be at most %d characters", maxAboutMeLength))
+	}
+	if doc.CustomInstructions != nil && len(*doc.CustomInstructions) > maxCustomInstructionsLength {
+		problems = append(problems, fmt.Sprintf("custom_instructions must be at most %d characters", maxCustomInstructionsLength))
+	}
+
+	return problems
+}
+
+// syncedPreferences is the part of the preferences document that profile
+// fields written through POST /api/sync change. The preference columns are
+// copied into the document, an empty value removes it.
+func syncedPreferences(fields map[string]any) *preferencesDocument {
+	doc := &preferencesDocument{}
+	columns := map[string]**string{
+		"theme":         &doc.Theme,
+		"response_mode": &doc.ResponseMode,
+		"work_function": &doc.WorkFunction,
+		"preferences":   &doc.CustomInstructions,
+	}
+	for name, field := range columns {
+		if value, ok := fields[name].(string); ok && value != "" {
+			*field = &value
+		}
+	}
+	return doc
+}
+
+// mergePatch applies an RFC 7386 JSON merge patch to target. A null in the
+// patch removes the key, objects are merged recursively, anything else replaces.
+func mergePatch(target, patch map[string]any) map[string]any {
+	if target == nil {
+		target = map[string]any{}
+	}
+
+	for key, value := range patch {
+		if value == nil {
+			delete(target, key)
+			continue
+		}
+
+		if patchObject, ok := value.(map[string]any); ok {
+			targetObject, _ := target[key].(map[string]any)
+			merged := mergePatch(targetObject, patchObject)
+			if len(merged) == 0 {
+				delete(target, key)
+			} else {
+				target[key] = merged
+			}
+			continue
+		}
+
+		target[key] = value
+	}
+
+	return target
+}
+
+// resolvedPreferences fills in defaults that come from server config
+func resolvedPreferences(prefs store.UserPreferences) store.UserPreferences {
+	if prefs.DefaultModel == "" {
+		prefs.DefaultModel = viper.GetString("MODEL")
+	}
+	return prefs
+}
+
+// pushAllowed reports whether a user wants push notifications of kind
+func pushAllowed(userID, kind string) bool {
+	prefs, err := store.GetUserPreferences(userID)
+	if err != nil {
+		// Fall back to the defaults rather than dropping the notification
+		slog.Warn("Failed to get notification preferences", "user_id", userID, "error", err)
+	}
+
+	notifications := prefs.Notifications
+	if !notifications.Push {
+		return false
+	}
+
+	switch kind {
+	case notifyTaskCompleted:
+		return notifications.TaskCompleted
+	case notifyChatInvitations:
+		return notifications.ChatInvitations
+	case notifyDataExports:
+		return notifications.DataExports
+	}
+	return true
+}
+
+// notifyUser sends a push notification of kind unless the user turned it off
+func notifyUser(ctx context.Context, userID, kind string, payload store.NotificationPayload) {
+	if !pushAllowed(userID, kind) {
+		slog.Debug("Push notification disabled by preferences", "user_id", userID, "kind", kind)
+		return
+	}
+	sendPushToUser(ctx, userID, payload)
+}
+
+// PreferencesHandler handles GET and PATCH /api/preferences
+//
+// GET returns every preference with defaults filled in. PATCH takes a JSON
+// merge patch (RFC 7386) of the preferences document, null resets a value.
+func PreferencesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	doc, version, err := store.GetUserPreferencesDoc(userID)
+	if err != nil {
+		slog.Error("Failed to get preferences", "user_id", userID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to get preferences",
+		})
+		return
+	}
+
+	if doc == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User not found",
+		})
+		return
+	}
+
+	if r.Method == http.MethodPatch {
+		patchPreferences(w, r, userID, doc, version)
+		return
+	}
+
+	if notModified(w, r, versionETag(version)) {
+		return
+	}
+
+	prefs, err := store.ResolvePreferences(doc)
+	if err != nil {
+		// A damaged document should not lock the user out of their settings
+		slog.Warn("Failed to parse preferences document", "user_id", userID, "error", err)
+	}
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Preferences retrieved successfully",
+		Data:    resolvedPreferences(prefs),
+	})
+}
+
+// patchPreferences merges a patch into the stored document, validates the
+// result and saves it
+func patchPreferences(w http.ResponseWriter, r *http.Request, userID string, doc []byte, version int64) {
+	expected, ok := ifMatchVersion(w, r, version)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Invalid request body",
+		})
+		return
+	}
+
+	var patch map[string]any
+	if err := json.Unmarshal(body, &patch); err != nil || patch == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Request body must be a JSON object",
+		})
+		return
+	}
+
+	// The schema version is owned by the server
+	delete(patch, "schema_version")
+
+	current := map[string]any{}
+	if err := json.Unmarshal(doc, &current); err != nil {
+		slog.Warn("Replacing unreadable preferences document", "user_id", userID, "error", err)
+		current = map[string]any{}
+	}
+	merged := mergePatch(current, patch)
+	merged["schema_version"] = store.PreferencesSchemaVersion
+
+	mergedJSON, err := json.Marshal(merged)
+	if err != nil {
+		slog.Error("Failed to encode preferences", "user_id", userID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to update preferences",
+		})
+		return
+	}
+
+	// Decoding strictly rejects unknown keys and values of the wrong type
+	var checked preferencesDocument
+	decoder := json.NewDecoder(bytes.NewReader(mergedJSON))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&checked); err != nil {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Invalid preferences",
+			Data:    map[string]any{"errors": []string{err.Error()}},
+		})
+		return
+	}
+
+	if problems := checked.validate(); len(problems) > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Invalid preferences",
+			Data:    map[string]any{"errors": problems},
+		})
+		return
+	}
+
+	// Store the checked struct so the document only ever holds known keys
+	stored, err := json.Marshal(checked)
+	if err != nil {
+		slog.Error("Failed to encode preferences", "user_id", userID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to update preferences",
+		})
+		return
+	}
+
+	newVersion, err := store.UpdateUserPreferencesDoc(userID, stored, expected)
+	if errors.Is(err, store.ErrVersionConflict) {
+		preconditionFailed(w, 0)
+		return
+	}
+	if err != nil {
+		slog.Error("Failed to update preferences", "user_id", userID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to update preferences",
+		})
+		return
+	}
+
+	prefs, err := store.ResolvePreferences(stored)
+	if err != nil {
+		slog.Warn("Failed to parse preferences document", "user_id", userID, "error", err)
+	}
+
+	slog.Info("Preferences updated", "user_id", userID)
+
+	w.Header().Set("ETag", versionETag(newVersion))
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Preferences updated successfully",
+		Data:    resolvedPreferences(prefs),
+	})
+}
@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/imrany/gemmie/gemmie-server/store"
+)
+
+const (
+	// retentionPurgeBatch is how many messages, and chats, one purge batch removes
+	retentionPurgeBatch = 500
+	// maxRetentionPurgeBatches caps the work of one run, the rest waits for the next
+	maxRetentionPurgeBatches = 20
+)
+
+// RetentionHandler handles GET and PUT /api/retention, the user's default
+// retention in days. 0 keeps chats forever.
+func RetentionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	if r.Method == http.MethodPut {
+		var req struct {
+			RetentionDays *int `json:"retention_days"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Invalid request body",
+			})
+			return
+		}
+
+		if req.RetentionDays == nil || !slices.Contains(store.RetentionPeriods, *req.RetentionDays) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "retention_days must be 0 (forever), 30, 90 or 365",
+			})
+			return
+		}
+
+		if err := store.SetUserRetentionDays(userID, *req.RetentionDays); err != nil {
+			slog.Error("Failed to set retention", "user_id", userID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Failed to update retention",
+			})
+			return
+		}
+
+		slog.Info("Retention updated", "user_id", userID, "retention_days", *req.RetentionDays)
+	}
+
+	days, err := store.GetUserRetentionDays(userID)
+	if err != nil {
+		slog.Error("Failed to get retention", "user_id", userID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to get retention",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Retention retrieved successfully",
+		Data:    map[string]int{"retention_days": days},
+	})
+}
+
+// ChatRetentionHandler handles PUT /api/chats/{id}/retention. retention_days
+// overrides the owner's setting, null follows it again. Kept chats are never purged.
+func ChatRetentionHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	chatID := mux.Vars(r)["id"]
+
+	var req struct {
+		RetentionDays *int  `json:"retention_days"`
+		IsKept        *bool `json:"is_kept"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Invalid request body",
+		})
+		return
+	}
+
+	if req.RetentionDays != nil && !slices.Contains(store.RetentionPeriods, *req.RetentionDays) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "retention_days must be null, 0 (forever), 30, 90 or 365",
+		})
+		return
+	}
+
+	// Only the owner decides how long a chat lives
+	chat, _, ok := authorizeChat(w, chatID, userID, store.ChatRoleOwner)
+	if !ok {
+		return
+	}
+
+	kept := chat.IsKept
+	if req.IsKept != nil {
+		kept = *req.IsKept
+	}
+
+	if err := store.SetChatRetention(chatID, req.RetentionDays, kept); err != nil {
+		slog.Error("Failed to set chat retention", "chat_id", chatID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to update chat retention",
+		})
+		return
+	}
+
+	slog.Info("Chat retention updated", "chat_id", chatID, "retention_days", req.RetentionDays, "is_kept", kept, "user_id", userID)
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Chat retention updated successfully",
+		Data: map[string]any{
+			"chat_id":        chatID,
+			"retention_days": req.RetentionDays,
+			"is_kept":        kept,
+		},
+	})
+}
+
+// StartRetentionPurge periodically deletes messages and chats past their
+// retention. It is safe to run on every replica, only one purges at a time.
+func StartRetentionPurge(interval time.Duration) {
+	slog.Info("Starting retention purge", "interval", interval.String())
+
+	ticker := time.NewTicker(interval)
+	go func() {
+		for range ticker.C {
+			runRetentionPurge(time.Now())
+		}
+	}()
+}
+
+// runRetentionPurge purges in batches until nothing is left or the run's cap is hit
+func runRetentionPurge(now time.Time) {
+	messagesByUser := map[string]int{}
+	chatsByUser := map[string][]string{}
+
+	for range maxRetentionPurgeBatches {
+		purge, err := store.PurgeExpiredData(now, retentionPurgeBatch)
+		if err != nil {
+			slog.Error("Retention purge failed", "error", err)
+			break
+		}
+		if purge.Skipped {
+			slog.Debug("Retention purge running on another replica, skipping")
+			break
+		}
+
+		for _, item := range purge.Messages {
+			messagesByUser[item.UserId]++
+		}
+		for _, item := range purge.Chats {
+			chatsByUser[item.UserId] = append(chatsByUser[item.UserId], item.ID)
+		}
+
+		if len(purge.Messages) < retentionPurgeBatch && len(purge.Chats) < retentionPurgeBatch {
+			break
+		}
+	}
+
+	users := map[string]bool{}
+	for userID := range messagesByUser {
+		users[userID] = true
+	}
+	for userID := range chatsByUser {
+		users[userID] = true
+	}
+	for userID := range users {
+		slog.Info("Retention purge removed expired data",
+			"user_id", userID,
+			"messages", messagesByUser[userID],
+			"chats", len(chatsByUser[userID]),
+			"chat_ids", chatsByUser[userID],
+		)
+	}
+}
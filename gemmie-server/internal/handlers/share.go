@@ -0,0 +1,429 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/imrany/gemmie/gemmie-server/internal/encrypt"
+	"github.com/imrany/gemmie/gemmie-server/store"
+)
+
+const (
+	// sharePasswordMaxFailures is how many wrong passwords in a row lock a
+	// password protected link
+	sharePasswordMaxFailures = 5
+	// sharePasswordLockout is how long a locked link refuses passwords
+	sharePasswordLockout = 15 * time.Minute
+)
+
+// sharedMessage is the public view of a message, without ids of the owner
+type sharedMessage struct {
+	Prompt     string    `json:"prompt,omitempty"`
+	Response   string    `json:"response"`
+	Model      string    `json:"model,omitempty"`
+	References []string  `json:"references,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// sharedChat is what a visitor of /s/{token} receives
+type sharedChat struct {
+	Title     string          `json:"title"`
+	Mode      string          `json:"mode"`
+	SharedAt  time.Time       `json:"shared_at"`
+	ExpiresAt time.Time       `json:"expires_at,omitzero"`
+	Messages  []sharedMessage `json:"messages"`
+}
+
+func toSharedMessages(messages []store.Message) []sharedMessage {
+	shared := make([]sharedMessage, 0, len(messages))
+	for _, m := range messages {
+		shared = append(shared, sharedMessage{
+			Prompt:     m.Prompt,
+			Response:   m.Response,
+			Model:      m.Model,
+			References: m.References,
+			CreatedAt:  m.CreatedAt,
+		})
+	}
+	return shared
+}
+
+// ChatSharesHandler handles POST /api/chats/{id}/shares and GET /api/chats/{id}/shares
+func ChatSharesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	chatID := mux.Vars(r)["id"]
+	// Only the owner manages share links
+	chat, _, ok := authorizeChat(w, chatID, userID, store.ChatRoleOwner)
+	if !ok {
+		return
+	}
+
+	baseURL := publicBaseURL(r)
+
+	if r.Method == http.MethodGet {
+		shares, err := store.GetChatSharesByChatID(chatID)
+		if err != nil {
+			slog.Error("Failed to get share links", "chat_id", chatID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Failed to retrieve share links",
+			})
+			return
+		}
+		if shares == nil {
+			shares = []store.ChatShare{}
+		}
+		for i := range shares {
+			shares[i].URL = baseURL + "/s/" + shares[i].Token
+		}
+
+		json.NewEncoder(w).Encode(store.Response{
+			Success: true,
+			Message: "Share links retrieved successfully",
+			Data:    shares,
+		})
+		return
+	}
+
+	var req struct {
+		Mode           string    `json:"mode"`
+		Password       string    `json:"password,omitempty"`
+		ExpiresAt      time.Time `json:"expires_at,omitzero"`
+		ExpiresInHours int       `json:"expires_in_hours,omitempty"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Invalid request body",
+		})
+		return
+	}
+
+	if req.Mode == "" {
+		req.Mode = store.ShareModeLive
+	}
+	if req.Mode != store.ShareModeLive && req.Mode != store.ShareModeSnapshot {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "mode must be 'live' or 'snapshot'",
+		})
+		return
+	}
+
+	expiresAt := req.ExpiresAt
+	if req.ExpiresInHours > 0 {
+		expiresAt = time.Now().Add(time.Duration(req.ExpiresInHours) * time.Hour)
+	}
+	if !expiresAt.IsZero() && expiresAt.Before(time.Now()) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Expiry must be in the future",
+		})
+		return
+	}
+
+	token, err := encrypt.GenerateSecureToken(16)
+	if err != nil {
+		slog.Error("Failed to generate share token", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to create share link",
+		})
+		return
+	}
+
+	prefix := "shr"
+	share := store.ChatShare{
+		ID:        encrypt.GenerateID(&prefix),
+		ChatId:    chatID,
+		CreatedBy: userID,
+		Token:     token,
+		Mode:      req.Mode,
+		ExpiresAt: expiresAt,
+		CreatedAt: time.Now(),
+	}
+
+	if req.Password != "" {
+		hash, err := encrypt.HashPassword(req.Password)
+		if err != nil {
+			slog.Error("Failed to hash share password", "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Failed to create share link",
+			})
+			return
+		}
+		share.PasswordHash = hash
+		share.HasPassword = true
+	}
+
+	// Snapshot links freeze the active branch as it is right now
+	if share.Mode == store.ShareModeSnapshot {
+		snapshot, err := json.Marshal(toSharedMessages(chat.Messages))
+		if err != nil {
+			slog.Error("Failed to snapshot chat", "chat_id", chatID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Failed to create share link",
+			})
+			return
+		}
+		share.Snapshot = string(snapshot)
+	}
+
+	if err := store.CreateChatShare(share); err != nil {
+		slog.Error("Failed to create share link", "chat_id", chatID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to create share link",
+		})
+		return
+	}
+
+	share.URL = baseURL + "/s/" + share.Token
+	slog.Info("Share link created", "share_id", share.ID, "chat_id", chatID, "mode", share.Mode, "user_id", userID)
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Share link created successfully",
+		Data:    share,
+	})
+}
+
+// RevokeChatShareHandler handles DELETE /api/chats/{id}/shares/{share_id}
+func RevokeChatShareHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	vars := mux.Vars(r)
+	chatID := vars["id"]
+	shareID := vars["share_id"]
+
+	if _, _, ok := authorizeChat(w, chatID, userID, store.ChatRoleOwner); !ok {
+		return
+	}
+
+	share, err := store.GetChatShareByID(shareID)
+	if err != nil {
+		slog.Error("Failed to get share link", "share_id", shareID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve share link",
+		})
+		return
+	}
+
+	if share == nil || share.ChatId != chatID {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Share link not found",
+		})
+		return
+	}
+
+	if err := store.RevokeChatShare(shareID); err != nil {
+		slog.Error("Failed to revoke share link", "share_id", shareID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to revoke share link",
+		})
+		return
+	}
+
+	slog.Info("Share link revoked", "share_id", shareID, "chat_id", chatID, "user_id", userID)
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Share link revoked successfully",
+	})
+}
+
+// SharedChatHandler handles GET and POST /s/{token}
+// No login is needed. Password protected links take the password in the
+// X-Share-Password header, or as {"password": "..."} when using POST.
+func SharedChatHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+
+	token := mux.Vars(r)["token"]
+
+	share, err := store.GetChatShareByToken(token)
+	if err != nil {
+		slog.Error("Failed to get share link", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve shared chat",
+		})
+		return
+	}
+
+	// Revoked links look the same as links that never existed
+	if share == nil || !share.RevokedAt.IsZero() {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Shared chat not found",
+		})
+		return
+	}
+
+	if !share.ExpiresAt.IsZero() && time.Now().After(share.ExpiresAt) {
+		w.WriteHeader(http.StatusGone)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "This share link has expired",
+		})
+		return
+	}
+
+	if share.HasPassword {
+		if time.Now().Before(share.LockedUntil) {
+			sharePasswordLocked(w, share.LockedUntil)
+			return
+		}
+
+		password := r.Header.Get("X-Share-Password")
+		if password == "" && r.Method == http.MethodPost {
+			var req struct {
+				Password string `json:"password"`
+			}
+			json.NewDecoder(r.Body).Decode(&req)
+			password = req.Password
+		}
+
+		if password == "" || !encrypt.CheckPassword(share.PasswordHash, password) {
+			message := "Password required"
+			if password != "" {
+				message = "Invalid password"
+
+				lockedUntil, err := store.RecordChatSharePasswordFailure(share.ID, sharePasswordMaxFailures, sharePasswordLockout)
+				if err != nil {
+					slog.Error("Failed to record wrong share password", "share_id", share.ID, "error", err)
+				} else if !lockedUntil.IsZero() {
+					slog.Warn("Share link locked after wrong passwords", "share_id", share.ID, "locked_until", lockedUntil)
+					sharePasswordLocked(w, lockedUntil)
+					return
+				}
+			}
+			w.WriteHeader(http.StatusUnauthorized)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: message,
+				Data:    map[string]bool{"password_required": true},
+			})
+			return
+		}
+
+		if err := store.ResetChatSharePasswordFailures(share.ID); err != nil {
+			slog.Warn("Failed to reset wrong share passwords", "share_id", share.ID, "error", err)
+		}
+	}
+
+	chat, err := store.GetChatById(share.ChatId)
+	if err != nil {
+		slog.Error("Failed to get chat", "chat_id", share.ChatId, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve shared chat",
+		})
+		return
+	}
+
+	if chat == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Shared chat not found",
+		})
+		return
+	}
+
+	view := sharedChat{
+		Title:     chat.Title,
+		Mode:      share.Mode,
+		SharedAt:  share.CreatedAt,
+		ExpiresAt: share.ExpiresAt,
+	}
+
+	if share.Mode == store.ShareModeSnapshot {
+		if err := json.Unmarshal([]byte(share.Snapshot), &view.Messages); err != nil {
+			slog.Error("Failed to read chat snapshot", "share_id", share.ID, "error", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Failed to retrieve shared chat",
+			})
+			return
+		}
+	} else {
+		view.Messages = toSharedMessages(chat.Messages)
+	}
+	if view.Messages == nil {
+		view.Messages = []sharedMessage{}
+	}
+
+	if err := store.RecordChatShareView(share.ID); err != nil {
+		slog.Warn("Failed to record share view", "share_id", share.ID, "error", err)
+	}
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Shared chat retrieved successfully",
+		Data:    view,
+	})
+}
+
+// sharePasswordLocked tells a visitor that a link takes no passwords until
+// lockedUntil
+func sharePasswordLocked(w http.ResponseWriter, lockedUntil time.Time) {
+	retryAfter := int(math.Ceil(time.Until(lockedUntil).Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+	w.WriteHeader(http.StatusTooManyRequests)
+	json.NewEncoder(w).Encode(store.Response{
+		Success: false,
+		Message: "Too many wrong passwords, try again later",
+		Data: map[string]any{
+			"password_required": true,
+			"locked_until":      lockedUntil,
+		},
+	})
+}
@@ -0,0 +1,245 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/imrany/gemmie/gemmie-server/internal/genai"
+	"github.com/imrany/gemmie/gemmie-server/store"
+)
+
+// Server-Sent Event names of a streamed response
+const (
+	eventDelta   = "delta"   // {"delta": "..."}, the next piece of the response
+	eventMessage = "message" // the stored store.Message, always the last event of a chat stream
+	eventDone    = "done"    // the whole response of POST /api/genai
+	eventSearch  = "search"  // {"query": "..."}, a web search the response mode runs
+	eventError   = "error"   // store.Response with the failure
+)
+
+// wantsStream reports whether the client asked for the response as
+// Server-Sent Events, with Accept: text/event-stream or ?stream=true
+func wantsStream(r *http.Request) bool {
+	if stream, _ := strconv.ParseBool(r.URL.Query().Get("stream")); stream {
+		return true
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// eventStream writes Server-Sent Events to a response
+type eventStream struct {
+	w  http.ResponseWriter
+	rc *http.ResponseController
+}
+
+// newEventStream starts an event stream response. Streams last as long as the
+// generation does, so the server's write timeout is lifted for them.
+func newEventStream(w http.ResponseWriter) *eventStream {
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		slog.Warn("Failed to clear write deadline", "error", err)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	// Keep reverse proxies like nginx from buffering the events
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	stream := &eventStream{w: w, rc: rc}
+	stream.flush()
+	return stream
+}
+
+// send writes one event with data encoded as JSON
+func (s *eventStream) send(event string, data any) error {
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(s.w, "event: %s\ndata: %s\n\n", event, payload); err != nil {
+		return err
+	}
+	return s.flush()
+}
+
+func (s *eventStream) flush() error {
+	if err := s.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+// sendDelta is the onDelta of a streamed generation
+func (s *eventStream) sendDelta(delta string) error {
+	return s.send(eventDelta, map[string]string{"delta": delta})
+}
+
+func (s *eventStream) sendError(message string) {
+	if err := s.send(eventError, store.Response{Success: false, Message: message}); err != nil {
+		slog.Debug("Failed to send error event", "error", err)
+	}
+}
+
+var (
+	// errSaveMessage is returned when a generated message could not be stored
+	errSaveMessage = errors.New("failed to create message")
+	// errHistory is returned when the conversation leading up to a message
+	// could not be loaded
+	errHistory = errors.New("failed to retrieve conversation history")
+)
+
+// generateMessage generates the response to message piece by piece, passing
+// each piece to onDelta, and stores the message when the generation ends.
+// When ctx is canceled, onDelta fails or the provider fails midway, the
+// response so far is stored and marked partial, and returned together with
+// the error. Nothing is stored when no response was generated at all.
+// deviceID is the device that asked, it is not told about the new message.
+// The sources a search mode found are added to the message's references.
+func generateMessage(ctx context.Context, userID, deviceID string, chat *store.Chat, message store.Message, opts generateOptions, onDelta func(delta string) error) (*store.Message, error) {
+	registry := genai.Default()
+
+	provider, name, err := registry.Resolve(message.Model)
+	if err != nil {
+		return nil, err
+	}
+	message.Model = genai.ModelID(provider.Name(), name)
+
+	req, sources, err := messageRequest(ctx, userID, chat, message, opts)
+	if err != nil {
+		slog.Error("Failed to get conversation history", "chat_id", chat.ID, "error", err)
+		return nil, errHistory
+	}
+	if len(sources) > 0 {
+		message.References = uniqueStrings(append(message.References, sources...))
+	}
+
+	var response strings.Builder
+	_, genErr := registry.Stream(ctx, req, func(delta string) error {
+		response.WriteString(delta)
+		return onDelta(delta)
+	})
+	if genErr != nil {
+		if response.Len() == 0 {
+			return nil, genErr
+		}
+		slog.Warn("Streamed response stopped early, storing it as partial",
+			"chat_id", message.ChatId, "user_id", userID, "error", genErr)
+		message.IsPartial = true
+	}
+	countRequest(userID)
+
+	message.Response = response.String()
+	message.CreatedAt = time.Now()
+
+	if err := store.CreateMessage(message); err != nil {
+		slog.Error("Failed to create message", "error", err)
+		return nil, errSaveMessage
+	}
+
+	chat.MessageCount++
+	chat.LastMessageAt = time.Now()
+	chat.UpdatedAt = time.Now()
+	if err := store.TouchChat(chat.ID, chat.LastMessageAt); err != nil {
+		slog.Error("Failed to update chat", "chat_id", chat.ID, "error", err)
+	}
+
+	slog.Info("Message created successfully", "message_id", message.ID, "chat_id", chat.ID, "user_id", userID, "partial", message.IsPartial)
+
+	publishMessageCreated(chat.UserId, message, deviceID)
+	if !message.IsPartial {
+		go sendTaskCompletedPush(userID, message)
+	}
+	return &message, genErr
+}
+
+// generationError is the text sent to a client when generateMessage fails
+func generationError(err error) string {
+	if errors.Is(err, errSaveMessage) {
+		return "Failed to create message"
+	}
+	if errors.Is(err, errHistory) {
+		return "Failed to retrieve conversation history"
+	}
+	return fmt.Sprintf("Failed to generate AI response: %s", err.Error())
+}
+
+// streamMessage streams the response to message as Server-Sent Events and
+// sends the stored message last, see generateMessage
+func streamMessage(w http.ResponseWriter, r *http.Request, userID string, chat *store.Chat, message store.Message, opts generateOptions) {
+	// Unknown models fail as a plain JSON error, before the stream starts, as
+	// they do without streaming
+	if _, _, err := genai.Default().Resolve(message.Model); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	stream := newEventStream(w)
+	opts.onSearch = func(query string) {
+		if err := stream.send(eventSearch, map[string]string{"query": query}); err != nil {
+			slog.Debug("Failed to send search event", "error", err)
+		}
+	}
+
+	stored, err := generateMessage(r.Context(), userID, r.Header.Get("X-Device-ID"), chat, message, opts, stream.sendDelta)
+	if r.Context().Err() != nil {
+		// The client is gone, a partial response was stored for it to find
+		return
+	}
+	if err != nil {
+		stream.sendError(generationError(err))
+	}
+	if stored != nil {
+		if err := stream.send(eventMessage, stored); err != nil {
+			slog.Debug("Failed to send message event", "message_id", stored.ID, "error", err)
+		}
+	}
+}
+
+// streamGeneration streams a response of POST /api/genai without storing it
+func streamGeneration(w http.ResponseWriter, r *http.Request, userID, model, prompt string) {
+	if _, _, err := genai.Default().Resolve(model); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: err.Error(),
+		})
+		return
+	}
+
+	stream := newEventStream(w)
+
+	started := false
+	resp, err := genai.Default().Stream(r.Context(), genai.Request{Model: model, Prompt: prompt, System: plainSystemPrompt(userID)}, func(delta string) error {
+		started = true
+		return stream.sendDelta(delta)
+	})
+	if started {
+		countRequest(userID)
+	}
+	if err != nil {
+		if !errors.Is(err, context.Canceled) {
+			slog.Error("Failed to generate AI response", "error", err)
+		}
+		if r.Context().Err() == nil {
+			stream.sendError(generationError(err))
+		}
+		return
+	}
+
+	if err := stream.send(eventDone, resp); err != nil {
+		slog.Debug("Failed to send done event", "error", err)
+	}
+}
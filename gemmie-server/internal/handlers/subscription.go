@@ -2,11 +2,13 @@
 package handlers
 
 import (
+	"context"
 	"encoding/json"
 	"log"
 	"log/slog"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/SherClockHolmes/webpush-go"
 	"github.com/imrany/gemmie/gemmie-server/store"
@@ -358,3 +360,80 @@ func VerifySubscriptionHandler(w http.ResponseWriter, r *http.Request) {
 		Message: "Subscription exists",
 	})
 }
+
+// sendPushToUser delivers a notification to every device the user has subscribed,
+// pruning subscriptions the push service reports as gone
+func sendPushToUser(ctx context.Context, userID string, payload store.NotificationPayload) {
+	notifCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	subscriptions, err := store.GetSubscriptionsByUserID(notifCtx, userID)
+	if err != nil {
+		slog.Error("Failed to get subscriptions", "user_id", userID, "error", err)
+		return
+	}
+
+	if len(subscriptions) == 0 {
+		slog.Debug("No subscriptions found for user", "user_id", userID)
+		return
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		slog.Error("Failed to marshal notification payload", "user_id", userID, "error", err)
+		return
+	}
+
+	successCount := 0
+	failureCount := 0
+
+	for _, sub := range subscriptions {
+		if sub.Endpoint == "" || sub.P256dhKey == "" || sub.AuthKey == "" {
+			slog.Warn("Invalid subscription data", "user_id", userID)
+			store.DeleteSubscription(notifCtx, sub.Endpoint)
+			failureCount++
+			continue
+		}
+
+		resp, err := webpush.SendNotification(data, &webpush.Subscription{
+			Endpoint: sub.Endpoint,
+			Keys: webpush.Keys{
+				Auth:   sub.AuthKey,
+				P256dh: sub.P256dhKey,
+			},
+		}, &webpush.Options{
+			Subscriber:      viper.GetString("VAPID_EMAIL"),
+			VAPIDPublicKey:  viper.GetString("VAPID_PUBLIC_KEY"),
+			VAPIDPrivateKey: viper.GetString("VAPID_PRIVATE_KEY"),
+			TTL:             30,
+		})
+
+		if err != nil {
+			slog.Error("Failed to send push notification", "user_id", userID, "error", err.Error())
+			if resp != nil && (resp.StatusCode == http.StatusGone || resp.StatusCode == http.StatusNotFound) {
+				store.DeleteSubscription(notifCtx, sub.Endpoint)
+			}
+			failureCount++
+			continue
+		}
+
+		if resp.Body != nil {
+			resp.Body.Close()
+		}
+
+		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+			successCount++
+		} else {
+			slog.Warn("Push notification failed", "user_id", userID, "status", resp.StatusCode)
+			failureCount++
+		}
+	}
+
+	slog.Info("Push notification summary",
+		"user_id", userID,
+		"tag", payload.Tag,
+		"success", successCount,
+		"failed", failureCount,
+		"total", len(subscriptions),
+	)
+}
@@ -0,0 +1,476 @@
+package handlers
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+
+	"github.com/imrany/gemmie/gemmie-server/store"
+)
+
+const (
+	defaultSyncLimit = 500
+	maxSyncLimit     = 1000
+)
+
+// syncDeletion tells a client to drop an entity it holds
+type syncDeletion struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// syncProfile is the user profile as clients see it through sync
+func syncProfile(user *store.User) map[string]any {
+	return map[string]any{
+		"preferences":      user.Preferences,
+		"work_function":    user.WorkFunction,
+		"theme":            user.Theme,
+		"sync_enabled":     user.SyncEnabled,
+		"username":         user.Username,
+		"plan":             user.Plan,
+		"plan_name":        user.PlanName,
+		"amount":           user.Amount,
+		"duration":         user.Duration,
+		"phone_number":     user.PhoneNumber,
+		"expiry_timestamp": user.ExpiryTimestamp,
+		"expire_duration":  user.ExpireDuration,
+		"price":            user.Price,
+		"response_mode":    user.ResponseMode,
+		"email_verified":   user.EmailVerified,
+		"email_subscribed": user.EmailSubscribed,
+		"request_count":    user.RequestCount,
+		"updated_at":       user.UpdatedAt,
+	}
+}
+
+// SyncHandler handles GET and POST /api/sync
+//
+// GET without ?since returns the full profile, transactions and chats along
+// with a cursor. GET ?since=<cursor> returns only what changed after it.
+// POST merges client owned profile fields, server owned ones are ignored.
+func SyncHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	// Read the cursor before the data, so anything changed while we read is sent again next time
+	cursor, err := store.GetUserChangeSeq(userID)
+	if err != nil {
+		slog.Error("Database error", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Database error",
+		})
+		return
+	}
+
+	// Verify user exists
+	user, err := store.GetUserByID(userID)
+	if err != nil {
+		slog.Error("Database error", "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Database error",
+		})
+		return
+	}
+
+	if user == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User not found",
+		})
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		if r.URL.Query().Has("since") {
+			getSyncChanges(w, r, user, cursor)
+			return
+		}
+
+		userTranx, err := store.GetUserTransactions(user.PhoneNumber)
+		if err != nil {
+			slog.Error("Failed to get user transactions", "user_id", user.ID, "error", err)
+		}
+
+		userChats, err := store.GetChatsByUserId(user.ID)
+		if err != nil {
+			slog.Error("Failed to get user chats", "user_id", user.ID, "error", err)
+		}
+
+		data := syncProfile(user)
+		data["user_transactions"] = userTranx
+		data["chats"] = userChats
+		data["cursor"] = cursor
+
+		json.NewEncoder(w).Encode(store.Response{
+			Success: true,
+			Message: "Data retrieved successfully",
+			Data:    data,
+		})
+
+	case http.MethodPost:
+		postSyncChanges(w, r, user)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Method not allowed",
+		})
+	}
+}
+
+// getSyncChanges answers GET /api/sync?since=<cursor>&limit=<n>
+func getSyncChanges(w http.ResponseWriter, r *http.Request, user *store.User, current int64) {
+	since, err := strconv.ParseInt(r.URL.Query().Get("since"), 10, 64)
+	if err != nil || since < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "since must be a cursor returned by a previous sync",
+		})
+		return
+	}
+
+	limit := defaultSyncLimit
+	if value := r.URL.Query().Get("limit"); value != "" {
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "limit must be a positive number",
+			})
+			return
+		}
+		limit = min(limit, maxSyncLimit)
+	}
+
+	// A cursor we never handed out means the client state can't be trusted
+	if since > current {
+		w.WriteHeader(http.StatusGone)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Sync cursor is unknown, run a full sync",
+			Data:    map[string]int64{"cursor": current},
+		})
+		return
+	}
+
+	changes, err := store.GetChangesSince(user.ID, since, limit+1)
+	if err != nil {
+		slog.Error("Failed to get changes", "user_id", user.ID, "since", since, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve changes",
+		})
+		return
+	}
+
+	hasMore := len(changes) > limit
+	if hasMore {
+		changes = changes[:limit]
+	}
+
+	cursor := since
+	if len(changes) > 0 {
+		cursor = changes[len(changes)-1].Seq
+	}
+
+	changed, deleted, err := loadSyncChanges(user, changes)
+	if err != nil {
+		slog.Error("Failed to load changed entities", "user_id", user.ID, "since", since, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to retrieve changes",
+		})
+		return
+	}
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Changes retrieved successfully",
+		Data: map[string]any{
+			"cursor":   cursor,
+			"has_more": hasMore,
+			"changes":  changed,
+			"deleted":  deleted,
+		},
+	})
+}
+
+// loadSyncChanges turns change log entries into the current state of every
+// changed entity. An entity that can no longer be loaded, because it is gone
+// or the user lost access, is reported as deleted.
+func loadSyncChanges(user *store.User, changes []store.Change) (map[string]any, []syncDeletion, error) {
+	upserts := map[string][]string{}
+	deleted := []syncDeletion{}
+	for _, change := range changes {
+		if change.Op == store.ChangeOpDelete {
+			deleted = append(deleted, syncDeletion{Type: change.EntityType, ID: change.EntityId})
+			continue
+		}
+		upserts[change.EntityType] = append(upserts[change.EntityType], change.EntityId)
+	}
+
+	changed := map[string]any{}
+	missing := func(entityType string, found map[string]bool) {
+		for _, id := range upserts[entityType] {
+			if !found[id] {
+				deleted = append(deleted, syncDeletion{Type: entityType, ID: id})
+			}
+		}
+	}
+
+	if len(upserts[store.ChangeEntityUser]) > 0 {
+		changed["user"] = syncProfile(user)
+	}
+
+	if ids := upserts[store.ChangeEntityChat]; len(ids) > 0 {
+		chats, err := store.GetChatsByUserId(user.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		found := map[string]bool{}
+		list := []store.Chat{}
+		for _, chat := range chats {
+			if slices.Contains(ids, chat.ID) {
+				found[chat.ID] = true
+				list = append(list, chat)
+			}
+		}
+		changed["chats"] = list
+		missing(store.ChangeEntityChat, found)
+	}
+
+	if ids := upserts[store.ChangeEntityMessage]; len(ids) > 0 {
+		messages, err := store.GetMessagesByIDs(user.ID, ids)
+		if err != nil {
+			return nil, nil, err
+		}
+		found := map[string]bool{}
+		for _, message := range messages {
+			found[message.ID] = true
+		}
+		if messages == nil {
+			messages = []store.Message{}
+		}
+		changed["messages"] = messages
+		missing(store.ChangeEntityMessage, found)
+	}
+
+	if ids := upserts[store.ChangeEntityArcade]; len(ids) > 0 {
+		arcades, err := store.GetArcadesByUserID(user.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		found := map[string]bool{}
+		list := []*store.Arcade{}
+		for _, arcade := range arcades {
+			if slices.Contains(ids, arcade.ID) {
+				found[arcade.ID] = true
+				list = append(list, arcade)
+			}
+		}
+		changed["arcades"] = list
+		missing(store.ChangeEntityArcade, found)
+	}
+
+	if ids := upserts[store.ChangeEntityFolder]; len(ids) > 0 {
+		folders, err := store.GetFoldersByUserID(user.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		found := map[string]bool{}
+		list := []store.Folder{}
+		for _, folder := range folders {
+			if slices.Contains(ids, folder.ID) {
+				found[folder.ID] = true
+				list = append(list, folder)
+			}
+		}
+		changed["folders"] = list
+		missing(store.ChangeEntityFolder, found)
+	}
+
+	if ids := upserts[store.ChangeEntityTag]; len(ids) > 0 {
+		tags, err := store.GetTagsByUserID(user.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		found := map[string]bool{}
+		list := []store.Tag{}
+		for _, tag := range tags {
+			if slices.Contains(ids, tag.ID) {
+				found[tag.ID] = true
+				list = append(list, tag)
+			}
+		}
+		changed["tags"] = list
+		missing(store.ChangeEntityTag, found)
+	}
+
+	return changed, deleted, nil
+}
+
+// postSyncChanges answers POST /api/sync
+//
+// Only keys present in the body are written. "field_timestamps" optionally
+// maps a field name to the unix ms time the client changed it; when the
+// server holds a newer write of that field the client value loses and the
+// field is listed under "conflicts" with the server value.
+func postSyncChanges(w http.ResponseWriter, r *http.Request, user *store.User) {
+	var body map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Invalid request body",
+		})
+		return
+	}
+
+	var timestamps map[string]int64
+	if raw, ok := body["field_timestamps"]; ok {
+		if err := json.Unmarshal(raw, &timestamps); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "field_timestamps must map field names to unix milliseconds",
+			})
+			return
+		}
+		delete(body, "field_timestamps")
+	}
+
+	fields := map[string]any{}
+	ignored := []string{}
+	for name, raw := range body {
+		if _, ok := store.ClientSyncFields[name]; !ok {
+			// Plan, verification and request counts are owned by the server
+			ignored = append(ignored, name)
+			continue
+		}
+
+		var value any
+		var err error
+		if name == "sync_enabled" {
+			var enabled bool
+			err = json.Unmarshal(raw, &enabled)
+			value = enabled
+		} else {
+			var text string
+			err = json.Unmarshal(raw, &text)
+			value = text
+		}
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Invalid value for " + name,
+			})
+			return
+		}
+		fields[name] = value
+	}
+	sort.Strings(ignored)
+
+	// Sanitize inputs
+	if username, ok := fields["username"].(string); ok {
+		username = sanitizeString(username)
+		if username == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Username cannot be empty",
+			})
+			return
+		}
+		fields["username"] = username
+	}
+
+	// Preferences follow the same rules as PATCH /api/preferences
+	if problems := syncedPreferences(fields).validate(); len(problems) > 0 {
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Invalid preferences",
+			Data:    map[string]any{"errors": problems},
+		})
+		return
+	}
+
+	applied, conflicts, err := store.ApplyClientSync(user.ID, fields, timestamps)
+	if err != nil {
+		if store.IsUniqueViolation(err) {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(store.Response{
+				Success: false,
+				Message: "Username is already taken",
+			})
+			return
+		}
+		slog.Error("Failed to update user data", "user_id", user.ID, "error", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Failed to save data",
+		})
+		return
+	}
+
+	updated, err := store.GetUserByID(user.ID)
+	if err != nil || updated == nil {
+		slog.Error("Failed to reload user after sync", "user_id", user.ID, "error", err)
+		updated = user
+	}
+
+	cursor, err := store.GetUserChangeSeq(user.ID)
+	if err != nil {
+		slog.Error("Failed to get sync cursor", "user_id", user.ID, "error", err)
+	}
+
+	profile := syncProfile(updated)
+	conflicting := map[string]any{}
+	for _, name := range conflicts {
+		conflicting[name] = profile[name]
+	}
+	if applied == nil {
+		applied = []string{}
+	}
+
+	if len(ignored) > 0 {
+		slog.Warn("Ignored server owned fields in sync", "user_id", user.ID, "fields", ignored)
+	}
+
+	json.NewEncoder(w).Encode(store.Response{
+		Success: true,
+		Message: "Data synchronized successfully",
+		Data: map[string]any{
+			"cursor":     cursor,
+			"applied":    applied,
+			"conflicts":  conflicting,
+			"ignored":    ignored,
+			"updated_at": updated.UpdatedAt,
+		},
+	})
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"encoding/json"
+	"errors"
 	"log/slog"
 	"net/http"
 	"regexp"
@@ -37,29 +38,6 @@ type RegisterRequest struct {
 	UserAgent    string `json:"user_agent"`
 }
 
-// SyncRequest represents data sync request
-type SyncRequest struct {
-	Preferences       string             `json:"preferences,omitempty"`
-	WorkFunction      string             `json:"work_function,omitempty"`
-	Theme             string             `json:"theme,omitempty"`
-	SyncEnabled       bool               `json:"sync_enabled"`
-	Username          string             `json:"username"`
-	Plan              string             `json:"plan,omitempty"`
-	PlanName          string             `json:"plan_name,omitempty"`
-	ResponseMode      store.Modes        `json:"response_mode,omitempty"`
-	Amount            int                `json:"amount,omitempty"`
-	Duration          string             `json:"duration,omitempty"`
-	PhoneNumber       string             `json:"phone_number,omitempty"` // Consistent naming
-	ExpiryTimestamp   int64              `json:"expiry_timestamp,omitempty"`
-	ExpireDuration    int64              `json:"expire_duration,omitempty"`
-	Price             string             `json:"price,omitempty"`
-	ExternalReference string             `json:"external_reference,omitempty"` // For payment tracking
-	EmailVerified     bool               `json:"email_verified"`               // Whether email is verified
-	EmailSubscribed   bool               `json:"email_subscribed"`             // Whether user subscribed to promotional emails
-	RequestCount      store.RequestCount `json:"request_count"`
-	Chats             []store.Chat       `json:"chats,omitempty"`
-}
-
 // Update AuthResponse struct
 type AuthResponse struct {
 	UserID          string             `json:"user_id"`
@@ -410,219 +388,6 @@ func LoginHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// SyncHandler
-func SyncHandler(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Content-Type", "application/json")
-
-	userID := r.Header.Get("X-User-ID")
-	if userID == "" {
-		w.WriteHeader(http.StatusUnauthorized)
-		json.NewEncoder(w).Encode(store.Response{
-			Success: false,
-			Message: "User ID header required",
-		})
-		return
-	}
-
-	// Verify user exists
-	user, err := store.GetUserByID(userID)
-	if err != nil {
-		slog.Error("Database error", "error", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		json.NewEncoder(w).Encode(store.Response{
-			Success: false,
-			Message: "Database error",
-		})
-		return
-	}
-
-	if user == nil {
-		w.WriteHeader(http.StatusNotFound)
-		json.NewEncoder(w).Encode(store.Response{
-			Success: false,
-			Message: "User not found",
-		})
-		return
-	}
-
-	switch r.Method {
-	case "GET":
-		userTranx, err := store.GetUserTransactions(user.PhoneNumber)
-		if err != nil {
-			slog.Error("Failed to get user transactions", "user_id", user.ID, "error", err)
-		}
-
-		userChats, err := store.GetChatsByUserId(user.ID)
-		if err != nil {
-			slog.Error("Failed to get user chats", "user_id", user.ID, "error", err)
-		}
-
-		json.NewEncoder(w).Encode(store.Response{
-			Success: true,
-			Message: "Data retrieved successfully",
-			Data: map[string]any{
-				"preferences":       user.Preferences,
-				"work_function":     user.WorkFunction,
-				"theme":             user.Theme,
-				"sync_enabled":      user.SyncEnabled,
-				"username":          user.Username,
-				"plan":              user.Plan,
-				"plan_name":         user.PlanName,
-				"amount":            user.Amount,
-				"duration":          user.Duration,
-				"phone_number":      user.PhoneNumber,
-				"expiry_timestamp":  user.ExpiryTimestamp,
-				"expire_duration":   user.ExpireDuration,
-				"price":             user.Price,
-				"response_mode":     user.ResponseMode,
-				"email_verified":    user.EmailVerified,
-				"email_subscribed":  user.EmailSubscribed,
-				"request_count":     user.RequestCount,
-				"user_transactions": userTranx,
-				"chats":             userChats,
-			},
-		})
-
-	case "POST":
-		var req SyncRequest
-		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(store.Response{
-				Success: false,
-				Message: "Invalid request body",
-			})
-			return
-		}
-
-		// Sanitize inputs
-		req.Username = sanitizeString(req.Username)
-		req.PhoneNumber = sanitizeString(req.PhoneNumber)
-		req.Plan = sanitizeString(req.Plan)
-		req.PlanName = sanitizeString(req.PlanName)
-
-		// Validate phone number
-		if req.PhoneNumber != "" && !validatePhoneNumber(req.PhoneNumber) {
-			w.WriteHeader(http.StatusBadRequest)
-			json.NewEncoder(w).Encode(store.Response{
-				Success: false,
-				Message: "Invalid phone number format",
-			})
-			return
-		}
-
-		// Update user data in database
-		user.Preferences = req.Preferences
-		user.WorkFunction = req.WorkFunction
-		user.Theme = req.Theme
-		user.SyncEnabled = req.SyncEnabled
-		user.Username = req.Username
-		user.Plan = req.Plan
-		user.PlanName = req.PlanName
-		user.ResponseMode = req.ResponseMode
-		user.Amount = req.Amount
-		user.Duration = req.Duration
-		user.PhoneNumber = req.PhoneNumber
-		user.ExpiryTimestamp = req.ExpiryTimestamp
-		user.ExpireDuration = req.ExpireDuration
-		user.Price = req.Price
-		user.EmailVerified = req.EmailVerified
-		user.EmailSubscribed = req.EmailSubscribed
-		user.RequestCount = req.RequestCount
-
-		if err := store.UpdateUser(*user); err != nil {
-			slog.Error("Failed to update user data", "error", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(store.Response{
-				Success: false,
-				Message: "Failed to save data",
-			})
-			return
-		}
-
-		// Update user profile fields
-		if req.Username != "" {
-			user.Username = req.Username
-		}
-		if req.Preferences != "" {
-			user.Preferences = req.Preferences
-		}
-		if req.WorkFunction != "" {
-			user.WorkFunction = req.WorkFunction
-		}
-		if req.Theme != "" {
-			user.Theme = req.Theme
-		}
-
-		if user.SyncEnabled != req.SyncEnabled {
-			user.SyncEnabled = req.SyncEnabled
-		}
-
-		if req.Amount != 0 {
-			user.Amount = req.Amount
-		}
-		if req.Plan != "" {
-			user.Plan = req.Plan
-		}
-		if req.PlanName != "" {
-			user.PlanName = req.PlanName
-		}
-		if req.Duration != "" {
-			user.Duration = req.Duration
-		}
-		if req.PhoneNumber != "" {
-			user.PhoneNumber = req.PhoneNumber
-		}
-		if req.ExpiryTimestamp != 0 {
-			user.ExpiryTimestamp = req.ExpiryTimestamp
-		}
-		if req.ExpireDuration != 0 {
-			user.ExpireDuration = req.ExpireDuration
-		}
-		if req.Price != "" {
-			user.Price = req.Price
-		}
-		if req.ResponseMode != "" {
-			user.ResponseMode = req.ResponseMode
-		}
-
-		if req.RequestCount.Count != 0 || req.RequestCount.Timestamp != 0 {
-			incomingTime := time.Unix(0, req.RequestCount.Timestamp*int64(time.Millisecond))
-			existingTime := time.Unix(0, user.RequestCount.Timestamp*int64(time.Millisecond))
-
-			if incomingTime.After(existingTime) || req.RequestCount.Count != user.RequestCount.Count {
-				user.RequestCount = req.RequestCount
-			}
-		}
-
-		user.UpdatedAt = time.Now()
-
-		if err := store.UpdateUser(*user); err != nil {
-			slog.Error("Failed to update user", "error", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			json.NewEncoder(w).Encode(store.Response{
-				Success: false,
-				Message: "Failed to save user data",
-			})
-			return
-		}
-
-		json.NewEncoder(w).Encode(store.Response{
-			Success: true,
-			Message: "Data synchronized successfully",
-			Data: map[string]any{
-				"updated_at": user.UpdatedAt,
-			},
-		})
-
-	default:
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		json.NewEncoder(w).Encode(store.Response{
-			Success: false,
-			Message: "Method not allowed",
-		})
-	}
-}
-
 // ProfileHandler
 func ProfileHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
@@ -667,6 +432,11 @@ func ProfileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ifVersion, ok := ifMatchVersion(w, r, existingUser.Version)
+	if !ok {
+		return
+	}
+
 	var req ProfileUpdateRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		w.WriteHeader(http.StatusBadRequest)
@@ -727,7 +497,12 @@ func ProfileHandler(w http.ResponseWriter, r *http.Request) {
 	existingUser.UpdatedAt = time.Now()
 
 	// Save to database
-	if err := store.UpdateUser(*existingUser); err != nil {
+	version, err := store.UpdateUserIfVersion(*existingUser, ifVersion)
+	if errors.Is(err, store.ErrVersionConflict) {
+		preconditionFailed(w, 0)
+		return
+	}
+	if err != nil {
 		slog.Error("Failed to update user", "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(store.Response{
@@ -737,6 +512,7 @@ func ProfileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	w.Header().Set("ETag", versionETag(version))
 	json.NewEncoder(w).Encode(store.Response{
 		Success: true,
 		Message: "Profile updated successfully",
@@ -748,6 +524,7 @@ func ProfileHandler(w http.ResponseWriter, r *http.Request) {
 			"sync_enabled":  existingUser.SyncEnabled,
 			"phone_number":  existingUser.PhoneNumber,
 			"updated_at":    existingUser.UpdatedAt,
+			"version":       version,
 		},
 	})
 }
@@ -855,6 +632,11 @@ func DeleteAccountHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	ifVersion, ok := ifMatchVersion(w, r, user.Version)
+	if !ok {
+		return
+	}
+
 	slog.Info("Account deletion requested",
 		"user_id", userID,
 		"username", user.Username,
@@ -862,8 +644,14 @@ func DeleteAccountHandler(w http.ResponseWriter, r *http.Request) {
 		"timestamp", time.Now(),
 	)
 
-	// Delete from database (CASCADE will delete user_data)
-	if err := store.DeleteUser(userID); err != nil {
+	// Delete from database (CASCADE will delete user_data), unless the
+	// account changed since the If-Match check
+	err = store.DeleteUserIfVersion(userID, ifVersion)
+	if errors.Is(err, store.ErrVersionConflict) {
+		preconditionFailed(w, 0)
+		return
+	}
+	if err != nil {
 		slog.Error("Failed to delete user", "user_id", userID, "error", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		json.NewEncoder(w).Encode(store.Response{
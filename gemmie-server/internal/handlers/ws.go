@@ -0,0 +1,632 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/imrany/gemmie/gemmie-server/internal/encrypt"
+	"github.com/imrany/gemmie/gemmie-server/store"
+)
+
+const (
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+	wsMaxFrame   = 64 * 1024
+	wsSendBuffer = 256
+	// wsMaxGenerations is how many prompts one socket may have generating at once
+	wsMaxGenerations = 4
+	// wsMaxPending is how many unacknowledged events are kept per device
+	wsMaxPending = 100
+	// wsResumeWindow is how long a disconnected device's unacknowledged
+	// events are kept for it to reconnect
+	wsResumeWindow = 2 * time.Minute
+	// wsTypingCacheTTL is how long a socket trusts a chat's participants
+	// when relaying typing frames
+	wsTypingCacheTTL = 30 * time.Second
+
+	// wsCloseReplaced closes a socket when the same device connects again
+	wsCloseReplaced = 4000
+)
+
+// Frame types. Clients send prompt, cancel, typing and ack frames.
+const (
+	wsFramePrompt  = "prompt"  // id, chat_id, prompt, optional model, parent_id, references, history and mode
+	wsFrameCancel  = "cancel"  // id of the prompt to stop
+	wsFrameTyping  = "typing"  // chat_id and typing (default true), relayed to the chat's other participants
+	wsFrameAck     = "ack"     // event_id, acknowledges that event and every one before it
+	wsFrameReady   = "ready"   // device_id, sent once the socket is set up
+	wsFrameSearch  = "search"  // id, chat_id and the web search the response mode runs in data
+	wsFrameDelta   = "delta"   // id, chat_id and the next piece of the response in delta
+	wsFrameMessage = "message" // id, chat_id and the stored store.Message in data, last frame of a prompt
+	wsFrameError   = "error"   // message, with the id of the frame that failed when there is one
+	wsFrameEvent   = "event"   // event_id, event and data, kept until acknowledged
+)
+
+// Server events pushed to users' devices
+const (
+	wsEventMessageCreated   = "message.created"   // data is the store.Message
+	wsEventPaymentConfirmed = "payment.confirmed" // data is the store.PlanSubscription
+)
+
+// wsFrame is one JSON frame in either direction
+type wsFrame struct {
+	Type       string   `json:"type"`
+	ID         string   `json:"id,omitempty"` // chosen by the client for a prompt, echoed on its frames
+	EventID    int64    `json:"event_id,omitempty"`
+	Event      string   `json:"event,omitempty"`
+	DeviceID   string   `json:"device_id,omitempty"`
+	ChatID     string   `json:"chat_id,omitempty"`
+	UserID     string   `json:"user_id,omitempty"`
+	Prompt     string   `json:"prompt,omitempty"`
+	Model      string   `json:"model,omitempty"`
+	ParentID   string   `json:"parent_id,omitempty"`
+	References []string `json:"references,omitempty"`
+	History    *bool    `json:"history,omitempty"`
+	Mode       string   `json:"mode,omitempty"`
+	Typing     *bool    `json:"typing,omitempty"`
+	Delta      string   `json:"delta,omitempty"`
+	Message    string   `json:"message,omitempty"`
+	Data       any      `json:"data,omitempty"`
+}
+
+// wsDevice is one device of a user and the events it has not acknowledged.
+// It outlives its socket for wsResumeWindow so a reconnect gets what it missed.
+type wsDevice struct {
+	id          string
+	client      *wsClient // nil while disconnected
+	nextEventID int64
+	pending     []wsFrame
+	detachedAt  time.Time
+}
+
+// wsHub tracks the connected devices of every user
+type wsHub struct {
+	mu    sync.Mutex
+	users map[string]map[string]*wsDevice // user id, device id
+}
+
+var hub = &wsHub{users: map[string]map[string]*wsDevice{}}
+
+// attach connects a socket to its device, replacing the device's previous
+// socket, and returns the events the device still has to acknowledge
+func (h *wsHub) attach(c *wsClient) []wsFrame {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.sweep()
+
+	devices := h.users[c.userID]
+	if devices == nil {
+		devices = map[string]*wsDevice{}
+		h.users[c.userID] = devices
+	}
+	device := devices[c.deviceID]
+	if device == nil {
+		device = &wsDevice{id: c.deviceID}
+		devices[c.deviceID] = device
+	}
+
+	if device.client != nil {
+		device.client.closeWith(wsCloseReplaced, "replaced by a newer connection")
+	}
+	device.client = c
+	device.detachedAt = time.Time{}
+
+	return append([]wsFrame(nil), device.pending...)
+}
+
+// detach disconnects a socket, unless its device has moved to a newer one
+func (h *wsHub) detach(c *wsClient) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if device := h.users[c.userID][c.deviceID]; device != nil && device.client == c {
+		device.client = nil
+		device.detachedAt = time.Now()
+	}
+}
+
+// sweep forgets devices that have been disconnected past the resume window
+func (h *wsHub) sweep() {
+	cutoff := time.Now().Add(-wsResumeWindow)
+	for userID, devices := range h.users {
+		for id, device := range devices {
+			if device.client == nil && device.detachedAt.Before(cutoff) {
+				delete(devices, id)
+			}
+		}
+		if len(devices) == 0 {
+			delete(h.users, userID)
+		}
+	}
+}
+
+// ack drops the events a device acknowledged
+func (h *wsHub) ack(c *wsClient, eventID int64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	device := h.users[c.userID][c.deviceID]
+	if device == nil {
+		return
+	}
+	n := 0
+	for n < len(device.pending) && device.pending[n].EventID <= eventID {
+		n++
+	}
+	device.pending = device.pending[n:]
+}
+
+// publish sends an event to every device of the users, except the device
+// exceptDevice of exceptUser. Events are kept until the device acknowledges them.
+func (h *wsHub) publish(userIDs []string, exceptUser, exceptDevice, event string, data any) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, userID := range userIDs {
+		for _, device := range h.users[userID] {
+			if userID == exceptUser && device.id == exceptDevice {
+				continue
+			}
+
+			device.nextEventID++
+			frame := wsFrame{Type: wsFrameEvent, EventID: device.nextEventID, Event: event, Data: data}
+			device.pending = append(device.pending, frame)
+			if len(device.pending) > wsMaxPending {
+				device.pending = device.pending[len(device.pending)-wsMaxPending:]
+			}
+
+			if device.client != nil {
+				device.client.tryWrite(frame)
+			}
+		}
+	}
+}
+
+// publishMessageCreated tells the participants of a chat about a new message.
+// originDevice is the author's device that created it, which already knows.
+func publishMessageCreated(ownerID string, message store.Message, originDevice string) {
+	userIDs, err := chatParticipants(message.ChatId, ownerID)
+	if err != nil {
+		slog.Warn("Failed to get chat participants", "chat_id", message.ChatId, "error", err)
+		userIDs = []string{ownerID}
+	}
+	hub.publish(userIDs, message.AuthorId, originDevice, wsEventMessageCreated, message)
+}
+
+// publishPaymentConfirmed tells users that a plan period they paid for or
+// joined through an organization is recorded
+func publishPaymentConfirmed(userIDs []string, sub *store.PlanSubscription) {
+	hub.publish(userIDs, "", "", wsEventPaymentConfirmed, sub)
+}
+
+// chatParticipants returns the owner and members of a chat
+func chatParticipants(chatID, ownerID string) ([]string, error) {
+	members, err := store.GetChatMemberIDs(chatID)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{ownerID}, members...), nil
+}
+
+// wsClient is one open socket
+type wsClient struct {
+	conn     *websocket.Conn
+	userID   string
+	deviceID string
+	send     chan []byte
+
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+	closeCode int
+	closeText string
+
+	mu          sync.Mutex
+	generations map[string]context.CancelFunc // running prompts by frame id
+	typing      map[string]wsTypingEntry      // chat id
+}
+
+type wsTypingEntry struct {
+	participants []string // nil when the user may not type in the chat
+	expiresAt    time.Time
+}
+
+// write queues a frame, waiting while the send buffer is full. It reports
+// false once the socket is closed.
+func (c *wsClient) write(frame wsFrame) bool {
+	payload, err := json.Marshal(frame)
+	if err != nil {
+		slog.Error("Failed to encode websocket frame", "type", frame.Type, "error", err)
+		return false
+	}
+
+	select {
+	case c.send <- payload:
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
+
+// tryWrite queues a frame without waiting. A socket that cannot keep up is
+// closed, the device gets unacknowledged events again when it reconnects.
+func (c *wsClient) tryWrite(frame wsFrame) {
+	payload, err := json.Marshal(frame)
+	if err != nil {
+		slog.Error("Failed to encode websocket frame", "type", frame.Type, "error", err)
+		return
+	}
+
+	select {
+	case c.send <- payload:
+	case <-c.ctx.Done():
+	default:
+		slog.Warn("Websocket send buffer full, closing", "user_id", c.userID, "device_id", c.deviceID)
+		c.closeWith(websocket.CloseTryAgainLater, "too slow")
+	}
+}
+
+func (c *wsClient) writeError(id, message string) {
+	c.write(wsFrame{Type: wsFrameError, ID: id, Message: message})
+}
+
+// closeWith closes the socket, canceling its running prompts
+func (c *wsClient) closeWith(code int, text string) {
+	c.closeOnce.Do(func() {
+		c.closeCode = code
+		c.closeText = text
+		c.cancel()
+	})
+}
+
+// writePump is the only writer of the connection
+func (c *wsClient) writePump() {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		c.conn.Close()
+	}()
+
+	for {
+		select {
+		case payload := <-c.send:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.TextMessage, payload); err != nil {
+				c.closeWith(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-ticker.C:
+			c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := c.conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				c.closeWith(websocket.CloseAbnormalClosure, "")
+				return
+			}
+		case <-c.ctx.Done():
+			c.conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(c.closeCode, c.closeText), time.Now().Add(wsWriteWait))
+			return
+		}
+	}
+}
+
+// readPump reads frames until the socket closes
+func (c *wsClient) readPump() {
+	c.conn.SetReadLimit(wsMaxFrame)
+	c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		_, payload, err := c.conn.ReadMessage()
+		if err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				slog.Debug("Websocket closed unexpectedly", "user_id", c.userID, "device_id", c.deviceID, "error", err)
+			}
+			c.closeWith(websocket.CloseNormalClosure, "")
+			return
+		}
+
+		var frame wsFrame
+		if err := json.Unmarshal(payload, &frame); err != nil {
+			c.writeError("", "Invalid frame")
+			continue
+		}
+		c.handle(frame)
+	}
+}
+
+func (c *wsClient) handle(frame wsFrame) {
+	switch frame.Type {
+	case wsFramePrompt:
+		c.startPrompt(frame)
+	case wsFrameCancel:
+		c.mu.Lock()
+		cancel, ok := c.generations[frame.ID]
+		c.mu.Unlock()
+		if !ok {
+			c.writeError(frame.ID, "No running prompt with this id")
+			return
+		}
+		cancel()
+	case wsFrameTyping:
+		c.relayTyping(frame)
+	case wsFrameAck:
+		hub.ack(c, frame.EventID)
+	default:
+		c.writeError(frame.ID, fmt.Sprintf("Unknown frame type %q", frame.Type))
+	}
+}
+
+// startPrompt runs a prompt frame in the background, so one socket can
+// generate for several chats at once
+func (c *wsClient) startPrompt(frame wsFrame) {
+	if frame.ID == "" || frame.ChatID == "" || frame.Prompt == "" {
+		c.writeError(frame.ID, "id, chat_id and prompt are required")
+		return
+	}
+	if !validMode(store.Modes(frame.Mode)) {
+		c.writeError(frame.ID, "mode must be one of light-response, web-search or deep-search")
+		return
+	}
+
+	c.mu.Lock()
+	if _, running := c.generations[frame.ID]; running {
+		c.mu.Unlock()
+		c.writeError(frame.ID, "A prompt with this id is already running")
+		return
+	}
+	if len(c.generations) >= wsMaxGenerations {
+		c.mu.Unlock()
+		c.writeError(frame.ID, fmt.Sprintf("At most %d prompts can run at once", wsMaxGenerations))
+		return
+	}
+	ctx, cancel := context.WithCancel(c.ctx)
+	c.generations[frame.ID] = cancel
+	c.mu.Unlock()
+
+	go func() {
+		defer func() {
+			c.mu.Lock()
+			delete(c.generations, frame.ID)
+			c.mu.Unlock()
+			cancel()
+		}()
+		c.runPrompt(ctx, frame)
+	}()
+}
+
+// runPrompt generates and stores the response to a prompt frame. A canceled
+// prompt is stored as partial, like a stream whose client went away.
+func (c *wsClient) runPrompt(ctx context.Context, frame wsFrame) {
+	chat, errMessage := c.authorizeChat(frame.ChatID, store.ChatRoleEditor)
+	if chat == nil {
+		c.writeError(frame.ID, errMessage)
+		return
+	}
+
+	model, accessErr := authorizeGeneration(c.userID, generationModel(c.userID, chat, frame.Model))
+	if accessErr != nil {
+		c.write(wsFrame{Type: wsFrameError, ID: frame.ID, ChatID: chat.ID, Message: accessErr.Message, Data: accessErr.Data})
+		return
+	}
+
+	// New messages reply to the given parent, or continue the active branch
+	parentID := frame.ParentID
+	if parentID != "" {
+		parent, err := store.GetMessageById(parentID)
+		if err != nil {
+			slog.Error("Failed to get parent message", "message_id", parentID, "error", err)
+			c.writeError(frame.ID, "Failed to retrieve parent message")
+			return
+		}
+		if parent == nil || parent.ChatId != chat.ID {
+			c.writeError(frame.ID, "Parent message not found in this chat")
+			return
+		}
+	} else if len(chat.Messages) > 0 {
+		parentID = chat.Messages[len(chat.Messages)-1].ID
+	}
+
+	message := store.Message{
+		ID:         encrypt.GenerateID(nil),
+		ChatId:     chat.ID,
+		ParentId:   parentID,
+		AuthorId:   c.userID,
+		Prompt:     frame.Prompt,
+		Model:      model,
+		References: frame.References,
+	}
+
+	opts := generateOptions{
+		withHistory: frame.History == nil || *frame.History,
+		mode:        store.Modes(frame.Mode),
+		onSearch: func(query string) {
+			c.write(wsFrame{Type: wsFrameSearch, ID: frame.ID, ChatID: chat.ID, Data: map[string]string{"query": query}})
+		},
+	}
+	stored, err := generateMessage(ctx, c.userID, c.deviceID, chat, message, opts, func(delta string) error {
+		if !c.write(wsFrame{Type: wsFrameDelta, ID: frame.ID, ChatID: chat.ID, Delta: delta}) {
+			return context.Canceled
+		}
+		return nil
+	})
+	if err != nil && !errors.Is(err, context.Canceled) {
+		c.writeError(frame.ID, generationError(err))
+	}
+	if stored != nil {
+		c.write(wsFrame{Type: wsFrameMessage, ID: frame.ID, ChatID: chat.ID, Data: stored})
+	} else if errors.Is(err, context.Canceled) {
+		c.writeError(frame.ID, "Prompt canceled")
+	}
+}
+
+// authorizeChat loads a chat the user has at least minRole in, or returns
+// the error to send
+func (c *wsClient) authorizeChat(chatID, minRole string) (*store.Chat, string) {
+	chat, err := store.GetChatById(chatID)
+	if err != nil {
+		slog.Error("Failed to get chat", "chat_id", chatID, "error", err)
+		return nil, "Failed to retrieve chat"
+	}
+	if chat == nil {
+		return nil, "Chat not found"
+	}
+
+	role, err := chatRole(chat, c.userID)
+	if err != nil {
+		slog.Error("Failed to get chat role", "chat_id", chatID, "user_id", c.userID, "error", err)
+		return nil, "Failed to retrieve chat"
+	}
+	if role == "" {
+		return nil, "Chat not found"
+	}
+	if !store.ChatRoleAtLeast(role, minRole) {
+		return nil, "You don't have permission to do this in this chat"
+	}
+	return chat, ""
+}
+
+// relayTyping forwards a typing frame to the other participants of a chat
+// who are connected. Typing is not kept for later, unlike events.
+func (c *wsClient) relayTyping(frame wsFrame) {
+	if frame.ChatID == "" {
+		c.writeError(frame.ID, "chat_id is required")
+		return
+	}
+
+	c.mu.Lock()
+	entry, ok := c.typing[frame.ChatID]
+	c.mu.Unlock()
+
+	if !ok || time.Now().After(entry.expiresAt) {
+		entry = wsTypingEntry{expiresAt: time.Now().Add(wsTypingCacheTTL)}
+		chat, errMessage := c.authorizeChat(frame.ChatID, store.ChatRoleEditor)
+		if chat != nil {
+			participants, err := chatParticipants(chat.ID, chat.UserId)
+			if err != nil {
+				slog.Warn("Failed to get chat participants", "chat_id", chat.ID, "error", err)
+				c.writeError(frame.ID, "Failed to retrieve chat")
+				return
+			}
+			entry.participants = participants
+		} else {
+			c.writeError(frame.ID, errMessage)
+		}
+
+		c.mu.Lock()
+		c.typing[frame.ChatID] = entry
+		c.mu.Unlock()
+	}
+	if entry.participants == nil {
+		return
+	}
+
+	typing := frame.Typing == nil || *frame.Typing
+	relayed := wsFrame{Type: wsFrameTyping, ChatID: frame.ChatID, UserID: c.userID, Typing: &typing}
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+	for _, userID := range entry.participants {
+		for _, device := range hub.users[userID] {
+			if device.client != nil && device.client != c {
+				device.client.tryWrite(relayed)
+			}
+		}
+	}
+}
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  4096,
+	WriteBufferSize: 4096,
+	// Sockets are authorized like the rest of the API, by user id and not by
+	// cookies, so any origin may connect, matching the CORS setup
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// WebSocketHandler handles GET /api/ws, one socket per device that carries
+// prompts for any of the user's chats and pushes server events. Browsers
+// cannot set headers on a websocket, so the user id and device id may also
+// be given as the user_id and device_id query parameters.
+func WebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	userID := r.Header.Get("X-User-ID")
+	if userID == "" {
+		userID = r.URL.Query().Get("user_id")
+	}
+	if userID == "" {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "User ID header required",
+		})
+		return
+	}
+
+	user, err := store.GetUserByID(userID)
+	if err != nil || user == nil {
+		if err != nil {
+			slog.Error("Failed to get user", "user_id", userID, "error", err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(store.Response{
+			Success: false,
+			Message: "Unknown user",
+		})
+		return
+	}
+
+	deviceID := r.Header.Get("X-Device-ID")
+	if deviceID == "" {
+		deviceID = r.URL.Query().Get("device_id")
+	}
+	if deviceID == "" {
+		prefix := "dev"
+		deviceID = encrypt.GenerateID(&prefix)
+	}
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// The upgrader has already answered the request
+		slog.Warn("Websocket upgrade failed", "user_id", userID, "error", err)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c := &wsClient{
+		conn:        conn,
+		userID:      userID,
+		deviceID:    deviceID,
+		send:        make(chan []byte, wsSendBuffer),
+		ctx:         ctx,
+		cancel:      cancel,
+		closeCode:   websocket.CloseNormalClosure,
+		generations: map[string]context.CancelFunc{},
+		typing:      map[string]wsTypingEntry{},
+	}
+
+	pending := hub.attach(c)
+	defer hub.detach(c)
+
+	slog.Info("Websocket connected", "user_id", userID, "device_id", deviceID, "pending_events", len(pending))
+
+	go c.writePump()
+
+	c.write(wsFrame{Type: wsFrameReady, DeviceID: deviceID})
+	for _, frame := range pending {
+		c.write(frame)
+	}
+
+	c.readPump()
+
+	slog.Info("Websocket disconnected", "user_id", userID, "device_id", deviceID)
+}
@@ -0,0 +1,69 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+const (
+	braveBaseURL = "https://api.search.brave.com"
+	// braveMaxCount is the most results the API returns at once
+	braveMaxCount = 20
+)
+
+// brave queries the Brave Search API
+type brave struct {
+	baseURL string
+	apiKey  string
+	client  *http.Client
+}
+
+func (b *brave) Name() string {
+	return KindBrave
+}
+
+func (b *brave) Search(ctx context.Context, query string, limit int) ([]Result, error) {
+	params := url.Values{"q": {query}, "count": {strconv.Itoa(min(limit, braveMaxCount))}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.baseURL+"/res/v1/web/search?"+params.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Subscription-Token", b.apiKey)
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("brave: unexpected status %s", resp.Status)
+	}
+
+	var body struct {
+		Web struct {
+			Results []struct {
+				Title       string `json:"title"`
+				URL         string `json:"url"`
+				Description string `json:"description"`
+			} `json:"results"`
+		} `json:"web"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("brave: decode response: %w", err)
+	}
+
+	results := make([]Result, 0, min(limit, len(body.Web.Results)))
+	for _, r := range body.Web.Results {
+		if len(results) == limit {
+			break
+		}
+		results = append(results, Result{Title: r.Title, URL: r.URL, Snippet: r.Description})
+	}
+	return results, nil
+}
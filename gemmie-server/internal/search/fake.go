@@ -0,0 +1,87 @@
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+// fakeResultCount is how many results the fake makes up for a query no
+// fixture matches
+const fakeResultCount = 3
+
+// Fake answers searches without the network. Queries containing a keyword
+// of its fixtures get that keyword's results, any other query gets made up
+// results on example.com that repeat the query. The same query always gets
+// the same results.
+type Fake struct {
+	fixtures map[string][]Result // lower cased keyword to results
+}
+
+// NewFake creates a fake backend. file is an optional JSON object of
+// keywords to results, such as {"nairobi": [{"title": "...", "url": "...",
+// "snippet": "..."}]}.
+func NewFake(file string) (*Fake, error) {
+	fake := &Fake{fixtures: map[string][]Result{}}
+	if file == "" {
+		return fake, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("search backend %s: %w", KindFake, err)
+	}
+
+	var fixtures map[string][]Result
+	if err := json.Unmarshal(data, &fixtures); err != nil {
+		return nil, fmt.Errorf("search backend %s: invalid fixtures in %s: %w", KindFake, file, err)
+	}
+	for keyword, results := range fixtures {
+		fake.fixtures[strings.ToLower(keyword)] = results
+	}
+	return fake, nil
+}
+
+func (f *Fake) Name() string {
+	return KindFake
+}
+
+func (f *Fake) Search(ctx context.Context, query string, limit int) ([]Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	lower := strings.ToLower(query)
+	keywords := make([]string, 0, len(f.fixtures))
+	for keyword := range f.fixtures {
+		if strings.Contains(lower, keyword) {
+			keywords = append(keywords, keyword)
+		}
+	}
+	sort.Strings(keywords)
+
+	var results []Result
+	for _, keyword := range keywords {
+		results = append(results, f.fixtures[keyword]...)
+	}
+
+	if len(results) == 0 {
+		slug := url.PathEscape(strings.Join(strings.Fields(lower), "-"))
+		for i := 1; i <= fakeResultCount; i++ {
+			results = append(results, Result{
+				Title:   fmt.Sprintf("%s (result %d)", query, i),
+				URL:     fmt.Sprintf("https://example.com/search/%s/%d", slug, i),
+				Snippet: fmt.Sprintf("Offline result %d for %q, served by the fake search backend.", i, query),
+			})
+		}
+	}
+
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, nil
+}
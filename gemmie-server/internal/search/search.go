@@ -0,0 +1,86 @@
+// Package search looks things up on the web for responses that are grounded
+// in sources. Each search engine is a Backend, picked by SEARCH_BACKEND.
+package search
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Backend kinds
+const (
+	KindSearXNG = "searxng" // a self hosted SearXNG instance with the JSON format enabled
+	KindBrave   = "brave"   // the Brave Search API
+	KindFake    = "fake"    // canned results for offline development and testing
+)
+
+// DefaultTimeout bounds a search when its backend sets no timeout
+const DefaultTimeout = 15 * time.Second
+
+// Result is one page a search found
+type Result struct {
+	Title   string `json:"title"`
+	URL     string `json:"url"`
+	Snippet string `json:"snippet"`
+}
+
+// Backend is one search engine
+type Backend interface {
+	// Name is the backend's kind
+	Name() string
+	// Search returns at most limit results for query, best first
+	Search(ctx context.Context, query string, limit int) ([]Result, error)
+}
+
+// Config configures the search backend
+type Config struct {
+	Kind     string        // KindSearXNG, KindBrave or KindFake
+	BaseURL  string        // required for SearXNG, empty uses Brave's public API
+	APIKey   string        // required for Brave
+	Timeout  time.Duration // longest a search may take, 0 for DefaultTimeout
+	FakeFile string        // JSON results the fake serves, see NewFake
+}
+
+// New creates the backend a config describes
+func New(cfg Config) (Backend, error) {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	client := &http.Client{Timeout: cfg.Timeout}
+
+	switch cfg.Kind {
+	case KindSearXNG:
+		if cfg.BaseURL == "" {
+			return nil, fmt.Errorf("search backend %s: base URL is required", cfg.Kind)
+		}
+		return &searxng{baseURL: strings.TrimRight(cfg.BaseURL, "/"), client: client}, nil
+	case KindBrave:
+		if cfg.APIKey == "" {
+			return nil, fmt.Errorf("search backend %s: API key is required", cfg.Kind)
+		}
+		baseURL := braveBaseURL
+		if cfg.BaseURL != "" {
+			baseURL = strings.TrimRight(cfg.BaseURL, "/")
+		}
+		return &brave{baseURL: baseURL, apiKey: cfg.APIKey, client: client}, nil
+	case KindFake:
+		return NewFake(cfg.FakeFile)
+	default:
+		return nil, fmt.Errorf("unknown search backend %q", cfg.Kind)
+	}
+}
+
+var backend Backend
+
+// Configure sets the backend used by Default, nil turns search off
+func Configure(b Backend) {
+	backend = b
+}
+
+// Default returns the backend set up by Configure, nil when search is off
+func Default() Backend {
+	return backend
+}
@@ -0,0 +1,307 @@
+package seed
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/imrany/gemmie/gemmie-server/store"
+)
+
+const day = 24 * time.Hour
+
+func init() {
+	register(Scenario{
+		Name:        "empty",
+		Description: "No data, only the migrated schema",
+		run:         func(s *seeder) error { return nil },
+	})
+	register(Scenario{
+		Name:        "demo",
+		Description: "Three users with chats, an arcade, plans bought with M-Pesa and push subscriptions",
+		run:         seedDemo,
+	})
+	register(Scenario{
+		Name:        "heavy-user",
+		Description: "One Pro user with 50 chats of 100 messages each, 5000 messages in all",
+		run:         seedHeavyUser,
+	})
+	register(Scenario{
+		Name:        "expired-pro-plan",
+		Description: "A user whose week of Pro ended yesterday",
+		run:         seedExpiredProPlan,
+	})
+	register(Scenario{
+		Name:        "pending-payment",
+		Description: "A free user whose M-Pesa payment for Pro is still waiting for their PIN",
+		run:         seedPendingPayment,
+	})
+}
+
+func seedDemo(s *seeder) error {
+	amina, err := s.user(userSpec{
+		key:          "amina",
+		username:     "amina_wanjiru",
+		email:        "amina.wanjiru@example.com",
+		phone:        "254712000001",
+		workFunction: "Software engineer",
+		createdAgo:   30 * day,
+	})
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.chat(amina, 1, "Planning a weekend in Naivasha", 3*day, []turn{
+		{
+			prompt:   "I have a free weekend and want to visit Lake Naivasha from Nairobi. What should I plan for?",
+			response: "Naivasha is about a 90 minute drive from Nairobi. A relaxed weekend could be:\n\n1. **Saturday morning:** boat ride on the lake to see hippos and fish eagles.\n2. **Saturday afternoon:** walking safari on Crescent Island.\n3. **Sunday:** cycle through Hell's Gate National Park and hike the gorge.\n\nBook accommodation early on holiday weekends and carry cash for park fees.",
+		},
+		{
+			prompt:   "How much should I budget for Hell's Gate?",
+			response: "For residents, park entry is a few hundred shillings, bikes rent for around 500 to 800 Ksh at the gate, and a gorge guide is usually 1,000 to 1,500 Ksh per group. Budget roughly 3,000 Ksh per person including snacks and water.",
+		},
+	}); err != nil {
+		return err
+	}
+
+	timer, err := s.chat(amina, 2, "Pomodoro timer in plain JavaScript", 2*day, []turn{
+		{
+			prompt:   "Build me a simple pomodoro timer page with start, pause and reset buttons.",
+			response: "Here is a self contained page. It counts down 25 minutes, and the buttons start, pause and reset the countdown. Save it as an arcade to run it in the browser.",
+		},
+		{
+			prompt:   "Can it play a sound when the time is up?",
+			response: "Yes. The updated version creates a short beep with the Web Audio API when the countdown reaches zero, so no audio file is needed.",
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.arcade(amina, timer, "Pomodoro timer", "html", pomodoroHTML); err != nil {
+		return err
+	}
+
+	if _, err := s.chat(amina, 3, "Explain Go contexts", 5*time.Hour, []turn{
+		{
+			prompt:   "When should I pass a context.Context in Go?",
+			response: "Pass a context as the first argument of any function that does I/O, waits, or calls something that might. It carries cancellation and deadlines from the caller, so an HTTP handler can stop a database query when the client disconnects. Don't store contexts in structs, and use context.Background() only at the top of a program or in tests.",
+		},
+	}); err != nil {
+		return err
+	}
+
+	if err := s.pushSubscription(amina, "laptop", "Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0 Safari/537.36"); err != nil {
+		return err
+	}
+	if err := s.pushSubscription(amina, "phone", "Mozilla/5.0 (Linux; Android 14; Pixel 7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/126.0 Mobile Safari/537.36"); err != nil {
+		return err
+	}
+
+	brian, err := s.user(userSpec{
+		key:          "brian",
+		username:     "brian_otieno",
+		email:        "brian.otieno@example.com",
+		phone:        "254712000002",
+		workFunction: "Student",
+		createdAgo:   10 * day,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := s.transaction(brian, 1, 100, "Success", 2*time.Hour); err != nil {
+		return err
+	}
+	if _, err := s.chat(brian, 1, "Revision plan for exams", 90*time.Minute, []turn{
+		{
+			prompt:   "I have three weeks before my statistics exam. Help me make a revision plan.",
+			response: "Split the three weeks into: week one for going through every topic once and listing what you don't understand, week two for working past papers by topic, and week three for full timed papers and reviewing mistakes. Keep one evening a week free to catch up.",
+		},
+		{
+			prompt:   "Which topics usually carry the most marks?",
+			response: "In most introductory courses hypothesis testing, regression and probability distributions carry the most marks. Check your past papers to confirm, and weight your time towards the topics that keep coming up.",
+		},
+	}); err != nil {
+		return err
+	}
+	if err := s.pushSubscription(brian, "phone", "Mozilla/5.0 (iPhone; CPU iPhone OS 17_5 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.5 Mobile/15E148 Safari/604.1"); err != nil {
+		return err
+	}
+
+	chloe, err := s.user(userSpec{
+		key:          "chloe",
+		username:     "chloe_mutua",
+		email:        "chloe.mutua@example.com",
+		phone:        "254712000003",
+		workFunction: "Product designer",
+		createdAgo:   60 * day,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := s.transaction(chloe, 1, 500, "Success", 2*day); err != nil {
+		return err
+	}
+	_, err = s.chat(chloe, 1, "Onboarding copy review", 1*day, []turn{
+		{
+			prompt:   "Review this onboarding headline: \"Start your journey to smarter conversations today!\"",
+			response: "It is friendly but vague. Say what the user gets: \"Ask anything and get answers you can use, on every device.\" Keep the button label to a verb, like \"Start chatting\".",
+		},
+	})
+	return err
+}
+
+// heavyTopics give the heavy user's chats their titles and prompts
+var heavyTopics = []string{
+	"SQL indexing", "Kubernetes probes", "React state", "Go generics", "Rust lifetimes",
+	"Swahili phrases", "Budget tracking", "Marathon training", "Sourdough baking", "Chess openings",
+}
+
+func seedHeavyUser(s *seeder) error {
+	user, err := s.user(userSpec{
+		key:          "hana",
+		username:     "hana_kamau",
+		email:        "hana.kamau@example.com",
+		phone:        "254712000010",
+		workFunction: "Data scientist",
+		createdAgo:   365 * day,
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := s.transaction(user, 1, 500, "Success", 3*day); err != nil {
+		return err
+	}
+
+	const chats, turns = 50, 100
+	for c := 0; c < chats; c++ {
+		topic := heavyTopics[c%len(heavyTopics)]
+		conversation := make([]turn, turns)
+		for t := range conversation {
+			conversation[t] = turn{
+				prompt:   fmt.Sprintf("Question %d about %s: what is the next thing I should understand?", t+1, topic),
+				response: fmt.Sprintf("Step %d for %s: build on the previous answer with a small example, try it yourself, then ask about anything that did not behave as you expected.", t+1, topic),
+			}
+		}
+
+		title := fmt.Sprintf("%s, part %d", topic, c/len(heavyTopics)+1)
+		if _, err := s.chat(user, fmt.Sprintf("%02d", c+1), title, time.Duration(chats-c)*day, conversation); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func seedExpiredProPlan(s *seeder) error {
+	user, err := s.user(userSpec{
+		key:          "david",
+		username:     "david_kiprop",
+		email:        "david.kiprop@example.com",
+		phone:        "254712000020",
+		workFunction: "Consultant",
+		createdAgo:   45 * day,
+	})
+	if err != nil {
+		return err
+	}
+
+	// A week of Pro bought eight days ago ended yesterday
+	sub, err := s.transaction(user, 1, 500, "Success", 8*day)
+	if err != nil {
+		return err
+	}
+
+	// The period was recorded after it ended, so the plan columns still say
+	// free. Set them to what they held while it ran, as on a real account.
+	current, err := store.GetUserByID(user.ID)
+	if err != nil {
+		return err
+	}
+	current.Plan = sub.PlanKey
+	current.PlanName = sub.PlanName
+	current.Amount = sub.Amount
+	current.Duration = sub.Duration
+	current.Price = sub.Price
+	current.ExpiryTimestamp = sub.EndsAt.Unix()
+	current.ExpireDuration = int64(sub.EndsAt.Sub(sub.StartsAt).Seconds())
+	if err := store.UpdateUser(*current); err != nil {
+		return err
+	}
+
+	_, err = s.chat(user, 1, "Client proposal outline", 6*day, []turn{
+		{
+			prompt:   "Outline a proposal for a three month data migration project.",
+			response: "1. Background and goals\n2. Current systems and data volumes\n3. Approach: assessment, pilot migration, full migration, cut over\n4. Timeline by month with milestones\n5. Risks and how each is handled\n6. Team and responsibilities\n7. Costs and payment schedule",
+		},
+	})
+	return err
+}
+
+func seedPendingPayment(s *seeder) error {
+	user, err := s.user(userSpec{
+		key:          "esther",
+		username:     "esther_njeri",
+		email:        "esther.njeri@example.com",
+		phone:        "254712000030",
+		workFunction: "Teacher",
+		createdAgo:   7 * day,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Transactions without a receipt share the empty receipt number, so this
+	// is the only scenario that writes one
+	if _, err := s.transaction(user, 1, 500, "Pending", 10*time.Minute); err != nil {
+		return err
+	}
+
+	_, err = s.chat(user, 1, "Lesson plan on fractions", 1*day, []turn{
+		{
+			prompt:   "Give me a 40 minute lesson plan introducing fractions to ten year olds.",
+			response: "Start with 5 minutes sharing a chapati into equal pieces, then 15 minutes naming halves, quarters and thirds with paper folding, 15 minutes of pair work comparing fractions, and 5 minutes of exit questions to check understanding.",
+		},
+	})
+	return err
+}
+
+const pomodoroHTML = `<!DOCTYPE html>
+<html>
+<head>
+  <title>Pomodoro</title>
+  <style>
+    body { font-family: sans-serif; text-align: center; margin-top: 20vh; }
+    #time { font-size: 4rem; }
+    button { font-size: 1rem; margin: 0 .25rem; }
+  </style>
+</head>
+<body>
+  <div id="time">25:00</div>
+  <button id="start">Start</button>
+  <button id="pause">Pause</button>
+  <button id="reset">Reset</button>
+  <script>
+    let remaining = 25 * 60, timer = null;
+    const show = () => {
+      const m = String(Math.floor(remaining / 60)).padStart(2, "0");
+      const s = String(remaining % 60).padStart(2, "0");
+      document.getElementById("time").textContent = m + ":" + s;
+    };
+    const beep = () => {
+      const ctx = new AudioContext(), osc = ctx.createOscillator();
+      osc.connect(ctx.destination);
+      osc.start();
+      osc.stop(ctx.currentTime + 0.5);
+    };
+    document.getElementById("start").onclick = () => {
+      if (timer) return;
+      timer = setInterval(() => {
+        remaining--;
+        show();
+        if (remaining === 0) { clearInterval(timer); timer = null; beep(); }
+      }, 1000);
+    };
+    document.getElementById("pause").onclick = () => { clearInterval(timer); timer = null; };
+    document.getElementById("reset").onclick = () => { clearInterval(timer); timer = null; remaining = 25 * 60; show(); };
+  </script>
+</body>
+</html>
+`
@@ -0,0 +1,313 @@
+// Package seed fills a development database with named scenarios. Everything
+// is written through the store API, and ids, names and content are fixed so
+// two runs of a scenario give the same data for tests and screenshots.
+// Timestamps are relative to the hour the scenario runs in.
+package seed
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/imrany/gemmie/gemmie-server/internal/encrypt"
+	"github.com/imrany/gemmie/gemmie-server/store"
+)
+
+// Password is the password of every seeded user
+const Password = "gemmie-seed"
+
+// Options changes how a scenario is seeded
+type Options struct {
+	// Reset deletes the scenario's users and transactions before seeding
+	// them again, otherwise an already seeded scenario is an error
+	Reset bool
+}
+
+// Scenario is a named set of seed data
+type Scenario struct {
+	Name        string
+	Description string
+	run         func(s *seeder) error
+}
+
+var scenarios = map[string]Scenario{}
+
+func register(scenario Scenario) {
+	scenarios[scenario.Name] = scenario
+}
+
+// Scenarios lists the scenarios by name
+func Scenarios() []Scenario {
+	all := make([]Scenario, 0, len(scenarios))
+	for _, scenario := range scenarios {
+		all = append(all, scenario)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Name < all[j].Name })
+	return all
+}
+
+// Stats counts what a scenario wrote
+type Stats struct {
+	Users             int
+	Chats             int
+	Messages          int
+	Arcades           int
+	Transactions      int
+	PushSubscriptions int
+}
+
+// Run seeds a scenario into the database opened by store.InitStorage
+func Run(name string, opts Options) (*Stats, error) {
+	scenario, ok := scenarios[name]
+	if !ok {
+		names := make([]string, 0, len(scenarios))
+		for _, s := range Scenarios() {
+			names = append(names, s.Name)
+		}
+		return nil, fmt.Errorf("unknown scenario %q, use one of: %s", name, strings.Join(names, ", "))
+	}
+
+	s := &seeder{
+		scenario: name,
+		reset:    opts.Reset,
+		now:      time.Now().Truncate(time.Hour),
+		stats:    &Stats{},
+	}
+	if err := scenario.run(s); err != nil {
+		return s.stats, fmt.Errorf("seed %s: %w", name, err)
+	}
+	return s.stats, nil
+}
+
+// seeder writes the rows of one scenario run
+type seeder struct {
+	scenario string
+	reset    bool
+	now      time.Time
+	stats    *Stats
+}
+
+// id builds a deterministic id. Seeded ids all contain "seed" so they are
+// easy to find, and the scenario so scenarios can be seeded side by side.
+func (s *seeder) id(prefix string, parts ...any) string {
+	id := fmt.Sprintf("%s_seed_%s", prefix, strings.ReplaceAll(s.scenario, "-", "_"))
+	for _, part := range parts {
+		id += fmt.Sprintf("_%v", part)
+	}
+	return id
+}
+
+// ago returns a time before the scenario's hour
+func (s *seeder) ago(d time.Duration) time.Time {
+	return s.now.Add(-d)
+}
+
+type userSpec struct {
+	key          string
+	username     string
+	email        string
+	phone        string
+	workFunction string
+	createdAgo   time.Duration
+}
+
+// user creates a user on the free plan, plans are bought with transaction
+func (s *seeder) user(spec userSpec) (*store.User, error) {
+	id := s.id("user", spec.key)
+
+	existing, err := store.GetUserByID(id)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		if !s.reset {
+			return nil, fmt.Errorf("user %s is already seeded, run again with --reset to recreate it", id)
+		}
+		// Chats, messages, arcades, subscriptions and push subscriptions go with the user
+		if err := store.DeleteUser(id); err != nil {
+			return nil, err
+		}
+	}
+
+	createdAt := s.ago(spec.createdAgo)
+	user := store.User{
+		ID:              id,
+		Username:        spec.username,
+		Email:           spec.email,
+		PasswordHash:    encrypt.HashCredentials(spec.username, spec.email, Password),
+		CreatedAt:       createdAt,
+		UpdatedAt:       createdAt,
+		WorkFunction:    spec.workFunction,
+		Theme:           "system",
+		SyncEnabled:     true,
+		Plan:            "free",
+		PlanName:        "Free",
+		PhoneNumber:     spec.phone,
+		ResponseMode:    store.ModesLightResponse,
+		AgreeToTerms:    true,
+		EmailVerified:   true,
+		EmailSubscribed: true,
+		RequestCount: store.RequestCount{
+			Timestamp: createdAt.UnixMilli(),
+		},
+	}
+	if err := store.CreateUser(user); err != nil {
+		return nil, err
+	}
+
+	s.stats.Users++
+	return &user, nil
+}
+
+// turn is one prompt and its response
+type turn struct {
+	prompt   string
+	response string
+}
+
+// chat creates a chat with a linear conversation, one turn every few minutes
+// starting at startedAgo
+func (s *seeder) chat(user *store.User, key any, title string, startedAgo time.Duration, turns []turn) (*store.Chat, error) {
+	createdAt := s.ago(startedAgo)
+	chat := store.Chat{
+		ID:            s.id("chat", user.Username, key),
+		UserId:        user.ID,
+		Title:         title,
+		CreatedAt:     createdAt,
+		UpdatedAt:     createdAt,
+		LastMessageAt: createdAt,
+		IsPrivate:     true,
+	}
+	if err := store.CreateChat(chat); err != nil {
+		return nil, err
+	}
+	s.stats.Chats++
+
+	parentID := ""
+	for i, t := range turns {
+		message := store.Message{
+			ID:        s.id("msg", user.Username, key, fmt.Sprintf("%04d", i+1)),
+			ChatId:    chat.ID,
+			ParentId:  parentID,
+			AuthorId:  user.ID,
+			Prompt:    t.prompt,
+			Response:  t.response,
+			CreatedAt: createdAt.Add(time.Duration(i) * 3 * time.Minute),
+			Model:     "gemini-2.5-flash",
+		}
+		if err := store.CreateMessage(message); err != nil {
+			return nil, err
+		}
+		parentID = message.ID
+		s.stats.Messages++
+	}
+
+	return &chat, nil
+}
+
+// arcade saves code generated in a chat, arcades share the id of their chat
+func (s *seeder) arcade(user *store.User, chat *store.Chat, label, codeType, code string) error {
+	arcade := store.Arcade{
+		ID:          chat.ID,
+		UserId:      user.ID,
+		Label:       label,
+		Description: "Generated in " + chat.Title,
+		CodeType:    codeType,
+		Code:        code,
+		CreatedAt:   chat.CreatedAt.Format(time.RFC3339),
+	}
+	if _, err := store.CreateArcade(&arcade); err != nil {
+		return err
+	}
+	s.stats.Arcades++
+	return nil
+}
+
+// plans describes the paid plans by amount, as handlers.planConfigs does
+var plans = map[int]struct {
+	key, name, price, duration string
+	length                     time.Duration
+}{
+	50:  {"student", "Student Plan", "50 Ksh", "5 hours", 5 * time.Hour},
+	100: {"hobbyist", "Hobbyist Plan", "100 Ksh", "24 hours", 24 * time.Hour},
+	500: {"pro", "Pro Plan", "500 Ksh", "1 week", 7 * 24 * time.Hour},
+}
+
+// transaction records an M-Pesa payment the way the PayHero callback does. A
+// successful one also records the plan period it paid for.
+func (s *seeder) transaction(user *store.User, key any, amount int, status string, paidAgo time.Duration) (*store.PlanSubscription, error) {
+	id := s.id("tx", user.Username, key)
+	if s.reset {
+		if err := store.DeleteTransaction(id); err != nil {
+			return nil, err
+		}
+	}
+
+	paidAt := s.ago(paidAgo)
+	tx := store.Transaction{
+		ID:                id,
+		ExternalReference: fmt.Sprintf("%s-%d", user.Username, paidAt.Unix()),
+		CheckoutRequestID: strings.ToUpper(s.id("ws_co", key)),
+		MerchantRequestID: strings.ToUpper(s.id("mr", key)),
+		Amount:            amount,
+		PhoneNumber:       user.PhoneNumber,
+		Status:            status,
+		CreatedAt:         paidAt,
+		UpdatedAt:         paidAt,
+	}
+	switch status {
+	case "Success":
+		tx.MpesaReceiptNumber = strings.ToUpper(strings.ReplaceAll(strings.TrimPrefix(id, "tx_"), "_", ""))
+		tx.ResultDescription = "The service request is processed successfully."
+	case "Pending":
+		tx.ResultCode = -1
+		tx.ResultDescription = "Waiting for the customer to enter their M-Pesa PIN."
+	default:
+		tx.ResultCode = 1032
+		tx.ResultDescription = "Request cancelled by user."
+	}
+	if err := store.CreateTransaction(tx); err != nil {
+		return nil, err
+	}
+	s.stats.Transactions++
+
+	if status != "Success" {
+		return nil, nil
+	}
+
+	plan, ok := plans[amount]
+	if !ok {
+		return nil, fmt.Errorf("no plan costs %d", amount)
+	}
+	sub, _, err := store.CreatePlanSubscription(store.PlanSubscription{
+		ID:             s.id("sub", user.Username, key),
+		UserId:         user.ID,
+		TransactionRef: tx.ExternalReference,
+		PlanKey:        plan.key,
+		PlanName:       plan.name,
+		Amount:         amount,
+		Price:          plan.price,
+		Duration:       plan.duration,
+		PhoneNumber:    user.PhoneNumber,
+		StartsAt:       paidAt,
+		EndsAt:         paidAt.Add(plan.length),
+	})
+	return sub, err
+}
+
+// pushSubscription registers a browser for push notifications. The endpoint
+// is not a real push service, sends to it fail and are logged.
+func (s *seeder) pushSubscription(user *store.User, device, userAgent string) error {
+	var sub store.SubscriptionRequest
+	sub.Endpoint = fmt.Sprintf("https://push.example.com/send/%s", s.id("push", user.Username, device))
+	sub.Keys.P256dh = "BNcRdreALRFXTkOOUHK1EtK2wtaz5Ry4YfYCA_0QTpQtUbVlUls0VJXg7A8u-Ts1XbjhazAkj7I99e8QcYP7DkM"
+	sub.Keys.Auth = "tBHItJI5svbpez7KI4CCXg"
+
+	if err := store.SaveSubscription(context.Background(), user.ID, sub, userAgent); err != nil {
+		return err
+	}
+	s.stats.PushSubscriptions++
+	return nil
+}
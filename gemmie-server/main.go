@@ -1,21 +1,33 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"syscall"
+	"text/tabwriter"
 	"time"
 
+	"github.com/imrany/gemmie/gemmie-server/internal/genai"
 	v1 "github.com/imrany/gemmie/gemmie-server/internal/handlers"
 	"github.com/imrany/gemmie/gemmie-server/internal/handlers/public"
+	"github.com/imrany/gemmie/gemmie-server/internal/search"
+	"github.com/imrany/gemmie/gemmie-server/internal/seed"
 	"github.com/imrany/gemmie/gemmie-server/store"
 	"github.com/imrany/whats-email/pkg/mailer"
 	"github.com/imrany/whats-email/pkg/whatsapp"
 
+	"github.com/golang-migrate/migrate/v4/source"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
@@ -69,6 +81,20 @@ func (lrw *loggingResponseWriter) WriteHeader(code int) {
 	lrw.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap lets http.ResponseController reach the connection, for streaming
+func (lrw *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return lrw.ResponseWriter
+}
+
+// Hijack hands the connection over to websocket upgrades
+func (lrw *loggingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	conn, rw, err := http.NewResponseController(lrw.ResponseWriter).Hijack()
+	if err == nil {
+		lrw.statusCode = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
 // loggingMiddleware logs method, path, query, status, duration, and remote IP for each request.
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -157,6 +183,33 @@ func runServer() {
 
 	slog.Info("Database storage initialized successfully")
 
+	if err := initEncryption(); err != nil {
+		slog.Error("Failed to initialize encryption", "error", err)
+		os.Exit(1)
+	}
+
+	if err := initProviders(); err != nil {
+		slog.Error("Failed to initialize LLM providers", "error", err)
+		os.Exit(1)
+	}
+
+	if err := initSearch(); err != nil {
+		slog.Error("Failed to initialize search backend", "error", err)
+		os.Exit(1)
+	}
+
+	// Remove expired data exports in background
+	v1.StartDataExportCleanup(time.Hour)
+
+	// Forget idempotency keys past their retention window
+	v1.StartIdempotencyKeyCleanup(time.Hour)
+
+	// Move users off plan periods that have ended
+	v1.StartPlanSubscriptionExpiry(10 * time.Minute)
+
+	// Delete chats past their owner's retention
+	v1.StartRetentionPurge(time.Hour)
+
 	// Router setup
 	r := mux.NewRouter()
 
@@ -167,9 +220,19 @@ func runServer() {
 	r.HandleFunc("/api/health", v1.HealthHandler).Methods(http.MethodGet)
 	r.HandleFunc("/api/delete_account", v1.DeleteAccountHandler).Methods(http.MethodDelete)
 	r.HandleFunc("/api/profile", v1.ProfileHandler)
+	r.HandleFunc("/api/preferences", v1.PreferencesHandler).Methods(http.MethodGet, http.MethodPatch)
+	r.HandleFunc("/api/retention", v1.RetentionHandler).Methods(http.MethodGet, http.MethodPut)
+
+	// Account data export routes
+	r.HandleFunc("/api/exports", func(w http.ResponseWriter, r *http.Request) {
+		v1.RequestDataExportHandler(w, r, smtpConfig)
+	}).Methods(http.MethodPost)
+	r.HandleFunc("/api/exports", v1.GetDataExportsHandler).Methods(http.MethodGet)
+	r.HandleFunc("/api/exports/{id}", v1.GetDataExportHandler).Methods(http.MethodGet)
+	r.HandleFunc("/api/exports/{id}/download", v1.DownloadDataExportHandler).Methods(http.MethodGet)
 
 	// Chat routes
-	r.HandleFunc("/api/chats", v1.CreateChatHandler).Methods(http.MethodPost)
+	r.HandleFunc("/api/chats", v1.Idempotent(v1.CreateChatHandler)).Methods(http.MethodPost)
 	r.HandleFunc("/api/chats", v1.GetChatsHandler).Methods(http.MethodGet)
 	r.HandleFunc("/api/chats", v1.DeleteAllChatsHandler).Methods(http.MethodDelete)
 	r.HandleFunc("/api/chats/{id}", v1.GetChatHandler).Methods(http.MethodGet)
@@ -184,17 +247,70 @@ func runServer() {
 	r.HandleFunc("/api/arcades/{id}", v1.DeleteArcadeHandler).Methods(http.MethodDelete)
 
 	// Message routes
-	r.HandleFunc("/api/chats/{id}/messages", v1.CreateMessageHandler).Methods(http.MethodPost)
+	r.HandleFunc("/api/chats/{id}/messages", v1.Idempotent(v1.CreateMessageHandler)).Methods(http.MethodPost)
+	r.HandleFunc("/api/chats/{id}/messages", v1.GetChatMessagesHandler).Methods(http.MethodGet)
 	r.HandleFunc("/api/chats/{id}/messages", v1.UpdateMessageHandler).Methods(http.MethodPut)
+	r.HandleFunc("/api/chats/{id}/branch", v1.SetActiveBranchHandler).Methods(http.MethodPut)
+	r.HandleFunc("/api/chats/{id}/folder", v1.OrganizeChatHandler).Methods(http.MethodPut)
+	r.HandleFunc("/api/chats/{id}/tags", v1.OrganizeChatHandler).Methods(http.MethodPut)
+	r.HandleFunc("/api/chats/{id}/pin", v1.OrganizeChatHandler).Methods(http.MethodPut)
+	r.HandleFunc("/api/chats/{id}/retention", v1.ChatRetentionHandler).Methods(http.MethodPut)
+	r.HandleFunc("/api/chats/{id}/persona", v1.ChatPersonaHandler).Methods(http.MethodPut)
+	r.HandleFunc("/api/chats/{id}/model", v1.ChatModelHandler).Methods(http.MethodPut)
+
+	r.HandleFunc("/api/chats/{id}/shares", v1.ChatSharesHandler).Methods(http.MethodPost, http.MethodGet)
+	r.HandleFunc("/api/chats/{id}/shares/{share_id}", v1.RevokeChatShareHandler).Methods(http.MethodDelete)
+
+	r.HandleFunc("/api/chats/{id}/members", v1.ChatMembersHandler).Methods(http.MethodGet)
+	r.HandleFunc("/api/chats/{id}/members/{user_id}", v1.ChatMemberHandler).Methods(http.MethodPut, http.MethodDelete)
+	r.HandleFunc("/api/chats/{id}/invitations", v1.InviteChatMemberHandler).Methods(http.MethodPost)
+	r.HandleFunc("/api/chats/{id}/invitations/{invitation_id}", v1.CancelChatInvitationHandler).Methods(http.MethodDelete)
+	r.HandleFunc("/api/invitations", v1.GetInvitationsHandler).Methods(http.MethodGet)
+	r.HandleFunc("/api/invitations/{id}/accept", v1.RespondInvitationHandler).Methods(http.MethodPost)
+	r.HandleFunc("/api/invitations/{id}/decline", v1.RespondInvitationHandler).Methods(http.MethodPost)
+
+	// Organization routes, a team sharing one plan and a chat space
+	r.HandleFunc("/api/organizations", v1.OrganizationsHandler).Methods(http.MethodPost, http.MethodGet)
+	r.HandleFunc("/api/organizations/{id}", v1.OrganizationHandler).Methods(http.MethodGet, http.MethodPut, http.MethodDelete)
+	r.HandleFunc("/api/organizations/{id}/members", v1.OrganizationMembersHandler).Methods(http.MethodGet)
+	r.HandleFunc("/api/organizations/{id}/members/{user_id}", v1.OrganizationMemberHandler).Methods(http.MethodPut, http.MethodDelete)
+	r.HandleFunc("/api/organizations/{id}/invitations", v1.InviteOrganizationMemberHandler).Methods(http.MethodPost)
+	r.HandleFunc("/api/organizations/{id}/invitations/{invitation_id}", v1.CancelOrganizationInvitationHandler).Methods(http.MethodDelete)
+	r.HandleFunc("/api/organizations/{id}/chats", v1.OrganizationChatsHandler).Methods(http.MethodPost, http.MethodGet)
+	r.HandleFunc("/api/organizations/{id}/chats/{chat_id}", v1.OrganizationChatHandler).Methods(http.MethodDelete)
+	r.HandleFunc("/api/organizations/{id}/usage", v1.OrganizationUsageHandler).Methods(http.MethodGet)
+	r.HandleFunc("/api/organizations/{id}/subscriptions", v1.GetOrganizationPlanSubscriptionsHandler).Methods(http.MethodGet)
+	r.HandleFunc("/api/organization-invitations", v1.GetOrganizationInvitationsHandler).Methods(http.MethodGet)
+	r.HandleFunc("/api/organization-invitations/{id}/accept", v1.RespondOrganizationInvitationHandler).Methods(http.MethodPost)
+	r.HandleFunc("/api/organization-invitations/{id}/decline", v1.RespondOrganizationInvitationHandler).Methods(http.MethodPost)
+
+	// Public share links, no login required
+	r.HandleFunc("/s/{token}", v1.SharedChatHandler).Methods(http.MethodGet, http.MethodPost)
+
+	// Folder and tag routes
+	r.HandleFunc("/api/folders", v1.FoldersHandler).Methods(http.MethodPost, http.MethodGet)
+	r.HandleFunc("/api/folders/{id}", v1.FolderHandler).Methods(http.MethodGet, http.MethodPut, http.MethodDelete)
+	r.HandleFunc("/api/tags", v1.TagsHandler).Methods(http.MethodPost, http.MethodGet)
+	r.HandleFunc("/api/tags/{id}", v1.TagHandler).Methods(http.MethodPut, http.MethodDelete)
+	r.HandleFunc("/api/personas", v1.PersonasHandler).Methods(http.MethodPost, http.MethodGet)
+	r.HandleFunc("/api/personas/{id}", v1.PersonaHandler).Methods(http.MethodGet, http.MethodPut, http.MethodDelete)
+	r.HandleFunc("/api/system-prompt", v1.SystemPromptHandler).Methods(http.MethodGet)
+	r.HandleFunc("/api/models", v1.ModelsHandler).Methods(http.MethodGet)
+	r.HandleFunc("/api/messages/{id}", v1.UpdateMessageHandler).Methods(http.MethodPut)
 	r.HandleFunc("/api/messages/{id}", v1.DeleteMessageHandler).Methods(http.MethodDelete)
+	r.HandleFunc("/api/messages/{id}/versions", v1.GetMessageVersionsHandler).Methods(http.MethodGet)
+	r.HandleFunc("/api/messages/{id}/regenerate", v1.RegenerateMessageHandler).Methods(http.MethodPost)
+	r.HandleFunc("/api/messages/{id}/branch", v1.BranchMessageHandler).Methods(http.MethodPost)
+	r.HandleFunc("/api/messages/{id}/versions/{version_id}/restore", v1.RestoreMessageVersionHandler).Methods(http.MethodPost)
 
 	// Errors Handler - stores user errors for later support and fix
 	r.HandleFunc("/api/errors", v1.ErrorsHandler).Methods(http.MethodPost, http.MethodGet, http.MethodDelete)
 	r.HandleFunc("/api/errors/{id}", v1.ErrorHandler).Methods(http.MethodDelete, http.MethodGet, http.MethodPut)
 
 	// Payment routes
-	r.HandleFunc("/api/payments/stk", v1.SendSTKHandler).Methods(http.MethodPost)
+	r.HandleFunc("/api/payments/stk", v1.Idempotent(v1.SendSTKHandler)).Methods(http.MethodPost)
 	r.HandleFunc("/api/transactions", v1.GetTransactionsHandler).Methods(http.MethodGet)
+	r.HandleFunc("/api/subscriptions", v1.GetPlanSubscriptionsHandler).Methods(http.MethodGet)
 	r.HandleFunc("/api/transactions/{external_reference}", v1.GetTransactionByRefHandler).Methods(http.MethodGet)
 	r.HandleFunc("/api/callback", v1.StoreTransactionHandler).Methods(http.MethodPost)
 
@@ -207,6 +323,7 @@ func runServer() {
 
 	// genai routes
 	r.HandleFunc("/api/genai", v1.GenerateAIResponseHandler).Methods(http.MethodPost)
+	r.HandleFunc("/api/ws", v1.WebSocketHandler).Methods(http.MethodGet)
 
 	// Email management routes
 	r.HandleFunc("/unsubscribe", v1.UnsubscribeHandler).Methods(http.MethodGet, http.MethodPost)
@@ -236,11 +353,12 @@ func runServer() {
 
 	// CORS middleware
 	corsOptions := handlers.AllowedOrigins([]string{"*"})
-	corsMethods := handlers.AllowedMethods([]string{"GET", "POST", "PUT", "DELETE", "OPTIONS"})
-	corsHeaders := handlers.AllowedHeaders([]string{"Content-Type", "X-User-ID", "Authorization"})
+	corsMethods := handlers.AllowedMethods([]string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"})
+	corsHeaders := handlers.AllowedHeaders([]string{"Content-Type", "X-User-ID", "Authorization", "X-Share-Password", "If-Match", "If-None-Match", "Idempotency-Key", "X-Device-ID"})
+	corsExposed := handlers.ExposedHeaders([]string{"ETag", "Idempotent-Replayed"})
 	corsCredentials := handlers.AllowCredentials()
 
-	handler := handlers.CORS(corsOptions, corsMethods, corsHeaders, corsCredentials)(r)
+	handler := handlers.CORS(corsOptions, corsMethods, corsHeaders, corsExposed, corsCredentials)(r)
 	handler = loggingMiddleware(handler)
 
 	// HTTP server
@@ -278,6 +396,553 @@ func runServer() {
 	}
 }
 
+// initEncryption loads the master keys used to encrypt content at rest
+func initEncryption() error {
+	var previous []string
+	if keys := viper.GetString("ENCRYPTION_PREVIOUS_KEYS"); keys != "" {
+		previous = strings.Split(keys, ",")
+	}
+
+	if err := store.InitEncryption(viper.GetString("ENCRYPTION_MASTER_KEY"), previous); err != nil {
+		return err
+	}
+
+	if store.EncryptionEnabled() {
+		slog.Info("Encryption at rest enabled", "master_key_id", store.MasterKeyID())
+	} else {
+		slog.Warn("ENCRYPTION_MASTER_KEY not set, message and arcade content is stored unencrypted")
+	}
+	return nil
+}
+
+// initProviders registers the LLM providers that have credentials configured.
+// Gemini, OpenAI and Anthropic read <KIND>_API_KEY, <KIND>_BASE_URL,
+// <KIND>_TIMEOUT, <KIND>_MODELS, <KIND>_CONTEXT_WINDOW and <KIND>_COST_TIER, and every name listed in
+// OPENAI_COMPATIBLE_PROVIDERS reads the same keys under its own upper cased
+// name.
+func initProviders() error {
+	defaultModel := viper.GetString("MODEL")
+	legacyProvider, _ := genai.ParseModelID(defaultModel)
+
+	var configs []genai.ProviderConfig
+	for _, kind := range []string{genai.KindGemini, genai.KindOpenAI, genai.KindAnthropic} {
+		cfg, err := providerConfig(kind, kind)
+		if err != nil {
+			return err
+		}
+		// API_KEY predates per provider keys and belongs to the provider of MODEL
+		if cfg.APIKey == "" && kind == legacyProvider {
+			cfg.APIKey = viper.GetString("API_KEY")
+		}
+		if cfg.APIKey == "" {
+			continue
+		}
+		configs = append(configs, cfg)
+	}
+
+	for _, name := range strings.Split(viper.GetString("OPENAI_COMPATIBLE_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		cfg, err := providerConfig(name, genai.KindOpenAICompatible)
+		if err != nil {
+			return err
+		}
+		configs = append(configs, cfg)
+	}
+
+	if err := genai.Configure(defaultModel, configs...); err != nil {
+		return err
+	}
+
+	for _, cfg := range configs {
+		slog.Info("LLM provider registered", "provider", cfg.Name, "kind", cfg.Kind)
+	}
+	if len(configs) == 0 {
+		slog.Warn("No LLM provider configured, AI responses are unavailable")
+	}
+	return nil
+}
+
+// initSearch sets up the search backend of the web-search and deep-search
+// response modes from SEARCH_BACKEND and its SEARCH_* settings. Without a
+// backend those modes answer without searching.
+func initSearch() error {
+	kind := strings.ToLower(strings.TrimSpace(viper.GetString("SEARCH_BACKEND")))
+	if kind == "" {
+		search.Configure(nil)
+		slog.Warn("No search backend configured, web-search and deep-search answer without searching")
+		return nil
+	}
+
+	cfg := search.Config{
+		Kind:     kind,
+		BaseURL:  viper.GetString("SEARCH_BASE_URL"),
+		APIKey:   viper.GetString("SEARCH_API_KEY"),
+		FakeFile: viper.GetString("SEARCH_FAKE_FILE"),
+	}
+	if timeout := viper.GetString("SEARCH_TIMEOUT"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return fmt.Errorf("invalid SEARCH_TIMEOUT %q: %w", timeout, err)
+		}
+		cfg.Timeout = d
+	}
+
+	backend, err := search.New(cfg)
+	if err != nil {
+		return err
+	}
+	search.Configure(backend)
+
+	slog.Info("Search backend configured", "backend", backend.Name())
+	return nil
+}
+
+// providerConfig reads the settings of one provider from its environment keys
+func providerConfig(name, kind string) (genai.ProviderConfig, error) {
+	prefix := strings.ToUpper(strings.ReplaceAll(name, "-", "_")) + "_"
+	cfg := genai.ProviderConfig{
+		Name:     name,
+		Kind:     kind,
+		APIKey:   viper.GetString(prefix + "API_KEY"),
+		BaseURL:  viper.GetString(prefix + "BASE_URL"),
+		CostTier: strings.ToLower(viper.GetString(prefix + "COST_TIER")),
+	}
+
+	if timeout := viper.GetString(prefix + "TIMEOUT"); timeout != "" {
+		d, err := time.ParseDuration(timeout)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid %sTIMEOUT %q: %w", prefix, timeout, err)
+		}
+		cfg.Timeout = d
+	}
+
+	if window := viper.GetString(prefix + "CONTEXT_WINDOW"); window != "" {
+		n, err := strconv.Atoi(window)
+		if err != nil || n <= 0 {
+			return cfg, fmt.Errorf("invalid %sCONTEXT_WINDOW %q, expected a number of tokens", prefix, window)
+		}
+		cfg.ContextWindow = n
+	}
+
+	for _, model := range strings.Split(viper.GetString(prefix+"MODELS"), ",") {
+		if model = strings.TrimSpace(model); model != "" {
+			cfg.Models = append(cfg.Models, model)
+		}
+	}
+	return cfg, nil
+}
+
+// runReencrypt rewrites stored content with the current encryption keys
+func runReencrypt(opts store.ReencryptOptions) {
+	if err := store.InitStorage(viper.GetString("DSN")); err != nil {
+		slog.Error("Failed to initialize database", "error", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+
+	if err := initEncryption(); err != nil {
+		slog.Error("Failed to initialize encryption", "error", err)
+		os.Exit(1)
+	}
+
+	stats, err := store.Reencrypt(opts)
+	if stats != nil {
+		slog.Info("Re-encryption summary",
+			"rewrapped_keys", stats.RewrappedKeys,
+			"retired_keys", stats.RetiredKeys,
+			"rows", stats.Rows,
+		)
+	}
+	if err != nil {
+		slog.Error("Re-encryption failed, it can be run again to continue", "error", err)
+		os.Exit(1)
+	}
+}
+
+// runBackup writes a backup archive of all data or of one user
+func runBackup(output string, opts store.BackupOptions) {
+	if err := store.InitStorageWithoutMigration(viper.GetString("DSN")); err != nil {
+		slog.Error("Failed to initialize database", "error", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+
+	if output == "" {
+		name := "gemmie-backup"
+		if opts.UserID != "" {
+			name += "-" + opts.UserID
+		}
+		output = fmt.Sprintf("%s-%s.tar.gz", name, time.Now().UTC().Format("20060102-150405"))
+	}
+
+	manifest, err := store.Backup(output, opts)
+	if err != nil {
+		slog.Error("Backup failed", "error", err)
+		os.Exit(1)
+	}
+
+	var rows int64
+	for _, table := range manifest.Tables {
+		slog.Info("Backed up table", "table", table.Name, "rows", table.Rows)
+		rows += table.Rows
+	}
+	slog.Info("Backup written", "file", output, "schema_version", manifest.SchemaVersion, "rows", rows)
+}
+
+// runRestore writes a backup archive into the database
+func runRestore(path string, opts store.RestoreOptions) {
+	// Migrations run first so an empty database gets the schema
+	if err := store.InitStorage(viper.GetString("DSN")); err != nil {
+		slog.Error("Failed to initialize database", "error", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+
+	if err := initEncryption(); err != nil {
+		slog.Error("Failed to initialize encryption", "error", err)
+		os.Exit(1)
+	}
+
+	stats, err := store.Restore(path, opts)
+	if err != nil {
+		slog.Error("Restore failed, nothing was written", "error", err)
+		os.Exit(1)
+	}
+
+	for _, table := range stats.Tables {
+		slog.Info("Restored table", "table", table,
+			"inserted", stats.Inserted[table],
+			"updated", stats.Updated[table],
+			"skipped", stats.Skipped[table],
+		)
+	}
+	for _, id := range stats.MissingMasterKeys {
+		slog.Warn("Archive has data keys wrapped by a master key this server does not have, add it to ENCRYPTION_PREVIOUS_KEYS and run reencrypt", "master_key_id", id)
+	}
+	if opts.DryRun {
+		slog.Info("Dry run, the restore was rolled back")
+	}
+}
+
+// runSeed fills the database with a development scenario
+func runSeed(scenario string, opts seed.Options) {
+	if err := store.InitStorage(viper.GetString("DSN")); err != nil {
+		slog.Error("Failed to initialize database", "error", err)
+		os.Exit(1)
+	}
+	defer store.Close()
+
+	if err := initEncryption(); err != nil {
+		slog.Error("Failed to initialize encryption", "error", err)
+		os.Exit(1)
+	}
+
+	stats, err := seed.Run(scenario, opts)
+	if err != nil {
+		slog.Error("Seeding failed", "error", err)
+		os.Exit(1)
+	}
+
+	slog.Info("Scenario seeded",
+		"scenario", scenario,
+		"users", stats.Users,
+		"chats", stats.Chats,
+		"messages", stats.Messages,
+		"arcades", stats.Arcades,
+		"transactions", stats.Transactions,
+		"push_subscriptions", stats.PushSubscriptions,
+	)
+	if stats.Users > 0 {
+		slog.Info("Seeded users log in with the seed password", "password", seed.Password)
+	}
+}
+
+// migrationNamePattern matches what is replaced by underscores in a new migration name
+var migrationNamePattern = regexp.MustCompile(`[^a-z0-9]+`)
+
+// newMigrateCmd builds the `migrate` command tree
+func newMigrateCmd() *cobra.Command {
+	migrateCmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Inspect and run database migrations",
+		Long: `Runs the migrations embedded in the binary against DSN. The server runs
+pending migrations when it starts, these commands are for inspecting the
+schema, rolling back and recovering from a failed migration.`,
+	}
+
+	statusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "List applied and pending migrations",
+		Run: func(cmd *cobra.Command, args []string) {
+			withMigrationDB(printMigrationStatus)
+		},
+	}
+
+	verifyCmd := &cobra.Command{
+		Use:   "verify",
+		Short: "Fail on missing down files, a dirty database or a schema newer than the binary",
+		Run: func(cmd *cobra.Command, args []string) {
+			withMigrationDB(func() error {
+				problems, err := store.VerifyMigrations()
+				if err != nil {
+					return err
+				}
+				if len(problems) == 0 {
+					fmt.Println("✓ Migrations verified")
+					return nil
+				}
+				for _, problem := range problems {
+					fmt.Println("✗", problem)
+				}
+				return fmt.Errorf("%d migration problem(s) found", len(problems))
+			})
+		},
+	}
+
+	var createDir string
+	var createGo bool
+	createCmd := &cobra.Command{
+		Use:   "create <name>",
+		Short: "Scaffold the up and down files of a new migration",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			files, err := createMigration(createDir, args[0], createGo)
+			if err != nil {
+				slog.Error("Failed to create migration", "error", err)
+				os.Exit(1)
+			}
+			for _, file := range files {
+				fmt.Println("Created", file)
+			}
+		},
+	}
+	createCmd.Flags().StringVar(&createDir, "dir", filepath.Join("store", "migrations"), "Migrations directory")
+	createCmd.Flags().BoolVar(&createGo, "go", false, "Also scaffold a Go data migration for the version")
+
+	upCmd := &cobra.Command{
+		Use:   "up",
+		Short: "Apply all pending migrations",
+		Run: func(cmd *cobra.Command, args []string) {
+			withMigrationDB(store.MigrateUp)
+		},
+	}
+
+	downCmd := &cobra.Command{
+		Use:   "down",
+		Short: "Roll back the last migration",
+		Run: func(cmd *cobra.Command, args []string) {
+			withMigrationDB(store.MigrateDown)
+		},
+	}
+
+	stepsCmd := &cobra.Command{
+		Use:   "steps <n>",
+		Short: "Migrate n steps, negative n rolls back",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			steps, err := strconv.Atoi(args[0])
+			if err != nil {
+				slog.Error("Invalid number of steps", "steps", args[0])
+				os.Exit(1)
+			}
+			withMigrationDB(func() error { return store.MigrateSteps(steps) })
+		},
+	}
+
+	gotoCmd := &cobra.Command{
+		Use:   "goto <version>",
+		Short: "Migrate up or down to a version, 0 rolls back everything",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			version, err := strconv.ParseUint(args[0], 10, 64)
+			if err != nil {
+				slog.Error("Invalid version", "version", args[0])
+				os.Exit(1)
+			}
+			withMigrationDB(func() error { return store.MigrateTo(uint(version)) })
+		},
+	}
+
+	versionCmd := &cobra.Command{
+		Use:   "version",
+		Short: "Show the database migration version",
+		Run: func(cmd *cobra.Command, args []string) {
+			withMigrationDB(func() error {
+				version, dirty, err := store.GetMigrationVersion()
+				if err != nil {
+					return err
+				}
+				fmt.Printf("Version: %d, Dirty: %v\n", version, dirty)
+				return nil
+			})
+		},
+	}
+
+	forceCmd := &cobra.Command{
+		Use:   "force <version>",
+		Short: "Set the version and clear the dirty flag without running migrations",
+		Long: `Marks the database as clean at version. Only use it after fixing a failed
+migration by hand: force the last version that is fully applied, then run up.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			version, err := strconv.Atoi(args[0])
+			if err != nil {
+				slog.Error("Invalid version", "version", args[0])
+				os.Exit(1)
+			}
+			withMigrationDB(func() error { return store.ForceMigrationVersion(version) })
+		},
+	}
+
+	migrateCmd.AddCommand(statusCmd, verifyCmd, createCmd, upCmd, downCmd, stepsCmd, gotoCmd, versionCmd, forceCmd)
+	return migrateCmd
+}
+
+// withMigrationDB connects without running migrations, runs fn and exits
+// non-zero when it fails
+func withMigrationDB(fn func() error) {
+	if err := store.InitStorageWithoutMigration(viper.GetString("DSN")); err != nil {
+		slog.Error("Failed to initialize database", "error", err)
+		os.Exit(1)
+	}
+
+	err := fn()
+	store.Close()
+	if err != nil {
+		if errors.Is(err, store.ErrMigrationDirty) {
+			slog.Error("Migration state is dirty, see `gemmie-server migrate status`", "error", err)
+		} else {
+			slog.Error("Migration command failed", "error", err)
+		}
+		os.Exit(1)
+	}
+}
+
+func printMigrationStatus() error {
+	files, version, dirty, err := store.MigrationStatus()
+	if err != nil {
+		return err
+	}
+
+	state := "clean"
+	if dirty {
+		state = "DIRTY"
+	}
+	fmt.Printf("Database version: %d (%s)\n\n", version, state)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tNAME\tSTATE\tDOWN\tGO")
+	pending := 0
+	for _, file := range files {
+		fileState := "pending"
+		switch {
+		case file.Version == version && dirty:
+			fileState = "dirty"
+		case file.Applied:
+			fileState = "applied"
+		default:
+			pending++
+		}
+
+		down := "yes"
+		if !file.HasDown {
+			down = "missing"
+		}
+		goMigration := ""
+		if file.GoMigration {
+			goMigration = "yes"
+			if !file.GoReversible {
+				goMigration = "no down"
+			}
+		}
+		fmt.Fprintf(w, "%06d\t%s\t%s\t%s\t%s\n", file.Version, file.Name, fileState, down, goMigration)
+	}
+	w.Flush()
+
+	fmt.Printf("\n%d applied, %d pending\n", len(files)-pending, pending)
+	return nil
+}
+
+// createMigration writes the files of the next migration version in dir
+func createMigration(dir, name string, withGo bool) ([]string, error) {
+	name = strings.Trim(migrationNamePattern.ReplaceAllString(strings.ToLower(name), "_"), "_")
+	if name == "" {
+		return nil, errors.New("migration name must contain letters or digits")
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var last uint
+	for _, entry := range entries {
+		if parsed, err := source.DefaultParse(entry.Name()); err == nil && parsed.Version > last {
+			last = parsed.Version
+		}
+	}
+
+	base := fmt.Sprintf("%06d_%s", last+1, name)
+	up := fmt.Sprintf("-- %s.up.sql\n", base)
+	down := fmt.Sprintf("-- %s.down.sql\n", base)
+	if withGo {
+		up += fmt.Sprintf("-- The data changes of this version are in %s.go\n", base)
+		down += fmt.Sprintf("-- The data changes of this version are in %s.go\n", base)
+	}
+
+	files := [][2]string{
+		{filepath.Join(dir, base+".up.sql"), up},
+		{filepath.Join(dir, base+".down.sql"), down},
+	}
+	if withGo {
+		files = append(files, [2]string{filepath.Join(dir, base+".go"), fmt.Sprintf(dataMigrationTemplate, last+1, name)})
+	}
+
+	created := make([]string, 0, len(files))
+	for _, file := range files {
+		path, content := file[0], file[1]
+		// O_EXCL so an existing migration is never overwritten
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err != nil {
+			return created, err
+		}
+		if _, err := f.WriteString(content); err != nil {
+			f.Close()
+			return created, err
+		}
+		if err := f.Close(); err != nil {
+			return created, err
+		}
+		created = append(created, path)
+	}
+	return created, nil
+}
+
+const dataMigrationTemplate = `package migrations
+
+import (
+	"context"
+	"database/sql"
+)
+
+func init() {
+	Register(DataMigration{
+		Version: %d,
+		Name:    %q,
+		// Up runs after the version's up.sql
+		Up: func(ctx context.Context, tx *sql.Tx) error {
+			return nil
+		},
+		// Down runs before the version's down.sql
+		Down: func(ctx context.Context, tx *sql.Tx) error {
+			return nil
+		},
+	})
+}
+`
+
 func main() {
 	// Setup logging first so we can log everything
 	setupLogging()
@@ -306,27 +971,114 @@ func main() {
 		},
 	}
 
+	var reencryptOpts store.ReencryptOptions
+	reencryptCmd := &cobra.Command{
+		Use:   "reencrypt",
+		Short: "Re-encrypt stored content with the current encryption keys",
+		Long: `Moves data keys wrapped by a previous master key (ENCRYPTION_PREVIOUS_KEYS)
+under ENCRYPTION_MASTER_KEY, then rewrites message, arcade and share content so
+it is encrypted with each user's active data key. Content stored before
+encryption was turned on is encrypted too. Safe to run again after a failure.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runReencrypt(reencryptOpts)
+		},
+	}
+	reencryptCmd.Flags().StringVar(&reencryptOpts.UserID, "user", "", "Only re-encrypt this user's content")
+	reencryptCmd.Flags().BoolVar(&reencryptOpts.RotateDataKeys, "rotate-data-keys", false, "Replace the users' data keys with new ones")
+	reencryptCmd.Flags().BoolVar(&reencryptOpts.Decrypt, "decrypt", false, "Write all content back as plaintext")
+	reencryptCmd.Flags().IntVar(&reencryptOpts.BatchSize, "batch-size", 500, "Rows read per batch")
+
+	var backupOutput string
+	var backupOpts store.BackupOptions
+	backupCmd := &cobra.Command{
+		Use:   "backup",
+		Short: "Write all data, or one user's data, to a backup archive",
+		Long: `Writes a gzipped tar with a manifest and one JSON lines file per table.
+The manifest records the schema version and a checksum of every file. Unlike
+pg_dump the archive can be restored into another environment that already
+has data, to move users between environments.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			runBackup(backupOutput, backupOpts)
+		},
+	}
+	backupCmd.Flags().StringVarP(&backupOutput, "output", "o", "", "Archive path (default gemmie-backup-<time>.tar.gz)")
+	backupCmd.Flags().StringVar(&backupOpts.UserID, "user", "", "Only back up this user's data")
+
+	var restoreOpts store.RestoreOptions
+	restoreCmd := &cobra.Command{
+		Use:   "restore <archive>",
+		Short: "Restore a backup archive into the database",
+		Long: `Checks the archive against its manifest, migrates the database and writes
+every row in one transaction. Rows whose id already exists fail the restore
+unless --on-conflict is skip (keep the existing row) or overwrite.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			runRestore(args[0], restoreOpts)
+		},
+	}
+	restoreCmd.Flags().StringVar(&restoreOpts.OnConflict, "on-conflict", store.RestoreConflictFail, "What to do with rows that already exist: fail, skip or overwrite")
+	restoreCmd.Flags().BoolVar(&restoreOpts.DryRun, "dry-run", false, "Roll back after writing, to see what a restore would do")
+
+	var seedOpts seed.Options
+	var scenarioHelp strings.Builder
+	var scenarioNames []string
+	for _, scenario := range seed.Scenarios() {
+		fmt.Fprintf(&scenarioHelp, "\n  %-18s %s", scenario.Name, scenario.Description)
+		scenarioNames = append(scenarioNames, scenario.Name)
+	}
+	seedCmd := &cobra.Command{
+		Use:   "seed <scenario>",
+		Short: "Fill a development database with a named scenario",
+		Long: `Creates users, chats, messages, arcades, transactions and push subscriptions
+through the store API. Ids and content are fixed, so every run of a scenario
+gives the same data. Seeded users log in with the password "` + seed.Password + `".
+
+Scenarios:` + scenarioHelp.String(),
+		Args:      cobra.ExactArgs(1),
+		ValidArgs: scenarioNames,
+		Run: func(cmd *cobra.Command, args []string) {
+			runSeed(args[0], seedOpts)
+		},
+	}
+	seedCmd.Flags().BoolVar(&seedOpts.Reset, "reset", false, "Delete the scenario's users and transactions and seed them again")
+
 	rootCmd.AddCommand(generateVapidCmd)
+	rootCmd.AddCommand(reencryptCmd)
+	rootCmd.AddCommand(newMigrateCmd())
+	rootCmd.AddCommand(backupCmd)
+	rootCmd.AddCommand(restoreCmd)
+	rootCmd.AddCommand(seedCmd)
 
 	envBindings := map[string]string{
-		"port":               "PORT",
-		"dsn":                "DSN",
-		"payhero-username":   "PAYHERO_USERNAME",
-		"payhero-password":   "PAYHERO_PASSWORD",
-		"payhero-channel-id": "PAYHERO_CHANNEL_ID",
-		"callback-url":       "CALLBACK_URL",
-		"smtp-host":          "SMTP_HOST",
-		"smtp-port":          "SMTP_PORT",
-		"smtp-username":      "SMTP_USERNAME",
-		"smtp-password":      "SMTP_PASSWORD",
-		"smtp-email":         "SMTP_EMAIL",
-		"whatsapp-db-path":   "WHATSAPP_DB_PATH",
-		"api-key":            "API_KEY",
-		"model":              "MODEL",
-		"log-level":          "LOG_LEVEL",
-		"vapid-public-key":   "VAPID_PUBLIC_KEY",
-		"vapid-private-key":  "VAPID_PRIVATE_KEY",
-		"vapid-email":        "VAPID_EMAIL",
+		"port":                     "PORT",
+		"dsn":                      "DSN",
+		"payhero-username":         "PAYHERO_USERNAME",
+		"payhero-password":         "PAYHERO_PASSWORD",
+		"payhero-channel-id":       "PAYHERO_CHANNEL_ID",
+		"callback-url":             "CALLBACK_URL",
+		"smtp-host":                "SMTP_HOST",
+		"smtp-port":                "SMTP_PORT",
+		"smtp-username":            "SMTP_USERNAME",
+		"smtp-password":            "SMTP_PASSWORD",
+		"smtp-email":               "SMTP_EMAIL",
+		"whatsapp-db-path":         "WHATSAPP_DB_PATH",
+		"api-key":                  "API_KEY",
+		"model":                    "MODEL",
+		"gemini-api-key":           "GEMINI_API_KEY",
+		"openai-api-key":           "OPENAI_API_KEY",
+		"anthropic-api-key":        "ANTHROPIC_API_KEY",
+		"openai-compatible":        "OPENAI_COMPATIBLE_PROVIDERS",
+		"search-backend":           "SEARCH_BACKEND",
+		"search-base-url":          "SEARCH_BASE_URL",
+		"search-api-key":           "SEARCH_API_KEY",
+		"log-level":                "LOG_LEVEL",
+		"vapid-public-key":         "VAPID_PUBLIC_KEY",
+		"vapid-private-key":        "VAPID_PRIVATE_KEY",
+		"vapid-email":              "VAPID_EMAIL",
+		"export-dir":               "EXPORT_DIR",
+		"public-url":               "PUBLIC_URL",
+		"encryption-master-key":    "ENCRYPTION_MASTER_KEY",
+		"encryption-previous-keys": "ENCRYPTION_PREVIOUS_KEYS",
 	}
 
 	rootCmd.PersistentFlags().Int("port", 8080, "Port to listen on (env: PORT)")
@@ -341,12 +1093,23 @@ func main() {
 	rootCmd.PersistentFlags().String("smtp-password", "", "SMTP Password (env: SMTP_PASSWORD)")
 	rootCmd.PersistentFlags().String("smtp-email", "", "SMTP Email (env: SMTP_EMAIL)")
 	rootCmd.PersistentFlags().String("whatsapp-db-path", "", "WhatsApp Database Path (env: WHATSAPP_DB_PATH)")
-	rootCmd.PersistentFlags().String("api-key", "", "API Key (env: API_KEY)")
-	rootCmd.PersistentFlags().String("model", "", "Model (env: MODEL)")
+	rootCmd.PersistentFlags().String("api-key", "", "API Key of the MODEL's provider (env: API_KEY)")
+	rootCmd.PersistentFlags().String("model", "", "Default model, as provider/model (env: MODEL)")
+	rootCmd.PersistentFlags().String("gemini-api-key", "", "Gemini API Key (env: GEMINI_API_KEY)")
+	rootCmd.PersistentFlags().String("openai-api-key", "", "OpenAI API Key (env: OPENAI_API_KEY)")
+	rootCmd.PersistentFlags().String("anthropic-api-key", "", "Anthropic API Key (env: ANTHROPIC_API_KEY)")
+	rootCmd.PersistentFlags().String("openai-compatible", "", "Comma separated names of OpenAI compatible providers (env: OPENAI_COMPATIBLE_PROVIDERS)")
+	rootCmd.PersistentFlags().String("search-backend", "", "Search backend of the search response modes: searxng, brave or fake (env: SEARCH_BACKEND)")
+	rootCmd.PersistentFlags().String("search-base-url", "", "Base URL of the search backend, required for searxng (env: SEARCH_BASE_URL)")
+	rootCmd.PersistentFlags().String("search-api-key", "", "API key of the search backend, required for brave (env: SEARCH_API_KEY)")
 	rootCmd.PersistentFlags().String("log-level", "info", "Log level (debug, info, warn, error) (env: LOG_LEVEL)")
 	rootCmd.PersistentFlags().String("vapid-public-key", "", "VAPID Public Key (env: VAPID_PUBLIC_KEY)")
 	rootCmd.PersistentFlags().String("vapid-private-key", "", "VAPID Private Key (env: VAPID_PRIVATE_KEY)")
 	rootCmd.PersistentFlags().String("vapid-email", "", "VAPID Email (env: VAPID_EMAIL)")
+	rootCmd.PersistentFlags().String("export-dir", "", "Directory for account data export archives (env: EXPORT_DIR)")
+	rootCmd.PersistentFlags().String("public-url", "", "Public base URL of this server, used in download links (env: PUBLIC_URL)")
+	rootCmd.PersistentFlags().String("encryption-master-key", "", "32 byte base64 or hex key that wraps the data keys (env: ENCRYPTION_MASTER_KEY)")
+	rootCmd.PersistentFlags().String("encryption-previous-keys", "", "Comma separated master keys replaced by a rotation (env: ENCRYPTION_PREVIOUS_KEYS)")
 
 	for key, env := range envBindings {
 		if err := viper.BindPFlag(env, rootCmd.PersistentFlags().Lookup(key)); err != nil {
@@ -2,6 +2,7 @@ package store
 
 import (
 	"context"
+	"database/sql"
 	"fmt"
 	"time"
 )
@@ -10,8 +11,12 @@ import (
 func CreateArcade(arcade *Arcade) (*string, error) {
 	ctx := context.Background()
 	now := time.Now()
+	code, err := encryptForUser(ctx, arcade.UserId, arcade.Code)
+	if err != nil {
+		return nil, err
+	}
 	query := `INSERT INTO arcades (user_id, code, label, code_type, description, created_at, updated_at, id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`
-	_, err := DB.ExecContext(ctx, query, arcade.UserId, arcade.Code, arcade.Label, arcade.CodeType, arcade.Description, arcade.CreatedAt, now, arcade.ID)
+	_, err = DB.ExecContext(ctx, query, arcade.UserId, code, arcade.Label, arcade.CodeType, arcade.Description, arcade.CreatedAt, now, arcade.ID)
 	if err != nil {
 		return nil, err
 	}
@@ -20,22 +25,31 @@ func CreateArcade(arcade *Arcade) (*string, error) {
 
 // UpdateArcade - updates an arcade where user_id and id matches
 func UpdateArcade(arcade *Arcade) (*Arcade, error) {
+	return UpdateArcadeIfVersion(arcade, 0)
+}
+
+// UpdateArcadeIfVersion - updates an arcade only while it is still at version, 0 skips the check
+func UpdateArcadeIfVersion(arcade *Arcade, version int64) (*Arcade, error) {
 	ctx := context.Background()
 	now := time.Now()
 	if arcade.UpdatedAt.IsZero() {
 		arcade.UpdatedAt = now
 	}
-	query := `UPDATE arcades SET code = $1, label = $2, code_type = $3, description = $4, updated_at = $5 WHERE user_id = $6 AND id = $7`
-	result, err := DB.ExecContext(ctx, query, arcade.Code, arcade.Label, arcade.CodeType, arcade.Description, arcade.UpdatedAt, arcade.UserId, arcade.ID)
+	code, err := encryptForUser(ctx, arcade.UserId, arcade.Code)
 	if err != nil {
 		return nil, err
 	}
-
-	if count, err := result.RowsAffected(); err != nil {
-		return nil, err
-	} else if count == 0 {
+	query := `UPDATE arcades SET code = $1, label = $2, code_type = $3, description = $4, updated_at = $5 WHERE user_id = $6 AND id = $7 AND ($8 = 0 OR version = $8) RETURNING version`
+	err = DB.QueryRowContext(ctx, query, code, arcade.Label, arcade.CodeType, arcade.Description, arcade.UpdatedAt, arcade.UserId, arcade.ID, version).Scan(&arcade.Version)
+	if err == sql.ErrNoRows {
+		if version != 0 {
+			return nil, ErrVersionConflict
+		}
 		return nil, fmt.Errorf("arcade not found")
 	}
+	if err != nil {
+		return nil, err
+	}
 
 	return arcade, nil
 }
@@ -64,6 +78,27 @@ func DeleteAllArcadesByUserID(userID string) error {
 	return nil
 }
 
+// DeleteArcadeByIDIfVersion deletes an arcade and its chat only while the
+// arcade is still at version, 0 skips the check. It returns
+// ErrVersionConflict when the arcade changed.
+func DeleteArcadeByIDIfVersion(id int64, version int64) error {
+	ctx := context.Background()
+
+	result, err := DB.ExecContext(ctx,
+		"DELETE FROM arcades WHERE id = $1 AND ($2 = 0 OR version = $2)", id, version,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 && version != 0 {
+		return ErrVersionConflict
+	}
+
+	return DeleteChatByID(fmt.Sprintf("%d", id))
+}
+
 // DeleteArcadeByID - Deletes an arcade by its id
 func DeleteArcadeByID(id int64) error {
 	ctx := context.Background()
@@ -86,22 +121,51 @@ func DeleteArcadeByID(id int64) error {
 // GetArcadeById - Gets an arcade by its id
 func GetArcadeById(id int64) (*Arcade, error) {
 	ctx := context.Background()
-	query := `SELECT id, user_id, code, label, code_type, description, created_at, updated_at FROM arcades WHERE id = $1`
+	query := `SELECT id, user_id, code, label, code_type, description, created_at, updated_at, version FROM arcades WHERE id = $1`
 	row := DB.QueryRowContext(ctx, query, id)
 	var arcade Arcade
-	err := row.Scan(&arcade.ID, &arcade.UserId, &arcade.Code, &arcade.Label, &arcade.CodeType, &arcade.Description, &arcade.CreatedAt, &arcade.UpdatedAt)
+	err := row.Scan(&arcade.ID, &arcade.UserId, &arcade.Code, &arcade.Label, &arcade.CodeType, &arcade.Description, &arcade.CreatedAt, &arcade.UpdatedAt, &arcade.Version)
 	if err != nil {
 		return nil, err
 	}
+	if err := decryptValues(ctx, &arcade.Code); err != nil {
+		return nil, err
+	}
 	return &arcade, nil
 }
 
+// GetArcadesByUserID - gets all arcades owned by a user
+func GetArcadesByUserID(userID string) ([]*Arcade, error) {
+	ctx := context.Background()
+	query := `SELECT id, user_id, code, label, code_type, description, created_at, updated_at, version FROM arcades WHERE user_id = $1 ORDER BY updated_at DESC`
+	rows, err := DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var arcades []*Arcade
+	for rows.Next() {
+		var arcade Arcade
+		err := rows.Scan(&arcade.ID, &arcade.UserId, &arcade.Code, &arcade.Label, &arcade.CodeType, &arcade.Description, &arcade.CreatedAt, &arcade.UpdatedAt, &arcade.Version)
+		if err != nil {
+			return nil, err
+		}
+		if err := decryptValues(ctx, &arcade.Code); err != nil {
+			return nil, err
+		}
+		arcades = append(arcades, &arcade)
+	}
+
+	return arcades, rows.Err()
+}
+
 // GetArcadesByOption - gets all arcades that matches the option e.g user_id or code or code_type
 func GetArcadesByOption(option any) ([]*Arcade, error) {
 	ctx := context.Background()
 	if option == nil {
 		// gets all arcades
-		query := `SELECT id, user_id, code, label, code_type, description, created_at, updated_at FROM arcades ORDER BY updated_at DESC`
+		query := `SELECT id, user_id, code, label, code_type, description, created_at, updated_at, version FROM arcades ORDER BY updated_at DESC`
 		ctx := context.Background()
 		rows, err := DB.QueryContext(ctx, query)
 		if err != nil {
@@ -112,17 +176,20 @@ func GetArcadesByOption(option any) ([]*Arcade, error) {
 		var arcades []*Arcade
 		for rows.Next() {
 			var arcade Arcade
-			err := rows.Scan(&arcade.ID, &arcade.UserId, &arcade.Code, &arcade.Label, &arcade.CodeType, &arcade.Description, &arcade.CreatedAt, &arcade.UpdatedAt)
+			err := rows.Scan(&arcade.ID, &arcade.UserId, &arcade.Code, &arcade.Label, &arcade.CodeType, &arcade.Description, &arcade.CreatedAt, &arcade.UpdatedAt, &arcade.Version)
 			if err != nil {
 				return nil, err
 			}
+			if err := decryptValues(ctx, &arcade.Code); err != nil {
+				return nil, err
+			}
 			arcades = append(arcades, &arcade)
 		}
 
 		return arcades, nil
 	}
 
-	query := `SELECT id, user_id, code, label, code_type, description, created_at, updated_at FROM arcades WHERE user_id = $1 OR code = $2 OR code_type = $3 ORDER BY updated_at DESC`
+	query := `SELECT id, user_id, code, label, code_type, description, created_at, updated_at, version FROM arcades WHERE user_id = $1 OR code = $2 OR code_type = $3 ORDER BY updated_at DESC`
 	rows, err := DB.QueryContext(ctx, query, option)
 	if err != nil {
 		return nil, err
@@ -132,10 +199,13 @@ func GetArcadesByOption(option any) ([]*Arcade, error) {
 	var arcades []*Arcade
 	for rows.Next() {
 		var arcade Arcade
-		err := rows.Scan(&arcade.ID, &arcade.UserId, &arcade.Code, &arcade.Label, &arcade.CodeType, &arcade.Description, &arcade.CreatedAt, &arcade.UpdatedAt)
+		err := rows.Scan(&arcade.ID, &arcade.UserId, &arcade.Code, &arcade.Label, &arcade.CodeType, &arcade.Description, &arcade.CreatedAt, &arcade.UpdatedAt, &arcade.Version)
 		if err != nil {
 			return nil, err
 		}
+		if err := decryptValues(ctx, &arcade.Code); err != nil {
+			return nil, err
+		}
 		arcades = append(arcades, &arcade)
 	}
 
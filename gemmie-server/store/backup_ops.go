@@ -0,0 +1,747 @@
+package store
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Logical backups: one JSON object per row and one file per table, so an
+// archive does not depend on Postgres and can be restored into another
+// environment, or one day another storage backend.
+
+const (
+	// BackupFormat names the archive layout in its manifest
+	BackupFormat = "gemmie-backup"
+	// BackupFormatVersion is bumped when the layout changes in a way older
+	// servers cannot restore
+	BackupFormatVersion = 1
+
+	backupManifestFile = "manifest.json"
+	// restoreBatchSize is the number of rows inserted per statement
+	restoreBatchSize = 500
+)
+
+// How restore handles a row whose id already exists
+const (
+	RestoreConflictFail      = "fail"
+	RestoreConflictSkip      = "skip"
+	RestoreConflictOverwrite = "overwrite"
+)
+
+// BackupOptions selects what Backup writes
+type BackupOptions struct {
+	UserID string // only this user's data, empty for everything
+}
+
+// BackupManifest describes an archive, it is its first file
+type BackupManifest struct {
+	Format        string        `json:"format"`
+	FormatVersion int           `json:"format_version"`
+	CreatedAt     time.Time     `json:"created_at"`
+	SchemaVersion uint          `json:"schema_version"`
+	UserID        string        `json:"user_id,omitempty"`
+	MasterKeyIDs  []string      `json:"master_key_ids"` // master keys that wrapped the archived data keys
+	Tables        []BackupTable `json:"tables"`
+}
+
+// BackupTable is one table file of an archive
+type BackupTable struct {
+	Name    string   `json:"name"`
+	File    string   `json:"file"`
+	Columns []string `json:"columns"`
+	Rows    int64    `json:"rows"`
+	SHA256  string   `json:"sha256"`
+}
+
+// RestoreOptions selects how Restore writes an archive
+type RestoreOptions struct {
+	OnConflict string // RestoreConflictFail, RestoreConflictSkip or RestoreConflictOverwrite
+	DryRun     bool   // roll back once every row has been written
+}
+
+// RestoreStats counts what Restore wrote, by table
+type RestoreStats struct {
+	Tables            []string // in the order they were restored
+	Inserted          map[string]int64
+	Updated           map[string]int64
+	Skipped           map[string]int64
+	MissingMasterKeys []string // data keys in the archive this server cannot unwrap
+}
+
+// backupTables are the tables in an archive, in an order that restores
+// without breaking foreign keys. change_log, idempotency_keys and
+// data_exports are left out: they are rebuilt, short lived or point at
+// files on one server.
+var backupTables = []struct {
+	name string
+	key  []string
+	// order of the rows in the archive
+	order string
+	// userFilter selects one user's rows, $1 is the user id. Tables without
+	// one hold rows shared with other accounts and are only in full backups.
+	userFilter string
+	// deferred columns point at rows that may come later, they are set once
+	// every table has been restored
+	deferred []string
+	// userRefs reference users(id) ON DELETE SET NULL and are cleared when
+	// that user is not in the target database
+	userRefs []string
+	// preserve columns keep the target's value when a row is overwritten
+	preserve []string
+}{
+	{name: "users", key: []string{"id"}, order: "created_at, id", userFilter: "id = $1", preserve: []string{"change_seq"}},
+	{name: "user_data_keys", key: []string{"id"}, order: "created_at, id", userFilter: "user_id = $1"},
+	{name: "organizations", key: []string{"id"}, order: "created_at, id", userRefs: []string{"created_by"}},
+	{name: "organization_members", key: []string{"org_id", "user_id"}, order: "org_id, user_id", userRefs: []string{"invited_by"}},
+	{name: "organization_invitations", key: []string{"id"}, order: "created_at, id"},
+	{
+		name:  "transactions",
+		key:   []string{"id"},
+		order: "created_at, id",
+		userFilter: `external_reference IN (SELECT transaction_ref FROM subscriptions WHERE user_id = $1)
+			OR (phone_number <> '' AND phone_number = (SELECT phone_number FROM users WHERE id = $1))`,
+	},
+	{name: "subscriptions", key: []string{"id"}, order: "created_at, id", userFilter: "user_id = $1"},
+	{name: "folders", key: []string{"id"}, order: "created_at, id", userFilter: "user_id = $1"},
+	{name: "tags", key: []string{"id"}, order: "created_at, id", userFilter: "user_id = $1"},
+	{name: "personas", key: []string{"id"}, order: "created_at, id", userFilter: "user_id = $1"},
+	{name: "chats", key: []string{"id"}, order: "created_at, id", userFilter: "user_id = $1", deferred: []string{"active_leaf_id"}},
+	{
+		name:       "messages",
+		key:        []string{"id"},
+		order:      "created_at, id",
+		userFilter: "chat_id IN (SELECT id FROM chats WHERE user_id = $1)",
+		deferred:   []string{"parent_id"},
+		userRefs:   []string{"author_id"},
+	},
+	{
+		name:       "message_versions",
+		key:        []string{"id"},
+		order:      "created_at, id",
+		userFilter: "chat_id IN (SELECT id FROM chats WHERE user_id = $1)",
+		userRefs:   []string{"edited_by"},
+	},
+	{name: "chat_tags", key: []string{"chat_id", "tag_id"}, order: "chat_id, tag_id", userFilter: "chat_id IN (SELECT id FROM chats WHERE user_id = $1)"},
+	{name: "chat_members", key: []string{"chat_id", "user_id"}, order: "chat_id, user_id", userRefs: []string{"invited_by"}},
+	{name: "chat_invitations", key: []string{"id"}, order: "created_at, id"},
+	{name: "organization_chats", key: []string{"org_id", "chat_id"}, order: "org_id, chat_id", userRefs: []string{"shared_by"}},
+	{name: "chat_shares", key: []string{"id"}, order: "created_at, id", userFilter: "created_by = $1 AND chat_id IN (SELECT id FROM chats WHERE user_id = $1)"},
+	{name: "arcades", key: []string{"id"}, order: "created_at, id", userFilter: "user_id = $1"},
+	{name: "push_subscriptions", key: []string{"endpoint"}, order: "created_at, endpoint", userFilter: "user_id = $1"},
+	{name: "platform_errors", key: []string{"id"}, order: "updated_at, id", userFilter: "user_id = $1"},
+}
+
+func backupTableFile(name string) string {
+	return "tables/" + name + ".jsonl"
+}
+
+// Backup writes an archive of all data, or of one user's data, to path.
+// Rows are read in one repeatable read transaction so the archive is
+// consistent. Content encrypted at rest stays encrypted, the data keys are
+// archived wrapped by their master key.
+func Backup(path string, opts BackupOptions) (*BackupManifest, error) {
+	ctx := context.Background()
+
+	version, dirty, err := GetMigrationVersion()
+	if err != nil {
+		return nil, err
+	}
+	if dirty {
+		return nil, fmt.Errorf("%w at version %d, fix it before taking a backup", ErrMigrationDirty, version)
+	}
+
+	if opts.UserID != "" {
+		user, err := GetUserByID(opts.UserID)
+		if err != nil {
+			return nil, err
+		}
+		if user == nil {
+			return nil, fmt.Errorf("user %s not found", opts.UserID)
+		}
+	}
+
+	tx, err := DB.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	manifest := &BackupManifest{
+		Format:        BackupFormat,
+		FormatVersion: BackupFormatVersion,
+		CreatedAt:     time.Now().UTC(),
+		SchemaVersion: version,
+		UserID:        opts.UserID,
+		MasterKeyIDs:  []string{},
+	}
+
+	// Each table goes to a temporary file first, the manifest with the
+	// checksums has to be written ahead of them
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	for _, spec := range backupTables {
+		if opts.UserID != "" && spec.userFilter == "" {
+			continue
+		}
+
+		f, err := os.CreateTemp("", "gemmie-backup-*.jsonl")
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+
+		table, err := dumpTable(ctx, tx, spec.name, spec.order, spec.userFilter, opts.UserID, f)
+		if err != nil {
+			return nil, fmt.Errorf("backup %s: %w", spec.name, err)
+		}
+		manifest.Tables = append(manifest.Tables, *table)
+	}
+
+	keyQuery := "SELECT DISTINCT master_key_id FROM user_data_keys WHERE $1 = '' OR user_id = $1 ORDER BY master_key_id"
+	rows, err := tx.QueryContext(ctx, keyQuery, opts.UserID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		manifest.MasterKeyIDs = append(manifest.MasterKeyIDs, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := writeBackupArchive(path, manifest, files); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// dumpTable writes the rows of a table as JSON lines
+func dumpTable(ctx context.Context, tx *sql.Tx, name, order, userFilter, userID string, w io.Writer) (*BackupTable, error) {
+	columns, err := tableColumns(ctx, tx, name)
+	if err != nil {
+		return nil, err
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("table %s does not exist", name)
+	}
+
+	query := fmt.Sprintf("SELECT row_to_json(t)::text FROM %s t", pq.QuoteIdentifier(name))
+	var args []any
+	if userID != "" {
+		query += " WHERE " + userFilter
+		args = append(args, userID)
+	}
+	query += " ORDER BY " + order
+
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hash := sha256.New()
+	buf := bufio.NewWriter(io.MultiWriter(w, hash))
+	table := &BackupTable{Name: name, File: backupTableFile(name), Columns: columns}
+	for rows.Next() {
+		var line string
+		if err := rows.Scan(&line); err != nil {
+			return nil, err
+		}
+		if _, err := buf.WriteString(line + "\n"); err != nil {
+			return nil, err
+		}
+		table.Rows++
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := buf.Flush(); err != nil {
+		return nil, err
+	}
+
+	table.SHA256 = hex.EncodeToString(hash.Sum(nil))
+	return table, nil
+}
+
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// tableColumns lists the columns of a table in their declared order
+func tableColumns(ctx context.Context, q queryer, name string) ([]string, error) {
+	query := `
+		SELECT column_name FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = $1
+		ORDER BY ordinal_position
+	`
+	rows, err := q.QueryContext(ctx, query, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+	return columns, rows.Err()
+}
+
+// writeBackupArchive writes the manifest and the table files as a gzipped tar
+func writeBackupArchive(path string, manifest *BackupManifest, files []*os.File) (err error) {
+	// The archive holds password hashes and wrapped keys. O_EXCL so an
+	// existing file is never overwritten.
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		out.Close()
+		if err != nil {
+			os.Remove(path)
+		}
+	}()
+
+	gz := gzip.NewWriter(out)
+	tw := tar.NewWriter(gz)
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	header := &tar.Header{Name: backupManifestFile, Mode: 0o600, Size: int64(len(data)), ModTime: manifest.CreatedAt}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := tw.Write(data); err != nil {
+		return err
+	}
+
+	for i, table := range manifest.Tables {
+		f := files[i]
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		header := &tar.Header{Name: table.File, Mode: 0o600, Size: info.Size(), ModTime: manifest.CreatedAt}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, f); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// openBackupArchive opens an archive for reading from the start
+func openBackupArchive(path string) (*tar.Reader, func(), error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, fmt.Errorf("not a backup archive: %w", err)
+	}
+	return tar.NewReader(gz), func() { gz.Close(); f.Close() }, nil
+}
+
+// ReadBackupManifest reads the manifest of an archive and checks every table
+// file against its checksum and row count
+func ReadBackupManifest(path string) (*BackupManifest, error) {
+	tr, closeArchive, err := openBackupArchive(path)
+	if err != nil {
+		return nil, err
+	}
+	defer closeArchive()
+
+	header, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("not a backup archive: %w", err)
+	}
+	if header.Name != backupManifestFile {
+		return nil, fmt.Errorf("not a backup archive: %s is not the first file", backupManifestFile)
+	}
+
+	manifest := &BackupManifest{}
+	if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if manifest.Format != BackupFormat {
+		return nil, fmt.Errorf("not a backup archive: format %q", manifest.Format)
+	}
+	if manifest.FormatVersion > BackupFormatVersion {
+		return nil, fmt.Errorf("archive format version %d is newer than this server supports (%d)", manifest.FormatVersion, BackupFormatVersion)
+	}
+
+	expected := map[string]BackupTable{}
+	for _, table := range manifest.Tables {
+		expected[table.File] = table
+	}
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("corrupt archive: %w", err)
+		}
+
+		table, ok := expected[header.Name]
+		if !ok {
+			return nil, fmt.Errorf("archive file %s is not in the manifest", header.Name)
+		}
+		delete(expected, header.Name)
+
+		hash := sha256.New()
+		scanner := bufio.NewScanner(io.TeeReader(tr, hash))
+		scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+		var rows int64
+		for scanner.Scan() {
+			rows++
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("corrupt archive file %s: %w", header.Name, err)
+		}
+		if sum := hex.EncodeToString(hash.Sum(nil)); sum != table.SHA256 {
+			return nil, fmt.Errorf("checksum mismatch for %s", header.Name)
+		}
+		if rows != table.Rows {
+			return nil, fmt.Errorf("%s has %d rows, the manifest lists %d", header.Name, rows, table.Rows)
+		}
+	}
+
+	for _, table := range manifest.Tables {
+		if _, missing := expected[table.File]; missing {
+			return nil, fmt.Errorf("archive is missing %s", table.File)
+		}
+	}
+	return manifest, nil
+}
+
+// Restore writes an archive into the database in one transaction, nothing is
+// written when a row fails. The database has to be at the archive's schema
+// version or newer. Rows restored into a database that already has them are
+// handled as opts.OnConflict says.
+func Restore(path string, opts RestoreOptions) (*RestoreStats, error) {
+	ctx := context.Background()
+
+	switch opts.OnConflict {
+	case "":
+		opts.OnConflict = RestoreConflictFail
+	case RestoreConflictFail, RestoreConflictSkip, RestoreConflictOverwrite:
+	default:
+		return nil, fmt.Errorf("unknown conflict mode %q, use fail, skip or overwrite", opts.OnConflict)
+	}
+
+	manifest, err := ReadBackupManifest(path)
+	if err != nil {
+		return nil, err
+	}
+
+	version, dirty, err := GetMigrationVersion()
+	if err != nil {
+		return nil, err
+	}
+	if dirty {
+		return nil, fmt.Errorf("%w at version %d, fix it before restoring", ErrMigrationDirty, version)
+	}
+	if manifest.SchemaVersion > version {
+		return nil, fmt.Errorf("archive is at schema version %d, migrate the database from %d first", manifest.SchemaVersion, version)
+	}
+
+	stats := &RestoreStats{
+		Inserted: map[string]int64{},
+		Updated:  map[string]int64{},
+		Skipped:  map[string]int64{},
+	}
+	for _, id := range manifest.MasterKeyIDs {
+		if !MasterKeyLoaded(id) {
+			stats.MissingMasterKeys = append(stats.MissingMasterKeys, id)
+		}
+	}
+
+	tables := map[string]BackupTable{}
+	for _, table := range manifest.Tables {
+		tables[table.File] = table
+	}
+
+	tr, closeArchive, err := openBackupArchive(path)
+	if err != nil {
+		return nil, err
+	}
+	defer closeArchive()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var deferred []deferredValue
+	next := 0
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Name == backupManifestFile {
+			continue
+		}
+		table := tables[header.Name]
+
+		// Tables have to come in backupTables order for foreign keys to hold
+		index := -1
+		for i := next; i < len(backupTables); i++ {
+			if backupTables[i].name == table.Name {
+				index = i
+				break
+			}
+		}
+		if index == -1 {
+			return nil, fmt.Errorf("archive table %s is unknown or out of order", table.Name)
+		}
+		next = index + 1
+
+		values, err := restoreTable(ctx, tx, index, table, tr, opts.OnConflict, stats)
+		if err != nil {
+			return nil, fmt.Errorf("restore %s: %w", table.Name, err)
+		}
+		deferred = append(deferred, values...)
+	}
+
+	for _, value := range deferred {
+		query := fmt.Sprintf("UPDATE %s SET %s = $2 WHERE id = $1",
+			pq.QuoteIdentifier(value.table), pq.QuoteIdentifier(value.column))
+		if _, err := tx.ExecContext(ctx, query, value.id, value.value); err != nil {
+			return nil, fmt.Errorf("restore %s.%s of %s: %w", value.table, value.column, value.id, err)
+		}
+	}
+
+	if opts.DryRun {
+		return stats, nil
+	}
+	return stats, tx.Commit()
+}
+
+// deferredValue is a column set after every table has been restored
+type deferredValue struct {
+	table  string
+	column string
+	id     string
+	value  string
+}
+
+// restoreTable inserts the rows of one table file in batches
+func restoreTable(ctx context.Context, tx *sql.Tx, index int, table BackupTable, r io.Reader, onConflict string, stats *RestoreStats) ([]deferredValue, error) {
+	spec := backupTables[index]
+	stats.Tables = append(stats.Tables, spec.name)
+
+	target, err := tableColumns(ctx, tx, spec.name)
+	if err != nil {
+		return nil, err
+	}
+	targetSet := map[string]bool{}
+	for _, column := range target {
+		targetSet[column] = true
+	}
+	skip := map[string]bool{}
+	for _, column := range spec.deferred {
+		skip[column] = true
+	}
+	userRefs := map[string]bool{}
+	for _, column := range spec.userRefs {
+		userRefs[column] = true
+	}
+	preserve := map[string]bool{}
+	for _, column := range spec.preserve {
+		preserve[column] = true
+	}
+	keys := map[string]bool{}
+	for _, column := range spec.key {
+		keys[column] = true
+	}
+
+	// Columns dropped since the backup was taken are left out, columns added
+	// since get their defaults
+	var columns, selects, updates []string
+	for _, column := range table.Columns {
+		if !targetSet[column] {
+			slog.Warn("Archive column no longer exists, skipping it", "table", spec.name, "column", column)
+			continue
+		}
+		if skip[column] {
+			continue
+		}
+		quoted := pq.QuoteIdentifier(column)
+		columns = append(columns, quoted)
+		if userRefs[column] {
+			selects = append(selects, fmt.Sprintf("CASE WHEN EXISTS (SELECT 1 FROM users u WHERE u.id = r.%[1]s) THEN r.%[1]s END", quoted))
+		} else {
+			selects = append(selects, "r."+quoted)
+		}
+		if !keys[column] && !preserve[column] {
+			updates = append(updates, fmt.Sprintf("%[1]s = EXCLUDED.%[1]s", quoted))
+		}
+	}
+
+	quotedKeys := make([]string, len(spec.key))
+	for i, column := range spec.key {
+		quotedKeys[i] = pq.QuoteIdentifier(column)
+	}
+
+	query := fmt.Sprintf("INSERT INTO %[1]s (%[2]s) SELECT %[3]s FROM json_populate_recordset(NULL::%[1]s, $1::json) r",
+		pq.QuoteIdentifier(spec.name), strings.Join(columns, ", "), strings.Join(selects, ", "))
+	switch onConflict {
+	case RestoreConflictSkip:
+		query += " ON CONFLICT DO NOTHING"
+	case RestoreConflictOverwrite:
+		if len(updates) == 0 {
+			query += fmt.Sprintf(" ON CONFLICT (%s) DO NOTHING", strings.Join(quotedKeys, ", "))
+		} else {
+			query += fmt.Sprintf(" ON CONFLICT (%s) DO UPDATE SET %s", strings.Join(quotedKeys, ", "), strings.Join(updates, ", "))
+		}
+	}
+	// xmax is 0 for a row this statement inserted, set when it updated one
+	query += fmt.Sprintf(" RETURNING (xmax = 0), %s::text", quotedKeys[0])
+
+	var deferred []deferredValue
+	var batch []string
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		written, err := restoreBatch(ctx, tx, query, batch, spec.name, stats)
+		if err != nil {
+			if IsUniqueViolation(err) && onConflict == RestoreConflictFail {
+				return fmt.Errorf("%w (use --on-conflict skip or overwrite to restore over existing rows)", err)
+			}
+			return err
+		}
+
+		if len(spec.deferred) > 0 {
+			values, err := deferredValues(spec.name, spec.deferred, batch, written)
+			if err != nil {
+				return err
+			}
+			deferred = append(deferred, values...)
+		}
+		batch = batch[:0]
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		batch = append(batch, scanner.Text())
+		if len(batch) == restoreBatchSize {
+			if err := flush(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	return deferred, nil
+}
+
+// restoreBatch inserts rows and returns the keys that were written
+func restoreBatch(ctx context.Context, tx *sql.Tx, query string, batch []string, name string, stats *RestoreStats) (map[string]bool, error) {
+	rows, err := tx.QueryContext(ctx, query, "["+strings.Join(batch, ",")+"]")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	written := map[string]bool{}
+	for rows.Next() {
+		var inserted bool
+		var key string
+		if err := rows.Scan(&inserted, &key); err != nil {
+			return nil, err
+		}
+		written[key] = true
+		if inserted {
+			stats.Inserted[name]++
+		} else {
+			stats.Updated[name]++
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	stats.Skipped[name] += int64(len(batch) - len(written))
+	return written, nil
+}
+
+// deferredValues picks the deferred columns of the rows that were written
+func deferredValues(name string, columns []string, batch []string, written map[string]bool) ([]deferredValue, error) {
+	var values []deferredValue
+	for _, line := range batch {
+		var row map[string]any
+		if err := json.Unmarshal([]byte(line), &row); err != nil {
+			return nil, err
+		}
+		id, _ := row["id"].(string)
+		if !written[id] {
+			continue
+		}
+		for _, column := range columns {
+			if value, ok := row[column].(string); ok && value != "" {
+				values = append(values, deferredValue{table: name, column: column, id: id, value: value})
+			}
+		}
+	}
+	return values, nil
+}
@@ -3,7 +3,10 @@ package store
 import (
 	"context"
 	"database/sql"
+	"fmt"
 	"time"
+
+	"github.com/lib/pq"
 )
 
 func CreateChat(chat Chat) error {
@@ -12,33 +15,53 @@ func CreateChat(chat Chat) error {
 	if chat.LastMessageAt.IsZero() {
 		chat.LastMessageAt = time.Now()
 	}
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	query := `
-		INSERT INTO chats (id, user_id, title, created_at, updated_at, is_archived, last_message_at, is_private)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		INSERT INTO chats (id, user_id, title, created_at, updated_at, is_archived, last_message_at, is_private, model)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
 	`
 
-	_, err := DB.ExecContext(ctx, query,
+	if _, err := tx.ExecContext(ctx, query,
 		chat.ID, chat.UserId, chat.Title, chat.CreatedAt,
 		chat.UpdatedAt, chat.IsArchived,
-		chat.LastMessageAt, chat.IsPrivate,
-	)
+		chat.LastMessageAt, chat.IsPrivate, nullString(chat.Model),
+	); err != nil {
+		return err
+	}
 
-	return err
+	// The creator is the chat's owner
+	if _, err := tx.ExecContext(ctx,
+		"INSERT INTO chat_members (chat_id, user_id, role, created_at) VALUES ($1, $2, $3, $4)",
+		chat.ID, chat.UserId, ChatRoleOwner, chat.CreatedAt,
+	); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 func GetChatById(ID string) (*Chat, error) {
 	ctx := context.Background()
 
 	query := `
-		SELECT id, user_id, title, created_at, updated_at, is_archived, last_message_at, is_private
+		SELECT id, user_id, title, created_at, updated_at, is_archived, last_message_at, is_private,
+			   active_leaf_id, folder_id, is_pinned, version, retention_days, is_kept, persona_id, model
 		FROM chats WHERE id = $1
 	`
 
 	chat := &Chat{}
+	var activeLeafID, folderID, personaID, model sql.NullString
+	var retentionDays sql.NullInt64
 	err := DB.QueryRowContext(ctx, query, ID).Scan(
 		&chat.ID, &chat.UserId, &chat.Title, &chat.CreatedAt,
 		&chat.UpdatedAt, &chat.IsArchived,
-		&chat.LastMessageAt, &chat.IsPrivate,
+		&chat.LastMessageAt, &chat.IsPrivate, &activeLeafID,
+		&folderID, &chat.IsPinned, &chat.Version, &retentionDays, &chat.IsKept, &personaID, &model,
 	)
 
 	if err == sql.ErrNoRows {
@@ -49,21 +72,75 @@ func GetChatById(ID string) (*Chat, error) {
 		return nil, err
 	}
 
-	// Fetch messages for the chat
+	// Fetch messages for the chat, only the active branch is returned
 	messages, err := GetMessagesByChatId(ID)
 	if err != nil {
 		return nil, err
 	}
-	chat.Messages = messages
+	chat.ActiveLeafId = activeLeafID.String
+	chat.FolderId = folderID.String
+	chat.PersonaId = personaID.String
+	chat.Model = model.String
+	chat.RetentionDays = nullInt(retentionDays)
+	chat.Messages = ActivePath(messages, chat.ActiveLeafId)
 	chat.MessageCount = len(chat.Messages)
+
+	tagsByChat, err := GetTagsByChatIDs([]string{ID})
+	if err != nil {
+		return nil, err
+	}
+	chat.Tags = tagsByChat[ID]
 	return chat, nil
 }
 
 func GetChatsByUserId(userId string) ([]Chat, error) {
+	return GetChatsByUserIdFiltered(userId, ChatFilter{})
+}
+
+// chatSortColumns maps the allowed sort keys to their column
+var chatSortColumns = map[string]string{
+	"updated_at":      "c.updated_at DESC",
+	"created_at":      "c.created_at DESC",
+	"last_message_at": "c.last_message_at DESC NULLS LAST",
+	"title":           "LOWER(c.title) ASC",
+}
+
+// GetChatsByUserIdFiltered lists a user's chats, pinned chats first
+func GetChatsByUserIdFiltered(userId string, filter ChatFilter) ([]Chat, error) {
 	ctx := context.Background()
 
+	args := []any{userId}
+	conditions := ""
+	if filter.FolderId == "none" {
+		conditions += " AND c.folder_id IS NULL"
+	} else if filter.FolderId != "" {
+		args = append(args, filter.FolderId)
+		conditions += fmt.Sprintf(" AND c.folder_id = $%d", len(args))
+	}
+	if filter.TagId != "" {
+		args = append(args, filter.TagId)
+		conditions += fmt.Sprintf(" AND EXISTS (SELECT 1 FROM chat_tags ct WHERE ct.chat_id = c.id AND ct.tag_id = $%d)", len(args))
+	}
+	if filter.Pinned != nil {
+		args = append(args, *filter.Pinned)
+		conditions += fmt.Sprintf(" AND c.is_pinned = $%d", len(args))
+	}
+	if filter.Archived != nil {
+		args = append(args, *filter.Archived)
+		conditions += fmt.Sprintf(" AND COALESCE(c.is_archived, false) = $%d", len(args))
+	}
+
+	// Folders, tags and pins are the owner's, so those filters only match owned chats
+	if filter.FolderId != "" || filter.TagId != "" || filter.Pinned != nil {
+		conditions += " AND c.user_id = $1"
+	}
+
+	orderBy, ok := chatSortColumns[filter.SortBy]
+	if !ok {
+		orderBy = chatSortColumns["updated_at"]
+	}
+
 	// Check if the specific id exists in arcades, not just the user_id
-	// Also include message count in a single query to avoid N+1 problem
 	query := `
 		SELECT
 			c.id,
@@ -74,19 +151,25 @@ func GetChatsByUserId(userId string) ([]Chat, error) {
 			c.is_archived,
 			c.last_message_at,
 			c.is_private,
-			COALESCE(COUNT(m.id), 0) as message_count
+			c.folder_id,
+			c.is_pinned,
+			COALESCE(cm.role, 'owner') as role,
+			c.version,
+			c.retention_days,
+			c.is_kept,
+			c.persona_id,
+			c.model,
+			c.active_leaf_id
 		FROM chats c
-		LEFT JOIN messages m ON m.chat_id = c.id
-		WHERE c.user_id = $1
+		LEFT JOIN chat_members cm ON cm.chat_id = c.id AND cm.user_id = $1
+		WHERE (c.user_id = $1 OR cm.user_id IS NOT NULL)
 		AND NOT EXISTS (
 			SELECT 1 FROM arcades a WHERE a.id = c.id
-		)
-		GROUP BY c.id, c.user_id, c.title, c.created_at, c.updated_at,
-		         c.is_archived, c.last_message_at, c.is_private
-		ORDER BY c.updated_at DESC
+		)` + conditions + `
+		ORDER BY (c.is_pinned AND c.user_id = $1) DESC, ` + orderBy + `
 	`
 
-	rows, err := DB.QueryContext(ctx, query, userId)
+	rows, err := DB.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -95,6 +178,8 @@ func GetChatsByUserId(userId string) ([]Chat, error) {
 	var chats []Chat
 	for rows.Next() {
 		var chat Chat
+		var folderID, personaID, model, activeLeafID sql.NullString
+		var retentionDays sql.NullInt64
 		err := rows.Scan(
 			&chat.ID,
 			&chat.UserId,
@@ -104,11 +189,29 @@ func GetChatsByUserId(userId string) ([]Chat, error) {
 			&chat.IsArchived,
 			&chat.LastMessageAt,
 			&chat.IsPrivate,
-			&chat.MessageCount, // Now fetched in single query
+			&folderID,
+			&chat.IsPinned,
+			&chat.Role,
+			&chat.Version,
+			&retentionDays,
+			&chat.IsKept,
+			&personaID,
+			&model,
+			&activeLeafID,
 		)
 		if err != nil {
 			return nil, err
 		}
+		chat.RetentionDays = nullInt(retentionDays)
+		chat.PersonaId = personaID.String
+		chat.Model = model.String
+		chat.ActiveLeafId = activeLeafID.String
+		// Folders, tags and pins belong to the owner, members see the chat unorganised
+		if chat.Role == ChatRoleOwner {
+			chat.FolderId = folderID.String
+		} else {
+			chat.IsPinned = false
+		}
 		chats = append(chats, chat)
 	}
 
@@ -117,10 +220,73 @@ func GetChatsByUserId(userId string) ([]Chat, error) {
 		return nil, err
 	}
 
+	if len(chats) == 0 {
+		return chats, nil
+	}
+
+	// Attach tags with one query for the whole page
+	chatIDs := make([]string, len(chats))
+	for i, chat := range chats {
+		chatIDs[i] = chat.ID
+	}
+	tagsByChat, err := GetTagsByChatIDs(chatIDs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range chats {
+		if chats[i].Role == ChatRoleOwner {
+			chats[i].Tags = tagsByChat[chats[i].ID]
+		}
+	}
+
+	// Count the active branch like GetChatById does
+	messagesByChat, err := getMessageLinksByChatIDs(chatIDs)
+	if err != nil {
+		return nil, err
+	}
+	for i := range chats {
+		chats[i].MessageCount = len(ActivePath(messagesByChat[chats[i].ID], chats[i].ActiveLeafId))
+	}
+
 	return chats, nil
 }
 
+// getMessageLinksByChatIDs returns the ids and parents of the messages of
+// chats, in the order ActivePath expects, without their content
+func getMessageLinksByChatIDs(chatIDs []string) (map[string][]Message, error) {
+	ctx := context.Background()
+
+	rows, err := DB.QueryContext(ctx, `
+		SELECT id, chat_id, parent_id FROM messages
+		WHERE chat_id = ANY($1)
+		ORDER BY created_at ASC, id ASC
+	`, pq.Array(chatIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	byChat := make(map[string][]Message, len(chatIDs))
+	for rows.Next() {
+		var msg Message
+		var parentID sql.NullString
+		if err := rows.Scan(&msg.ID, &msg.ChatId, &parentID); err != nil {
+			return nil, err
+		}
+		msg.ParentId = parentID.String
+		byChat[msg.ChatId] = append(byChat[msg.ChatId], msg)
+	}
+	return byChat, rows.Err()
+}
+
 func UpdateChat(chat Chat) error {
+	_, err := UpdateChatIfVersion(chat, 0)
+	return err
+}
+
+// UpdateChatIfVersion updates a chat only while it is still at version, 0
+// skips the check. It returns the new version, or ErrVersionConflict.
+func UpdateChatIfVersion(chat Chat, version int64) (int64, error) {
 	ctx := context.Background()
 	chat.UpdatedAt = time.Now()
 
@@ -128,25 +294,92 @@ func UpdateChat(chat Chat) error {
 	UPDATE chats SET
 		user_id = $2, title = $3, created_at = $4,
 		updated_at = $5, is_archived = $6, last_message_at = $7, is_private = $8
-			WHERE id = $1
+			WHERE id = $1 AND ($9 = 0 OR version = $9)
+	RETURNING version
 	`
-	_, err := DB.ExecContext(ctx, query,
+	var newVersion int64
+	err := DB.QueryRowContext(ctx, query,
 		&chat.ID, &chat.UserId, &chat.Title, &chat.CreatedAt,
 		&chat.UpdatedAt, &chat.IsArchived,
-		&chat.LastMessageAt, &chat.IsPrivate,
+		&chat.LastMessageAt, &chat.IsPrivate, version,
+	).Scan(&newVersion)
+	if err == sql.ErrNoRows && version != 0 {
+		return 0, ErrVersionConflict
+	}
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return newVersion, err
+}
+
+// TouchChat records that a message was added to a chat at, without writing
+// any of the chat's other fields
+func TouchChat(chatID string, at time.Time) error {
+	ctx := context.Background()
+	_, err := DB.ExecContext(ctx,
+		"UPDATE chats SET last_message_at = $2, updated_at = NOW() WHERE id = $1", chatID, at,
 	)
+	return err
+}
+
+// SetChatPinned pins or unpins a chat
+func SetChatPinned(chatID string, pinned bool) error {
+	ctx := context.Background()
+	_, err := DB.ExecContext(ctx, "UPDATE chats SET is_pinned = $2 WHERE id = $1", chatID, pinned)
+	return err
+}
+
+// SetChatModel sets the model a chat is answered with, an empty model goes
+// back to the user's default
+func SetChatModel(chatID, model string) error {
+	ctx := context.Background()
+	_, err := DB.ExecContext(ctx, "UPDATE chats SET model = $2 WHERE id = $1", chatID, nullString(model))
+	return err
+}
 
+// SetChatFolder moves a chat into a folder, an empty folderID removes it from its folder
+func SetChatFolder(chatID, folderID string) error {
+	ctx := context.Background()
+	_, err := DB.ExecContext(ctx, "UPDATE chats SET folder_id = $2 WHERE id = $1", chatID, nullString(folderID))
 	return err
 }
 
 func DeleteChatByID(ID string) error {
+	return DeleteChatByIDIfVersion(ID, 0)
+}
+
+// DeleteChatByIDIfVersion deletes a chat and its messages only while the chat
+// is still at version, 0 skips the check. It returns ErrVersionConflict when
+// the chat changed.
+func DeleteChatByIDIfVersion(ID string, version int64) error {
 	ctx := context.Background()
-	_, err := DB.ExecContext(ctx, "DELETE FROM messages WHERE chat_id = $1", ID)
+
+	tx, err := DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
-	_, err = DB.ExecContext(ctx, "DELETE FROM chats WHERE id = $1", ID)
-	return err
+	defer tx.Rollback()
+
+	// Lock the chat so no edit lands between the check and the delete
+	var found int
+	err = tx.QueryRowContext(ctx,
+		"SELECT 1 FROM chats WHERE id = $1 AND ($2 = 0 OR version = $2) FOR UPDATE", ID, version,
+	).Scan(&found)
+	if err == sql.ErrNoRows && version != 0 {
+		return ErrVersionConflict
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM messages WHERE chat_id = $1", ID); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM chats WHERE id = $1", ID); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
 func DeleteAllChatsByUserID(userID string) error {
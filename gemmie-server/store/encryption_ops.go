@@ -0,0 +1,408 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/imrany/gemmie/gemmie-server/internal/encrypt"
+)
+
+// Encryption at rest. Message prompts and responses, arcade code and share
+// snapshots are encrypted with a data key of the user who owns them, and that
+// key is stored wrapped by the master key from config. Encrypted values look
+// like "enc:v1:<data key id>:<base64 nonce and ciphertext>". Plaintext that
+// starts with "enc:" itself is stored behind "enc:plain:", so a prompt can
+// never pass for ciphertext. Anything else is plaintext written while
+// encryption was off and is returned as is.
+
+const (
+	encryptedPrefix = "enc:v1:"
+	escapedPrefix   = "enc:plain:"
+
+	// activeKeyTTL is how long a server keeps encrypting with the active data
+	// key it looked up, so a rotation by another process is picked up
+	activeKeyTTL = 5 * time.Minute
+
+	DataKeyActive  = "active"
+	DataKeyRetired = "retired"
+)
+
+var ErrEncryptionDisabled = errors.New("encryption is not configured, set ENCRYPTION_MASTER_KEY")
+
+// keyring holds the master keys and the data keys unwrapped so far
+var keyring = struct {
+	sync.RWMutex
+	masterID  string
+	masters   map[string][]byte             // by key id, the current one and previous ones
+	dataKeys  map[string][]byte             // by data key id
+	activeKey map[string]activeDataKeyEntry // by user id
+}{
+	masters:   map[string][]byte{},
+	dataKeys:  map[string][]byte{},
+	activeKey: map[string]activeDataKeyEntry{},
+}
+
+type activeDataKeyEntry struct {
+	id       string
+	loadedAt time.Time
+}
+
+// InitEncryption sets the master key new data keys are wrapped with. previous
+// keys are only used to unwrap data keys until reencrypt has moved them over.
+// An empty master key leaves encryption off, plaintext is then written as before.
+func InitEncryption(masterKey string, previous []string) error {
+	keyring.Lock()
+	defer keyring.Unlock()
+
+	keyring.masterID = ""
+	keyring.masters = map[string][]byte{}
+	keyring.dataKeys = map[string][]byte{}
+	keyring.activeKey = map[string]activeDataKeyEntry{}
+
+	for _, encoded := range previous {
+		if strings.TrimSpace(encoded) == "" {
+			continue
+		}
+		key, err := encrypt.ParseKey(encoded)
+		if err != nil {
+			return fmt.Errorf("previous master key: %w", err)
+		}
+		keyring.masters[encrypt.KeyID(key)] = key
+	}
+
+	if strings.TrimSpace(masterKey) == "" {
+		return nil
+	}
+
+	key, err := encrypt.ParseKey(masterKey)
+	if err != nil {
+		return fmt.Errorf("master key: %w", err)
+	}
+	keyring.masterID = encrypt.KeyID(key)
+	keyring.masters[keyring.masterID] = key
+
+	return nil
+}
+
+// EncryptionEnabled reports whether new content is encrypted
+func EncryptionEnabled() bool {
+	keyring.RLock()
+	defer keyring.RUnlock()
+	return keyring.masterID != ""
+}
+
+// MasterKeyID is the fingerprint of the current master key, empty when encryption is off
+func MasterKeyID() string {
+	keyring.RLock()
+	defer keyring.RUnlock()
+	return keyring.masterID
+}
+
+// MasterKeyLoaded reports whether data keys wrapped by the master key with
+// this id can be unwrapped, as the current key or a previous one
+func MasterKeyLoaded(id string) bool {
+	keyring.RLock()
+	defer keyring.RUnlock()
+	_, ok := keyring.masters[id]
+	return ok
+}
+
+// isEncrypted reports whether a stored value is ciphertext
+func isEncrypted(value string) bool {
+	return strings.HasPrefix(value, encryptedPrefix)
+}
+
+// storedPlaintext returns plaintext as it is stored, escaped when it could be
+// taken for ciphertext or for an escaped value
+func storedPlaintext(plaintext string) string {
+	if strings.HasPrefix(plaintext, "enc:") {
+		return escapedPrefix + plaintext
+	}
+	return plaintext
+}
+
+// dataKeyIDOf returns the id of the data key a stored value was encrypted with
+func dataKeyIDOf(value string) string {
+	if !isEncrypted(value) {
+		return ""
+	}
+	id, _, _ := strings.Cut(strings.TrimPrefix(value, encryptedPrefix), ":")
+	return id
+}
+
+func dataKeyAAD(dataKeyID string) []byte {
+	return []byte("gemmie:" + dataKeyID)
+}
+
+// encryptForUser encrypts a value with the user's active data key. Empty
+// values and everything written while encryption is off stay plaintext.
+func encryptForUser(ctx context.Context, userID, plaintext string) (string, error) {
+	if plaintext == "" || !EncryptionEnabled() {
+		return storedPlaintext(plaintext), nil
+	}
+
+	id, key, err := activeDataKey(ctx, userID)
+	if err != nil {
+		return "", err
+	}
+
+	sealed, err := encrypt.Seal(key, []byte(plaintext), dataKeyAAD(id))
+	if err != nil {
+		return "", err
+	}
+
+	return encryptedPrefix + id + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptValue returns the plaintext of a stored value
+func decryptValue(ctx context.Context, value string) (string, error) {
+	if plaintext, ok := strings.CutPrefix(value, escapedPrefix); ok {
+		return plaintext, nil
+	}
+	if !isEncrypted(value) {
+		return value, nil
+	}
+
+	id, encoded, ok := strings.Cut(strings.TrimPrefix(value, encryptedPrefix), ":")
+	if !ok {
+		return "", fmt.Errorf("malformed encrypted value")
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("malformed encrypted value: %w", err)
+	}
+
+	key, err := dataKeyByID(ctx, id)
+	if err != nil {
+		return "", err
+	}
+
+	plaintext, err := encrypt.Open(key, sealed, dataKeyAAD(id))
+	if err != nil {
+		return "", fmt.Errorf("decrypt with data key %s: %w", id, err)
+	}
+
+	return string(plaintext), nil
+}
+
+// encryptForChat encrypts content of a chat with its owner's data key
+func encryptForChat(ctx context.Context, chatID string, values ...*string) error {
+	if !EncryptionEnabled() {
+		for _, value := range values {
+			*value = storedPlaintext(*value)
+		}
+		return nil
+	}
+
+	var ownerID string
+	if err := DB.QueryRowContext(ctx, "SELECT user_id FROM chats WHERE id = $1", chatID).Scan(&ownerID); err != nil {
+		return fmt.Errorf("chat owner: %w", err)
+	}
+
+	for _, value := range values {
+		encrypted, err := encryptForUser(ctx, ownerID, *value)
+		if err != nil {
+			return err
+		}
+		*value = encrypted
+	}
+
+	return nil
+}
+
+// decryptValues decrypts stored values in place
+func decryptValues(ctx context.Context, values ...*string) error {
+	for _, value := range values {
+		plaintext, err := decryptValue(ctx, *value)
+		if err != nil {
+			return err
+		}
+		*value = plaintext
+	}
+	return nil
+}
+
+// encryptSnapshot encrypts a share snapshot, kept as a JSON string so it fits the JSONB column
+func encryptSnapshot(ctx context.Context, chatID, snapshot string) (string, error) {
+	if snapshot == "" || !EncryptionEnabled() {
+		return snapshot, nil
+	}
+
+	values := []*string{&snapshot}
+	if err := encryptForChat(ctx, chatID, values...); err != nil {
+		return "", err
+	}
+
+	return jsonString(snapshot)
+}
+
+// decryptSnapshot undoes encryptSnapshot, plain JSON snapshots are returned as is
+func decryptSnapshot(ctx context.Context, snapshot string) (string, error) {
+	value := snapshotCiphertext(snapshot)
+	if value == "" {
+		return snapshot, nil
+	}
+	return decryptValue(ctx, value)
+}
+
+// snapshotCiphertext returns the encrypted value inside a stored snapshot,
+// empty when the snapshot is plain JSON
+func snapshotCiphertext(snapshot string) string {
+	if !strings.HasPrefix(snapshot, `"`+encryptedPrefix) {
+		return ""
+	}
+
+	var value string
+	if err := json.Unmarshal([]byte(snapshot), &value); err != nil {
+		return ""
+	}
+	return value
+}
+
+func jsonString(value string) (string, error) {
+	encoded, err := json.Marshal(value)
+	return string(encoded), err
+}
+
+// activeDataKey returns the user's active data key, creating one the first time
+func activeDataKey(ctx context.Context, userID string) (string, []byte, error) {
+	keyring.RLock()
+	entry, cached := keyring.activeKey[userID]
+	key := keyring.dataKeys[entry.id]
+	keyring.RUnlock()
+	if cached && key != nil && time.Since(entry.loadedAt) < activeKeyTTL {
+		return entry.id, key, nil
+	}
+
+	var id string
+	for attempt := 0; attempt < 2; attempt++ {
+		var wrapped []byte
+		var masterID string
+		err := DB.QueryRowContext(ctx, `
+			SELECT id, wrapped_key, master_key_id FROM user_data_keys
+			WHERE user_id = $1 AND state = $2
+		`, userID, DataKeyActive).Scan(&id, &wrapped, &masterID)
+		if err == nil {
+			key, err := unwrapDataKey(id, wrapped, masterID)
+			if err != nil {
+				return "", nil, err
+			}
+			cacheDataKey(userID, id, key)
+			return id, key, nil
+		}
+		if err != sql.ErrNoRows {
+			return "", nil, err
+		}
+
+		id, key, created, err := createDataKey(ctx, userID)
+		if err != nil {
+			return "", nil, err
+		}
+		if created {
+			cacheDataKey(userID, id, key)
+			return id, key, nil
+		}
+		// Another request created the key first, load that one
+	}
+
+	return "", nil, fmt.Errorf("no active data key for user %s", userID)
+}
+
+// createDataKey stores a new active data key for a user. It returns false when
+// the user already has one.
+func createDataKey(ctx context.Context, userID string) (string, []byte, bool, error) {
+	keyring.RLock()
+	masterID := keyring.masterID
+	master := keyring.masters[masterID]
+	keyring.RUnlock()
+	if master == nil {
+		return "", nil, false, ErrEncryptionDisabled
+	}
+
+	key, err := encrypt.NewKey()
+	if err != nil {
+		return "", nil, false, err
+	}
+	prefix := "dek"
+	id := encrypt.GenerateID(&prefix)
+
+	wrapped, err := encrypt.Seal(master, key, dataKeyAAD(id))
+	if err != nil {
+		return "", nil, false, err
+	}
+
+	result, err := DB.ExecContext(ctx, `
+		INSERT INTO user_data_keys (id, user_id, wrapped_key, master_key_id, state)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id) WHERE state = 'active' DO NOTHING
+	`, id, userID, wrapped, masterID, DataKeyActive)
+	if err != nil {
+		return "", nil, false, err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return "", nil, false, nil
+	}
+
+	return id, key, true, nil
+}
+
+// dataKeyByID returns a data key, unwrapping it on first use
+func dataKeyByID(ctx context.Context, id string) ([]byte, error) {
+	keyring.RLock()
+	key := keyring.dataKeys[id]
+	keyring.RUnlock()
+	if key != nil {
+		return key, nil
+	}
+
+	var wrapped []byte
+	var masterID string
+	err := DB.QueryRowContext(ctx,
+		"SELECT wrapped_key, master_key_id FROM user_data_keys WHERE id = $1", id,
+	).Scan(&wrapped, &masterID)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("data key %s not found", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key, err = unwrapDataKey(id, wrapped, masterID)
+	if err != nil {
+		return nil, err
+	}
+	cacheDataKey("", id, key)
+
+	return key, nil
+}
+
+func unwrapDataKey(id string, wrapped []byte, masterID string) ([]byte, error) {
+	keyring.RLock()
+	master := keyring.masters[masterID]
+	keyring.RUnlock()
+	if master == nil {
+		return nil, fmt.Errorf("data key %s is wrapped by master key %s, which is not configured", id, masterID)
+	}
+
+	key, err := encrypt.Open(master, wrapped, dataKeyAAD(id))
+	if err != nil {
+		return nil, fmt.Errorf("unwrap data key %s: %w", id, err)
+	}
+	return key, nil
+}
+
+func cacheDataKey(userID, id string, key []byte) {
+	keyring.Lock()
+	defer keyring.Unlock()
+	keyring.dataKeys[id] = key
+	if userID != "" {
+		keyring.activeKey[userID] = activeDataKeyEntry{id: id, loadedAt: time.Now()}
+	}
+}
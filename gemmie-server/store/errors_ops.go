@@ -72,6 +72,48 @@ func GetPlatformErrors() ([]PlatformError, error) {
 	return errors, nil
 }
 
+// GetPlatformErrorsByUserID returns the platform errors submitted by a user
+func GetPlatformErrorsByUserID(userID string) ([]PlatformError, error) {
+	ctx := context.Background()
+
+	query := `
+		SELECT id, user_id, message, description,
+			action, status, context, severity,
+			created_at, updated_at
+		FROM platform_errors WHERE user_id = $1
+		ORDER BY updated_at DESC
+	`
+
+	rows, err := DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var errors []PlatformError
+	for rows.Next() {
+		var error PlatformError
+		var description, action, status, errContext, severity, createdAt sql.NullString
+		err := rows.Scan(
+			&error.ID, &error.UserId, &error.Message, &description,
+			&action, &status, &errContext, &severity,
+			&createdAt, &error.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		error.Description = description.String
+		error.Action = action.String
+		error.Status = status.String
+		error.Context = errContext.String
+		error.Severity = severity.String
+		error.CreatedAt = createdAt.String
+		errors = append(errors, error)
+	}
+
+	return errors, rows.Err()
+}
+
 func GetPlatformErrorByID(errorID string) (*PlatformError, error) {
 	ctx := context.Background()
 
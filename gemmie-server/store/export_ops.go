@@ -0,0 +1,194 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Data export operations
+
+func CreateDataExport(export DataExport) error {
+	ctx := context.Background()
+
+	if export.CreatedAt.IsZero() {
+		export.CreatedAt = time.Now()
+	}
+	if export.Status == "" {
+		export.Status = ExportStatusPending
+	}
+
+	query := `
+		INSERT INTO data_exports (id, user_id, status, token, created_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`
+
+	_, err := DB.ExecContext(ctx, query,
+		export.ID, export.UserId, export.Status, export.Token, export.CreatedAt,
+	)
+
+	return err
+}
+
+func UpdateDataExport(export DataExport) error {
+	ctx := context.Background()
+
+	query := `
+		UPDATE data_exports SET
+			status = $2, file_path = $3, file_size = $4, error = $5,
+			completed_at = $6, expires_at = $7
+		WHERE id = $1
+	`
+
+	_, err := DB.ExecContext(ctx, query,
+		export.ID, export.Status, export.FilePath, export.FileSize, export.Error,
+		nullTime(export.CompletedAt), nullTime(export.ExpiresAt),
+	)
+
+	return err
+}
+
+func GetDataExportByID(ID string) (*DataExport, error) {
+	ctx := context.Background()
+
+	query := `
+		SELECT id, user_id, status, file_path, file_size, token, error,
+			   created_at, completed_at, expires_at
+		FROM data_exports WHERE id = $1
+	`
+
+	export, err := scanDataExport(DB.QueryRowContext(ctx, query, ID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return export, err
+}
+
+// GetDataExportsByUserID returns the export jobs of a user, newest first
+func GetDataExportsByUserID(userID string) ([]DataExport, error) {
+	ctx := context.Background()
+
+	query := `
+		SELECT id, user_id, status, file_path, file_size, token, error,
+			   created_at, completed_at, expires_at
+		FROM data_exports WHERE user_id = $1
+		ORDER BY created_at DESC
+	`
+
+	rows, err := DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var exports []DataExport
+	for rows.Next() {
+		export, err := scanDataExport(rows)
+		if err != nil {
+			return nil, err
+		}
+		exports = append(exports, *export)
+	}
+
+	return exports, rows.Err()
+}
+
+// HasActiveDataExport reports whether the user already has a pending or processing export
+func HasActiveDataExport(userID string) (bool, error) {
+	ctx := context.Background()
+
+	query := `SELECT EXISTS(SELECT 1 FROM data_exports WHERE user_id = $1 AND status IN ($2, $3))`
+	var exists bool
+	err := DB.QueryRowContext(ctx, query, userID, ExportStatusPending, ExportStatusProcessing).Scan(&exists)
+	return exists, err
+}
+
+// GetExpiredDataExports returns ready exports whose download window has passed
+func GetExpiredDataExports(now time.Time) ([]DataExport, error) {
+	ctx := context.Background()
+
+	query := `
+		SELECT id, user_id, status, file_path, file_size, token, error,
+			   created_at, completed_at, expires_at
+		FROM data_exports WHERE expires_at IS NOT NULL AND expires_at < $1
+	`
+
+	rows, err := DB.QueryContext(ctx, query, now)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var exports []DataExport
+	for rows.Next() {
+		export, err := scanDataExport(rows)
+		if err != nil {
+			return nil, err
+		}
+		exports = append(exports, *export)
+	}
+
+	return exports, rows.Err()
+}
+
+// FailStaleDataExports marks exports that never finished (e.g. the server restarted
+// mid-job) as failed so the user can request a new one
+func FailStaleDataExports(createdBefore time.Time) (int64, error) {
+	ctx := context.Background()
+
+	query := `
+		UPDATE data_exports SET status = $1, error = $2, completed_at = NOW()
+		WHERE status IN ($3, $4) AND created_at < $5
+	`
+	result, err := DB.ExecContext(ctx, query,
+		ExportStatusFailed, "export did not complete, please request a new one",
+		ExportStatusPending, ExportStatusProcessing, createdBefore,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func DeleteDataExportByID(ID string) error {
+	ctx := context.Background()
+	_, err := DB.ExecContext(ctx, "DELETE FROM data_exports WHERE id = $1", ID)
+	return err
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanDataExport(row rowScanner) (*DataExport, error) {
+	export := &DataExport{}
+	var filePath, exportErr sql.NullString
+	var fileSize sql.NullInt64
+	var completedAt, expiresAt sql.NullTime
+
+	err := row.Scan(
+		&export.ID, &export.UserId, &export.Status, &filePath, &fileSize,
+		&export.Token, &exportErr, &export.CreatedAt, &completedAt, &expiresAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	export.FilePath = filePath.String
+	export.FileSize = fileSize.Int64
+	export.Error = exportErr.String
+	if completedAt.Valid {
+		export.CompletedAt = completedAt.Time
+	}
+	if expiresAt.Valid {
+		export.ExpiresAt = expiresAt.Time
+	}
+
+	return export, nil
+}
+
+// nullTime maps a zero time to SQL NULL
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
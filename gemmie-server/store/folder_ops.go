@@ -0,0 +1,109 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Folder operations
+
+func CreateFolder(folder Folder) error {
+	ctx := context.Background()
+
+	now := time.Now()
+	if folder.CreatedAt.IsZero() {
+		folder.CreatedAt = now
+	}
+	folder.UpdatedAt = now
+
+	query := `
+		INSERT INTO folders (id, user_id, name, color, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`
+
+	_, err := DB.ExecContext(ctx, query,
+		folder.ID, folder.UserId, folder.Name, nullString(folder.Color),
+		folder.CreatedAt, folder.UpdatedAt,
+	)
+
+	return err
+}
+
+// GetFoldersByUserID returns a user's folders by name, with the number of chats in each
+func GetFoldersByUserID(userID string) ([]Folder, error) {
+	ctx := context.Background()
+
+	query := `
+		SELECT f.id, f.user_id, f.name, f.color, f.created_at, f.updated_at,
+			   (SELECT COUNT(*) FROM chats c WHERE c.folder_id = f.id) AS chat_count
+		FROM folders f
+		WHERE f.user_id = $1
+		ORDER BY LOWER(f.name) ASC
+	`
+
+	rows, err := DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var folders []Folder
+	for rows.Next() {
+		folder, err := scanFolder(rows)
+		if err != nil {
+			return nil, err
+		}
+		folders = append(folders, *folder)
+	}
+
+	return folders, rows.Err()
+}
+
+func GetFolderByID(ID string) (*Folder, error) {
+	ctx := context.Background()
+
+	query := `
+		SELECT f.id, f.user_id, f.name, f.color, f.created_at, f.updated_at,
+			   (SELECT COUNT(*) FROM chats c WHERE c.folder_id = f.id) AS chat_count
+		FROM folders f WHERE f.id = $1
+	`
+
+	folder, err := scanFolder(DB.QueryRowContext(ctx, query, ID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return folder, err
+}
+
+func UpdateFolder(folder Folder) error {
+	ctx := context.Background()
+
+	query := `UPDATE folders SET name = $2, color = $3, updated_at = $4 WHERE id = $1`
+	_, err := DB.ExecContext(ctx, query, folder.ID, folder.Name, nullString(folder.Color), time.Now())
+	return err
+}
+
+// DeleteFolderByID removes a folder, its chats are kept and moved out of it
+func DeleteFolderByID(ID string) error {
+	ctx := context.Background()
+	_, err := DB.ExecContext(ctx, "DELETE FROM folders WHERE id = $1", ID)
+	return err
+}
+
+func scanFolder(row rowScanner) (*Folder, error) {
+	folder := &Folder{}
+	var color sql.NullString
+
+	err := row.Scan(
+		&folder.ID, &folder.UserId, &folder.Name, &color,
+		&folder.CreatedAt, &folder.UpdatedAt, &folder.ChatCount,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	folder.Color = color.String
+	return folder, nil
+}
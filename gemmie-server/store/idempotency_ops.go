@@ -0,0 +1,97 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Idempotency key operations
+
+// ClaimIdempotencyKey reserves scope/key for a request about to run. It
+// returns true when the caller owns the key and should run the request. A
+// key can be taken over once it has expired, or when its request has been in
+// progress since before staleBefore, which means the server died mid-request.
+func ClaimIdempotencyKey(scope, key, fingerprint string, expiresAt, staleBefore time.Time) (bool, error) {
+	ctx := context.Background()
+
+	query := `
+		INSERT INTO idempotency_keys (scope, key, fingerprint, state, created_at, expires_at)
+		VALUES ($1, $2, $3, $4, NOW(), $5)
+		ON CONFLICT (scope, key) DO UPDATE SET
+			fingerprint = EXCLUDED.fingerprint, state = EXCLUDED.state, status_code = 0,
+			content_type = '', response = NULL,
+			created_at = EXCLUDED.created_at, expires_at = EXCLUDED.expires_at
+		WHERE idempotency_keys.expires_at < NOW()
+			OR (idempotency_keys.state = $4 AND idempotency_keys.created_at < $6)
+		RETURNING key
+	`
+
+	var claimed string
+	err := DB.QueryRowContext(ctx, query,
+		scope, key, fingerprint, IdempotencyStateInProgress, expiresAt, staleBefore,
+	).Scan(&claimed)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+func GetIdempotencyKey(scope, key string) (*IdempotencyKey, error) {
+	ctx := context.Background()
+
+	query := `
+		SELECT scope, key, fingerprint, state, status_code, content_type, response, created_at, expires_at
+		FROM idempotency_keys WHERE scope = $1 AND key = $2
+	`
+
+	record := &IdempotencyKey{}
+	err := DB.QueryRowContext(ctx, query, scope, key).Scan(
+		&record.Scope, &record.Key, &record.Fingerprint, &record.State,
+		&record.StatusCode, &record.ContentType, &record.Response,
+		&record.CreatedAt, &record.ExpiresAt,
+	)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// CompleteIdempotencyKey stores the response to replay for a claimed key
+func CompleteIdempotencyKey(scope, key string, statusCode int, contentType string, response []byte) error {
+	ctx := context.Background()
+
+	query := `
+		UPDATE idempotency_keys SET state = $3, status_code = $4, content_type = $5, response = $6
+		WHERE scope = $1 AND key = $2
+	`
+
+	_, err := DB.ExecContext(ctx, query,
+		scope, key, IdempotencyStateCompleted, statusCode, contentType, response,
+	)
+	return err
+}
+
+// ReleaseIdempotencyKey forgets a claimed key so the request can be retried
+func ReleaseIdempotencyKey(scope, key string) error {
+	ctx := context.Background()
+	_, err := DB.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE scope = $1 AND key = $2", scope, key)
+	return err
+}
+
+// DeleteExpiredIdempotencyKeys removes keys past their retention window
+func DeleteExpiredIdempotencyKeys(now time.Time) (int64, error) {
+	ctx := context.Background()
+
+	result, err := DB.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE expires_at < $1", now)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,261 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Chat membership operations
+
+// GetChatMemberRole returns the role of userID in a chat, or "" when they are not a member
+func GetChatMemberRole(chatID, userID string) (string, error) {
+	ctx := context.Background()
+
+	var role string
+	err := DB.QueryRowContext(ctx,
+		"SELECT role FROM chat_members WHERE chat_id = $1 AND user_id = $2", chatID, userID,
+	).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+
+	return role, err
+}
+
+// GetChatMembers returns the members of a chat, owner first
+func GetChatMembers(chatID string) ([]ChatMember, error) {
+	ctx := context.Background()
+
+	query := `
+		SELECT cm.chat_id, cm.user_id, u.username, cm.role, cm.invited_by, cm.created_at
+		FROM chat_members cm
+		JOIN users u ON u.id = cm.user_id
+		WHERE cm.chat_id = $1
+		ORDER BY CASE cm.role WHEN 'owner' THEN 0 WHEN 'editor' THEN 1 ELSE 2 END, cm.created_at
+	`
+
+	rows, err := DB.QueryContext(ctx, query, chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []ChatMember
+	for rows.Next() {
+		var member ChatMember
+		var invitedBy sql.NullString
+		if err := rows.Scan(
+			&member.ChatId, &member.UserId, &member.Username,
+			&member.Role, &invitedBy, &member.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		member.InvitedBy = invitedBy.String
+		members = append(members, member)
+	}
+
+	return members, rows.Err()
+}
+
+// GetChatMemberIDs returns the user ids of everyone in a chat
+func GetChatMemberIDs(chatID string) ([]string, error) {
+	ctx := context.Background()
+
+	rows, err := DB.QueryContext(ctx, "SELECT user_id FROM chat_members WHERE chat_id = $1", chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+func UpdateChatMemberRole(chatID, userID, role string) error {
+	ctx := context.Background()
+	_, err := DB.ExecContext(ctx,
+		"UPDATE chat_members SET role = $3 WHERE chat_id = $1 AND user_id = $2", chatID, userID, role,
+	)
+	return err
+}
+
+func RemoveChatMember(chatID, userID string) error {
+	ctx := context.Background()
+	_, err := DB.ExecContext(ctx,
+		"DELETE FROM chat_members WHERE chat_id = $1 AND user_id = $2", chatID, userID,
+	)
+	return err
+}
+
+// Chat invitation operations
+
+func CreateChatInvitation(invitation ChatInvitation) error {
+	ctx := context.Background()
+
+	if invitation.CreatedAt.IsZero() {
+		invitation.CreatedAt = time.Now()
+	}
+
+	query := `
+		INSERT INTO chat_invitations (id, chat_id, invitee_id, invited_by, role, status, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+
+	_, err := DB.ExecContext(ctx, query,
+		invitation.ID, invitation.ChatId, invitation.InviteeId, invitation.InvitedBy,
+		invitation.Role, InvitationStatusPending, invitation.CreatedAt,
+	)
+
+	return err
+}
+
+const chatInvitationColumns = `
+	i.id, i.chat_id, c.title, i.invitee_id, invitee.username, i.invited_by, inviter.username,
+	i.role, i.status, i.created_at, i.responded_at
+`
+
+const chatInvitationJoins = `
+	FROM chat_invitations i
+	JOIN chats c ON c.id = i.chat_id
+	JOIN users invitee ON invitee.id = i.invitee_id
+	JOIN users inviter ON inviter.id = i.invited_by
+`
+
+func GetChatInvitationByID(ID string) (*ChatInvitation, error) {
+	ctx := context.Background()
+
+	query := `SELECT ` + chatInvitationColumns + chatInvitationJoins + ` WHERE i.id = $1`
+
+	invitation, err := scanChatInvitation(DB.QueryRowContext(ctx, query, ID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return invitation, err
+}
+
+// GetPendingInvitationsForUser returns invitations waiting for userID to answer, newest first
+func GetPendingInvitationsForUser(userID string) ([]ChatInvitation, error) {
+	return queryChatInvitations(
+		`WHERE i.invitee_id = $1 AND i.status = $2 ORDER BY i.created_at DESC`,
+		userID, InvitationStatusPending,
+	)
+}
+
+// GetPendingInvitationsForChat returns invitations of a chat that are not answered yet
+func GetPendingInvitationsForChat(chatID string) ([]ChatInvitation, error) {
+	return queryChatInvitations(
+		`WHERE i.chat_id = $1 AND i.status = $2 ORDER BY i.created_at DESC`,
+		chatID, InvitationStatusPending,
+	)
+}
+
+func queryChatInvitations(where string, args ...any) ([]ChatInvitation, error) {
+	ctx := context.Background()
+
+	query := `SELECT ` + chatInvitationColumns + chatInvitationJoins + where
+
+	rows, err := DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invitations []ChatInvitation
+	for rows.Next() {
+		invitation, err := scanChatInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, *invitation)
+	}
+
+	return invitations, rows.Err()
+}
+
+// RespondToChatInvitation records the answer to a pending invitation. Accepting
+// adds the invitee as a member with the invited role in the same transaction.
+func RespondToChatInvitation(invitation ChatInvitation, accept bool) error {
+	ctx := context.Background()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	status := InvitationStatusDeclined
+	if accept {
+		status = InvitationStatusAccepted
+	}
+
+	result, err := tx.ExecContext(ctx,
+		"UPDATE chat_invitations SET status = $2, responded_at = NOW() WHERE id = $1 AND status = $3",
+		invitation.ID, status, InvitationStatusPending,
+	)
+	if err != nil {
+		return err
+	}
+	if count, err := result.RowsAffected(); err != nil {
+		return err
+	} else if count == 0 {
+		return sql.ErrNoRows
+	}
+
+	if accept {
+		// An existing member keeps the higher of the two roles
+		query := `
+			INSERT INTO chat_members (chat_id, user_id, role, invited_by, created_at)
+			VALUES ($1, $2, $3, $4, NOW())
+			ON CONFLICT (chat_id, user_id) DO UPDATE SET role = CASE
+				WHEN chat_members.role = 'owner' OR (chat_members.role = 'editor' AND EXCLUDED.role = 'viewer')
+				THEN chat_members.role ELSE EXCLUDED.role END
+		`
+		if _, err := tx.ExecContext(ctx, query,
+			invitation.ChatId, invitation.InviteeId, invitation.Role, invitation.InvitedBy,
+		); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// CancelChatInvitation withdraws a pending invitation
+func CancelChatInvitation(ID string) error {
+	ctx := context.Background()
+	_, err := DB.ExecContext(ctx,
+		"DELETE FROM chat_invitations WHERE id = $1 AND status = $2", ID, InvitationStatusPending,
+	)
+	return err
+}
+
+func scanChatInvitation(row rowScanner) (*ChatInvitation, error) {
+	invitation := &ChatInvitation{}
+	var respondedAt sql.NullTime
+
+	err := row.Scan(
+		&invitation.ID, &invitation.ChatId, &invitation.ChatTitle,
+		&invitation.InviteeId, &invitation.InviteeName,
+		&invitation.InvitedBy, &invitation.InviterName,
+		&invitation.Role, &invitation.Status, &invitation.CreatedAt, &respondedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if respondedAt.Valid {
+		invitation.RespondedAt = respondedAt.Time
+	}
+
+	return invitation, nil
+}
@@ -0,0 +1,129 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+)
+
+// SetChatActiveLeaf selects the branch shown for a chat by its last message
+func SetChatActiveLeaf(chatID, leafID string) error {
+	ctx := context.Background()
+	_, err := DB.ExecContext(ctx,
+		"UPDATE chats SET active_leaf_id = $2, updated_at = NOW() WHERE id = $1",
+		chatID, nullString(leafID),
+	)
+	return err
+}
+
+// messageIndex groups the messages of a chat by parent. Messages are expected in
+// created_at order, so every list of children is oldest first.
+type messageIndex struct {
+	byID     map[string]Message
+	children map[string][]string // "" holds the root messages
+}
+
+func indexMessages(messages []Message) messageIndex {
+	idx := messageIndex{
+		byID:     make(map[string]Message, len(messages)),
+		children: make(map[string][]string),
+	}
+	for _, msg := range messages {
+		idx.byID[msg.ID] = msg
+	}
+	for _, msg := range messages {
+		parent := msg.ParentId
+		if _, ok := idx.byID[parent]; !ok {
+			parent = ""
+		}
+		idx.children[parent] = append(idx.children[parent], msg.ID)
+	}
+	return idx
+}
+
+// latestLeaf follows the newest reply from fromID down to the end of its branch.
+// An empty fromID starts from the newest root message.
+func (idx messageIndex) latestLeaf(fromID string) string {
+	current := fromID
+	// bounded by the number of messages in case of a cycle in corrupted data
+	for range len(idx.byID) + 1 {
+		kids := idx.children[current]
+		if len(kids) == 0 {
+			break
+		}
+		current = kids[len(kids)-1]
+	}
+	return current
+}
+
+// LatestLeaf returns the last message of the newest branch below fromID
+func LatestLeaf(messages []Message, fromID string) string {
+	return indexMessages(messages).latestLeaf(fromID)
+}
+
+// ActivePath returns the messages from the root to leafID in conversation order.
+// When leafID is unknown the newest branch is used. Messages that have alternative
+// branches carry the ids of all of them in Siblings.
+func ActivePath(messages []Message, leafID string) []Message {
+	if len(messages) == 0 {
+		return nil
+	}
+
+	idx := indexMessages(messages)
+	if _, ok := idx.byID[leafID]; !ok {
+		leafID = idx.latestLeaf("")
+	}
+
+	var path []Message
+	seen := make(map[string]bool)
+	for id := leafID; id != "" && !seen[id]; {
+		seen[id] = true
+		msg, ok := idx.byID[id]
+		if !ok {
+			break
+		}
+		parent := msg.ParentId
+		if _, ok := idx.byID[parent]; !ok {
+			parent = ""
+		}
+		if siblings := idx.children[parent]; len(siblings) > 1 {
+			msg.Siblings = siblings
+		}
+		path = append(path, msg)
+		id = parent
+	}
+
+	// Reverse into root-first order
+	for i, j := 0, len(path)-1; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+	return path
+}
+
+// BuildMessageTree nests the messages of a chat under their parents
+func BuildMessageTree(messages []Message) []MessageNode {
+	idx := indexMessages(messages)
+
+	var build func(parent string, depth int) []MessageNode
+	build = func(parent string, depth int) []MessageNode {
+		ids := idx.children[parent]
+		nodes := make([]MessageNode, 0, len(ids))
+		// depth guards against a cycle in corrupted data
+		if depth > len(messages) {
+			return nodes
+		}
+		for _, id := range ids {
+			nodes = append(nodes, MessageNode{
+				Message:  idx.byID[id],
+				Children: build(id, depth+1),
+			})
+		}
+		return nodes
+	}
+
+	return build("", 0)
+}
+
+// nullString maps an empty string to SQL NULL
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
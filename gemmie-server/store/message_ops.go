@@ -8,6 +8,7 @@ import (
 	"github.com/lib/pq"
 )
 
+// CreateMessage inserts a message and makes it the active leaf of its chat
 func CreateMessage(msg Message) error {
 	ctx := context.Background()
 
@@ -15,18 +16,36 @@ func CreateMessage(msg Message) error {
 		msg.CreatedAt = time.Now()
 	}
 
+	if err := encryptForChat(ctx, msg.ChatId, &msg.Prompt, &msg.Response); err != nil {
+		return err
+	}
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	query := `
-		INSERT INTO messages (id, chat_id, prompt, response, created_at, model, references_ids)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		INSERT INTO messages (id, chat_id, parent_id, author_id, prompt, response, created_at, model, references_ids, is_partial)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
 	`
 
-	_, err := DB.ExecContext(ctx, query,
-		msg.ID, msg.ChatId, msg.Prompt,
+	if _, err := tx.ExecContext(ctx, query,
+		msg.ID, msg.ChatId, nullString(msg.ParentId), nullString(msg.AuthorId), msg.Prompt,
 		msg.Response, msg.CreatedAt, msg.Model,
-		pq.Array(msg.References),
-	)
+		pq.Array(msg.References), msg.IsPartial,
+	); err != nil {
+		return err
+	}
 
-	return err
+	if _, err := tx.ExecContext(ctx,
+		"UPDATE chats SET active_leaf_id = $2 WHERE id = $1", msg.ChatId, msg.ID,
+	); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 func GetMessagesByChatId(chatId string) ([]Message, error) {
@@ -34,11 +53,15 @@ func GetMessagesByChatId(chatId string) ([]Message, error) {
 
 	query := `
 	SELECT
-		m.id, m.chat_id, m.prompt, m.response, m.created_at, m.model, m.references_ids
+		m.id, m.chat_id, m.parent_id, m.author_id, u.username, m.prompt, m.response, m.created_at, m.model, m.references_ids,
+		m.edited_at, m.is_partial,
+		(SELECT COUNT(*) FROM message_versions v WHERE v.message_id = m.id) AS version_count,
+		m.version
 	FROM messages m
+	LEFT JOIN users u ON u.id = m.author_id
 	WHERE m.chat_id = $1
-	ORDER BY m.created_at ASC
-		`
+	ORDER BY m.created_at ASC, m.id ASC
+	`
 
 	rows, err := DB.QueryContext(ctx, query, chatId)
 	if err != nil {
@@ -50,14 +73,26 @@ func GetMessagesByChatId(chatId string) ([]Message, error) {
 
 	for rows.Next() {
 		var msg Message
+		var parentID, authorID, authorName sql.NullString
+		var editedAt sql.NullTime
 		err := rows.Scan(
-			&msg.ID, &msg.ChatId, &msg.Prompt,
+			&msg.ID, &msg.ChatId, &parentID, &authorID, &authorName, &msg.Prompt,
 			&msg.Response, &msg.CreatedAt, &msg.Model,
-			pq.Array(&msg.References),
+			pq.Array(&msg.References), &editedAt, &msg.IsPartial, &msg.VersionCount, &msg.Version,
 		)
 		if err != nil {
 			return nil, err
 		}
+		if err := decryptValues(ctx, &msg.Prompt, &msg.Response); err != nil {
+			return nil, err
+		}
+		msg.ParentId = parentID.String
+		msg.AuthorId = authorID.String
+		msg.AuthorName = authorName.String
+		if editedAt.Valid {
+			msg.EditedAt = editedAt.Time
+			msg.IsEdited = true
+		}
 		messages = append(messages, msg)
 	}
 
@@ -77,6 +112,9 @@ func UpdateMessage(msg Message) error {
 		chat_id = $2, prompt = $3, response = $4, created_at = $5, model = $6, references_ids = $7
 			WHERE id = $1
 	`
+	if err := encryptForChat(ctx, msg.ChatId, &msg.Prompt, &msg.Response); err != nil {
+		return err
+	}
 	_, err := DB.ExecContext(ctx, query,
 		msg.ID, msg.ChatId, msg.Prompt,
 		msg.Response, msg.CreatedAt, msg.Model,
@@ -91,28 +129,93 @@ func GetMessageById(ID string) (*Message, error) {
 
 	query := `
 	SELECT
-		m.id, m.chat_id, m.prompt, m.response, m.created_at, m.model, m.references_ids
-	FROM messages m WHERE m.id = $1
+		m.id, m.chat_id, m.parent_id, m.author_id, u.username, m.prompt, m.response, m.created_at, m.model, m.references_ids,
+		m.edited_at, m.is_partial,
+		(SELECT COUNT(*) FROM message_versions v WHERE v.message_id = m.id) AS version_count,
+		m.version
+	FROM messages m
+	LEFT JOIN users u ON u.id = m.author_id
+	WHERE m.id = $1
 	`
 
 	message := &Message{}
+	var parentID, authorID, authorName sql.NullString
+	var editedAt sql.NullTime
 	err := DB.QueryRowContext(ctx, query, ID).Scan(
-		&message.ID, &message.ChatId, &message.Prompt,
+		&message.ID, &message.ChatId, &parentID, &authorID, &authorName, &message.Prompt,
 		&message.Response, &message.CreatedAt, &message.Model,
-		pq.Array(&message.References),
+		pq.Array(&message.References), &editedAt, &message.IsPartial, &message.VersionCount, &message.Version,
 	)
 
 	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
 		return nil, err
 	}
 
-	return message, err
+	if err := decryptValues(ctx, &message.Prompt, &message.Response); err != nil {
+		return nil, err
+	}
+	message.ParentId = parentID.String
+	message.AuthorId = authorID.String
+	message.AuthorName = authorName.String
+	if editedAt.Valid {
+		message.EditedAt = editedAt.Time
+		message.IsEdited = true
+	}
+
+	return message, nil
 }
 
+// DeleteMessageByID removes a single message. Its replies are attached to its
+// parent so the rest of the branch is kept, as it was before chats had branches.
 func DeleteMessageByID(ID string) error {
+	return DeleteMessageByIDIfVersion(ID, 0)
+}
+
+// DeleteMessageByIDIfVersion deletes a message like DeleteMessageByID, only
+// while it is still at version, 0 skips the check. It returns
+// ErrVersionConflict when the message changed.
+func DeleteMessageByIDIfVersion(ID string, version int64) error {
 	ctx := context.Background()
-	_, err := DB.ExecContext(ctx, "DELETE FROM messages WHERE id = $1", ID)
-	return err
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the message so no edit lands between the check and the delete
+	var parentID sql.NullString
+	err = tx.QueryRowContext(ctx,
+		"SELECT parent_id FROM messages WHERE id = $1 AND ($2 = 0 OR version = $2) FOR UPDATE", ID, version,
+	).Scan(&parentID)
+	if err == sql.ErrNoRows && version != 0 {
+		return ErrVersionConflict
+	}
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx,
+		"UPDATE messages SET parent_id = $2 WHERE parent_id = $1", ID, parentID,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx,
+		"UPDATE chats SET active_leaf_id = $2 WHERE active_leaf_id = $1", ID, parentID,
+	); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM messages WHERE id = $1", ID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
 func DeleteAllMessageByChatID(chatID string) error {
@@ -0,0 +1,147 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/imrany/gemmie/gemmie-server/internal/encrypt"
+	"github.com/lib/pq"
+)
+
+// UpdateMessageWithHistory saves the current state of a message as a version and
+// then applies the new content, both in one transaction
+func UpdateMessageWithHistory(msg Message, editorID string) error {
+	_, err := UpdateMessageWithHistoryIfVersion(msg, editorID, 0)
+	return err
+}
+
+// UpdateMessageWithHistoryIfVersion is UpdateMessageWithHistory for a message
+// still at version, 0 skips the check. It returns the new version.
+func UpdateMessageWithHistoryIfVersion(msg Message, editorID string, version int64) (int64, error) {
+	ctx := context.Background()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Lock the row first so the version can't move between the check and the update
+	var current int64
+	var chatID string
+	err = tx.QueryRowContext(ctx,
+		"SELECT version, chat_id FROM messages WHERE id = $1 FOR UPDATE", msg.ID,
+	).Scan(&current, &chatID)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if version != 0 && current != version {
+		return 0, ErrVersionConflict
+	}
+
+	// The snapshot below copies the stored, possibly encrypted, content as is
+	if err := encryptForChat(ctx, chatID, &msg.Prompt, &msg.Response); err != nil {
+		return 0, err
+	}
+
+	prefix := "ver"
+	snapshot := `
+		INSERT INTO message_versions (id, message_id, chat_id, prompt, response, model, references_ids, edited_by, created_at)
+		SELECT $1, m.id, m.chat_id, m.prompt, m.response, m.model, m.references_ids, $2, $3
+		FROM messages m WHERE m.id = $4
+	`
+	if _, err := tx.ExecContext(ctx, snapshot,
+		encrypt.GenerateID(&prefix), editorID, time.Now(), msg.ID,
+	); err != nil {
+		return 0, err
+	}
+
+	update := `
+		UPDATE messages SET
+			prompt = $2, response = $3, model = $4, references_ids = $5, edited_at = $6,
+			is_partial = false
+		WHERE id = $1
+		RETURNING version
+	`
+	var newVersion int64
+	if err := tx.QueryRowContext(ctx, update,
+		msg.ID, msg.Prompt, msg.Response, msg.Model,
+		pq.Array(msg.References), time.Now(),
+	).Scan(&newVersion); err != nil {
+		return 0, err
+	}
+
+	return newVersion, tx.Commit()
+}
+
+// GetMessageVersions returns all prior states of a message, newest first
+func GetMessageVersions(messageID string) ([]MessageVersion, error) {
+	ctx := context.Background()
+
+	query := `
+	SELECT id, message_id, chat_id, prompt, response, model, references_ids, edited_by, created_at
+	FROM message_versions
+	WHERE message_id = $1
+	ORDER BY created_at DESC
+	`
+
+	rows, err := DB.QueryContext(ctx, query, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []MessageVersion
+	for rows.Next() {
+		version, err := scanMessageVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, *version)
+	}
+
+	return versions, rows.Err()
+}
+
+func GetMessageVersionByID(ID string) (*MessageVersion, error) {
+	ctx := context.Background()
+
+	query := `
+	SELECT id, message_id, chat_id, prompt, response, model, references_ids, edited_by, created_at
+	FROM message_versions WHERE id = $1
+	`
+
+	version, err := scanMessageVersion(DB.QueryRowContext(ctx, query, ID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return version, err
+}
+
+func scanMessageVersion(row rowScanner) (*MessageVersion, error) {
+	version := &MessageVersion{}
+	var prompt, model, editedBy sql.NullString
+
+	err := row.Scan(
+		&version.ID, &version.MessageId, &version.ChatId, &prompt,
+		&version.Response, &model, pq.Array(&version.References),
+		&editedBy, &version.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	version.Prompt = prompt.String
+	if err := decryptValues(context.Background(), &version.Prompt, &version.Response); err != nil {
+		return nil, err
+	}
+	version.Model = model.String
+	version.EditedBy = editedBy.String
+
+	return version, nil
+}
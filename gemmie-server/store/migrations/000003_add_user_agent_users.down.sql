@@ -0,0 +1,2 @@
+-- 000003_add_user_agent_users.down.sql
+ALTER TABLE users DROP COLUMN IF EXISTS user_agent;
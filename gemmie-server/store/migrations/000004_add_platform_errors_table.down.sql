@@ -0,0 +1,2 @@
+-- dropped platform_error table
+DROP TABLE IF EXISTS platform_errors;
@@ -0,0 +1,3 @@
+-- removed chat_id from arcades
+ALTER TABLE arcades DROP CONSTRAINT IF EXISTS unique_chat_id;
+ALTER TABLE arcades DROP COLUMN IF EXISTS chat_id;
@@ -0,0 +1,3 @@
+-- added chat_id back into arcades, the values dropped going up are not restored
+ALTER TABLE arcades ADD COLUMN IF NOT EXISTS chat_id TEXT REFERENCES chats(id);
+ALTER TABLE arcades ADD CONSTRAINT unique_chat_id UNIQUE (chat_id);
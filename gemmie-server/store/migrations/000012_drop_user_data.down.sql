@@ -0,0 +1,8 @@
+-- recreate user_data TABLE as created by 000001, without its dropped rows
+CREATE TABLE IF NOT EXISTS user_data (
+    user_id TEXT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    chats TEXT,
+    link_previews TEXT,
+    current_chat_id TEXT,
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
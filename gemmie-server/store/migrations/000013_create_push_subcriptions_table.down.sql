@@ -0,0 +1,2 @@
+-- drop push_subscriptions table
+DROP TABLE IF EXISTS push_subscriptions;
@@ -0,0 +1,8 @@
+-- user_id is the primary key again, so keep only the newest subscription of each user
+DELETE FROM push_subscriptions p
+USING push_subscriptions newer
+WHERE p.user_id = newer.user_id
+  AND (p.updated_at, p.endpoint) < (newer.updated_at, newer.endpoint);
+
+ALTER TABLE push_subscriptions ADD CONSTRAINT push_subscriptions_pkey PRIMARY KEY (user_id);
+CREATE INDEX IF NOT EXISTS idx_push_subscriptions_user_id ON push_subscriptions(user_id);
@@ -0,0 +1,2 @@
+-- drop data_exports table
+DROP TABLE IF EXISTS data_exports;
@@ -0,0 +1,3 @@
+-- drop message edit history
+ALTER TABLE messages DROP COLUMN IF EXISTS edited_at;
+DROP TABLE IF EXISTS message_versions;
@@ -0,0 +1,17 @@
+-- keep every prior state of an edited message
+CREATE TABLE IF NOT EXISTS message_versions (
+    id TEXT PRIMARY KEY,
+    message_id TEXT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    chat_id TEXT NOT NULL,
+    prompt TEXT,
+    response TEXT NOT NULL,
+    model TEXT,
+    references_ids TEXT,
+    edited_by TEXT REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_message_versions_message_id ON message_versions(message_id, created_at DESC);
+
+-- last time a message was edited, NULL if never edited
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS edited_at TIMESTAMP;
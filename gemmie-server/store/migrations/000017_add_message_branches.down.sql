@@ -0,0 +1,4 @@
+-- flatten chats back into created_at order
+ALTER TABLE chats DROP COLUMN IF EXISTS active_leaf_id;
+DROP INDEX IF EXISTS idx_messages_parent_id;
+ALTER TABLE messages DROP COLUMN IF EXISTS parent_id;
@@ -0,0 +1,21 @@
+-- messages form a tree: each message replies to its parent, siblings are alternative branches
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS parent_id TEXT REFERENCES messages(id) ON DELETE SET NULL;
+CREATE INDEX IF NOT EXISTS idx_messages_parent_id ON messages(parent_id);
+
+-- the last message of the branch currently shown for a chat
+ALTER TABLE chats ADD COLUMN IF NOT EXISTS active_leaf_id TEXT REFERENCES messages(id) ON DELETE SET NULL;
+
+-- existing chats become a single linear branch in created_at order
+UPDATE messages m SET parent_id = p.prev_id
+FROM (
+    SELECT id, LAG(id) OVER (PARTITION BY chat_id ORDER BY created_at, id) AS prev_id
+    FROM messages
+) p
+WHERE m.id = p.id AND p.prev_id IS NOT NULL;
+
+UPDATE chats c SET active_leaf_id = (
+    SELECT m.id FROM messages m
+    WHERE m.chat_id = c.id
+    ORDER BY m.created_at DESC, m.id DESC
+    LIMIT 1
+);
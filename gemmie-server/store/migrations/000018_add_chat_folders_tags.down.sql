@@ -0,0 +1,7 @@
+DROP INDEX IF EXISTS idx_chats_user_pinned_updated;
+DROP INDEX IF EXISTS idx_chats_user_folder;
+ALTER TABLE chats DROP COLUMN IF EXISTS is_pinned;
+ALTER TABLE chats DROP COLUMN IF EXISTS folder_id;
+DROP TABLE IF EXISTS chat_tags;
+DROP TABLE IF EXISTS tags;
+DROP TABLE IF EXISTS folders;
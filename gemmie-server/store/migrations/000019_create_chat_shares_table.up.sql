@@ -0,0 +1,17 @@
+-- revocable share links for chats, reached at /s/{token}
+CREATE TABLE IF NOT EXISTS chat_shares (
+    id TEXT PRIMARY KEY,
+    chat_id TEXT NOT NULL REFERENCES chats(id) ON DELETE CASCADE,
+    created_by TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token TEXT NOT NULL UNIQUE,
+    mode TEXT NOT NULL DEFAULT 'live', -- live or snapshot
+    password_hash TEXT,
+    snapshot JSONB, -- messages at the time of sharing, snapshot mode only
+    view_count INTEGER NOT NULL DEFAULT 0,
+    last_viewed_at TIMESTAMP,
+    expires_at TIMESTAMP,
+    revoked_at TIMESTAMP,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_chat_shares_chat_id ON chat_shares(chat_id);
@@ -0,0 +1,3 @@
+ALTER TABLE messages DROP COLUMN IF EXISTS author_id;
+DROP TABLE IF EXISTS chat_invitations;
+DROP TABLE IF EXISTS chat_members;
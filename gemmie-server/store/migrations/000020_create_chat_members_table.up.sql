@@ -0,0 +1,39 @@
+-- people who can open a chat and what they may do in it
+CREATE TABLE IF NOT EXISTS chat_members (
+    chat_id TEXT NOT NULL REFERENCES chats(id) ON DELETE CASCADE,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role TEXT NOT NULL CHECK (role IN ('owner', 'editor', 'viewer')),
+    invited_by TEXT REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (chat_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_chat_members_user_id ON chat_members(user_id);
+
+-- pending invitations, accepted ones become chat_members rows
+CREATE TABLE IF NOT EXISTS chat_invitations (
+    id TEXT PRIMARY KEY,
+    chat_id TEXT NOT NULL REFERENCES chats(id) ON DELETE CASCADE,
+    invitee_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    invited_by TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role TEXT NOT NULL CHECK (role IN ('editor', 'viewer')),
+    status TEXT NOT NULL DEFAULT 'pending', -- pending, accepted or declined
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    responded_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_chat_invitations_invitee ON chat_invitations(invitee_id, status);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_chat_invitations_pending
+    ON chat_invitations(chat_id, invitee_id) WHERE status = 'pending';
+
+-- every existing chat is owned by its creator
+INSERT INTO chat_members (chat_id, user_id, role, created_at)
+SELECT id, user_id, 'owner', created_at FROM chats
+ON CONFLICT DO NOTHING;
+
+-- messages record who sent the prompt, existing ones were all written by the chat owner
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS author_id TEXT REFERENCES users(id) ON DELETE SET NULL;
+
+UPDATE messages m SET author_id = c.user_id
+FROM chats c
+WHERE m.chat_id = c.id AND m.author_id IS NULL;
@@ -0,0 +1,26 @@
+DROP TRIGGER IF EXISTS chat_members_change_log ON chat_members;
+DROP TRIGGER IF EXISTS chat_tags_change_log ON chat_tags;
+DROP TRIGGER IF EXISTS tags_change_log_delete ON tags;
+DROP TRIGGER IF EXISTS tags_change_log ON tags;
+DROP TRIGGER IF EXISTS folders_change_log_delete ON folders;
+DROP TRIGGER IF EXISTS folders_change_log ON folders;
+DROP TRIGGER IF EXISTS arcades_change_log_delete ON arcades;
+DROP TRIGGER IF EXISTS arcades_change_log ON arcades;
+DROP TRIGGER IF EXISTS messages_change_log_delete ON messages;
+DROP TRIGGER IF EXISTS messages_change_log ON messages;
+DROP TRIGGER IF EXISTS chats_change_log_delete ON chats;
+DROP TRIGGER IF EXISTS chats_change_log ON chats;
+DROP TRIGGER IF EXISTS users_change_log ON users;
+
+DROP FUNCTION IF EXISTS chat_members_record_change();
+DROP FUNCTION IF EXISTS chat_tags_record_change();
+DROP FUNCTION IF EXISTS owned_record_change();
+DROP FUNCTION IF EXISTS messages_record_change();
+DROP FUNCTION IF EXISTS chats_record_change();
+DROP FUNCTION IF EXISTS users_record_change();
+DROP FUNCTION IF EXISTS record_change(TEXT, TEXT, TEXT, TEXT);
+
+DROP TABLE IF EXISTS change_log;
+
+ALTER TABLE users DROP COLUMN IF EXISTS field_versions;
+ALTER TABLE users DROP COLUMN IF EXISTS change_seq;
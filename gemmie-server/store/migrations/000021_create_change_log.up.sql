@@ -0,0 +1,173 @@
+-- per-user change counter, the sync cursor handed to clients
+ALTER TABLE users ADD COLUMN IF NOT EXISTS change_seq BIGINT NOT NULL DEFAULT 0;
+
+-- last client timestamp (unix ms) each synced profile field was written with
+ALTER TABLE users ADD COLUMN IF NOT EXISTS field_versions JSONB NOT NULL DEFAULT '{}';
+
+-- latest change of every entity a user can see, older changes of the same
+-- entity are overwritten so the log never grows past the number of entities
+CREATE TABLE IF NOT EXISTS change_log (
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    entity_type TEXT NOT NULL, -- user, chat, message, arcade, folder or tag
+    entity_id TEXT NOT NULL,
+    op TEXT NOT NULL, -- upsert or delete
+    seq BIGINT NOT NULL,
+    changed_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, entity_type, entity_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_change_log_user_seq ON change_log(user_id, seq);
+
+-- bumping users.change_seq locks the user row, so sequence numbers are
+-- handed out in commit order and a cursor never skips a change
+CREATE OR REPLACE FUNCTION record_change(p_user TEXT, p_type TEXT, p_id TEXT, p_op TEXT)
+RETURNS VOID AS $$
+DECLARE
+    next_seq BIGINT;
+BEGIN
+    IF p_user IS NULL THEN
+        RETURN;
+    END IF;
+
+    UPDATE users SET change_seq = change_seq + 1 WHERE id = p_user
+    RETURNING change_seq INTO next_seq;
+    IF NOT FOUND THEN
+        RETURN;
+    END IF;
+
+    INSERT INTO change_log (user_id, entity_type, entity_id, op, seq, changed_at)
+    VALUES (p_user, p_type, p_id, p_op, next_seq, NOW())
+    ON CONFLICT (user_id, entity_type, entity_id)
+    DO UPDATE SET op = EXCLUDED.op, seq = EXCLUDED.seq, changed_at = EXCLUDED.changed_at;
+END;
+$$ LANGUAGE plpgsql;
+
+-- users: profile changes, ignoring the cursor bump made by record_change itself
+CREATE OR REPLACE FUNCTION users_record_change() RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM record_change(NEW.id, 'user', NEW.id, 'upsert');
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER users_change_log AFTER UPDATE ON users
+FOR EACH ROW WHEN (OLD.change_seq IS NOT DISTINCT FROM NEW.change_seq)
+EXECUTE FUNCTION users_record_change();
+
+-- chats: the owner and every member see the change. Deletes are recorded
+-- BEFORE the row goes, while chat_members still lists who had access.
+CREATE OR REPLACE FUNCTION chats_record_change() RETURNS TRIGGER AS $$
+DECLARE
+    r RECORD;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        FOR r IN SELECT user_id FROM chat_members WHERE chat_id = OLD.id
+                 UNION SELECT OLD.user_id LOOP
+            PERFORM record_change(r.user_id, 'chat', OLD.id, 'delete');
+        END LOOP;
+        RETURN OLD;
+    END IF;
+
+    FOR r IN SELECT user_id FROM chat_members WHERE chat_id = NEW.id
+             UNION SELECT NEW.user_id LOOP
+        PERFORM record_change(r.user_id, 'chat', NEW.id, 'upsert');
+    END LOOP;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER chats_change_log AFTER INSERT OR UPDATE ON chats
+FOR EACH ROW EXECUTE FUNCTION chats_record_change();
+
+CREATE TRIGGER chats_change_log_delete BEFORE DELETE ON chats
+FOR EACH ROW EXECUTE FUNCTION chats_record_change();
+
+-- messages: everyone with access to the chat
+CREATE OR REPLACE FUNCTION messages_record_change() RETURNS TRIGGER AS $$
+DECLARE
+    r RECORD;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        FOR r IN SELECT user_id FROM chat_members WHERE chat_id = OLD.chat_id
+                 UNION SELECT user_id FROM chats WHERE id = OLD.chat_id LOOP
+            PERFORM record_change(r.user_id, 'message', OLD.id, 'delete');
+        END LOOP;
+        RETURN OLD;
+    END IF;
+
+    FOR r IN SELECT user_id FROM chat_members WHERE chat_id = NEW.chat_id
+             UNION SELECT user_id FROM chats WHERE id = NEW.chat_id LOOP
+        PERFORM record_change(r.user_id, 'message', NEW.id, 'upsert');
+    END LOOP;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER messages_change_log AFTER INSERT OR UPDATE ON messages
+FOR EACH ROW EXECUTE FUNCTION messages_record_change();
+
+CREATE TRIGGER messages_change_log_delete BEFORE DELETE ON messages
+FOR EACH ROW EXECUTE FUNCTION messages_record_change();
+
+-- arcades, folders and tags belong to a single user, TG_ARGV[0] is the entity type
+CREATE OR REPLACE FUNCTION owned_record_change() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        PERFORM record_change(OLD.user_id, TG_ARGV[0], OLD.id, 'delete');
+        RETURN OLD;
+    END IF;
+
+    PERFORM record_change(NEW.user_id, TG_ARGV[0], NEW.id, 'upsert');
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER arcades_change_log AFTER INSERT OR UPDATE ON arcades
+FOR EACH ROW EXECUTE FUNCTION owned_record_change('arcade');
+CREATE TRIGGER arcades_change_log_delete BEFORE DELETE ON arcades
+FOR EACH ROW EXECUTE FUNCTION owned_record_change('arcade');
+
+CREATE TRIGGER folders_change_log AFTER INSERT OR UPDATE ON folders
+FOR EACH ROW EXECUTE FUNCTION owned_record_change('folder');
+CREATE TRIGGER folders_change_log_delete BEFORE DELETE ON folders
+FOR EACH ROW EXECUTE FUNCTION owned_record_change('folder');
+
+CREATE TRIGGER tags_change_log AFTER INSERT OR UPDATE ON tags
+FOR EACH ROW EXECUTE FUNCTION owned_record_change('tag');
+CREATE TRIGGER tags_change_log_delete BEFORE DELETE ON tags
+FOR EACH ROW EXECUTE FUNCTION owned_record_change('tag');
+
+-- tags are part of the owner's view of a chat
+CREATE OR REPLACE FUNCTION chat_tags_record_change() RETURNS TRIGGER AS $$
+DECLARE
+    affected TEXT;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        affected := OLD.chat_id;
+    ELSE
+        affected := NEW.chat_id;
+    END IF;
+
+    PERFORM record_change((SELECT user_id FROM chats WHERE id = affected), 'chat', affected, 'upsert');
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER chat_tags_change_log AFTER INSERT OR DELETE ON chat_tags
+FOR EACH ROW EXECUTE FUNCTION chat_tags_record_change();
+
+-- joining a chat makes it appear for the member, leaving makes it disappear
+CREATE OR REPLACE FUNCTION chat_members_record_change() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        PERFORM record_change(OLD.user_id, 'chat', OLD.chat_id, 'delete');
+        RETURN NULL;
+    END IF;
+
+    PERFORM record_change(NEW.user_id, 'chat', NEW.chat_id, 'upsert');
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER chat_members_change_log AFTER INSERT OR UPDATE OR DELETE ON chat_members
+FOR EACH ROW EXECUTE FUNCTION chat_members_record_change();
@@ -0,0 +1,15 @@
+DROP TRIGGER IF EXISTS chat_members_touch_chat_version ON chat_members;
+DROP TRIGGER IF EXISTS chat_tags_touch_chat_version ON chat_tags;
+DROP TRIGGER IF EXISTS messages_touch_chat_version ON messages;
+DROP TRIGGER IF EXISTS arcades_bump_version ON arcades;
+DROP TRIGGER IF EXISTS messages_bump_version ON messages;
+DROP TRIGGER IF EXISTS chats_bump_version ON chats;
+DROP TRIGGER IF EXISTS users_bump_version ON users;
+
+DROP FUNCTION IF EXISTS touch_chat_version();
+DROP FUNCTION IF EXISTS bump_version();
+
+ALTER TABLE arcades DROP COLUMN IF EXISTS version;
+ALTER TABLE messages DROP COLUMN IF EXISTS version;
+ALTER TABLE chats DROP COLUMN IF EXISTS version;
+ALTER TABLE users DROP COLUMN IF EXISTS version;
@@ -0,0 +1,51 @@
+-- row versions used as ETags, every update moves them forward by one
+ALTER TABLE users ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
+ALTER TABLE chats ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
+ALTER TABLE arcades ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 1;
+
+-- an update that already moves the version (see touch_chat_version) is left as it is
+CREATE OR REPLACE FUNCTION bump_version() RETURNS TRIGGER AS $$
+BEGIN
+    IF NEW.version IS NOT DISTINCT FROM OLD.version THEN
+        NEW.version := OLD.version + 1;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+-- the sync cursor bump made by record_change is bookkeeping, not a profile change
+CREATE TRIGGER users_bump_version BEFORE UPDATE ON users
+FOR EACH ROW WHEN (OLD.change_seq IS NOT DISTINCT FROM NEW.change_seq)
+EXECUTE FUNCTION bump_version();
+
+CREATE TRIGGER chats_bump_version BEFORE UPDATE ON chats
+FOR EACH ROW EXECUTE FUNCTION bump_version();
+
+CREATE TRIGGER messages_bump_version BEFORE UPDATE ON messages
+FOR EACH ROW EXECUTE FUNCTION bump_version();
+
+CREATE TRIGGER arcades_bump_version BEFORE UPDATE ON arcades
+FOR EACH ROW EXECUTE FUNCTION bump_version();
+
+-- a chat is served with its messages, tags and members, so changing any of
+-- them is a new version of the chat
+CREATE OR REPLACE FUNCTION touch_chat_version() RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        UPDATE chats SET version = version + 1 WHERE id = OLD.chat_id;
+    ELSE
+        UPDATE chats SET version = version + 1 WHERE id = NEW.chat_id;
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER messages_touch_chat_version AFTER INSERT OR UPDATE OR DELETE ON messages
+FOR EACH ROW EXECUTE FUNCTION touch_chat_version();
+
+CREATE TRIGGER chat_tags_touch_chat_version AFTER INSERT OR DELETE ON chat_tags
+FOR EACH ROW EXECUTE FUNCTION touch_chat_version();
+
+CREATE TRIGGER chat_members_touch_chat_version AFTER INSERT OR UPDATE OR DELETE ON chat_members
+FOR EACH ROW EXECUTE FUNCTION touch_chat_version();
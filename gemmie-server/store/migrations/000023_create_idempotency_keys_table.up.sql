@@ -0,0 +1,15 @@
+-- responses of requests sent with an Idempotency-Key, replayed on retries
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    scope TEXT NOT NULL, -- the user id, or "anonymous" for requests without one
+    key TEXT NOT NULL,
+    fingerprint TEXT NOT NULL, -- sha256 of method, path and body
+    state TEXT NOT NULL DEFAULT 'in_progress', -- in_progress or completed
+    status_code INTEGER NOT NULL DEFAULT 0,
+    content_type TEXT NOT NULL DEFAULT '',
+    response BYTEA,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (scope, key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires_at ON idempotency_keys(expires_at);
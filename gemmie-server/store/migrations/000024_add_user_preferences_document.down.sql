@@ -0,0 +1,3 @@
+DROP TRIGGER IF EXISTS users_sync_preferences ON users;
+DROP FUNCTION IF EXISTS users_sync_preferences();
+ALTER TABLE users DROP COLUMN IF EXISTS preferences_doc;
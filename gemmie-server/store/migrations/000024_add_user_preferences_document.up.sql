@@ -0,0 +1,48 @@
+-- typed preferences document, only values the user has set are stored and
+-- the server fills in defaults on read
+ALTER TABLE users ADD COLUMN IF NOT EXISTS preferences_doc JSONB NOT NULL DEFAULT '{"schema_version": 1}';
+
+UPDATE users SET preferences_doc = jsonb_strip_nulls(jsonb_build_object(
+    'schema_version', 1,
+    'theme', NULLIF(theme, ''),
+    'response_mode', NULLIF(response_mode, ''),
+    'work_function', NULLIF(work_function, ''),
+    'custom_instructions', NULLIF(preferences, '')
+));
+
+-- theme, response_mode, work_function and preferences stay as columns for
+-- older clients. Whichever side an update changes is copied to the other,
+-- the document wins when both change.
+CREATE OR REPLACE FUNCTION users_sync_preferences() RETURNS TRIGGER AS $$
+DECLARE
+    doc JSONB;
+BEGIN
+    IF TG_OP = 'UPDATE' AND NEW.preferences_doc IS DISTINCT FROM OLD.preferences_doc THEN
+        NEW.theme := COALESCE(NEW.preferences_doc->>'theme', '');
+        NEW.response_mode := COALESCE(NEW.preferences_doc->>'response_mode', 'light-response');
+        NEW.work_function := COALESCE(NEW.preferences_doc->>'work_function', '');
+        NEW.preferences := COALESCE(NEW.preferences_doc->>'custom_instructions', '');
+        RETURN NEW;
+    END IF;
+
+    doc := NEW.preferences_doc;
+    IF TG_OP = 'INSERT' OR NEW.theme IS DISTINCT FROM OLD.theme THEN
+        doc := jsonb_strip_nulls(doc || jsonb_build_object('theme', NULLIF(NEW.theme, '')));
+    END IF;
+    IF TG_OP = 'INSERT' OR NEW.response_mode IS DISTINCT FROM OLD.response_mode THEN
+        doc := jsonb_strip_nulls(doc || jsonb_build_object('response_mode', NULLIF(NEW.response_mode, '')));
+    END IF;
+    IF TG_OP = 'INSERT' OR NEW.work_function IS DISTINCT FROM OLD.work_function THEN
+        doc := jsonb_strip_nulls(doc || jsonb_build_object('work_function', NULLIF(NEW.work_function, '')));
+    END IF;
+    IF TG_OP = 'INSERT' OR NEW.preferences IS DISTINCT FROM OLD.preferences THEN
+        doc := jsonb_strip_nulls(doc || jsonb_build_object('custom_instructions', NULLIF(NEW.preferences, '')));
+    END IF;
+    NEW.preferences_doc := doc;
+
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER users_sync_preferences BEFORE INSERT OR UPDATE ON users
+FOR EACH ROW EXECUTE FUNCTION users_sync_preferences();
@@ -0,0 +1,62 @@
+-- one row per purchased plan period, the users plan columns mirror the current one
+CREATE TABLE IF NOT EXISTS subscriptions (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    transaction_ref TEXT UNIQUE, -- external_reference of the paying transaction, NULL for backfilled rows
+    plan_key TEXT NOT NULL,
+    plan_name TEXT NOT NULL DEFAULT '',
+    amount INTEGER NOT NULL DEFAULT 0,
+    price TEXT NOT NULL DEFAULT '',
+    duration TEXT NOT NULL DEFAULT '',
+    phone_number TEXT NOT NULL DEFAULT '',
+    status TEXT NOT NULL DEFAULT 'active', -- active, expired or cancelled
+    starts_at TIMESTAMP NOT NULL,
+    ends_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_subscriptions_user_id ON subscriptions(user_id, ends_at DESC);
+CREATE INDEX IF NOT EXISTS idx_subscriptions_status_ends_at ON subscriptions(status, ends_at);
+
+-- Backfill one period per successful payment, found the same way the
+-- payment callback finds its user: by the email or username before the
+-- first "-" of the external reference
+INSERT INTO subscriptions (
+    id, user_id, transaction_ref, plan_key, plan_name, amount, price, duration,
+    phone_number, status, starts_at, ends_at, created_at, updated_at
+)
+SELECT DISTINCT ON (t.external_reference)
+    'sub_' || md5(t.external_reference), u.id, t.external_reference, p.plan_key,
+    p.plan_name, t.amount, p.price, p.duration, COALESCE(t.phone_number, ''),
+    CASE WHEN t.created_at + p.period > NOW() THEN 'active' ELSE 'expired' END,
+    t.created_at, t.created_at + p.period, t.created_at, t.created_at
+FROM transactions t
+JOIN (VALUES
+    (50, 'student', 'Student Plan', '50 Ksh', '5 hours', INTERVAL '5 hours'),
+    (100, 'hobbyist', 'Hobbyist Plan', '100 Ksh', '24 hours', INTERVAL '24 hours'),
+    (500, 'pro', 'Pro Plan', '500 Ksh', '1 week', INTERVAL '7 days')
+) AS p(amount, plan_key, plan_name, price, duration, period) ON p.amount = t.amount
+JOIN users u ON u.id = COALESCE(
+    (SELECT id FROM users WHERE email = split_part(t.external_reference, '-', 1)),
+    (SELECT id FROM users WHERE username = split_part(t.external_reference, '-', 1))
+)
+WHERE LOWER(t.status) = 'success' AND COALESCE(t.external_reference, '') <> ''
+ORDER BY t.external_reference, t.created_at
+ON CONFLICT DO NOTHING;
+
+-- Users whose plan has no matching payment keep it as a period without one
+INSERT INTO subscriptions (
+    id, user_id, plan_key, plan_name, amount, price, duration, phone_number,
+    status, starts_at, ends_at
+)
+SELECT
+    'sub_' || id, id, plan, COALESCE(plan_name, ''), COALESCE(amount, 0),
+    COALESCE(price, ''), COALESCE(duration, ''), COALESCE(phone_number, ''),
+    CASE WHEN expiry_timestamp > EXTRACT(EPOCH FROM NOW()) THEN 'active' ELSE 'expired' END,
+    to_timestamp(expiry_timestamp - COALESCE(expire_duration, 0))::timestamp,
+    to_timestamp(expiry_timestamp)::timestamp
+FROM users
+WHERE COALESCE(plan, '') NOT IN ('', 'free') AND expiry_timestamp > 0
+    AND NOT EXISTS (SELECT 1 FROM subscriptions s WHERE s.user_id = users.id)
+ON CONFLICT (id) DO NOTHING;
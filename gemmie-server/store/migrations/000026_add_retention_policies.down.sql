@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS idx_users_retention_days;
+ALTER TABLE chats DROP COLUMN IF EXISTS is_kept;
+ALTER TABLE chats DROP COLUMN IF EXISTS retention_days;
+ALTER TABLE users DROP COLUMN IF EXISTS retention_days;
@@ -0,0 +1,11 @@
+-- how many days chats are kept before they are purged, 0 keeps them forever
+ALTER TABLE users ADD COLUMN IF NOT EXISTS retention_days INTEGER NOT NULL DEFAULT 0
+    CHECK (retention_days IN (0, 30, 90, 365));
+
+-- a chat can override its owner's setting, NULL follows it
+ALTER TABLE chats ADD COLUMN IF NOT EXISTS retention_days INTEGER
+    CHECK (retention_days IS NULL OR retention_days IN (0, 30, 90, 365));
+-- kept chats are never purged
+ALTER TABLE chats ADD COLUMN IF NOT EXISTS is_kept BOOLEAN NOT NULL DEFAULT false;
+
+CREATE INDEX IF NOT EXISTS idx_users_retention_days ON users(retention_days) WHERE retention_days > 0;
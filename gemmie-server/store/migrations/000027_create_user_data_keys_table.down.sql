@@ -0,0 +1,3 @@
+-- Encrypted content can't be read without these keys, run
+-- `gemmie-server reencrypt --decrypt` before rolling back
+DROP TABLE IF EXISTS user_data_keys;
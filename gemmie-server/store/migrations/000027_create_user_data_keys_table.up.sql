@@ -0,0 +1,15 @@
+-- per-user data keys for encrypting message and arcade content, each wrapped
+-- (encrypted) by the master key from config
+CREATE TABLE IF NOT EXISTS user_data_keys (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    wrapped_key BYTEA NOT NULL,
+    master_key_id TEXT NOT NULL, -- fingerprint of the master key that wrapped it
+    state TEXT NOT NULL DEFAULT 'active', -- active, or retired after a data key rotation
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    retired_at TIMESTAMP
+);
+
+-- new content is always encrypted with the user's one active key
+CREATE UNIQUE INDEX IF NOT EXISTS idx_user_data_keys_active ON user_data_keys(user_id) WHERE state = 'active';
+CREATE INDEX IF NOT EXISTS idx_user_data_keys_master_key_id ON user_data_keys(master_key_id);
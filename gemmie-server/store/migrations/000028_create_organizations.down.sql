@@ -0,0 +1,11 @@
+-- periods bought by organizations have no user to fall back to
+DELETE FROM subscriptions WHERE org_id IS NOT NULL;
+DROP INDEX IF EXISTS idx_subscriptions_org_id;
+ALTER TABLE subscriptions DROP CONSTRAINT IF EXISTS subscriptions_owner_check;
+ALTER TABLE subscriptions ALTER COLUMN user_id SET NOT NULL;
+ALTER TABLE subscriptions DROP COLUMN IF EXISTS org_id;
+
+DROP TABLE IF EXISTS organization_chats;
+DROP TABLE IF EXISTS organization_invitations;
+DROP TABLE IF EXISTS organization_members;
+DROP TABLE IF EXISTS organizations;
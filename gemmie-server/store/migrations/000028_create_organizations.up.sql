@@ -0,0 +1,54 @@
+-- organizations share a plan between their members
+CREATE TABLE IF NOT EXISTS organizations (
+    id TEXT PRIMARY KEY,
+    name TEXT NOT NULL,
+    created_by TEXT REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS organization_members (
+    org_id TEXT NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role TEXT NOT NULL CHECK (role IN ('owner', 'admin', 'member')),
+    invited_by TEXT REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (org_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_organization_members_user_id ON organization_members(user_id);
+
+-- pending invitations, accepted ones become organization_members rows
+CREATE TABLE IF NOT EXISTS organization_invitations (
+    id TEXT PRIMARY KEY,
+    org_id TEXT NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    invitee_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    invited_by TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    role TEXT NOT NULL CHECK (role IN ('admin', 'member')),
+    status TEXT NOT NULL DEFAULT 'pending', -- pending, accepted or declined
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    responded_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_organization_invitations_invitee ON organization_invitations(invitee_id, status);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_organization_invitations_pending
+    ON organization_invitations(org_id, invitee_id) WHERE status = 'pending';
+
+-- chats shared into an organization's space, every member gets the role
+CREATE TABLE IF NOT EXISTS organization_chats (
+    org_id TEXT NOT NULL REFERENCES organizations(id) ON DELETE CASCADE,
+    chat_id TEXT NOT NULL REFERENCES chats(id) ON DELETE CASCADE,
+    role TEXT NOT NULL CHECK (role IN ('editor', 'viewer')),
+    shared_by TEXT REFERENCES users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (org_id, chat_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_organization_chats_chat_id ON organization_chats(chat_id);
+
+-- a plan period belongs to a user or, bought by an organization, to all its members
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS org_id TEXT REFERENCES organizations(id) ON DELETE CASCADE;
+ALTER TABLE subscriptions ALTER COLUMN user_id DROP NOT NULL;
+ALTER TABLE subscriptions ADD CONSTRAINT subscriptions_owner_check CHECK ((user_id IS NULL) <> (org_id IS NULL));
+
+CREATE INDEX IF NOT EXISTS idx_subscriptions_org_id ON subscriptions(org_id, ends_at DESC) WHERE org_id IS NOT NULL;
@@ -0,0 +1,2 @@
+-- a streamed response cut short by a disconnect is kept, flagged as partial
+ALTER TABLE messages ADD COLUMN IF NOT EXISTS is_partial BOOLEAN NOT NULL DEFAULT false;
@@ -0,0 +1,12 @@
+-- named personas a user picks per chat, their instructions go into the system prompt
+CREATE TABLE IF NOT EXISTS personas (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    instructions TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    updated_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    UNIQUE (user_id, name)
+);
+
+ALTER TABLE chats ADD COLUMN IF NOT EXISTS persona_id TEXT REFERENCES personas(id) ON DELETE SET NULL;
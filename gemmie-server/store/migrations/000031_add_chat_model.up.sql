@@ -0,0 +1,2 @@
+-- the model a chat's messages are generated with unless a message asks for another
+ALTER TABLE chats ADD COLUMN IF NOT EXISTS model TEXT;
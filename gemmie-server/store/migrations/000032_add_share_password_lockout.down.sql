@@ -0,0 +1,2 @@
+ALTER TABLE chat_shares DROP COLUMN IF EXISTS locked_until;
+ALTER TABLE chat_shares DROP COLUMN IF EXISTS failed_attempts;
@@ -0,0 +1,3 @@
+-- wrong passwords count against a share link, which locks for a while after too many
+ALTER TABLE chat_shares ADD COLUMN IF NOT EXISTS failed_attempts INTEGER NOT NULL DEFAULT 0;
+ALTER TABLE chat_shares ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP;
@@ -0,0 +1,55 @@
+// Package migrations holds the schema migrations of the store. SQL migrations
+// are NNNNNN_name.up.sql and NNNNNN_name.down.sql pairs run by golang-migrate.
+// A data migration that is easier to write in Go registers itself for its
+// version from a NNNNNN_name.go file next to that version's SQL pair, and runs
+// right after the SQL of its version going up, and before it going down.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"sort"
+)
+
+//go:embed *.sql
+var FS embed.FS
+
+// DataMigration is a migration written in Go. Up and Down run in a
+// transaction that is rolled back when they return an error.
+type DataMigration struct {
+	Version uint
+	Name    string
+	Up      func(ctx context.Context, tx *sql.Tx) error
+	Down    func(ctx context.Context, tx *sql.Tx) error
+}
+
+var registry = map[uint]DataMigration{}
+
+// Register adds a data migration, it is meant to be called from init
+func Register(migration DataMigration) {
+	if migration.Version == 0 || migration.Up == nil {
+		panic(fmt.Sprintf("migrations: data migration %q needs a version and an Up func", migration.Name))
+	}
+	if existing, ok := registry[migration.Version]; ok {
+		panic(fmt.Sprintf("migrations: version %d registered twice, by %q and %q", migration.Version, existing.Name, migration.Name))
+	}
+	registry[migration.Version] = migration
+}
+
+// Lookup returns the data migration of a version
+func Lookup(version uint) (DataMigration, bool) {
+	migration, ok := registry[version]
+	return migration, ok
+}
+
+// DataMigrations returns every registered data migration, oldest first
+func DataMigrations() []DataMigration {
+	all := make([]DataMigration, 0, len(registry))
+	for _, migration := range registry {
+		all = append(all, migration)
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].Version < all[j].Version })
+	return all
+}
@@ -1,181 +1,435 @@
 package store
 
 import (
-	"embed"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
 	"log/slog"
+	"sort"
 
 	"github.com/golang-migrate/migrate/v4"
+	"github.com/golang-migrate/migrate/v4/database"
 	"github.com/golang-migrate/migrate/v4/database/postgres"
+	"github.com/golang-migrate/migrate/v4/source"
 	"github.com/golang-migrate/migrate/v4/source/iofs"
+	"github.com/imrany/gemmie/gemmie-server/store/migrations"
 	_ "github.com/lib/pq"
 )
 
-//go:embed migrations/*.sql
-var migrationFS embed.FS
+// ErrMigrationDirty is returned instead of migrating when a previous
+// migration failed halfway, the database has to be fixed by hand and the
+// version forced before migrating again.
+var ErrMigrationDirty = errors.New("database migration is dirty")
+
+// MigrationFile is one version of the embedded migrations
+type MigrationFile struct {
+	Version uint   `json:"version"`
+	Name    string `json:"name"`
+	HasUp   bool   `json:"has_up"`
+	HasDown bool   `json:"has_down"`
+	// GoMigration is set when a Go data migration is registered for the version
+	GoMigration bool `json:"go_migration"`
+	// GoReversible is set when that data migration has a Down func
+	GoReversible bool `json:"go_reversible"`
+	Applied      bool `json:"applied"`
+}
 
-// RunMigrations executes database migrations
-func RunMigrations() error {
-	driver, err := postgres.WithInstance(DB, &postgres.Config{})
+// migrator wraps golang-migrate with the postgres connection it holds, so
+// the connection goes back to the pool without closing DB
+type migrator struct {
+	m      *migrate.Migrate
+	driver database.Driver
+}
+
+func newMigrator() (*migrator, error) {
+	ctx := context.Background()
+
+	conn, err := DB.Conn(ctx)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	sourceDriver, err := iofs.New(migrationFS, "migrations")
+	driver, err := postgres.WithConnection(ctx, conn, &postgres.Config{})
 	if err != nil {
-		return err
+		conn.Close()
+		return nil, err
+	}
+
+	sourceDriver, err := iofs.New(migrations.FS, ".")
+	if err != nil {
+		driver.Close()
+		return nil, err
 	}
 
 	m, err := migrate.NewWithInstance("iofs", sourceDriver, "postgres", driver)
 	if err != nil {
-		return err
+		driver.Close()
+		return nil, err
 	}
 
-	// Get current version
-	currentVersion, dirty, err := m.Version()
-	if err != nil && err != migrate.ErrNilVersion {
-		slog.Warn("Could not determine current migration version", "error", err)
+	return &migrator{m: m, driver: driver}, nil
+}
+
+func (mg *migrator) close() {
+	// Closes the source and the dedicated connection, DB stays open
+	mg.m.Close()
+}
+
+// version returns the applied version, 0 when nothing is applied
+func (mg *migrator) version() (uint, bool, error) {
+	version, dirty, err := mg.m.Version()
+	if err == migrate.ErrNilVersion {
+		return 0, false, nil
 	}
+	return version, dirty, err
+}
 
-	if dirty {
-		slog.Warn("Database is in dirty state, attempting to force version", "version", currentVersion)
-		// Try to force the version to recover from dirty state
-		if err := m.Force(int(currentVersion)); err != nil {
-			slog.Error("Failed to force version", "error", err)
-		}
+// lockMigrations keeps other instances from migrating while a walk is in progress.
+// golang-migrate only locks around each step, and Go data migrations run
+// between steps.
+func lockMigrations(ctx context.Context) (func(), error) {
+	conn, err := DB.Conn(ctx)
+	if err != nil {
+		return nil, err
 	}
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock(hashtext('gemmie.migrations'))`); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return func() {
+		if _, err := conn.ExecContext(context.Background(), `SELECT pg_advisory_unlock(hashtext('gemmie.migrations'))`); err != nil {
+			slog.Warn("Failed to release migration lock", "error", err)
+		}
+		conn.Close()
+	}, nil
+}
 
-	// Run all up migrations automatically
-	slog.Info("Running database migrations...")
-	if err := m.Up(); err != nil {
-		if err == migrate.ErrNoChange {
-			slog.Info("Database schema is up to date")
-			return nil
+// migrationVersions lists the versions of the embedded migrations, oldest first
+func migrationVersions() ([]uint, error) {
+	files, err := MigrationFiles()
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]uint, 0, len(files))
+	for _, file := range files {
+		if file.HasUp {
+			versions = append(versions, file.Version)
 		}
-		return err
 	}
+	return versions, nil
+}
 
-	// Get new version after migration
-	newVersion, _, err := m.Version()
-	if err != nil && err != migrate.ErrNilVersion {
-		return err
+// MigrationFiles lists the embedded migrations, oldest first. Applied is
+// left unset, see MigrationStatus.
+func MigrationFiles() ([]MigrationFile, error) {
+	entries, err := fs.ReadDir(migrations.FS, ".")
+	if err != nil {
+		return nil, err
 	}
 
-	slog.Info("Database migrations completed successfully", 
-		"previous_version", currentVersion, 
-		"current_version", newVersion)
-	return nil
-}
+	byVersion := map[uint]*MigrationFile{}
+	for _, entry := range entries {
+		parsed, err := source.DefaultParse(entry.Name())
+		if err != nil {
+			continue
+		}
+		file, ok := byVersion[parsed.Version]
+		if !ok {
+			file = &MigrationFile{Version: parsed.Version, Name: parsed.Identifier}
+			byVersion[parsed.Version] = file
+		}
+		switch parsed.Direction {
+		case source.Up:
+			file.HasUp = true
+		case source.Down:
+			file.HasDown = true
+		}
+	}
 
-// MigrateUp runs all pending migrations
-func MigrateUp() error {
-	return RunMigrations()
+	files := make([]MigrationFile, 0, len(byVersion))
+	for _, file := range byVersion {
+		if dm, ok := migrations.Lookup(file.Version); ok {
+			file.GoMigration = true
+			file.GoReversible = dm.Down != nil
+		}
+		files = append(files, *file)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Version < files[j].Version })
+	return files, nil
 }
 
-// MigrateDown rolls back the last migration (use with caution)
-func MigrateDown() error {
-	driver, err := postgres.WithInstance(DB, &postgres.Config{})
+// MigrationStatus returns the embedded migrations marked applied up to the
+// database version, with that version and its dirty state
+func MigrationStatus() ([]MigrationFile, uint, bool, error) {
+	files, err := MigrationFiles()
 	if err != nil {
-		return err
+		return nil, 0, false, err
 	}
 
-	sourceDriver, err := iofs.New(migrationFS, "migrations")
+	version, dirty, err := GetMigrationVersion()
 	if err != nil {
-		return err
+		return nil, 0, false, err
 	}
 
-	m, err := migrate.NewWithInstance("iofs", sourceDriver, "postgres", driver)
+	for i := range files {
+		files[i].Applied = files[i].Version <= version && version > 0
+	}
+	return files, version, dirty, nil
+}
+
+// VerifyMigrations checks the embedded migrations against each other and the
+// database, returning one line per problem found
+func VerifyMigrations() ([]string, error) {
+	files, version, dirty, err := MigrationStatus()
+	if err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	known := map[uint]bool{}
+	for _, file := range files {
+		known[file.Version] = true
+		if !file.HasUp {
+			problems = append(problems, fmt.Sprintf("%06d_%s has a down file but no up file", file.Version, file.Name))
+		}
+		if !file.HasDown {
+			problems = append(problems, fmt.Sprintf("%06d_%s has no down file", file.Version, file.Name))
+		}
+		if file.GoMigration && !file.GoReversible {
+			problems = append(problems, fmt.Sprintf("%06d_%s Go data migration has no Down func", file.Version, file.Name))
+		}
+	}
+
+	for _, dm := range migrations.DataMigrations() {
+		if !known[dm.Version] {
+			problems = append(problems, fmt.Sprintf("Go data migration %d (%s) has no SQL files for its version", dm.Version, dm.Name))
+		}
+	}
+
+	if dirty {
+		problems = append(problems, fmt.Sprintf("database is dirty at version %d", version))
+	}
+	if version > 0 && !known[version] {
+		problems = append(problems, fmt.Sprintf("database is at version %d which has no migration files", version))
+	}
+	return problems, nil
+}
+
+// RunMigrations executes database migrations. It refuses to run on a dirty
+// database rather than forcing the version, which would hide a half applied
+// migration.
+func RunMigrations() error {
+	versions, err := migrationVersions()
 	if err != nil {
 		return err
 	}
+	if len(versions) == 0 {
+		return nil
+	}
+
+	slog.Info("Running database migrations...")
+	return migrateTo(versions[len(versions)-1])
+}
 
+// MigrateUp runs all pending migrations
+func MigrateUp() error {
+	return RunMigrations()
+}
+
+// MigrateDown rolls back the last migration (use with caution)
+func MigrateDown() error {
 	slog.Info("Rolling back last migration...")
-	return m.Steps(-1)
+	return MigrateSteps(-1)
 }
 
 // MigrateSteps migrates up or down by the specified number of steps
 // Positive number = migrate up, Negative number = migrate down
 func MigrateSteps(steps int) error {
-	driver, err := postgres.WithInstance(DB, &postgres.Config{})
-	if err != nil {
-		return err
+	if steps == 0 {
+		return nil
 	}
 
-	sourceDriver, err := iofs.New(migrationFS, "migrations")
+	versions, err := migrationVersions()
 	if err != nil {
 		return err
 	}
-
-	m, err := migrate.NewWithInstance("iofs", sourceDriver, "postgres", driver)
+	current, _, err := GetMigrationVersion()
 	if err != nil {
 		return err
 	}
 
+	// Index of the current version, -1 when nothing is applied
+	index := -1
+	for i, v := range versions {
+		if v == current {
+			index = i
+		}
+	}
+	if current > 0 && index == -1 {
+		return fmt.Errorf("database version %d has no migration files", current)
+	}
+
+	targetIndex := index + steps
+	if targetIndex >= len(versions) || targetIndex < -1 {
+		return fmt.Errorf("cannot migrate %d steps from version %d, there are not enough migrations", steps, current)
+	}
+
+	var target uint
+	if targetIndex >= 0 {
+		target = versions[targetIndex]
+	}
+
 	slog.Info("Migrating by steps", "steps", steps)
-	return m.Steps(steps)
+	return migrateTo(target)
 }
 
-// MigrateTo migrates to a specific version
+// MigrateTo migrates to a specific version, 0 rolls every migration back
 func MigrateTo(version uint) error {
-	driver, err := postgres.WithInstance(DB, &postgres.Config{})
+	slog.Info("Migrating to version", "version", version)
+	return migrateTo(version)
+}
+
+// migrateTo walks one version at a time towards target so the Go data
+// migration of a version runs right after its SQL going up, and right before
+// it going down
+func migrateTo(target uint) error {
+	ctx := context.Background()
+
+	unlock, err := lockMigrations(ctx)
 	if err != nil {
 		return err
 	}
+	defer unlock()
 
-	sourceDriver, err := iofs.New(migrationFS, "migrations")
+	mg, err := newMigrator()
 	if err != nil {
 		return err
 	}
+	defer mg.close()
 
-	m, err := migrate.NewWithInstance("iofs", sourceDriver, "postgres", driver)
+	versions, err := migrationVersions()
 	if err != nil {
 		return err
 	}
+	if target > 0 && !containsVersion(versions, target) {
+		return fmt.Errorf("no migration with version %d", target)
+	}
 
-	slog.Info("Migrating to version", "version", version)
-	return m.Migrate(version)
-}
-
-// GetMigrationVersion returns the current migration version and dirty state
-func GetMigrationVersion() (uint, bool, error) {
-	driver, err := postgres.WithInstance(DB, &postgres.Config{})
+	current, dirty, err := mg.version()
 	if err != nil {
-		return 0, false, err
+		return err
+	}
+	if dirty {
+		return fmt.Errorf("%w at version %d: fix the database by hand, then run `gemmie-server migrate force <version>` with the last version that is fully applied", ErrMigrationDirty, current)
+	}
+	if current > 0 && !containsVersion(versions, current) {
+		return fmt.Errorf("database version %d has no migration files, the server is older than the database", current)
 	}
 
-	sourceDriver, err := iofs.New(migrationFS, "migrations")
-	if err != nil {
-		return 0, false, err
+	previous := current
+	if target == current {
+		slog.Info("Database schema is up to date")
+		return nil
 	}
 
-	m, err := migrate.NewWithInstance("iofs", sourceDriver, "postgres", driver)
-	if err != nil {
-		return 0, false, err
+	if target > current {
+		for _, v := range versions {
+			if v <= current || v > target {
+				continue
+			}
+			if err := mg.m.Migrate(v); err != nil {
+				return fmt.Errorf("migration %d: %w", v, err)
+			}
+			if dm, ok := migrations.Lookup(v); ok {
+				if err := mg.runData(ctx, v, dm.Name, dm.Up); err != nil {
+					return err
+				}
+			}
+		}
+	} else {
+		for i := len(versions) - 1; i >= 0; i-- {
+			v := versions[i]
+			if v > current || v <= target {
+				continue
+			}
+			if dm, ok := migrations.Lookup(v); ok {
+				if dm.Down == nil {
+					return fmt.Errorf("migration %d: Go data migration %q cannot be rolled back", v, dm.Name)
+				}
+				if err := mg.runData(ctx, v, dm.Name, dm.Down); err != nil {
+					return err
+				}
+			}
+			if err := mg.m.Steps(-1); err != nil {
+				return fmt.Errorf("migration %d: %w", v, err)
+			}
+		}
 	}
 
-	version, dirty, err := m.Version()
-	if err == migrate.ErrNilVersion {
-		return 0, false, nil
+	newVersion, _, err := mg.version()
+	if err != nil {
+		return err
 	}
-	return version, dirty, err
+
+	slog.Info("Database migrations completed successfully",
+		"previous_version", previous,
+		"current_version", newVersion)
+	return nil
 }
 
-// ForceMigrationVersion forces the migration version (use when in dirty state)
-func ForceMigrationVersion(version int) error {
-	driver, err := postgres.WithInstance(DB, &postgres.Config{})
-	if err != nil {
+// runData runs a Go data migration in a transaction. The version is marked
+// dirty while it runs, so a crash leaves the same trace as a failed SQL file.
+func (mg *migrator) runData(ctx context.Context, version uint, name string, fn func(context.Context, *sql.Tx) error) error {
+	if err := mg.driver.SetVersion(int(version), true); err != nil {
 		return err
 	}
 
-	sourceDriver, err := iofs.New(migrationFS, "migrations")
+	slog.Info("Running Go data migration", "version", version, "name", name)
+	tx, err := DB.BeginTx(ctx, nil)
 	if err != nil {
 		return err
 	}
+	if err := fn(ctx, tx); err != nil {
+		tx.Rollback()
+		return fmt.Errorf("Go data migration %d (%s): %w", version, name, err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("Go data migration %d (%s): %w", version, name, err)
+	}
 
-	m, err := migrate.NewWithInstance("iofs", sourceDriver, "postgres", driver)
+	return mg.driver.SetVersion(int(version), false)
+}
+
+// GetMigrationVersion returns the current migration version and dirty state
+func GetMigrationVersion() (uint, bool, error) {
+	mg, err := newMigrator()
+	if err != nil {
+		return 0, false, err
+	}
+	defer mg.close()
+
+	return mg.version()
+}
+
+// ForceMigrationVersion forces the migration version (use when in dirty state)
+func ForceMigrationVersion(version int) error {
+	mg, err := newMigrator()
 	if err != nil {
 		return err
 	}
+	defer mg.close()
 
 	slog.Warn("Forcing migration version", "version", version)
-	return m.Force(version)
-}
\ No newline at end of file
+	return mg.m.Force(version)
+}
+
+func containsVersion(versions []uint, version uint) bool {
+	for _, v := range versions {
+		if v == version {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,628 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Organization operations. Members are covered by the plans the organization
+// buys, so anything that changes who is a member refreshes their plan columns
+// in the same transaction.
+
+// CreateOrganization stores a new organization with its creator as the owner
+func CreateOrganization(org Organization) error {
+	ctx := context.Background()
+
+	now := time.Now()
+	if org.CreatedAt.IsZero() {
+		org.CreatedAt = now
+	}
+	org.UpdatedAt = now
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO organizations (id, name, created_by, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`, org.ID, org.Name, org.CreatedBy, org.CreatedAt, org.UpdatedAt); err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO organization_members (org_id, user_id, role, created_at)
+		VALUES ($1, $2, $3, $4)
+	`, org.ID, org.CreatedBy, OrgRoleOwner, org.CreatedAt); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+const organizationColumns = `
+	o.id, o.name, o.created_by, o.created_at, o.updated_at,
+	(SELECT COUNT(*) FROM organization_members m WHERE m.org_id = o.id) AS member_count
+`
+
+func GetOrganizationByID(ID string) (*Organization, error) {
+	ctx := context.Background()
+
+	org, err := scanOrganization(DB.QueryRowContext(ctx,
+		"SELECT "+organizationColumns+" FROM organizations o WHERE o.id = $1", ID,
+	))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return org, err
+}
+
+// GetOrganizationsForUser returns the organizations a user is a member of,
+// with their role in each, by name
+func GetOrganizationsForUser(userID string) ([]Organization, error) {
+	ctx := context.Background()
+
+	query := `
+		SELECT ` + organizationColumns + `, om.role
+		FROM organizations o
+		JOIN organization_members om ON om.org_id = o.id
+		WHERE om.user_id = $1
+		ORDER BY o.name, o.created_at
+	`
+
+	rows, err := DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var orgs []Organization
+	for rows.Next() {
+		org := Organization{}
+		var createdBy sql.NullString
+		if err := rows.Scan(
+			&org.ID, &org.Name, &createdBy, &org.CreatedAt, &org.UpdatedAt,
+			&org.MemberCount, &org.Role,
+		); err != nil {
+			return nil, err
+		}
+		org.CreatedBy = createdBy.String
+		orgs = append(orgs, org)
+	}
+
+	return orgs, rows.Err()
+}
+
+func UpdateOrganization(org Organization) error {
+	ctx := context.Background()
+	_, err := DB.ExecContext(ctx,
+		"UPDATE organizations SET name = $2, updated_at = NOW() WHERE id = $1", org.ID, org.Name,
+	)
+	return err
+}
+
+// DeleteOrganization removes an organization with its members, invitations,
+// chat shares and plans, and refreshes the plan columns of its former members
+func DeleteOrganization(ID string) error {
+	ctx := context.Background()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	members, err := organizationMemberIDs(ctx, tx, ID)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM organizations WHERE id = $1", ID); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, memberID := range members {
+		if err := refreshUserPlan(ctx, tx, memberID, now); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// handOverOrganizations passes each organization a user owns to its longest
+// standing admin, or member when it has no admin, before the user is deleted.
+// Organizations with no one else in them are deleted.
+func handOverOrganizations(ctx context.Context, userID string) error {
+	if _, err := DB.ExecContext(ctx, `
+		UPDATE organization_members om SET role = 'owner'
+		FROM (
+			SELECT DISTINCT ON (m.org_id) m.org_id, m.user_id
+			FROM organization_members m
+			JOIN organization_members owner
+				ON owner.org_id = m.org_id AND owner.user_id = $1 AND owner.role = 'owner'
+			WHERE m.user_id <> $1
+			ORDER BY m.org_id, CASE m.role WHEN 'admin' THEN 0 ELSE 1 END, m.created_at
+		) heir
+		WHERE om.org_id = heir.org_id AND om.user_id = heir.user_id
+	`, userID); err != nil {
+		return err
+	}
+
+	_, err := DB.ExecContext(ctx, `
+		DELETE FROM organizations o
+		WHERE EXISTS (SELECT 1 FROM organization_members m WHERE m.org_id = o.id AND m.user_id = $1)
+			AND NOT EXISTS (SELECT 1 FROM organization_members m WHERE m.org_id = o.id AND m.user_id <> $1)
+	`, userID)
+	return err
+}
+
+func scanOrganization(row rowScanner) (*Organization, error) {
+	org := &Organization{}
+	var createdBy sql.NullString
+
+	err := row.Scan(
+		&org.ID, &org.Name, &createdBy, &org.CreatedAt, &org.UpdatedAt, &org.MemberCount,
+	)
+	if err != nil {
+		return nil, err
+	}
+	org.CreatedBy = createdBy.String
+
+	return org, nil
+}
+
+// Organization membership operations
+
+// GetOrganizationMemberRole returns the role of userID in an organization, or "" when they are not a member
+func GetOrganizationMemberRole(orgID, userID string) (string, error) {
+	ctx := context.Background()
+
+	var role string
+	err := DB.QueryRowContext(ctx,
+		"SELECT role FROM organization_members WHERE org_id = $1 AND user_id = $2", orgID, userID,
+	).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+
+	return role, err
+}
+
+// GetOrganizationMembers returns the members of an organization, owner first
+func GetOrganizationMembers(orgID string) ([]OrganizationMember, error) {
+	ctx := context.Background()
+
+	query := `
+		SELECT om.org_id, om.user_id, u.username, om.role, om.invited_by, om.created_at
+		FROM organization_members om
+		JOIN users u ON u.id = om.user_id
+		WHERE om.org_id = $1
+		ORDER BY CASE om.role WHEN 'owner' THEN 0 WHEN 'admin' THEN 1 ELSE 2 END, om.created_at
+	`
+
+	rows, err := DB.QueryContext(ctx, query, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var members []OrganizationMember
+	for rows.Next() {
+		var member OrganizationMember
+		var invitedBy sql.NullString
+		if err := rows.Scan(
+			&member.OrgId, &member.UserId, &member.Username,
+			&member.Role, &invitedBy, &member.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		member.InvitedBy = invitedBy.String
+		members = append(members, member)
+	}
+
+	return members, rows.Err()
+}
+
+// organizationMemberIDs returns the user ids of everyone in an organization
+func organizationMemberIDs(ctx context.Context, q queryer, orgID string) ([]string, error) {
+	rows, err := q.QueryContext(ctx, "SELECT user_id FROM organization_members WHERE org_id = $1", orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+func UpdateOrganizationMemberRole(orgID, userID, role string) error {
+	ctx := context.Background()
+	_, err := DB.ExecContext(ctx,
+		"UPDATE organization_members SET role = $3 WHERE org_id = $1 AND user_id = $2", orgID, userID, role,
+	)
+	return err
+}
+
+// TransferOrganizationOwnership makes a member the owner, the previous owner stays on as an admin
+func TransferOrganizationOwnership(orgID, fromUserID, toUserID string) error {
+	ctx := context.Background()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx,
+		"UPDATE organization_members SET role = $3 WHERE org_id = $1 AND user_id = $2",
+		orgID, fromUserID, OrgRoleAdmin,
+	); err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx,
+		"UPDATE organization_members SET role = $3 WHERE org_id = $1 AND user_id = $2",
+		orgID, toUserID, OrgRoleOwner,
+	)
+	if err != nil {
+		return err
+	}
+	if count, err := result.RowsAffected(); err != nil {
+		return err
+	} else if count == 0 {
+		return sql.ErrNoRows
+	}
+
+	return tx.Commit()
+}
+
+// RemoveOrganizationMember removes a member, who loses the organization's
+// plan and the chats shared into it
+func RemoveOrganizationMember(orgID, userID string) error {
+	ctx := context.Background()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx,
+		"DELETE FROM organization_members WHERE org_id = $1 AND user_id = $2", orgID, userID,
+	); err != nil {
+		return err
+	}
+
+	if err := refreshUserPlan(ctx, tx, userID, time.Now()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Organization invitation operations
+
+func CreateOrganizationInvitation(invitation OrganizationInvitation) error {
+	ctx := context.Background()
+
+	if invitation.CreatedAt.IsZero() {
+		invitation.CreatedAt = time.Now()
+	}
+
+	query := `
+		INSERT INTO organization_invitations (id, org_id, invitee_id, invited_by, role, status, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+	`
+
+	_, err := DB.ExecContext(ctx, query,
+		invitation.ID, invitation.OrgId, invitation.InviteeId, invitation.InvitedBy,
+		invitation.Role, InvitationStatusPending, invitation.CreatedAt,
+	)
+
+	return err
+}
+
+const organizationInvitationColumns = `
+	i.id, i.org_id, o.name, i.invitee_id, invitee.username, i.invited_by, inviter.username,
+	i.role, i.status, i.created_at, i.responded_at
+`
+
+const organizationInvitationJoins = `
+	FROM organization_invitations i
+	JOIN organizations o ON o.id = i.org_id
+	JOIN users invitee ON invitee.id = i.invitee_id
+	JOIN users inviter ON inviter.id = i.invited_by
+`
+
+func GetOrganizationInvitationByID(ID string) (*OrganizationInvitation, error) {
+	ctx := context.Background()
+
+	query := `SELECT ` + organizationInvitationColumns + organizationInvitationJoins + ` WHERE i.id = $1`
+
+	invitation, err := scanOrganizationInvitation(DB.QueryRowContext(ctx, query, ID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return invitation, err
+}
+
+// GetPendingOrganizationInvitationsForUser returns organization invitations
+// waiting for userID to answer, newest first
+func GetPendingOrganizationInvitationsForUser(userID string) ([]OrganizationInvitation, error) {
+	return queryOrganizationInvitations(
+		`WHERE i.invitee_id = $1 AND i.status = $2 ORDER BY i.created_at DESC`,
+		userID, InvitationStatusPending,
+	)
+}
+
+// GetPendingInvitationsForOrganization returns invitations of an organization that are not answered yet
+func GetPendingInvitationsForOrganization(orgID string) ([]OrganizationInvitation, error) {
+	return queryOrganizationInvitations(
+		`WHERE i.org_id = $1 AND i.status = $2 ORDER BY i.created_at DESC`,
+		orgID, InvitationStatusPending,
+	)
+}
+
+func queryOrganizationInvitations(where string, args ...any) ([]OrganizationInvitation, error) {
+	ctx := context.Background()
+
+	query := `SELECT ` + organizationInvitationColumns + organizationInvitationJoins + where
+
+	rows, err := DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var invitations []OrganizationInvitation
+	for rows.Next() {
+		invitation, err := scanOrganizationInvitation(rows)
+		if err != nil {
+			return nil, err
+		}
+		invitations = append(invitations, *invitation)
+	}
+
+	return invitations, rows.Err()
+}
+
+// RespondToOrganizationInvitation records the answer to a pending invitation.
+// Accepting adds the invitee as a member, covered by the organization's plan
+// from then on, in the same transaction.
+func RespondToOrganizationInvitation(invitation OrganizationInvitation, accept bool) error {
+	ctx := context.Background()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	status := InvitationStatusDeclined
+	if accept {
+		status = InvitationStatusAccepted
+	}
+
+	result, err := tx.ExecContext(ctx,
+		"UPDATE organization_invitations SET status = $2, responded_at = NOW() WHERE id = $1 AND status = $3",
+		invitation.ID, status, InvitationStatusPending,
+	)
+	if err != nil {
+		return err
+	}
+	if count, err := result.RowsAffected(); err != nil {
+		return err
+	} else if count == 0 {
+		return sql.ErrNoRows
+	}
+
+	if accept {
+		// An existing member keeps the role they have
+		query := `
+			INSERT INTO organization_members (org_id, user_id, role, invited_by, created_at)
+			VALUES ($1, $2, $3, $4, NOW())
+			ON CONFLICT (org_id, user_id) DO NOTHING
+		`
+		if _, err := tx.ExecContext(ctx, query,
+			invitation.OrgId, invitation.InviteeId, invitation.Role, invitation.InvitedBy,
+		); err != nil {
+			return err
+		}
+
+		if err := refreshUserPlan(ctx, tx, invitation.InviteeId, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// CancelOrganizationInvitation withdraws a pending invitation
+func CancelOrganizationInvitation(ID string) error {
+	ctx := context.Background()
+	_, err := DB.ExecContext(ctx,
+		"DELETE FROM organization_invitations WHERE id = $1 AND status = $2", ID, InvitationStatusPending,
+	)
+	return err
+}
+
+func scanOrganizationInvitation(row rowScanner) (*OrganizationInvitation, error) {
+	invitation := &OrganizationInvitation{}
+	var respondedAt sql.NullTime
+
+	err := row.Scan(
+		&invitation.ID, &invitation.OrgId, &invitation.OrgName,
+		&invitation.InviteeId, &invitation.InviteeName,
+		&invitation.InvitedBy, &invitation.InviterName,
+		&invitation.Role, &invitation.Status, &invitation.CreatedAt, &respondedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	if respondedAt.Valid {
+		invitation.RespondedAt = respondedAt.Time
+	}
+
+	return invitation, nil
+}
+
+// Organization space operations
+
+// ShareChatWithOrganization puts a chat into an organization's space, sharing
+// it again changes the role members get
+func ShareChatWithOrganization(orgID, chatID, role, sharedBy string) error {
+	ctx := context.Background()
+
+	query := `
+		INSERT INTO organization_chats (org_id, chat_id, role, shared_by, created_at)
+		VALUES ($1, $2, $3, $4, NOW())
+		ON CONFLICT (org_id, chat_id) DO UPDATE SET role = EXCLUDED.role, shared_by = EXCLUDED.shared_by
+	`
+
+	_, err := DB.ExecContext(ctx, query, orgID, chatID, role, nullString(sharedBy))
+	return err
+}
+
+// UnshareChatFromOrganization takes a chat out of an organization's space. It
+// reports false when the chat was not in it.
+func UnshareChatFromOrganization(orgID, chatID string) (bool, error) {
+	ctx := context.Background()
+
+	result, err := DB.ExecContext(ctx,
+		"DELETE FROM organization_chats WHERE org_id = $1 AND chat_id = $2", orgID, chatID,
+	)
+	if err != nil {
+		return false, err
+	}
+
+	count, err := result.RowsAffected()
+	return count > 0, err
+}
+
+// GetOrganizationChats returns the chats in an organization's space, most recently active first
+func GetOrganizationChats(orgID string) ([]OrganizationChat, error) {
+	ctx := context.Background()
+
+	query := `
+		SELECT oc.org_id, oc.chat_id, c.title, c.user_id, u.username, oc.role,
+			   oc.shared_by, c.last_message_at, oc.created_at
+		FROM organization_chats oc
+		JOIN chats c ON c.id = oc.chat_id
+		JOIN users u ON u.id = c.user_id
+		WHERE oc.org_id = $1
+		ORDER BY COALESCE(c.last_message_at, c.updated_at) DESC
+	`
+
+	rows, err := DB.QueryContext(ctx, query, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var chats []OrganizationChat
+	for rows.Next() {
+		var chat OrganizationChat
+		var sharedBy sql.NullString
+		var lastMessageAt sql.NullTime
+		if err := rows.Scan(
+			&chat.OrgId, &chat.ChatId, &chat.Title, &chat.OwnerId, &chat.OwnerName,
+			&chat.Role, &sharedBy, &lastMessageAt, &chat.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		chat.SharedBy = sharedBy.String
+		if lastMessageAt.Valid {
+			chat.LastMessageAt = lastMessageAt.Time
+		}
+		chats = append(chats, chat)
+	}
+
+	return chats, rows.Err()
+}
+
+// GetOrganizationChatRole returns the highest role userID gets in a chat
+// through the organizations it is shared into, or "" when it gets none
+func GetOrganizationChatRole(chatID, userID string) (string, error) {
+	ctx := context.Background()
+
+	query := `
+		SELECT oc.role
+		FROM organization_chats oc
+		JOIN organization_members om ON om.org_id = oc.org_id AND om.user_id = $2
+		WHERE oc.chat_id = $1
+		ORDER BY CASE oc.role WHEN 'editor' THEN 0 ELSE 1 END
+		LIMIT 1
+	`
+
+	var role string
+	err := DB.QueryRowContext(ctx, query, chatID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+
+	return role, err
+}
+
+// GetOrganizationUsage sums the chats and messages each member created since
+// a time, and the AI requests in their current request count window
+func GetOrganizationUsage(orgID string, since time.Time) (*OrganizationUsage, error) {
+	ctx := context.Background()
+
+	windowStart := time.Now().Add(-requestCountWindow).UnixMilli()
+
+	query := `
+		SELECT om.user_id, u.username, om.role,
+			(SELECT COUNT(*) FROM chats c WHERE c.user_id = om.user_id AND c.created_at >= $2),
+			(SELECT COUNT(*) FROM messages m WHERE m.author_id = om.user_id AND m.created_at >= $2),
+			CASE WHEN u.request_count_timestamp >= $3 THEN u.request_count_value ELSE 0 END,
+			(SELECT MAX(m.created_at) FROM messages m WHERE m.author_id = om.user_id)
+		FROM organization_members om
+		JOIN users u ON u.id = om.user_id
+		WHERE om.org_id = $1
+		ORDER BY CASE om.role WHEN 'owner' THEN 0 WHEN 'admin' THEN 1 ELSE 2 END, u.username
+	`
+
+	rows, err := DB.QueryContext(ctx, query, orgID, since, windowStart)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	usage := &OrganizationUsage{OrgId: orgID, Since: since, Members: []MemberUsage{}}
+	for rows.Next() {
+		var member MemberUsage
+		var lastActiveAt sql.NullTime
+		if err := rows.Scan(
+			&member.UserId, &member.Username, &member.Role,
+			&member.Chats, &member.Messages, &member.Requests, &lastActiveAt,
+		); err != nil {
+			return nil, err
+		}
+		if lastActiveAt.Valid {
+			member.LastActiveAt = lastActiveAt.Time
+		}
+
+		usage.Chats += member.Chats
+		usage.Messages += member.Messages
+		usage.Requests += member.Requests
+		usage.Members = append(usage.Members, member)
+	}
+
+	return usage, rows.Err()
+}
@@ -0,0 +1,106 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Persona operations
+
+func CreatePersona(persona Persona) error {
+	ctx := context.Background()
+
+	query := `
+		INSERT INTO personas (id, user_id, name, instructions, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+	`
+
+	_, err := DB.ExecContext(ctx, query,
+		persona.ID, persona.UserId, persona.Name, persona.Instructions,
+		persona.CreatedAt, persona.UpdatedAt,
+	)
+
+	return err
+}
+
+// GetPersonasByUserID returns a user's personas by name
+func GetPersonasByUserID(userID string) ([]Persona, error) {
+	ctx := context.Background()
+
+	query := `
+		SELECT id, user_id, name, instructions, created_at, updated_at
+		FROM personas
+		WHERE user_id = $1
+		ORDER BY LOWER(name) ASC
+	`
+
+	rows, err := DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var personas []Persona
+	for rows.Next() {
+		persona, err := scanPersona(rows)
+		if err != nil {
+			return nil, err
+		}
+		personas = append(personas, *persona)
+	}
+
+	return personas, rows.Err()
+}
+
+func GetPersonaByID(ID string) (*Persona, error) {
+	ctx := context.Background()
+
+	query := `
+		SELECT id, user_id, name, instructions, created_at, updated_at
+		FROM personas WHERE id = $1
+	`
+
+	persona, err := scanPersona(DB.QueryRowContext(ctx, query, ID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return persona, err
+}
+
+func UpdatePersona(persona Persona) error {
+	ctx := context.Background()
+
+	query := `UPDATE personas SET name = $2, instructions = $3, updated_at = $4 WHERE id = $1`
+	_, err := DB.ExecContext(ctx, query, persona.ID, persona.Name, persona.Instructions, time.Now())
+	return err
+}
+
+// DeletePersonaByID removes a persona, chats using it go back to none
+func DeletePersonaByID(ID string) error {
+	ctx := context.Background()
+	_, err := DB.ExecContext(ctx, "DELETE FROM personas WHERE id = $1", ID)
+	return err
+}
+
+// SetChatPersona picks the persona a chat answers as, an empty personaID removes it
+func SetChatPersona(chatID, personaID string) error {
+	ctx := context.Background()
+	_, err := DB.ExecContext(ctx, "UPDATE chats SET persona_id = $2 WHERE id = $1", chatID, nullString(personaID))
+	return err
+}
+
+func scanPersona(row rowScanner) (*Persona, error) {
+	persona := &Persona{}
+
+	err := row.Scan(
+		&persona.ID, &persona.UserId, &persona.Name, &persona.Instructions,
+		&persona.CreatedAt, &persona.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return persona, nil
+}
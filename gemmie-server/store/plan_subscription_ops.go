@@ -0,0 +1,334 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Plan subscription operations. Every paid period is its own row, the plan
+// columns of users are kept as a copy of the current one for older readers.
+// A period bought by an organization has no user, it covers every member.
+
+const planSubscriptionColumns = `
+	id, user_id, org_id, transaction_ref, plan_key, plan_name, amount, price, duration,
+	phone_number, status, starts_at, ends_at, created_at, updated_at
+`
+
+// entitledPeriods selects the periods that cover user $1: their own and those
+// of the organizations they are a member of
+const entitledPeriods = `
+	(user_id = $1 OR org_id IN (SELECT org_id FROM organization_members WHERE user_id = $1))
+`
+
+// queryRower is what *sql.DB and *sql.Tx have in common for single row queries
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+}
+
+func scanPlanSubscription(row rowScanner) (*PlanSubscription, error) {
+	sub := &PlanSubscription{}
+	var userID, orgID, transactionRef sql.NullString
+
+	err := row.Scan(
+		&sub.ID, &userID, &orgID, &transactionRef, &sub.PlanKey, &sub.PlanName, &sub.Amount,
+		&sub.Price, &sub.Duration, &sub.PhoneNumber, &sub.Status, &sub.StartsAt, &sub.EndsAt,
+		&sub.CreatedAt, &sub.UpdatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+	sub.UserId = userID.String
+	sub.OrgId = orgID.String
+	sub.TransactionRef = transactionRef.String
+
+	return sub, nil
+}
+
+// CreatePlanSubscription records a purchased period and refreshes the plan
+// columns of the user, or of every member when OrgId is set. A transaction
+// pays for one period only, recording it again returns the existing row and
+// false.
+func CreatePlanSubscription(sub PlanSubscription) (*PlanSubscription, bool, error) {
+	ctx := context.Background()
+
+	now := time.Now()
+	if sub.Status == "" {
+		sub.Status = PlanSubscriptionActive
+	}
+	if sub.Status == PlanSubscriptionActive && !sub.EndsAt.After(now) {
+		sub.Status = PlanSubscriptionExpired
+	}
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		INSERT INTO subscriptions (
+			id, user_id, org_id, transaction_ref, plan_key, plan_name, amount, price, duration,
+			phone_number, status, starts_at, ends_at, created_at, updated_at
+		) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $14)
+		ON CONFLICT (transaction_ref) DO NOTHING
+		RETURNING ` + planSubscriptionColumns
+
+	created, err := scanPlanSubscription(tx.QueryRowContext(ctx, query,
+		sub.ID, nullString(sub.UserId), nullString(sub.OrgId), nullString(sub.TransactionRef), sub.PlanKey, sub.PlanName, sub.Amount,
+		sub.Price, sub.Duration, sub.PhoneNumber, sub.Status, sub.StartsAt, sub.EndsAt, now,
+	))
+	if err == sql.ErrNoRows {
+		existing, err := scanPlanSubscription(tx.QueryRowContext(ctx,
+			"SELECT "+planSubscriptionColumns+" FROM subscriptions WHERE transaction_ref = $1",
+			sub.TransactionRef,
+		))
+		if err != nil {
+			return nil, false, err
+		}
+		return existing, false, tx.Commit()
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	if err := refreshPlanHolders(ctx, tx, sub.UserId, sub.OrgId, now); err != nil {
+		return nil, false, err
+	}
+
+	return created, true, tx.Commit()
+}
+
+// refreshPlanHolders refreshes the plan columns of the user a period belongs
+// to, or of every member of its organization
+func refreshPlanHolders(ctx context.Context, tx *sql.Tx, userID, orgID string, now time.Time) error {
+	if orgID == "" {
+		return refreshUserPlan(ctx, tx, userID, now)
+	}
+
+	members, err := organizationMemberIDs(ctx, tx, orgID)
+	if err != nil {
+		return err
+	}
+	for _, memberID := range members {
+		if err := refreshUserPlan(ctx, tx, memberID, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// refreshUserPlan copies the current period into the plan columns of users.
+// Without one, columns whose expiry is still ahead are ended now, which
+// happens when the user leaves the organization that paid. Otherwise they are
+// left as they are, their expiry already says the plan is over.
+func refreshUserPlan(ctx context.Context, q queryRower, userID string, now time.Time) error {
+	current, err := scanPlanSubscription(q.QueryRowContext(ctx, `
+		SELECT `+planSubscriptionColumns+`
+		FROM subscriptions
+		WHERE `+entitledPeriods+` AND status = $2 AND starts_at <= $3 AND ends_at > $3
+		ORDER BY ends_at DESC
+		LIMIT 1
+	`, userID, PlanSubscriptionActive, now))
+	if err == sql.ErrNoRows {
+		_, err = q.ExecContext(ctx,
+			"UPDATE users SET expiry_timestamp = $2, updated_at = NOW() WHERE id = $1 AND expiry_timestamp > $2",
+			userID, now.Unix(),
+		)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	// The phone number that paid for an organization's plan is not the member's
+	phoneNumber := current.PhoneNumber
+	if current.OrgId != "" {
+		phoneNumber = ""
+	}
+
+	query := `
+		UPDATE users SET
+			plan = $2, plan_name = $3, amount = $4, duration = $5,
+			phone_number = CASE WHEN $6 = '' THEN phone_number ELSE $6 END,
+			expiry_timestamp = $7, expire_duration = $8, price = $9, updated_at = NOW()
+		WHERE id = $1
+	`
+
+	_, err = q.ExecContext(ctx, query,
+		userID, current.PlanKey, current.PlanName, current.Amount, current.Duration,
+		phoneNumber, current.EndsAt.Unix(),
+		int64(current.EndsAt.Sub(current.StartsAt).Seconds()), current.Price,
+	)
+
+	return err
+}
+
+// GetActivePlanSubscription returns the period a user is entitled to now,
+// the active one that ends last of their own and their organizations', or
+// nil on the free plan
+func GetActivePlanSubscription(userID string) (*PlanSubscription, error) {
+	ctx := context.Background()
+
+	sub, err := scanPlanSubscription(DB.QueryRowContext(ctx, `
+		SELECT `+planSubscriptionColumns+`
+		FROM subscriptions
+		WHERE `+entitledPeriods+` AND status = $2 AND starts_at <= $3 AND ends_at > $3
+		ORDER BY ends_at DESC
+		LIMIT 1
+	`, userID, PlanSubscriptionActive, time.Now()))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return sub, err
+}
+
+// GetPlanSubscriptionByTransactionRef returns the period a transaction paid for
+func GetPlanSubscriptionByTransactionRef(ref string) (*PlanSubscription, error) {
+	ctx := context.Background()
+
+	sub, err := scanPlanSubscription(DB.QueryRowContext(ctx,
+		"SELECT "+planSubscriptionColumns+" FROM subscriptions WHERE transaction_ref = $1", ref,
+	))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return sub, err
+}
+
+// GetPlanSubscriptions returns every period a user bought, newest first
+func GetPlanSubscriptions(userID string) ([]PlanSubscription, error) {
+	ctx := context.Background()
+
+	rows, err := DB.QueryContext(ctx, `
+		SELECT `+planSubscriptionColumns+`
+		FROM subscriptions
+		WHERE user_id = $1
+		ORDER BY starts_at DESC, created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []PlanSubscription
+	for rows.Next() {
+		sub, err := scanPlanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, *sub)
+	}
+
+	return subs, rows.Err()
+}
+
+// GetActiveOrganizationPlan returns the period an organization's members are
+// covered by now, or nil when it has none
+func GetActiveOrganizationPlan(orgID string) (*PlanSubscription, error) {
+	ctx := context.Background()
+
+	sub, err := scanPlanSubscription(DB.QueryRowContext(ctx, `
+		SELECT `+planSubscriptionColumns+`
+		FROM subscriptions
+		WHERE org_id = $1 AND status = $2 AND starts_at <= $3 AND ends_at > $3
+		ORDER BY ends_at DESC
+		LIMIT 1
+	`, orgID, PlanSubscriptionActive, time.Now()))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return sub, err
+}
+
+// GetOrganizationPlanSubscriptions returns every period an organization bought, newest first
+func GetOrganizationPlanSubscriptions(orgID string) ([]PlanSubscription, error) {
+	ctx := context.Background()
+
+	rows, err := DB.QueryContext(ctx, `
+		SELECT `+planSubscriptionColumns+`
+		FROM subscriptions
+		WHERE org_id = $1
+		ORDER BY starts_at DESC, created_at DESC
+	`, orgID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var subs []PlanSubscription
+	for rows.Next() {
+		sub, err := scanPlanSubscription(rows)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, *sub)
+	}
+
+	return subs, rows.Err()
+}
+
+// ExpirePlanSubscriptions marks active periods that ended before now as
+// expired and refreshes the plan columns of their users and organization
+// members, who may still be covered by a later period. It returns how many periods expired.
+func ExpirePlanSubscriptions(now time.Time) (int, error) {
+	ctx := context.Background()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `
+		UPDATE subscriptions SET status = $1, updated_at = NOW()
+		WHERE status = $2 AND ends_at <= $3
+		RETURNING user_id, org_id
+	`, PlanSubscriptionExpired, PlanSubscriptionActive, now)
+	if err != nil {
+		return 0, err
+	}
+
+	expired := 0
+	users := map[string]bool{}
+	orgs := map[string]bool{}
+	for rows.Next() {
+		var userID, orgID sql.NullString
+		if err := rows.Scan(&userID, &orgID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if orgID.Valid {
+			orgs[orgID.String] = true
+		} else {
+			users[userID.String] = true
+		}
+		expired++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for orgID := range orgs {
+		members, err := organizationMemberIDs(ctx, tx, orgID)
+		if err != nil {
+			return 0, err
+		}
+		for _, memberID := range members {
+			users[memberID] = true
+		}
+	}
+
+	for userID := range users {
+		if err := refreshUserPlan(ctx, tx, userID, now); err != nil {
+			return 0, err
+		}
+	}
+
+	return expired, tx.Commit()
+}
@@ -0,0 +1,87 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+)
+
+// User preferences operations
+
+// DefaultPreferences are the values of every preference a user has not set
+func DefaultPreferences() UserPreferences {
+	return UserPreferences{
+		SchemaVersion: PreferencesSchemaVersion,
+		Theme:         "system",
+		Language:      "en",
+		ResponseMode:  ModesLightResponse,
+		Notifications: NotificationPreferences{
+			Push:            true,
+			TaskCompleted:   true,
+			ChatInvitations: true,
+			DataExports:     true,
+		},
+	}
+}
+
+// ResolvePreferences lays a stored preferences document over the defaults
+func ResolvePreferences(doc []byte) (UserPreferences, error) {
+	prefs := DefaultPreferences()
+	if len(doc) == 0 {
+		return prefs, nil
+	}
+
+	if err := json.Unmarshal(doc, &prefs); err != nil {
+		return DefaultPreferences(), err
+	}
+	prefs.SchemaVersion = PreferencesSchemaVersion
+
+	return prefs, nil
+}
+
+// GetUserPreferencesDoc returns the stored preferences document of a user and
+// the user's row version, or nil when the user does not exist
+func GetUserPreferencesDoc(userID string) ([]byte, int64, error) {
+	ctx := context.Background()
+
+	var doc []byte
+	var version int64
+	err := DB.QueryRowContext(ctx,
+		"SELECT preferences_doc, version FROM users WHERE id = $1", userID,
+	).Scan(&doc, &version)
+	if err == sql.ErrNoRows {
+		return nil, 0, nil
+	}
+
+	return doc, version, err
+}
+
+// GetUserPreferences returns the resolved preferences of a user
+func GetUserPreferences(userID string) (UserPreferences, error) {
+	doc, _, err := GetUserPreferencesDoc(userID)
+	if err != nil {
+		return DefaultPreferences(), err
+	}
+
+	return ResolvePreferences(doc)
+}
+
+// UpdateUserPreferencesDoc replaces the stored preferences document while the
+// user is still at version, 0 skips the check. It returns the new version.
+func UpdateUserPreferencesDoc(userID string, doc []byte, version int64) (int64, error) {
+	ctx := context.Background()
+
+	query := `
+		UPDATE users SET preferences_doc = $2, updated_at = NOW()
+		WHERE id = $1 AND ($3 = 0 OR version = $3)
+		RETURNING version
+	`
+
+	var newVersion int64
+	err := DB.QueryRowContext(ctx, query, userID, doc, version).Scan(&newVersion)
+	if err == sql.ErrNoRows {
+		return 0, ErrVersionConflict
+	}
+
+	return newVersion, err
+}
@@ -0,0 +1,290 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+
+	"github.com/imrany/gemmie/gemmie-server/internal/encrypt"
+)
+
+// ReencryptOptions selects what Reencrypt does
+type ReencryptOptions struct {
+	UserID         string // only this user's keys and content, empty for everyone
+	RotateDataKeys bool   // retire the active data keys so content moves to new ones
+	Decrypt        bool   // write everything back as plaintext instead
+	BatchSize      int
+}
+
+// ReencryptStats counts what Reencrypt changed
+type ReencryptStats struct {
+	RewrappedKeys int
+	RetiredKeys   int
+	Rows          map[string]int // rows rewritten, by table
+}
+
+// encryptedColumns are the encrypted values of each table, with the query
+// that lists them after a keyset cursor along with the user whose key they use
+var encryptedColumns = []struct {
+	table  string
+	list   string
+	update string
+}{
+	{
+		table: "messages",
+		list: `
+			SELECT m.id, c.user_id, m.prompt, m.response
+			FROM messages m JOIN chats c ON c.id = m.chat_id
+			WHERE m.id > $1 AND ($2 = '' OR c.user_id = $2)
+			ORDER BY m.id LIMIT $3
+		`,
+		update: "UPDATE messages SET prompt = $2, response = $3 WHERE id = $1",
+	},
+	{
+		table: "message_versions",
+		list: `
+			SELECT v.id, c.user_id, v.prompt, v.response
+			FROM message_versions v JOIN chats c ON c.id = v.chat_id
+			WHERE v.id > $1 AND ($2 = '' OR c.user_id = $2)
+			ORDER BY v.id LIMIT $3
+		`,
+		update: "UPDATE message_versions SET prompt = $2, response = $3 WHERE id = $1",
+	},
+	{
+		table: "arcades",
+		list: `
+			SELECT id, user_id, code
+			FROM arcades
+			WHERE id > $1 AND user_id IS NOT NULL AND ($2 = '' OR user_id = $2)
+			ORDER BY id LIMIT $3
+		`,
+		update: "UPDATE arcades SET code = $2 WHERE id = $1",
+	},
+	{
+		table: "chat_shares",
+		list: `
+			SELECT s.id, c.user_id, s.snapshot::text
+			FROM chat_shares s JOIN chats c ON c.id = s.chat_id
+			WHERE s.id > $1 AND ($2 = '' OR c.user_id = $2) AND s.snapshot IS NOT NULL
+			ORDER BY s.id LIMIT $3
+		`,
+		update: "UPDATE chat_shares SET snapshot = $2::jsonb WHERE id = $1",
+	},
+}
+
+// Reencrypt moves data keys under the current master key and rewrites stored
+// content so it is encrypted with each user's active data key. Plaintext
+// written before encryption was turned on is encrypted on the way.
+func Reencrypt(opts ReencryptOptions) (*ReencryptStats, error) {
+	ctx := context.Background()
+
+	if !opts.Decrypt && !EncryptionEnabled() {
+		return nil, ErrEncryptionDisabled
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 500
+	}
+
+	stats := &ReencryptStats{Rows: map[string]int{}}
+
+	if !opts.Decrypt {
+		rewrapped, err := rewrapDataKeys(ctx, opts.UserID)
+		if err != nil {
+			return stats, fmt.Errorf("rewrap data keys: %w", err)
+		}
+		stats.RewrappedKeys = rewrapped
+	}
+
+	if opts.RotateDataKeys && !opts.Decrypt {
+		result, err := DB.ExecContext(ctx, `
+			UPDATE user_data_keys SET state = $1, retired_at = NOW()
+			WHERE state = $2 AND ($3 = '' OR user_id = $3)
+		`, DataKeyRetired, DataKeyActive, opts.UserID)
+		if err != nil {
+			return stats, fmt.Errorf("retire data keys: %w", err)
+		}
+		retired, _ := result.RowsAffected()
+		stats.RetiredKeys = int(retired)
+
+		keyring.Lock()
+		keyring.activeKey = map[string]activeDataKeyEntry{}
+		keyring.Unlock()
+	}
+
+	for _, columns := range encryptedColumns {
+		rows, err := reencryptTable(ctx, columns.table, columns.list, columns.update, opts)
+		stats.Rows[columns.table] = rows
+		if err != nil {
+			return stats, fmt.Errorf("%s: %w", columns.table, err)
+		}
+		slog.Info("Re-encrypted table", "table", columns.table, "rows", rows)
+	}
+
+	return stats, nil
+}
+
+// rewrapDataKeys wraps every data key still wrapped by an old master key with the current one
+func rewrapDataKeys(ctx context.Context, userID string) (int, error) {
+	masterID := MasterKeyID()
+
+	rows, err := DB.QueryContext(ctx, `
+		SELECT id, wrapped_key, master_key_id FROM user_data_keys
+		WHERE master_key_id <> $1 AND ($2 = '' OR user_id = $2)
+	`, masterID, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	type wrappedKey struct {
+		id       string
+		wrapped  []byte
+		masterID string
+	}
+	var keys []wrappedKey
+	for rows.Next() {
+		var key wrappedKey
+		if err := rows.Scan(&key.id, &key.wrapped, &key.masterID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		keys = append(keys, key)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	keyring.RLock()
+	master := keyring.masters[masterID]
+	keyring.RUnlock()
+
+	for i, key := range keys {
+		plain, err := unwrapDataKey(key.id, key.wrapped, key.masterID)
+		if err != nil {
+			return i, err
+		}
+		wrapped, err := encrypt.Seal(master, plain, dataKeyAAD(key.id))
+		if err != nil {
+			return i, err
+		}
+		if _, err := DB.ExecContext(ctx,
+			"UPDATE user_data_keys SET wrapped_key = $2, master_key_id = $3 WHERE id = $1",
+			key.id, wrapped, masterID,
+		); err != nil {
+			return i, err
+		}
+	}
+
+	return len(keys), nil
+}
+
+// reencryptTable rewrites the encrypted columns of one table in batches and
+// returns how many rows changed
+func reencryptTable(ctx context.Context, table, list, update string, opts ReencryptOptions) (int, error) {
+	changed := 0
+	cursor := ""
+
+	for {
+		rows, err := DB.QueryContext(ctx, list, cursor, opts.UserID, opts.BatchSize)
+		if err != nil {
+			return changed, err
+		}
+		columns, err := rows.Columns()
+		if err != nil {
+			rows.Close()
+			return changed, err
+		}
+
+		type storedRow struct {
+			id     string
+			owner  string
+			values []sql.NullString
+		}
+		var batch []storedRow
+		for rows.Next() {
+			row := storedRow{values: make([]sql.NullString, len(columns)-2)}
+			dest := []any{&row.id, &row.owner}
+			for i := range row.values {
+				dest = append(dest, &row.values[i])
+			}
+			if err := rows.Scan(dest...); err != nil {
+				rows.Close()
+				return changed, err
+			}
+			batch = append(batch, row)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return changed, err
+		}
+
+		for _, row := range batch {
+			args := []any{row.id}
+			dirty := false
+			for _, value := range row.values {
+				if !value.Valid {
+					args = append(args, nil)
+					continue
+				}
+				rewritten, err := reencryptValue(ctx, table, row.owner, value.String, opts.Decrypt)
+				if err != nil {
+					return changed, fmt.Errorf("row %s: %w", row.id, err)
+				}
+				dirty = dirty || rewritten != value.String
+				args = append(args, rewritten)
+			}
+			if !dirty {
+				continue
+			}
+			if _, err := DB.ExecContext(ctx, update, args...); err != nil {
+				return changed, fmt.Errorf("row %s: %w", row.id, err)
+			}
+			changed++
+		}
+
+		if len(batch) < opts.BatchSize {
+			return changed, nil
+		}
+		cursor = batch[len(batch)-1].id
+	}
+}
+
+// reencryptValue returns a stored value encrypted with the owner's active data
+// key, or as plaintext when decrypting. Values already in that form are returned unchanged.
+func reencryptValue(ctx context.Context, table, ownerID, value string, decrypt bool) (string, error) {
+	if table == "chat_shares" {
+		plain, err := decryptSnapshot(ctx, value)
+		if err != nil || decrypt {
+			return plain, err
+		}
+		if id := dataKeyIDOf(snapshotCiphertext(value)); id != "" && isActiveDataKey(ctx, ownerID, id) {
+			return value, nil
+		}
+		encrypted, err := encryptForUser(ctx, ownerID, plain)
+		if err != nil {
+			return "", err
+		}
+		return jsonString(encrypted)
+	}
+
+	if decrypt {
+		plain, err := decryptValue(ctx, value)
+		return storedPlaintext(plain), err
+	}
+	if id := dataKeyIDOf(value); id != "" && isActiveDataKey(ctx, ownerID, id) {
+		return value, nil
+	}
+
+	plain, err := decryptValue(ctx, value)
+	if err != nil {
+		return "", err
+	}
+	return encryptForUser(ctx, ownerID, plain)
+}
+
+// isActiveDataKey reports whether id is the owner's active data key
+func isActiveDataKey(ctx context.Context, ownerID, id string) bool {
+	activeID, _, err := activeDataKey(ctx, ownerID)
+	return err == nil && activeID == id
+}
@@ -0,0 +1,164 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Retention operations. A chat's retention is its own setting when set,
+// otherwise its owner's. Kept chats and a retention of 0 are never purged.
+
+// retentionPurgeLock names the advisory lock that lets only one replica
+// purge at a time
+const retentionPurgeLock = "gemmie.retention_purge"
+
+func nullInt(n sql.NullInt64) *int {
+	if !n.Valid {
+		return nil
+	}
+	v := int(n.Int64)
+	return &v
+}
+
+// GetUserRetentionDays returns a user's retention in days, 0 for forever
+func GetUserRetentionDays(userID string) (int, error) {
+	ctx := context.Background()
+
+	var days int
+	err := DB.QueryRowContext(ctx, "SELECT retention_days FROM users WHERE id = $1", userID).Scan(&days)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return days, err
+}
+
+// SetUserRetentionDays sets how long a user's chats are kept
+func SetUserRetentionDays(userID string, days int) error {
+	ctx := context.Background()
+	_, err := DB.ExecContext(ctx,
+		"UPDATE users SET retention_days = $2, updated_at = NOW() WHERE id = $1", userID, days,
+	)
+	return err
+}
+
+// SetChatRetention overrides the retention of one chat, nil follows the
+// owner's setting. Kept chats are never purged.
+func SetChatRetention(chatID string, days *int, kept bool) error {
+	ctx := context.Background()
+
+	var value sql.NullInt64
+	if days != nil {
+		value = sql.NullInt64{Int64: int64(*days), Valid: true}
+	}
+
+	_, err := DB.ExecContext(ctx,
+		"UPDATE chats SET retention_days = $2, is_kept = $3 WHERE id = $1", chatID, value, kept,
+	)
+	return err
+}
+
+// PurgeExpiredData removes up to batch messages older than their chat's
+// retention, then up to batch chats left empty whose last activity is older
+// than it. Replicas that run it at the same time skip the batch instead of
+// waiting, and rows locked by other writers are skipped until the next run.
+func PurgeExpiredData(now time.Time, batch int) (*RetentionPurge, error) {
+	ctx := context.Background()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := tx.QueryRowContext(ctx,
+		"SELECT pg_try_advisory_xact_lock(hashtext($1))", retentionPurgeLock,
+	).Scan(&locked); err != nil {
+		return nil, err
+	}
+	if !locked {
+		return &RetentionPurge{Skipped: true}, nil
+	}
+
+	purge := &RetentionPurge{}
+
+	messages, err := tx.QueryContext(ctx, `
+		WITH expired AS (
+			SELECT m.id
+			FROM messages m
+			JOIN chats c ON c.id = m.chat_id
+			JOIN users u ON u.id = c.user_id
+			WHERE NOT c.is_kept
+				AND COALESCE(c.retention_days, u.retention_days) > 0
+				AND m.created_at < $1::timestamp - make_interval(days => COALESCE(c.retention_days, u.retention_days))
+			ORDER BY m.created_at ASC
+			LIMIT $2
+			FOR UPDATE OF m SKIP LOCKED
+		)
+		DELETE FROM messages m
+		USING expired, chats c
+		WHERE m.id = expired.id AND c.id = m.chat_id
+		RETURNING m.id, m.chat_id, c.user_id
+	`, now, batch)
+	if err != nil {
+		return nil, err
+	}
+	for messages.Next() {
+		var item PurgedItem
+		if err := messages.Scan(&item.ID, &item.ChatId, &item.UserId); err != nil {
+			messages.Close()
+			return nil, err
+		}
+		purge.Messages = append(purge.Messages, item)
+	}
+	messages.Close()
+	if err := messages.Err(); err != nil {
+		return nil, err
+	}
+
+	chats, err := tx.QueryContext(ctx, `
+		SELECT c.id, c.user_id
+		FROM chats c
+		JOIN users u ON u.id = c.user_id
+		WHERE NOT c.is_kept
+			AND COALESCE(c.retention_days, u.retention_days) > 0
+			AND GREATEST(c.created_at, COALESCE(c.last_message_at, c.created_at))
+				< $1::timestamp - make_interval(days => COALESCE(c.retention_days, u.retention_days))
+			AND NOT EXISTS (SELECT 1 FROM messages m WHERE m.chat_id = c.id)
+		ORDER BY c.created_at ASC
+		LIMIT $2
+		FOR UPDATE OF c SKIP LOCKED
+	`, now, batch)
+	if err != nil {
+		return nil, err
+	}
+	var chatIDs []string
+	for chats.Next() {
+		var item PurgedItem
+		if err := chats.Scan(&item.ID, &item.UserId); err != nil {
+			chats.Close()
+			return nil, err
+		}
+		item.ChatId = item.ID
+		purge.Chats = append(purge.Chats, item)
+		chatIDs = append(chatIDs, item.ID)
+	}
+	chats.Close()
+	if err := chats.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(chatIDs) > 0 {
+		if _, err := tx.ExecContext(ctx,
+			"DELETE FROM chats WHERE id = ANY($1)", pq.Array(chatIDs),
+		); err != nil {
+			return nil, err
+		}
+	}
+
+	return purge, tx.Commit()
+}
@@ -0,0 +1,175 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// Chat share link operations
+
+func CreateChatShare(share ChatShare) error {
+	ctx := context.Background()
+
+	if share.CreatedAt.IsZero() {
+		share.CreatedAt = time.Now()
+	}
+
+	snapshot, err := encryptSnapshot(ctx, share.ChatId, share.Snapshot)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO chat_shares (id, chat_id, created_by, token, mode, password_hash, snapshot, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+	`
+
+	_, err = DB.ExecContext(ctx, query,
+		share.ID, share.ChatId, share.CreatedBy, share.Token, share.Mode,
+		nullString(share.PasswordHash), nullString(snapshot),
+		nullTime(share.ExpiresAt), share.CreatedAt,
+	)
+
+	return err
+}
+
+// GetChatSharesByChatID returns every link of a chat, including revoked ones, newest first
+func GetChatSharesByChatID(chatID string) ([]ChatShare, error) {
+	ctx := context.Background()
+
+	query := `
+		SELECT id, chat_id, created_by, token, mode, password_hash, snapshot,
+			   view_count, last_viewed_at, expires_at, revoked_at, locked_until, created_at
+		FROM chat_shares WHERE chat_id = $1
+		ORDER BY created_at DESC
+	`
+
+	rows, err := DB.QueryContext(ctx, query, chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var shares []ChatShare
+	for rows.Next() {
+		share, err := scanChatShare(rows)
+		if err != nil {
+			return nil, err
+		}
+		shares = append(shares, *share)
+	}
+
+	return shares, rows.Err()
+}
+
+func GetChatShareByID(ID string) (*ChatShare, error) {
+	return getChatShare("id", ID)
+}
+
+func GetChatShareByToken(token string) (*ChatShare, error) {
+	return getChatShare("token", token)
+}
+
+func getChatShare(column, value string) (*ChatShare, error) {
+	ctx := context.Background()
+
+	// column is one of two constants above, never user input
+	query := `
+		SELECT id, chat_id, created_by, token, mode, password_hash, snapshot,
+			   view_count, last_viewed_at, expires_at, revoked_at, locked_until, created_at
+		FROM chat_shares WHERE ` + column + ` = $1
+	`
+
+	share, err := scanChatShare(DB.QueryRowContext(ctx, query, value))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return share, err
+}
+
+// RevokeChatShare disables a link; the row is kept so the owner can see its history
+func RevokeChatShare(ID string) error {
+	ctx := context.Background()
+	_, err := DB.ExecContext(ctx,
+		"UPDATE chat_shares SET revoked_at = NOW() WHERE id = $1 AND revoked_at IS NULL", ID,
+	)
+	return err
+}
+
+// RecordChatSharePasswordFailure counts a wrong password for a link. Every
+// maxFailures wrong passwords in a row lock the link for lockout; it returns
+// when the link is locked until, zero when it is not locked.
+func RecordChatSharePasswordFailure(ID string, maxFailures int, lockout time.Duration) (time.Time, error) {
+	ctx := context.Background()
+
+	query := `
+		UPDATE chat_shares SET
+			failed_attempts = CASE WHEN failed_attempts + 1 >= $2 THEN 0 ELSE failed_attempts + 1 END,
+			locked_until = CASE WHEN failed_attempts + 1 >= $2 THEN NOW() + make_interval(secs => $3) ELSE locked_until END
+		WHERE id = $1
+		RETURNING locked_until
+	`
+
+	var lockedUntil sql.NullTime
+	err := DB.QueryRowContext(ctx, query, ID, maxFailures, lockout.Seconds()).Scan(&lockedUntil)
+	if err != nil || !lockedUntil.Valid || lockedUntil.Time.Before(time.Now()) {
+		return time.Time{}, err
+	}
+	return lockedUntil.Time, nil
+}
+
+// ResetChatSharePasswordFailures clears the wrong passwords counted for a
+// link once the right one is given
+func ResetChatSharePasswordFailures(ID string) error {
+	ctx := context.Background()
+	_, err := DB.ExecContext(ctx,
+		"UPDATE chat_shares SET failed_attempts = 0 WHERE id = $1 AND failed_attempts > 0", ID,
+	)
+	return err
+}
+
+func RecordChatShareView(ID string) error {
+	ctx := context.Background()
+	_, err := DB.ExecContext(ctx,
+		"UPDATE chat_shares SET view_count = view_count + 1, last_viewed_at = NOW() WHERE id = $1", ID,
+	)
+	return err
+}
+
+func scanChatShare(row rowScanner) (*ChatShare, error) {
+	share := &ChatShare{}
+	var passwordHash, snapshot sql.NullString
+	var lastViewedAt, expiresAt, revokedAt, lockedUntil sql.NullTime
+
+	err := row.Scan(
+		&share.ID, &share.ChatId, &share.CreatedBy, &share.Token, &share.Mode,
+		&passwordHash, &snapshot, &share.ViewCount, &lastViewedAt,
+		&expiresAt, &revokedAt, &lockedUntil, &share.CreatedAt,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	share.PasswordHash = passwordHash.String
+	share.HasPassword = passwordHash.Valid && passwordHash.String != ""
+	share.Snapshot, err = decryptSnapshot(context.Background(), snapshot.String)
+	if err != nil {
+		return nil, err
+	}
+	if lastViewedAt.Valid {
+		share.LastViewedAt = lastViewedAt.Time
+	}
+	if expiresAt.Valid {
+		share.ExpiresAt = expiresAt.Time
+	}
+	if revokedAt.Valid {
+		share.RevokedAt = revokedAt.Time
+	}
+	if lockedUntil.Valid {
+		share.LockedUntil = lockedUntil.Time
+	}
+
+	return share, nil
+}
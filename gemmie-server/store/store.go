@@ -3,10 +3,11 @@ package store
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"log/slog"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 // Response represents API response
@@ -54,6 +55,7 @@ type User struct {
 	UnsubscribeToken        string        `json:"unsubscribe_token,omitempty"`
 	UserTransactions        []Transaction `json:"user_transactions,omitempty"`
 	UserAgent               string        `json:"user_agent"`
+	Version                 int64         `json:"version"`
 }
 
 type RequestCount struct {
@@ -101,16 +103,93 @@ type Chat struct {
 	IsPrivate     bool      `json:"is_private"`
 	Messages      []Message `json:"messages"`
 	IsReadOnly    bool      `json:"is_read_only"`
+	ActiveLeafId  string    `json:"active_leaf_id,omitempty"`
+	FolderId      string    `json:"folder_id,omitempty"`
+	PersonaId     string    `json:"persona_id,omitempty"` // the owner's persona the chat answers as
+	Model         string    `json:"model,omitempty"`      // "provider/model" the chat is answered with, empty for the user's default
+	IsPinned      bool      `json:"is_pinned"`
+	Tags          []Tag     `json:"tags,omitempty"`
+	Role          string    `json:"role,omitempty"` // the requesting user's role in the chat
+	Version       int64     `json:"version"`
+	RetentionDays *int      `json:"retention_days"` // nil follows the owner's setting
+	IsKept        bool      `json:"is_kept"`
+}
+
+// ChatFilter narrows and orders the chat list, zero values mean no filter
+type ChatFilter struct {
+	FolderId string // "none" selects chats outside any folder
+	TagId    string
+	Pinned   *bool
+	Archived *bool
+	SortBy   string // updated_at (default), created_at, last_message_at or title
+}
+
+// Folder groups a user's chats
+type Folder struct {
+	ID        string    `json:"id"`
+	UserId    string    `json:"user_id"`
+	Name      string    `json:"name"`
+	Color     string    `json:"color,omitempty"`
+	ChatCount int       `json:"chat_count"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Tag is a free-form label that can be put on many chats
+type Tag struct {
+	ID        string    `json:"id"`
+	UserId    string    `json:"user_id,omitempty"`
+	Name      string    `json:"name"`
+	ChatCount int       `json:"chat_count,omitempty"`
+	CreatedAt time.Time `json:"created_at,omitzero"`
+}
+
+// Persona is a named set of instructions a user picks for a chat
+type Persona struct {
+	ID           string    `json:"id"`
+	UserId       string    `json:"user_id"`
+	Name         string    `json:"name"`
+	Instructions string    `json:"instructions"`
+	CreatedAt    time.Time `json:"created_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
 }
 
 type Message struct {
+	ID           string    `json:"id"`
+	ChatId       string    `json:"chat_id"`
+	ParentId     string    `json:"parent_id,omitempty"`
+	AuthorId     string    `json:"author_id,omitempty"`
+	AuthorName   string    `json:"author_name,omitempty"`
+	Prompt       string    `json:"prompt,omitempty"`
+	Response     string    `json:"response"`
+	CreatedAt    time.Time `json:"created_at"`
+	Model        string    `json:"model,omitempty"`
+	References   []string  `json:"references,omitempty"`
+	IsEdited     bool      `json:"is_edited"`
+	IsPartial    bool      `json:"is_partial,omitempty"` // the response stopped before it was complete
+	EditedAt     time.Time `json:"edited_at,omitzero"`
+	VersionCount int       `json:"version_count,omitempty"`
+	Siblings     []string  `json:"siblings,omitempty"` // alternative branches at this turn, oldest first
+	Version      int64     `json:"version"`
+}
+
+// MessageNode is a message with its replies, used to return a chat as a tree
+type MessageNode struct {
+	Message
+	Children []MessageNode `json:"children"`
+}
+
+// MessageVersion is a prior state of an edited message
+type MessageVersion struct {
 	ID         string    `json:"id"`
+	MessageId  string    `json:"message_id"`
 	ChatId     string    `json:"chat_id"`
 	Prompt     string    `json:"prompt,omitempty"`
 	Response   string    `json:"response"`
-	CreatedAt  time.Time `json:"created_at"`
 	Model      string    `json:"model,omitempty"`
 	References []string  `json:"references,omitempty"`
+	EditedBy   string    `json:"edited_by,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
 }
 
 type Arcade struct {
@@ -122,6 +201,7 @@ type Arcade struct {
 	CodeType    string    `json:"code_type"`
 	CreatedAt   string    `json:"created_at"`
 	UpdatedAt   time.Time `json:"updated_at"`
+	Version     int64     `json:"version"`
 }
 
 // PushSubscription represents a stored subscription
@@ -162,6 +242,164 @@ type SendNotificationRequest struct {
 	Payload NotificationPayload `json:"payload"`
 }
 
+// Data export job states
+const (
+	ExportStatusPending    = "pending"
+	ExportStatusProcessing = "processing"
+	ExportStatusReady      = "ready"
+	ExportStatusFailed     = "failed"
+)
+
+// DataExport represents an account data export (takeout) job
+type DataExport struct {
+	ID          string    `json:"id"`
+	UserId      string    `json:"user_id"`
+	Status      string    `json:"status"`
+	FilePath    string    `json:"-"`
+	FileSize    int64     `json:"file_size,omitempty"`
+	Token       string    `json:"-"`
+	DownloadURL string    `json:"download_url,omitempty"` // for the owner while the archive is ready, not stored
+	Error       string    `json:"error,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	CompletedAt time.Time `json:"completed_at,omitzero"`
+	ExpiresAt   time.Time `json:"expires_at,omitzero"`
+}
+
+// Chat member roles, each includes the permissions of the ones below it
+const (
+	ChatRoleOwner  = "owner"  // manages members, sharing and can delete the chat
+	ChatRoleEditor = "editor" // sends, edits and regenerates messages
+	ChatRoleViewer = "viewer" // reads the chat
+)
+
+var chatRoleRank = map[string]int{ChatRoleViewer: 1, ChatRoleEditor: 2, ChatRoleOwner: 3}
+
+// ChatRoleAtLeast reports whether role grants at least the permissions of min
+func ChatRoleAtLeast(role, min string) bool {
+	return chatRoleRank[role] >= chatRoleRank[min] && chatRoleRank[role] > 0
+}
+
+// ChatMember is a user with access to a chat
+type ChatMember struct {
+	ChatId    string    `json:"chat_id"`
+	UserId    string    `json:"user_id"`
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	InvitedBy string    `json:"invited_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Chat invitation states
+const (
+	InvitationStatusPending  = "pending"
+	InvitationStatusAccepted = "accepted"
+	InvitationStatusDeclined = "declined"
+)
+
+// ChatInvitation asks a user to join a chat with a role
+type ChatInvitation struct {
+	ID          string    `json:"id"`
+	ChatId      string    `json:"chat_id"`
+	ChatTitle   string    `json:"chat_title,omitempty"`
+	InviteeId   string    `json:"invitee_id"`
+	InviteeName string    `json:"invitee_name,omitempty"`
+	InvitedBy   string    `json:"invited_by"`
+	InviterName string    `json:"inviter_name,omitempty"`
+	Role        string    `json:"role"`
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"created_at"`
+	RespondedAt time.Time `json:"responded_at,omitzero"`
+}
+
+// Share link modes
+const (
+	ShareModeLive     = "live"     // viewers see the chat as it is now
+	ShareModeSnapshot = "snapshot" // viewers see the chat as it was when shared
+)
+
+// ChatShare is a revocable public link to a chat
+type ChatShare struct {
+	ID           string    `json:"id"`
+	ChatId       string    `json:"chat_id"`
+	CreatedBy    string    `json:"created_by"`
+	Token        string    `json:"token"`
+	URL          string    `json:"url,omitempty"`
+	Mode         string    `json:"mode"`
+	HasPassword  bool      `json:"has_password"`
+	PasswordHash string    `json:"-"`
+	Snapshot     string    `json:"-"`
+	ViewCount    int       `json:"view_count"`
+	LastViewedAt time.Time `json:"last_viewed_at,omitzero"`
+	ExpiresAt    time.Time `json:"expires_at,omitzero"`
+	RevokedAt    time.Time `json:"revoked_at,omitzero"`
+	LockedUntil  time.Time `json:"locked_until,omitzero"` // set after too many wrong passwords
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Entity types and operations recorded in the change log
+const (
+	ChangeEntityUser    = "user"
+	ChangeEntityChat    = "chat"
+	ChangeEntityMessage = "message"
+	ChangeEntityArcade  = "arcade"
+	ChangeEntityFolder  = "folder"
+	ChangeEntityTag     = "tag"
+
+	ChangeOpUpsert = "upsert"
+	ChangeOpDelete = "delete"
+)
+
+// Change is the latest change of one entity visible to a user
+type Change struct {
+	EntityType string    `json:"type"`
+	EntityId   string    `json:"id"`
+	Op         string    `json:"op"`
+	Seq        int64     `json:"seq"`
+	ChangedAt  time.Time `json:"changed_at"`
+}
+
+const (
+	IdempotencyStateInProgress = "in_progress"
+	IdempotencyStateCompleted  = "completed"
+)
+
+// IdempotencyKey is a stored request made with an Idempotency-Key header
+type IdempotencyKey struct {
+	Scope       string
+	Key         string
+	Fingerprint string
+	State       string
+	StatusCode  int
+	ContentType string
+	Response    []byte
+	CreatedAt   time.Time
+	ExpiresAt   time.Time
+}
+
+// PreferencesSchemaVersion is the current layout of the preferences document
+const PreferencesSchemaVersion = 1
+
+// UserPreferences is a user's preferences document with defaults filled in
+type UserPreferences struct {
+	SchemaVersion      int                     `json:"schema_version"`
+	Theme              string                  `json:"theme"`    // system, light or dark
+	Language           string                  `json:"language"` // BCP 47 tag, e.g. en or sw-KE
+	DefaultModel       string                  `json:"default_model"`
+	ResponseMode       Modes                   `json:"response_mode"`
+	WorkFunction       string                  `json:"work_function"`
+	AboutMe            string                  `json:"about_me"`
+	CustomInstructions string                  `json:"custom_instructions"` // how the user wants responses
+	Notifications      NotificationPreferences `json:"notifications"`
+}
+
+// NotificationPreferences says which push notifications a user wants
+type NotificationPreferences struct {
+	Push            bool `json:"push"` // turns all of the others off when false
+	TaskCompleted   bool `json:"task_completed"`
+	ChatInvitations bool `json:"chat_invitations"`
+	DataExports     bool `json:"data_exports"`
+}
+
 var DB *sql.DB
 
 // InitStorage initializes the PostgreSQL database connection and runs migrations
@@ -218,6 +456,144 @@ func Close() error {
 	return nil
 }
 
+// ErrVersionConflict is returned by the ...IfVersion updates when the row was
+// changed since the caller read it
+var ErrVersionConflict = errors.New("version conflict")
+
+// IsUniqueViolation reports whether err is a PostgreSQL unique constraint violation
+func IsUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
 func GetVersion() string {
 	return "v0.34.2"
 }
+
+const (
+	PlanSubscriptionActive    = "active"
+	PlanSubscriptionExpired   = "expired"
+	PlanSubscriptionCancelled = "cancelled"
+)
+
+// PlanSubscription is one purchased plan period. The plan fields of User
+// mirror the active period that ends last.
+type PlanSubscription struct {
+	ID             string    `json:"id"`
+	UserId         string    `json:"user_id"`
+	OrgId          string    `json:"org_id,omitempty"` // set instead of UserId for a plan bought by an organization
+	TransactionRef string    `json:"transaction_ref,omitempty"`
+	PlanKey        string    `json:"plan_key"`
+	PlanName       string    `json:"plan_name"`
+	Amount         int       `json:"amount"`
+	Price          string    `json:"price"`
+	Duration       string    `json:"duration"`
+	PhoneNumber    string    `json:"phone_number,omitempty"`
+	Status         string    `json:"status"`
+	StartsAt       time.Time `json:"starts_at"`
+	EndsAt         time.Time `json:"ends_at"`
+	CreatedAt      time.Time `json:"created_at"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// Organization member roles, each includes the permissions of the ones below it
+const (
+	OrgRoleOwner  = "owner"  // manages admins and can delete the organization
+	OrgRoleAdmin  = "admin"  // invites and removes members, buys plans and sees usage
+	OrgRoleMember = "member" // is covered by the organization's plan and sees its chats
+)
+
+var orgRoleRank = map[string]int{OrgRoleMember: 1, OrgRoleAdmin: 2, OrgRoleOwner: 3}
+
+// OrgRoleAtLeast reports whether role grants at least the permissions of min
+func OrgRoleAtLeast(role, min string) bool {
+	return orgRoleRank[role] >= orgRoleRank[min] && orgRoleRank[role] > 0
+}
+
+// Organization is a team whose plan covers all its members
+type Organization struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	CreatedBy   string    `json:"created_by,omitempty"`
+	Role        string    `json:"role,omitempty"` // of the user who asked for it
+	MemberCount int       `json:"member_count"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// OrganizationMember is a user in an organization
+type OrganizationMember struct {
+	OrgId     string    `json:"org_id"`
+	UserId    string    `json:"user_id"`
+	Username  string    `json:"username"`
+	Role      string    `json:"role"`
+	InvitedBy string    `json:"invited_by,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// OrganizationInvitation asks a user to join an organization with a role
+type OrganizationInvitation struct {
+	ID          string    `json:"id"`
+	OrgId       string    `json:"org_id"`
+	OrgName     string    `json:"org_name,omitempty"`
+	InviteeId   string    `json:"invitee_id"`
+	InviteeName string    `json:"invitee_name,omitempty"`
+	InvitedBy   string    `json:"invited_by"`
+	InviterName string    `json:"inviter_name,omitempty"`
+	Role        string    `json:"role"`
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"created_at"`
+	RespondedAt time.Time `json:"responded_at,omitzero"`
+}
+
+// OrganizationChat is a chat shared into an organization's space. Every
+// member gets Role in it, the chat itself stays owned by its creator.
+type OrganizationChat struct {
+	OrgId         string    `json:"org_id"`
+	ChatId        string    `json:"chat_id"`
+	Title         string    `json:"title"`
+	OwnerId       string    `json:"owner_id"`
+	OwnerName     string    `json:"owner_name"`
+	Role          string    `json:"role"`
+	SharedBy      string    `json:"shared_by,omitempty"`
+	LastMessageAt time.Time `json:"last_message_at,omitzero"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// OrganizationUsage sums what an organization's members did since a time
+type OrganizationUsage struct {
+	OrgId    string        `json:"org_id"`
+	Since    time.Time     `json:"since"`
+	Chats    int           `json:"chats"`
+	Messages int           `json:"messages"`
+	Requests int           `json:"requests"` // AI requests in the current request count window
+	Members  []MemberUsage `json:"members"`
+}
+
+// MemberUsage is one member's share of OrganizationUsage
+type MemberUsage struct {
+	UserId       string    `json:"user_id"`
+	Username     string    `json:"username"`
+	Role         string    `json:"role"`
+	Chats        int       `json:"chats"`
+	Messages     int       `json:"messages"`
+	Requests     int       `json:"requests"`
+	LastActiveAt time.Time `json:"last_active_at,omitzero"`
+}
+
+// RetentionPeriods are the allowed retention settings in days, 0 keeps data forever
+var RetentionPeriods = []int{0, 30, 90, 365}
+
+// PurgedItem is a message or chat removed by the retention purge
+type PurgedItem struct {
+	ID     string
+	ChatId string
+	UserId string // owner of the chat
+}
+
+// RetentionPurge is the outcome of one purge batch
+type RetentionPurge struct {
+	Skipped  bool // another replica holds the purge lock
+	Messages []PurgedItem
+	Chats    []PurgedItem
+}
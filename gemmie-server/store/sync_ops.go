@@ -0,0 +1,236 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Delta sync operations. The change_log table is filled by database triggers,
+// see migration 000021.
+
+// ClientSyncFields maps the profile fields a client may write through
+// POST /api/sync to their users column. Anything else is owned by the server,
+// including the phone number, which links a user to their transactions and is
+// only changed through PUT /api/profile.
+var ClientSyncFields = map[string]string{
+	"preferences":   "preferences",
+	"work_function": "work_function",
+	"theme":         "theme",
+	"sync_enabled":  "sync_enabled",
+	"username":      "username",
+	"response_mode": "response_mode",
+}
+
+// requestCountWindow is how long a request count runs before it starts over
+const requestCountWindow = 24 * time.Hour
+
+// GetUserChangeSeq returns the current sync cursor of a user, 0 for unknown users
+func GetUserChangeSeq(userID string) (int64, error) {
+	ctx := context.Background()
+
+	var seq int64
+	err := DB.QueryRowContext(ctx, "SELECT change_seq FROM users WHERE id = $1", userID).Scan(&seq)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+
+	return seq, err
+}
+
+// GetChangesSince returns up to limit changes recorded after the since cursor, oldest first
+func GetChangesSince(userID string, since int64, limit int) ([]Change, error) {
+	ctx := context.Background()
+
+	query := `
+		SELECT entity_type, entity_id, op, seq, changed_at
+		FROM change_log
+		WHERE user_id = $1 AND seq > $2
+		ORDER BY seq ASC
+		LIMIT $3
+	`
+
+	rows, err := DB.QueryContext(ctx, query, userID, since, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var changes []Change
+	for rows.Next() {
+		var change Change
+		if err := rows.Scan(
+			&change.EntityType, &change.EntityId, &change.Op, &change.Seq, &change.ChangedAt,
+		); err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+
+	return changes, rows.Err()
+}
+
+// GetMessagesByIDs returns the messages among ids that sit in chats userID
+// owns or is a member of
+func GetMessagesByIDs(userID string, ids []string) ([]Message, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+
+	ctx := context.Background()
+
+	query := `
+	SELECT
+		m.id, m.chat_id, m.parent_id, m.author_id, u.username, m.prompt, m.response, m.created_at, m.model, m.references_ids,
+		m.edited_at, m.is_partial,
+		(SELECT COUNT(*) FROM message_versions v WHERE v.message_id = m.id) AS version_count,
+		m.version
+	FROM messages m
+	JOIN chats c ON c.id = m.chat_id
+	LEFT JOIN users u ON u.id = m.author_id
+	WHERE m.id = ANY($1)
+		AND (c.user_id = $2 OR EXISTS (
+			SELECT 1 FROM chat_members cm WHERE cm.chat_id = m.chat_id AND cm.user_id = $2
+		))
+	ORDER BY m.created_at ASC, m.id ASC
+	`
+
+	rows, err := DB.QueryContext(ctx, query, pq.Array(ids), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var messages []Message
+	for rows.Next() {
+		var msg Message
+		var parentID, authorID, authorName sql.NullString
+		var editedAt sql.NullTime
+		if err := rows.Scan(
+			&msg.ID, &msg.ChatId, &parentID, &authorID, &authorName, &msg.Prompt,
+			&msg.Response, &msg.CreatedAt, &msg.Model,
+			pq.Array(&msg.References), &editedAt, &msg.IsPartial, &msg.VersionCount, &msg.Version,
+		); err != nil {
+			return nil, err
+		}
+		if err := decryptValues(ctx, &msg.Prompt, &msg.Response); err != nil {
+			return nil, err
+		}
+		msg.ParentId = parentID.String
+		msg.AuthorId = authorID.String
+		msg.AuthorName = authorName.String
+		if editedAt.Valid {
+			msg.EditedAt = editedAt.Time
+			msg.IsEdited = true
+		}
+		messages = append(messages, msg)
+	}
+
+	return messages, rows.Err()
+}
+
+// ApplyClientSync writes client profile fields with last-writer-wins per field.
+// timestamps holds the unix ms time the client changed each field, a missing
+// timestamp means "now" and one in the future is taken as now, so a client
+// clock cannot claim a field ahead of later writes. A field whose stored
+// version is newer is left alone
+// and returned in conflicts. Only keys of ClientSyncFields are accepted.
+func ApplyClientSync(userID string, fields map[string]any, timestamps map[string]int64) (applied, conflicts []string, err error) {
+	ctx := context.Background()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	var raw []byte
+	err = tx.QueryRowContext(ctx,
+		"SELECT field_versions FROM users WHERE id = $1 FOR UPDATE", userID,
+	).Scan(&raw)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	versions := map[string]int64{}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &versions); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		if _, ok := ClientSyncFields[name]; ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	now := time.Now().UnixMilli()
+	written := map[string]int64{}
+	sets := []string{}
+	args := []any{userID}
+
+	for _, name := range names {
+		version := min(timestamps[name], now)
+		if version <= 0 {
+			version = now
+		}
+		if versions[name] > version {
+			conflicts = append(conflicts, name)
+			continue
+		}
+
+		args = append(args, fields[name])
+		sets = append(sets, ClientSyncFields[name]+" = $"+strconv.Itoa(len(args)))
+		written[name] = version
+		applied = append(applied, name)
+	}
+
+	if len(applied) == 0 {
+		return nil, conflicts, tx.Commit()
+	}
+
+	patch, err := json.Marshal(written)
+	if err != nil {
+		return nil, nil, err
+	}
+	args = append(args, string(patch))
+	sets = append(sets, "field_versions = field_versions || $"+strconv.Itoa(len(args))+"::jsonb", "updated_at = NOW()")
+
+	if _, err := tx.ExecContext(ctx,
+		"UPDATE users SET "+strings.Join(sets, ", ")+" WHERE id = $1", args...,
+	); err != nil {
+		return nil, nil, err
+	}
+
+	return applied, conflicts, tx.Commit()
+}
+
+// IncrementRequestCount counts one AI request for a user. The count starts
+// over once the current 24 hour window has passed.
+func IncrementRequestCount(userID string) (RequestCount, error) {
+	ctx := context.Background()
+
+	now := time.Now().UnixMilli()
+	windowStart := now - requestCountWindow.Milliseconds()
+
+	query := `
+		UPDATE users SET
+			request_count_value = CASE WHEN request_count_timestamp < $2 THEN 1 ELSE request_count_value + 1 END,
+			request_count_timestamp = CASE WHEN request_count_timestamp < $2 THEN $3 ELSE request_count_timestamp END
+		WHERE id = $1
+		RETURNING request_count_value, request_count_timestamp
+	`
+
+	var count RequestCount
+	err := DB.QueryRowContext(ctx, query, userID, windowStart, now).Scan(&count.Count, &count.Timestamp)
+	return count, err
+}
@@ -0,0 +1,155 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Tag operations
+
+func CreateTag(tag Tag) error {
+	ctx := context.Background()
+
+	if tag.CreatedAt.IsZero() {
+		tag.CreatedAt = time.Now()
+	}
+
+	query := `INSERT INTO tags (id, user_id, name, created_at) VALUES ($1, $2, $3, $4)`
+	_, err := DB.ExecContext(ctx, query, tag.ID, tag.UserId, tag.Name, tag.CreatedAt)
+	return err
+}
+
+// GetTagsByUserID returns a user's tags by name, with the number of chats using each
+func GetTagsByUserID(userID string) ([]Tag, error) {
+	ctx := context.Background()
+
+	query := `
+		SELECT t.id, t.user_id, t.name, t.created_at,
+			   (SELECT COUNT(*) FROM chat_tags ct WHERE ct.tag_id = t.id) AS chat_count
+		FROM tags t
+		WHERE t.user_id = $1
+		ORDER BY LOWER(t.name) ASC
+	`
+
+	rows, err := DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []Tag
+	for rows.Next() {
+		var tag Tag
+		if err := rows.Scan(&tag.ID, &tag.UserId, &tag.Name, &tag.CreatedAt, &tag.ChatCount); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+
+	return tags, rows.Err()
+}
+
+func GetTagByID(ID string) (*Tag, error) {
+	ctx := context.Background()
+
+	query := `
+		SELECT t.id, t.user_id, t.name, t.created_at,
+			   (SELECT COUNT(*) FROM chat_tags ct WHERE ct.tag_id = t.id) AS chat_count
+		FROM tags t WHERE t.id = $1
+	`
+
+	tag := &Tag{}
+	err := DB.QueryRowContext(ctx, query, ID).Scan(&tag.ID, &tag.UserId, &tag.Name, &tag.CreatedAt, &tag.ChatCount)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+
+	return tag, err
+}
+
+func UpdateTag(tag Tag) error {
+	ctx := context.Background()
+	_, err := DB.ExecContext(ctx, "UPDATE tags SET name = $2 WHERE id = $1", tag.ID, tag.Name)
+	return err
+}
+
+// DeleteTagByID removes a tag and takes it off every chat
+func DeleteTagByID(ID string) error {
+	ctx := context.Background()
+	_, err := DB.ExecContext(ctx, "DELETE FROM tags WHERE id = $1", ID)
+	return err
+}
+
+// CountUserTags returns how many of tagIDs belong to userID
+func CountUserTags(userID string, tagIDs []string) (int, error) {
+	ctx := context.Background()
+
+	var count int
+	err := DB.QueryRowContext(ctx,
+		"SELECT COUNT(*) FROM tags WHERE user_id = $1 AND id = ANY($2)",
+		userID, pq.Array(tagIDs),
+	).Scan(&count)
+	return count, err
+}
+
+// SetChatTags replaces the tags on a chat
+func SetChatTags(chatID string, tagIDs []string) error {
+	ctx := context.Background()
+
+	tx, err := DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM chat_tags WHERE chat_id = $1", chatID); err != nil {
+		return err
+	}
+
+	if len(tagIDs) > 0 {
+		query := `
+			INSERT INTO chat_tags (chat_id, tag_id)
+			SELECT $1, UNNEST($2::TEXT[])
+			ON CONFLICT DO NOTHING
+		`
+		if _, err := tx.ExecContext(ctx, query, chatID, pq.Array(tagIDs)); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GetTagsByChatIDs returns the tags of each chat, keyed by chat id
+func GetTagsByChatIDs(chatIDs []string) (map[string][]Tag, error) {
+	ctx := context.Background()
+
+	query := `
+		SELECT ct.chat_id, t.id, t.name
+		FROM chat_tags ct
+		JOIN tags t ON t.id = ct.tag_id
+		WHERE ct.chat_id = ANY($1)
+		ORDER BY LOWER(t.name) ASC
+	`
+
+	rows, err := DB.QueryContext(ctx, query, pq.Array(chatIDs))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := make(map[string][]Tag)
+	for rows.Next() {
+		var chatID string
+		var tag Tag
+		if err := rows.Scan(&chatID, &tag.ID, &tag.Name); err != nil {
+			return nil, err
+		}
+		tags[chatID] = append(tags[chatID], tag)
+	}
+
+	return tags, rows.Err()
+}
@@ -125,7 +125,8 @@ func GetUserByID(userID string) (*User, error) {
 			   amount, duration, phone_number, expiry_timestamp, expire_duration,
 			   price, response_mode, agree_to_terms, request_count_value,
 			   request_count_timestamp, email_verified, email_subscribed,
-			   verification_token, verification_token_expiry, unsubscribe_token, user_agent
+			   verification_token, verification_token_expiry, unsubscribe_token, user_agent,
+			   version
 		FROM users WHERE id = $1
 	`
 
@@ -140,7 +141,7 @@ func GetUserByID(userID string) (*User, error) {
 		&user.Price, &user.ResponseMode, &user.AgreeToTerms, &user.RequestCount.Count,
 		&user.RequestCount.Timestamp, &user.EmailVerified, &user.EmailSubscribed,
 		&user.VerificationToken, &verificationTokenExpiry, &user.UnsubscribeToken,
-		&user.UserAgent,
+		&user.UserAgent, &user.Version,
 	)
 
 	if verificationTokenExpiry.Valid {
@@ -375,6 +376,13 @@ func FindUserByEmailOrUsername(identifier string) (*User, string, bool) {
 }
 
 func UpdateUser(user User) error {
+	_, err := UpdateUserIfVersion(user, 0)
+	return err
+}
+
+// UpdateUserIfVersion updates a user only while it is still at version, 0
+// skips the check. It returns the new version, or ErrVersionConflict.
+func UpdateUserIfVersion(user User, version int64) (int64, error) {
 	ctx := context.Background()
 	user.UpdatedAt = time.Now()
 
@@ -388,25 +396,53 @@ func UpdateUser(user User) error {
 			request_count_value = $20, request_count_timestamp = $21,
 			email_verified = $22, email_subscribed = $23, verification_token = $24,
 			verification_token_expiry = $25, unsubscribe_token = $26, user_agent = $27
-		WHERE id = $1
+		WHERE id = $1 AND ($28 = 0 OR version = $28)
+		RETURNING version
 	`
 
-	_, err := DB.ExecContext(ctx, query,
+	var newVersion int64
+	err := DB.QueryRowContext(ctx, query,
 		user.ID, user.Username, user.Email, user.PasswordHash, user.UpdatedAt,
 		user.Preferences, user.WorkFunction, user.Theme, user.SyncEnabled,
 		user.Plan, user.PlanName, user.Amount, user.Duration, user.PhoneNumber,
 		user.ExpiryTimestamp, user.ExpireDuration, user.Price, user.ResponseMode,
 		user.AgreeToTerms, user.RequestCount.Count, user.RequestCount.Timestamp,
 		user.EmailVerified, user.EmailSubscribed, user.VerificationToken,
-		user.VerificationTokenExpiry, user.UnsubscribeToken, user.UserAgent,
-	)
+		user.VerificationTokenExpiry, user.UnsubscribeToken, user.UserAgent, version,
+	).Scan(&newVersion)
+	if err == sql.ErrNoRows && version != 0 {
+		return 0, ErrVersionConflict
+	}
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
 
-	return err
+	return newVersion, err
 }
 
 func DeleteUser(userID string) error {
+	return DeleteUserIfVersion(userID, 0)
+}
+
+// DeleteUserIfVersion deletes a user and everything they own only while the
+// user is still at version, 0 skips the check. It returns ErrVersionConflict
+// when the user changed, checked before anything is deleted and again when
+// the user row goes.
+func DeleteUserIfVersion(userID string, version int64) error {
 	ctx := context.Background()
-	err := DeleteAllChatsByUserID(userID)
+
+	var found int
+	err := DB.QueryRowContext(ctx,
+		"SELECT 1 FROM users WHERE id = $1 AND ($2 = 0 OR version = $2)", userID, version,
+	).Scan(&found)
+	if err == sql.ErrNoRows && version != 0 {
+		return ErrVersionConflict
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	err = DeleteAllChatsByUserID(userID)
 	if err != nil {
 		return err
 	}
@@ -416,6 +452,21 @@ func DeleteUser(userID string) error {
 		return err
 	}
 
-	_, err = DB.ExecContext(ctx, "DELETE FROM users WHERE id = $1", userID)
-	return err
+	err = handOverOrganizations(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	result, err := DB.ExecContext(ctx,
+		"DELETE FROM users WHERE id = $1 AND ($2 = 0 OR version = $2)", userID, version,
+	)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 && version != 0 {
+		return ErrVersionConflict
+	}
+	return nil
 }